@@ -40,16 +40,75 @@ var (
 
 // EncryptKey encrypts a key with a password using scrypt and AES-128-CTR
 func EncryptKey(key *Key, password string) (*encryptedKeyJSON, error) {
+	cryptoStruct, err := encryptData(crypto.FromECDSA(key.PrivateKey), password, scryptN, scryptP)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create encrypted key JSON
+	encryptedKeyJSON := &encryptedKeyJSON{
+		Address: hex.EncodeToString(key.Address[:]),
+		ID:      key.ID.String(),
+		Version: keyFileVersion,
+		Crypto:  cryptoStruct,
+	}
+
+	return encryptedKeyJSON, nil
+}
+
+// DecryptKey decrypts an encrypted key JSON with a password
+func DecryptKey(encryptedKey *encryptedKeyJSON, password string) (*Key, error) {
+	if encryptedKey.Version != keyFileVersion {
+		return nil, fmt.Errorf("unsupported key file version: %d", encryptedKey.Version)
+	}
+
+	// Decrypt private key
+	privateKeyBytes, err := decryptData(encryptedKey.Crypto, password)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse private key
+	privateKey, err := crypto.ToECDSA(privateKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse UUID
+	id, err := uuid.Parse(encryptedKey.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse address
+	address := common.HexToAddress(encryptedKey.Address)
+
+	// Verify address matches
+	derivedAddress := crypto.PubkeyToAddress(privateKey.PublicKey)
+	if derivedAddress != address {
+		return nil, errors.New("address mismatch")
+	}
+
+	return &Key{
+		ID:         id,
+		Address:    address,
+		PrivateKey: privateKey,
+	}, nil
+}
+
+// encryptData encrypts data with a password using scrypt with the given cost
+// parameters and AES-128-CTR
+func encryptData(data []byte, password string, n, p int) (cryptoJSON, error) {
 	// Generate random salt
 	salt, err := GenerateRandomBytes(32)
 	if err != nil {
-		return nil, err
+		return cryptoJSON{}, err
 	}
 
 	// Derive key using scrypt
-	derivedKey, err := scrypt.Key([]byte(password), salt, scryptN, scryptR, scryptP, scryptDKLen)
+	derivedKey, err := scrypt.Key([]byte(password), salt, n, scryptR, p, scryptDKLen)
 	if err != nil {
-		return nil, err
+		return cryptoJSON{}, err
 	}
 
 	// First half of derived key is encryption key
@@ -58,61 +117,47 @@ func EncryptKey(key *Key, password string) (*encryptedKeyJSON, error) {
 	// Generate random IV
 	iv, err := GenerateRandomBytes(aes.BlockSize)
 	if err != nil {
-		return nil, err
+		return cryptoJSON{}, err
 	}
 
-	// Encrypt private key
-	privateKeyBytes := crypto.FromECDSA(key.PrivateKey)
-	cipherText, err := aesCTRXOR(encryptKey, privateKeyBytes, iv)
+	cipherText, err := aesCTRXOR(encryptKey, data, iv)
 	if err != nil {
-		return nil, err
+		return cryptoJSON{}, err
 	}
 
 	// Generate MAC: Keccak256(derivedKey[16:32] + cipherText)
 	mac := crypto.Keccak256(derivedKey[16:32], cipherText)
 
-	// Create encrypted key JSON
-	encryptedKeyJSON := &encryptedKeyJSON{
-		Address: hex.EncodeToString(key.Address[:]),
-		ID:      key.ID.String(),
-		Version: keyFileVersion,
-		Crypto: cryptoJSON{
-			Cipher: "aes-128-ctr",
-			CipherParams: cipherparamsJSON{
-				IV: hex.EncodeToString(iv),
-			},
-			CipherText: hex.EncodeToString(cipherText),
-			KDF:        "scrypt",
-			KDFParams: map[string]interface{}{
-				"dklen": scryptDKLen,
-				"n":     scryptN,
-				"p":     scryptP,
-				"r":     scryptR,
-				"salt":  hex.EncodeToString(salt),
-			},
-			MAC: hex.EncodeToString(mac),
+	return cryptoJSON{
+		Cipher: "aes-128-ctr",
+		CipherParams: cipherparamsJSON{
+			IV: hex.EncodeToString(iv),
 		},
-	}
-
-	return encryptedKeyJSON, nil
+		CipherText: hex.EncodeToString(cipherText),
+		KDF:        "scrypt",
+		KDFParams: map[string]interface{}{
+			"dklen": scryptDKLen,
+			"n":     n,
+			"p":     p,
+			"r":     scryptR,
+			"salt":  hex.EncodeToString(salt),
+		},
+		MAC: hex.EncodeToString(mac),
+	}, nil
 }
 
-// DecryptKey decrypts an encrypted key JSON with a password
-func DecryptKey(encryptedKey *encryptedKeyJSON, password string) (*Key, error) {
-	if encryptedKey.Version != keyFileVersion {
-		return nil, fmt.Errorf("unsupported key file version: %d", encryptedKey.Version)
-	}
-
-	if encryptedKey.Crypto.Cipher != "aes-128-ctr" {
-		return nil, fmt.Errorf("unsupported cipher: %s", encryptedKey.Crypto.Cipher)
+// decryptData decrypts data encrypted by encryptData
+func decryptData(cryptoStruct cryptoJSON, password string) ([]byte, error) {
+	if cryptoStruct.Cipher != "aes-128-ctr" {
+		return nil, fmt.Errorf("unsupported cipher: %s", cryptoStruct.Cipher)
 	}
 
-	if encryptedKey.Crypto.KDF != "scrypt" {
-		return nil, fmt.Errorf("unsupported KDF: %s", encryptedKey.Crypto.KDF)
+	if cryptoStruct.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported KDF: %s", cryptoStruct.KDF)
 	}
 
 	// Extract KDF params
-	kdfParams := encryptedKey.Crypto.KDFParams
+	kdfParams := cryptoStruct.KDFParams
 	salt, err := hex.DecodeString(kdfParams["salt"].(string))
 	if err != nil {
 		return nil, err
@@ -130,12 +175,12 @@ func DecryptKey(encryptedKey *encryptedKeyJSON, password string) (*Key, error) {
 	}
 
 	// Verify MAC
-	cipherText, err := hex.DecodeString(encryptedKey.Crypto.CipherText)
+	cipherText, err := hex.DecodeString(cryptoStruct.CipherText)
 	if err != nil {
 		return nil, err
 	}
 
-	mac, err := hex.DecodeString(encryptedKey.Crypto.MAC)
+	mac, err := hex.DecodeString(cryptoStruct.MAC)
 	if err != nil {
 		return nil, err
 	}
@@ -145,44 +190,12 @@ func DecryptKey(encryptedKey *encryptedKeyJSON, password string) (*Key, error) {
 		return nil, ErrMACMismatch
 	}
 
-	// Decrypt private key
-	iv, err := hex.DecodeString(encryptedKey.Crypto.CipherParams.IV)
-	if err != nil {
-		return nil, err
-	}
-
-	encryptKey := derivedKey[:16]
-	privateKeyBytes, err := aesCTRXOR(encryptKey, cipherText, iv)
-	if err != nil {
-		return nil, err
-	}
-
-	// Parse private key
-	privateKey, err := crypto.ToECDSA(privateKeyBytes)
+	iv, err := hex.DecodeString(cryptoStruct.CipherParams.IV)
 	if err != nil {
 		return nil, err
 	}
 
-	// Parse UUID
-	id, err := uuid.Parse(encryptedKey.ID)
-	if err != nil {
-		return nil, err
-	}
-
-	// Parse address
-	address := common.HexToAddress(encryptedKey.Address)
-
-	// Verify address matches
-	derivedAddress := crypto.PubkeyToAddress(privateKey.PublicKey)
-	if derivedAddress != address {
-		return nil, errors.New("address mismatch")
-	}
-
-	return &Key{
-		ID:         id,
-		Address:    address,
-		PrivateKey: privateKey,
-	}, nil
+	return aesCTRXOR(derivedKey[:16], cipherText, iv)
 }
 
 // aesCTRXOR performs AES-128-CTR encryption/decryption
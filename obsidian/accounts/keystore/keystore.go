@@ -41,6 +41,9 @@ type KeyStore struct {
 	accounts map[common.Address]*accountCache
 	unlocked map[common.Address]*unlockState
 
+	stealth         map[string]*stealthCache       // keyed by meta-address
+	stealthUnlocked map[string]*stealthUnlockState // keyed by meta-address
+
 	quit chan struct{}
 }
 
@@ -59,10 +62,14 @@ func NewKeyStore(keyDir string) *KeyStore {
 		accounts: make(map[common.Address]*accountCache),
 		unlocked: make(map[common.Address]*unlockState),
 		quit:     make(chan struct{}),
+
+		stealth:         make(map[string]*stealthCache),
+		stealthUnlocked: make(map[string]*stealthUnlockState),
 	}
 
 	// Scan existing keys
 	ks.scanAccounts()
+	ks.scanStealthKeys()
 
 	// Start expiration loop
 	go ks.expireLoop()
@@ -79,9 +86,13 @@ func NewLightKeyStore(keyDir string) *KeyStore {
 		accounts: make(map[common.Address]*accountCache),
 		unlocked: make(map[common.Address]*unlockState),
 		quit:     make(chan struct{}),
+
+		stealth:         make(map[string]*stealthCache),
+		stealthUnlocked: make(map[string]*stealthUnlockState),
 	}
 
 	ks.scanAccounts()
+	ks.scanStealthKeys()
 	go ks.expireLoop()
 	return ks
 }
@@ -118,6 +129,12 @@ func (ks *KeyStore) expireUnlocked() {
 			log.Info("Account auto-locked due to timeout", "address", addr.Hex())
 		}
 	}
+	for meta, state := range ks.stealthUnlocked {
+		if !state.expiry.IsZero() && now.After(state.expiry) {
+			delete(ks.stealthUnlocked, meta)
+			log.Info("Stealth account auto-locked due to timeout", "meta", meta)
+		}
+	}
 }
 
 // scanAccounts scans the keystore directory for existing accounts
@@ -0,0 +1,380 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package keystore
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/google/uuid"
+	obstypes "github.com/obsidian-chain/obsidian/core/types"
+	"github.com/obsidian-chain/obsidian/stealth"
+)
+
+// stealthKeyDir is the subdirectory of the keystore holding stealth key files
+const stealthKeyDir = "stealth"
+
+var (
+	ErrNoStealthMatch = errors.New("no stealth key for given meta-address")
+	ErrSpendLocked    = errors.New("stealth spend key is locked")
+)
+
+// StealthAccount is a stealth key pair held in the keystore, identified by
+// its meta-address
+type StealthAccount struct {
+	MetaAddress string `json:"metaAddress"`
+	URL         URL    `json:"url"`
+}
+
+// encryptedStealthKeyJSON is the format of stealth key files. The spend and
+// view keys are encrypted separately so that the view key can be unlocked
+// alone for watch-only scanning.
+type encryptedStealthKeyJSON struct {
+	MetaAddress string     `json:"metaAddress"`
+	ID          string     `json:"id"`
+	Version     int        `json:"version"`
+	Spend       cryptoJSON `json:"spendCrypto"`
+	View        cryptoJSON `json:"viewCrypto"`
+}
+
+// stealthUnlockState holds the decrypted keys of an unlocked stealth account
+type stealthUnlockState struct {
+	view   *ecdsa.PrivateKey
+	spend  *ecdsa.PrivateKey // nil if only the view key is unlocked
+	expiry time.Time         // zero means indefinitely unlocked
+}
+
+// stealthCache caches stealth account information
+type stealthCache struct {
+	Account StealthAccount
+	meta    *stealth.StealthMetaAddress
+	path    string
+}
+
+// scanStealthKeys scans the keystore directory for existing stealth keys.
+// Meta-addresses are stored in the clear, nothing is decrypted.
+func (ks *KeyStore) scanStealthKeys() {
+	if ks.keyDir == "" {
+		return
+	}
+	dir := filepath.Join(ks.keyDir, stealthKeyDir)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		encrypted, err := loadStealthKeyFile(path)
+		if err != nil {
+			log.Debug("Skipping invalid stealth key file", "path", path, "err", err)
+			continue
+		}
+		meta, err := stealth.ParseMetaAddress(encrypted.MetaAddress)
+		if err != nil {
+			log.Debug("Skipping invalid stealth key file", "path", path, "err", err)
+			continue
+		}
+		ks.addStealthAccount(meta, path)
+	}
+}
+
+// addStealthAccount records a stealth key file. It must be called with the
+// lock held or before the keystore is shared.
+func (ks *KeyStore) addStealthAccount(meta *stealth.StealthMetaAddress, path string) StealthAccount {
+	account := StealthAccount{
+		MetaAddress: meta.String(),
+		URL: URL{
+			Scheme: "keystore",
+			Path:   path,
+		},
+	}
+	ks.stealth[account.MetaAddress] = &stealthCache{Account: account, meta: meta, path: path}
+	return account
+}
+
+// StealthAccounts returns all stealth accounts in the keystore
+func (ks *KeyStore) StealthAccounts() []StealthAccount {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	accounts := make([]StealthAccount, 0, len(ks.stealth))
+	for _, cache := range ks.stealth {
+		accounts = append(accounts, cache.Account)
+	}
+	return accounts
+}
+
+// NewStealthKey generates a stealth key pair and stores it encrypted with the
+// given password
+func (ks *KeyStore) NewStealthKey(password string) (StealthAccount, error) {
+	keyPair, err := stealth.GenerateStealthKeyPair()
+	if err != nil {
+		return StealthAccount{}, err
+	}
+	return ks.ImportStealthKey(keyPair, password)
+}
+
+// ImportStealthKey stores an existing stealth key pair encrypted with the
+// given password
+func (ks *KeyStore) ImportStealthKey(keyPair *stealth.StealthKeyPair, password string) (StealthAccount, error) {
+	meta := keyPair.MetaAddress()
+
+	ks.mu.RLock()
+	_, exists := ks.stealth[meta.String()]
+	ks.mu.RUnlock()
+	if exists {
+		return StealthAccount{}, ErrAlreadyExist
+	}
+
+	spend, err := encryptData(crypto.FromECDSA(keyPair.SpendPrivateKey), password, ks.scryptN, ks.scryptP)
+	if err != nil {
+		return StealthAccount{}, err
+	}
+	view, err := encryptData(crypto.FromECDSA(keyPair.ViewPrivateKey), password, ks.scryptN, ks.scryptP)
+	if err != nil {
+		return StealthAccount{}, err
+	}
+	content, err := json.MarshalIndent(&encryptedStealthKeyJSON{
+		MetaAddress: meta.String(),
+		ID:          uuid.New().String(),
+		Version:     keyFileVersion,
+		Spend:       spend,
+		View:        view,
+	}, "", "  ")
+	if err != nil {
+		return StealthAccount{}, err
+	}
+	name := keyFileName(stealth.PublicKeyToAddress(keyPair.SpendPublicKey))
+	path, err := WriteTemporaryKeyFile(filepath.Join(ks.keyDir, stealthKeyDir, name), content)
+	if err != nil {
+		return StealthAccount{}, err
+	}
+
+	ks.mu.Lock()
+	account := ks.addStealthAccount(meta, path)
+	ks.mu.Unlock()
+
+	log.Info("New stealth key stored", "meta", account.MetaAddress)
+	return account, nil
+}
+
+// findStealth returns the cached stealth account for a meta-address. It must
+// be called with the lock held.
+func (ks *KeyStore) findStealth(metaAddress string) (*stealthCache, error) {
+	meta, err := stealth.ParseMetaAddress(metaAddress)
+	if err != nil {
+		return nil, err
+	}
+	cache, exists := ks.stealth[meta.String()]
+	if !exists {
+		return nil, ErrNoStealthMatch
+	}
+	return cache, nil
+}
+
+// TimedUnlockStealth unlocks both keys of a stealth account for the given
+// duration, allowing to sign for payments received. If duration is 0, the
+// account remains unlocked indefinitely.
+func (ks *KeyStore) TimedUnlockStealth(metaAddress, password string, duration time.Duration) error {
+	return ks.unlockStealth(metaAddress, password, duration, true)
+}
+
+// TimedUnlockStealthView unlocks only the view key of a stealth account, which
+// is enough to scan for payments but not to spend them
+func (ks *KeyStore) TimedUnlockStealthView(metaAddress, password string, duration time.Duration) error {
+	return ks.unlockStealth(metaAddress, password, duration, false)
+}
+
+// unlockStealth decrypts the keys of a stealth account and keeps them for the
+// given duration. An unlock never narrows an earlier one: the longer expiry
+// and the wider set of keys stay.
+func (ks *KeyStore) unlockStealth(metaAddress, password string, duration time.Duration, spend bool) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	cache, err := ks.findStealth(metaAddress)
+	if err != nil {
+		return err
+	}
+	id := cache.Account.MetaAddress
+
+	state, unlocked := ks.stealthUnlocked[id]
+	if unlocked && !state.expiry.IsZero() && time.Now().After(state.expiry) {
+		unlocked = false
+	}
+	if !unlocked || (spend && state.spend == nil) {
+		view, spendKey, err := decryptStealthKey(cache, password, spend)
+		if err != nil {
+			return err
+		}
+		if !unlocked {
+			state = &stealthUnlockState{expiry: time.Now().Add(duration)}
+			ks.stealthUnlocked[id] = state
+		}
+		state.view, state.spend = view, spendKey
+	}
+	switch {
+	case duration == 0:
+		state.expiry = time.Time{}
+	case !state.expiry.IsZero():
+		if expiry := time.Now().Add(duration); expiry.After(state.expiry) {
+			state.expiry = expiry
+		}
+	}
+	log.Info("Stealth account unlocked", "meta", id, "spend", state.spend != nil, "duration", duration)
+	return nil
+}
+
+// decryptStealthKey decrypts the view key of a stealth account, and the spend
+// key too if asked to, checking both against the meta-address
+func decryptStealthKey(cache *stealthCache, password string, spend bool) (view, spendKey *ecdsa.PrivateKey, err error) {
+	encrypted, err := loadStealthKeyFile(cache.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if view, err = decryptStealthPart(encrypted.View, password, cache.meta.ViewPubKey); err != nil {
+		return nil, nil, err
+	}
+	if spend {
+		if spendKey, err = decryptStealthPart(encrypted.Spend, password, cache.meta.SpendPubKey); err != nil {
+			return nil, nil, err
+		}
+	}
+	return view, spendKey, nil
+}
+
+// decryptStealthPart decrypts one key of a stealth key file
+func decryptStealthPart(cryptoStruct cryptoJSON, password string, pubKey []byte) (*ecdsa.PrivateKey, error) {
+	data, err := decryptData(cryptoStruct, password)
+	if err != nil {
+		return nil, err
+	}
+	key, err := crypto.ToECDSA(data)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(stealth.CompressPublicKey(&key.PublicKey), pubKey) {
+		return nil, errors.New("stealth key does not match its meta-address")
+	}
+	return key, nil
+}
+
+// loadStealthKeyFile reads a stealth key file without decrypting it
+func loadStealthKeyFile(path string) (*encryptedStealthKeyJSON, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var encrypted encryptedStealthKeyJSON
+	if err := json.Unmarshal(content, &encrypted); err != nil {
+		return nil, err
+	}
+	if encrypted.Version != keyFileVersion {
+		return nil, fmt.Errorf("unsupported key file version: %d", encrypted.Version)
+	}
+	return &encrypted, nil
+}
+
+// LockStealth locks both keys of a stealth account
+func (ks *KeyStore) LockStealth(metaAddress string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	cache, err := ks.findStealth(metaAddress)
+	if err != nil {
+		return err
+	}
+	if _, exists := ks.stealthUnlocked[cache.Account.MetaAddress]; !exists {
+		return ErrNoStealthMatch
+	}
+	delete(ks.stealthUnlocked, cache.Account.MetaAddress)
+	log.Info("Stealth account locked", "meta", cache.Account.MetaAddress)
+	return nil
+}
+
+// getUnlockedStealth returns the keys of a stealth account if unlocked and
+// not expired. It must be called with the lock held.
+func (ks *KeyStore) getUnlockedStealth(metaAddress string) (*stealthUnlockState, error) {
+	cache, err := ks.findStealth(metaAddress)
+	if err != nil {
+		return nil, err
+	}
+	state, exists := ks.stealthUnlocked[cache.Account.MetaAddress]
+	if !exists {
+		return nil, ErrLocked
+	}
+	if !state.expiry.IsZero() && time.Now().After(state.expiry) {
+		return nil, ErrLocked
+	}
+	return state, nil
+}
+
+// StealthViewKey returns the view key of an unlocked stealth account, for
+// scanning. The spend key never leaves the keystore.
+func (ks *KeyStore) StealthViewKey(metaAddress string) (*ecdsa.PrivateKey, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	state, err := ks.getUnlockedStealth(metaAddress)
+	if err != nil {
+		return nil, err
+	}
+	return state.view, nil
+}
+
+// stealthPaymentKey derives the private key of the stealth address a payment
+// with the given ephemeral key was sent to. It needs the spend key unlocked.
+func (ks *KeyStore) stealthPaymentKey(metaAddress string, ephemeralPubKey []byte) (*ecdsa.PrivateKey, error) {
+	ks.mu.RLock()
+	state, err := ks.getUnlockedStealth(metaAddress)
+	ks.mu.RUnlock()
+
+	if err != nil {
+		return nil, err
+	}
+	if state.spend == nil {
+		return nil, ErrSpendLocked
+	}
+	key, _, err := stealth.DeriveStealthAddressPrivateKey(state.view, state.spend, ephemeralPubKey)
+	return key, err
+}
+
+// SignStealthHash signs a hash with the key of the stealth address a payment
+// with the given ephemeral key was sent to. The key is derived for the
+// signature and not kept.
+func (ks *KeyStore) SignStealthHash(metaAddress string, ephemeralPubKey []byte, hash []byte) ([]byte, error) {
+	key, err := ks.stealthPaymentKey(metaAddress, ephemeralPubKey)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.Sign(hash, key)
+}
+
+// SignStealthTx signs a transaction spending from the stealth address a
+// payment with the given ephemeral key was sent to
+func (ks *KeyStore) SignStealthTx(metaAddress string, ephemeralPubKey []byte, tx *obstypes.StealthTransaction, chainID *big.Int) (*obstypes.StealthTransaction, error) {
+	key, err := ks.stealthPaymentKey(metaAddress, ephemeralPubKey)
+	if err != nil {
+		return nil, err
+	}
+	signer := obstypes.NewStealthEIP155Signer(chainID)
+	hash := signer.Hash(tx)
+	sig, err := crypto.Sign(hash[:], key)
+	if err != nil {
+		return nil, err
+	}
+	return tx.WithSignature(signer, sig)
+}
@@ -0,0 +1,164 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package keystore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/obsidian-chain/obsidian/stealth"
+)
+
+func TestStealthKeyStore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "keystore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ks := NewLightKeyStore(dir)
+	defer ks.Close()
+
+	keyPair, err := stealth.GenerateStealthKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := ks.ImportStealthKey(keyPair, "testpassword123")
+	if err != nil {
+		t.Fatalf("failed to import stealth key: %v", err)
+	}
+	if account.MetaAddress != keyPair.MetaAddress().String() {
+		t.Errorf("stealth account identified by %s, want its meta-address", account.MetaAddress)
+	}
+	if _, err := ks.ImportStealthKey(keyPair, "testpassword123"); err != ErrAlreadyExist {
+		t.Errorf("imported stealth key twice, err %v", err)
+	}
+
+	// Neither private key is written in the clear
+	content, err := os.ReadFile(account.URL.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range [][]byte{crypto.FromECDSA(keyPair.SpendPrivateKey), crypto.FromECDSA(keyPair.ViewPrivateKey)} {
+		if bytes.Contains(content, []byte(hex.EncodeToString(key))) {
+			t.Fatal("stealth key file contains a private key")
+		}
+	}
+
+	// Stealth keys are found again, and aren't mistaken for accounts
+	reopened := NewLightKeyStore(dir)
+	defer reopened.Close()
+
+	if accounts := reopened.StealthAccounts(); len(accounts) != 1 || accounts[0].MetaAddress != account.MetaAddress {
+		t.Fatalf("unexpected stealth accounts after reopening: %v", accounts)
+	}
+	if len(reopened.Accounts()) != 0 {
+		t.Fatal("stealth key listed as an account")
+	}
+}
+
+func TestStealthUnlock(t *testing.T) {
+	dir, err := os.MkdirTemp("", "keystore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ks := NewLightKeyStore(dir)
+	defer ks.Close()
+
+	password := "testpassword123"
+	account, err := ks.NewStealthKey(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, _ := stealth.ParseMetaAddress(account.MetaAddress)
+	payment, err := stealth.GenerateStealthAddress(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := crypto.Keccak256([]byte("test message"))
+
+	if _, err := ks.StealthViewKey(account.MetaAddress); err != ErrLocked {
+		t.Errorf("view key available while locked, err %v", err)
+	}
+	if err := ks.TimedUnlockStealthView(account.MetaAddress, "wrongpassword", 0); err == nil {
+		t.Error("unlock with wrong password should fail")
+	}
+
+	// The view key alone scans but can't sign
+	if err := ks.TimedUnlockStealthView(account.MetaAddress, password, 0); err != nil {
+		t.Fatal(err)
+	}
+	view, err := ks.StealthViewKey(account.MetaAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spendPub, _ := stealth.DecompressPublicKey(meta.SpendPubKey)
+	if ok, _ := stealth.CheckStealthAddress(view, spendPub, payment.EphemeralPubKey, payment.ViewTag); !ok {
+		t.Error("view key does not recognise payments")
+	}
+	if _, err := ks.SignStealthHash(account.MetaAddress, payment.EphemeralPubKey, hash); err != ErrSpendLocked {
+		t.Errorf("signed with only the view key unlocked, err %v", err)
+	}
+
+	// Fully unlocked, signatures come from the stealth address
+	if err := ks.TimedUnlockStealth(account.MetaAddress, password, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := ks.SignStealthHash(account.MetaAddress, payment.EphemeralPubKey, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := crypto.SigToPub(hash, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crypto.PubkeyToAddress(*pub) != payment.Address {
+		t.Error("signature not made by the stealth address key")
+	}
+
+	// A timed unlock doesn't shorten an indefinite one
+	time.Sleep(150 * time.Millisecond)
+	if _, err := ks.StealthViewKey(account.MetaAddress); err != nil {
+		t.Errorf("view key locked early: %v", err)
+	}
+	if err := ks.LockStealth(account.MetaAddress); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.SignStealthHash(account.MetaAddress, payment.EphemeralPubKey, hash); err != ErrLocked {
+		t.Errorf("signed after locking, err %v", err)
+	}
+}
+
+func TestStealthTimedUnlock(t *testing.T) {
+	dir, err := os.MkdirTemp("", "keystore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ks := NewLightKeyStore(dir)
+	defer ks.Close()
+
+	password := "testpassword123"
+	account, err := ks.NewStealthKey(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.TimedUnlockStealth(account.MetaAddress, password, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.StealthViewKey(account.MetaAddress); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if _, err := ks.StealthViewKey(account.MetaAddress); err != ErrLocked {
+		t.Errorf("stealth account still unlocked after timeout, err %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of Obsidian.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/dnsdisc"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/urfave/cli/v2"
+)
+
+// A tree directory holds the node set to publish in nodes.json and the tree
+// metadata in enrtree-info.json, the layout used by devp2p, so crawls made
+// with 'devp2p crawl' can be signed directly.
+const (
+	treeInfoFile  = "enrtree-info.json"
+	treeNodesFile = "nodes.json"
+)
+
+var (
+	dnsDomainFlag = &cli.StringFlag{
+		Name:  "domain",
+		Usage: "Domain name of the tree (defaults to the one in the tree URL, or the directory name)",
+	}
+	dnsSeqFlag = &cli.UintFlag{
+		Name:  "seq",
+		Usage: "New sequence number of the tree (defaults to the previous one plus one)",
+	}
+)
+
+// dnsdiscCommand manages EIP-1459 node lists published in DNS
+var dnsdiscCommand = &cli.Command{
+	Name:  "dnsdisc",
+	Usage: "Manage DNS discovery node lists (EIP-1459)",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "sign",
+			Usage:     "Sign the node tree in a directory",
+			ArgsUsage: "<tree-directory> <key-file>",
+			Flags:     []cli.Flag{dnsDomainFlag, dnsSeqFlag},
+			Action:    dnsSign,
+		},
+		{
+			Name:      "to-txt",
+			Usage:     "Export a signed node tree as DNS TXT records",
+			ArgsUsage: "<tree-directory> [output-file]",
+			Action:    dnsToTXT,
+		},
+	},
+}
+
+// treeMeta is the content of enrtree-info.json
+type treeMeta struct {
+	URL          string    `json:"url,omitempty"`
+	Seq          uint      `json:"seq"`
+	Sig          string    `json:"signature,omitempty"`
+	Links        []string  `json:"links"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+// crawledNode is an entry of nodes.json
+type crawledNode struct {
+	Seq uint64      `json:"seq"`
+	N   *enode.Node `json:"record"`
+}
+
+func dnsSign(ctx *cli.Context) error {
+	if ctx.NArg() < 2 {
+		return errors.New("need tree directory and key file as arguments")
+	}
+	dir, keyfile := ctx.Args().Get(0), ctx.Args().Get(1)
+
+	meta, nodes, err := loadTree(dir)
+	if err != nil {
+		return err
+	}
+	domain, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	domain = filepath.Base(domain)
+	if meta.URL != "" {
+		if domain, _, err = dnsdisc.ParseURL(meta.URL); err != nil {
+			return fmt.Errorf("invalid tree URL: %v", err)
+		}
+	}
+	if ctx.IsSet(dnsDomainFlag.Name) {
+		domain = ctx.String(dnsDomainFlag.Name)
+	}
+	if ctx.IsSet(dnsSeqFlag.Name) {
+		meta.Seq = ctx.Uint(dnsSeqFlag.Name)
+	} else {
+		meta.Seq++
+	}
+
+	tree, err := dnsdisc.MakeTree(meta.Seq, nodes, meta.Links)
+	if err != nil {
+		return err
+	}
+	key, err := crypto.LoadECDSA(keyfile)
+	if err != nil {
+		return fmt.Errorf("failed to load signing key: %v", err)
+	}
+	if meta.URL, err = tree.Sign(key, domain); err != nil {
+		return fmt.Errorf("failed to sign tree: %v", err)
+	}
+	meta.Sig = tree.Signature()
+	meta.LastModified = time.Now()
+
+	if err := writeJSON(filepath.Join(dir, treeInfoFile), meta); err != nil {
+		return err
+	}
+	fmt.Printf("Signed tree of %d nodes\n", len(nodes))
+	fmt.Println("URL:", meta.URL)
+	return nil
+}
+
+func dnsToTXT(ctx *cli.Context) error {
+	if ctx.NArg() < 1 {
+		return errors.New("need tree directory as argument")
+	}
+	dir := ctx.Args().Get(0)
+
+	meta, nodes, err := loadTree(dir)
+	if err != nil {
+		return err
+	}
+	if meta.URL == "" || meta.Sig == "" {
+		return errors.New("tree is not signed, run 'obsidian dnsdisc sign' first")
+	}
+	domain, pubkey, err := dnsdisc.ParseURL(meta.URL)
+	if err != nil {
+		return fmt.Errorf("invalid tree URL: %v", err)
+	}
+	tree, err := dnsdisc.MakeTree(meta.Seq, nodes, meta.Links)
+	if err != nil {
+		return err
+	}
+	if err := tree.SetSignature(pubkey, meta.Sig); err != nil {
+		return errors.New("tree signature is invalid, run 'obsidian dnsdisc sign' to update it")
+	}
+
+	records := tree.ToTXT(domain)
+	if output := ctx.Args().Get(1); output != "" {
+		return writeJSON(output, records)
+	}
+	out, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// loadTree reads a tree directory. The metadata file is optional for trees
+// that haven't been signed yet.
+func loadTree(dir string) (*treeMeta, []*enode.Node, error) {
+	meta := new(treeMeta)
+	if data, err := os.ReadFile(filepath.Join(dir, treeInfoFile)); err == nil {
+		if err := json.Unmarshal(data, meta); err != nil {
+			return nil, nil, fmt.Errorf("invalid %s: %v", treeInfoFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	if meta.Links == nil {
+		meta.Links = []string{}
+	}
+	for _, link := range meta.Links {
+		if _, _, err := dnsdisc.ParseURL(link); err != nil {
+			return nil, nil, fmt.Errorf("invalid link %q: %v", link, err)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, treeNodesFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	var crawled map[enode.ID]crawledNode
+	if err := json.Unmarshal(data, &crawled); err != nil {
+		return nil, nil, fmt.Errorf("invalid %s: %v", treeNodesFile, err)
+	}
+	nodes := make([]*enode.Node, 0, len(crawled))
+	for id, n := range crawled {
+		if n.N == nil || n.N.ID() != id {
+			return nil, nil, fmt.Errorf("invalid node %v: record missing or for another ID", id)
+		}
+		nodes = append(nodes, n.N)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return bytes.Compare(nodes[i].ID().Bytes(), nodes[j].ID().Bytes()) < 0
+	})
+	return meta, nodes, nil
+}
+
+// writeJSON writes a value to a file as indented JSON
+func writeJSON(file string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, append(data, '\n'), 0644)
+}
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -20,6 +21,8 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/eth/ethconfig"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/rlp"
 	ethrpc "github.com/ethereum/go-ethereum/rpc"
@@ -27,6 +30,7 @@ import (
 	"github.com/urfave/cli/v2"
 
 	"github.com/obsidian-chain/obsidian/accounts/keystore"
+	"github.com/obsidian-chain/obsidian/core/txpool"
 	obstypes "github.com/obsidian-chain/obsidian/core/types"
 	"github.com/obsidian-chain/obsidian/eth/backend"
 	"github.com/obsidian-chain/obsidian/node"
@@ -34,6 +38,7 @@ import (
 	obsparams "github.com/obsidian-chain/obsidian/params"
 	obsrpc "github.com/obsidian-chain/obsidian/rpc"
 	"github.com/obsidian-chain/obsidian/stealth"
+	"github.com/obsidian-chain/obsidian/stealth/registry"
 )
 
 var (
@@ -129,6 +134,23 @@ var (
 		Usage: "Disables the peer discovery mechanism",
 		Value: false,
 	}
+	dnsDiscoveryFlag = &cli.StringFlag{
+		Name:  "discovery.dns",
+		Usage: "Comma separated enrtree:// URLs of DNS node lists to find peers from",
+	}
+	dandelionFlag = &cli.BoolFlag{
+		Name:  "dandelion",
+		Usage: "Relay transactions over Dandelion++ stems, hiding which node sent them",
+	}
+	syncModeFlag = &cli.StringFlag{
+		Name:  "syncmode",
+		Usage: `Blockchain sync mode ("snap" or "full")`,
+		Value: ethconfig.SnapSync.String(),
+	}
+	stealthRegistryFlag = &cli.Uint64Flag{
+		Name:  "override.stealthregistry",
+		Usage: "Block to activate the stealth meta-address registry at",
+	}
 )
 
 func main() {
@@ -149,6 +171,8 @@ func main() {
 			backupCommand,
 			nodeCommand,
 			walletCommand,
+			dnsdiscCommand,
+			relayCommand,
 		},
 		Flags: []cli.Flag{
 			dataDirFlag,
@@ -184,6 +208,10 @@ var runCommand = &cli.Command{
 		logLevelFlag,
 		bootnodesFlag,
 		noDiscoverFlag,
+		dnsDiscoveryFlag,
+		dandelionFlag,
+		syncModeFlag,
+		stealthRegistryFlag,
 	},
 	Action: runNode,
 }
@@ -201,10 +229,7 @@ func runNode(ctx *cli.Context) error {
 	// Parse seed nodes
 	bootnodes := ctx.String(bootnodesFlag.Name)
 	var nodes []*enode.Node
-	for _, url := range strings.Split(bootnodes, ",") {
-		if url = strings.TrimSpace(url); url == "" {
-			continue
-		}
+	for _, url := range splitAndTrim(bootnodes) {
 		node, err := enode.Parse(enode.ValidSchemes, url)
 		if err != nil {
 			log.Error("Invalid bootstrap node URL", "url", url, "err", err)
@@ -235,6 +260,12 @@ func runNode(ctx *cli.Context) error {
 
 	// Create backend
 	backendConfig := backend.DefaultConfig()
+	if err := backendConfig.SyncMode.UnmarshalText([]byte(ctx.String(syncModeFlag.Name))); err != nil {
+		return fmt.Errorf("invalid sync mode: %v", err)
+	}
+	if ctx.IsSet(stealthRegistryFlag.Name) {
+		backendConfig.StealthRegistryBlock = new(big.Int).SetUint64(ctx.Uint64(stealthRegistryFlag.Name))
+	}
 	b, err := backend.New(backendConfig)
 	if err != nil {
 		return fmt.Errorf("failed to create backend: %v", err)
@@ -246,8 +277,23 @@ func runNode(ctx *cli.Context) error {
 		b, // Pass backend as P2P backend interface
 	)
 
+	// Find peers through DNS node lists unless discovery is off
+	if urls := splitAndTrim(ctx.String(dnsDiscoveryFlag.Name)); len(urls) > 0 && !ctx.Bool(noDiscoverFlag.Name) {
+		if err := p2pHandler.EnableDNSDiscovery(urls, nil); err != nil {
+			return fmt.Errorf("invalid DNS discovery URL: %v", err)
+		}
+		log.Info("DNS discovery enabled", "trees", len(urls))
+	}
+
+	if ctx.Bool(dandelionFlag.Name) {
+		if err := p2pHandler.EnableDandelion(obsp2p.DefaultDandelionConfig); err != nil {
+			return err
+		}
+		log.Info("Dandelion++ transaction relay enabled")
+	}
+
 	// Register P2P protocol with node
-	nodeConfig.P2P.Protocols = append(nodeConfig.P2P.Protocols, p2pHandler.Protocol())
+	n.RegisterProtocols(append(p2pHandler.Protocols(), p2pHandler.SnapProtocol()))
 
 	// Set P2P handler in backend for broadcasting
 	b.SetP2PHandler(p2pHandler)
@@ -267,6 +313,18 @@ func runNode(ctx *cli.Context) error {
 	if err := n.Start(); err != nil {
 		return fmt.Errorf("failed to start node: %v", err)
 	}
+	if err := p2pHandler.StartSync(); err != nil {
+		return fmt.Errorf("failed to start sync: %v", err)
+	}
+
+	// Keep the fork ID in our node record current as the chain advances
+	if srv := n.Server(); srv != nil {
+		heads := make(chan uint64, 10)
+		if err := b.SubscribeNewBlocks(context.Background(), heads); err != nil {
+			return fmt.Errorf("failed to subscribe to chain heads: %v", err)
+		}
+		p2pHandler.StartENRUpdater(srv.LocalNode(), heads)
+	}
 
 	// Start mining if enabled
 	if ctx.Bool(minerEnabledFlag.Name) {
@@ -305,6 +363,7 @@ func runNode(ctx *cli.Context) error {
 	<-sigCh
 
 	log.Info("Shutting down...")
+	p2pHandler.StopSync()
 	if err := n.Stop(); err != nil {
 		log.Error("Error stopping node", "error", err)
 	}
@@ -374,10 +433,21 @@ var stealthCommand = &cli.Command{
 	Usage: "Manage stealth addresses",
 	Subcommands: []*cli.Command{
 		{
-			Name:   "generate",
-			Usage:  "Generate a new stealth key pair",
+			Name:  "generate",
+			Usage: "Generate a new stealth key pair and store it in the keystore",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "password",
+					Usage: "Password to encrypt the stealth keys with",
+				},
+			},
 			Action: stealthGenerate,
 		},
+		{
+			Name:   "list",
+			Usage:  "List the stealth meta-addresses in the keystore",
+			Action: stealthList,
+		},
 		{
 			Name:      "address",
 			Usage:     "Generate a stealth address for a recipient",
@@ -387,8 +457,69 @@ var stealthCommand = &cli.Command{
 		{
 			Name:      "scan",
 			Usage:     "Scan for payments to your stealth addresses",
-			ArgsUsage: "<view-private-key>",
-			Action:    stealthScan,
+			ArgsUsage: "<meta-address>",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "password",
+					Usage: "Password to unlock the view key",
+				},
+			},
+			Action: stealthScan,
+		},
+		{
+			Name:      "register",
+			Usage:     "Register a meta-address in the on-chain stealth registry",
+			ArgsUsage: "<account> <meta-address>",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "rpc",
+					Usage: "RPC endpoint to connect to",
+					Value: "http://localhost:8545",
+				},
+				&cli.StringFlag{
+					Name:  "password",
+					Usage: "Password to unlock the account",
+				},
+				&cli.StringFlag{
+					Name:  "registrant",
+					Usage: "Account to register the meta-address for, which signed the registration",
+				},
+				&cli.StringFlag{
+					Name:  "signature",
+					Usage: "Registrant's signature from sign-registration",
+				},
+			},
+			Action: stealthRegister,
+		},
+		{
+			Name:      "sign-registration",
+			Usage:     "Sign a registration of a meta-address for someone else to submit",
+			ArgsUsage: "<account> <meta-address>",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "rpc",
+					Usage: "RPC endpoint to connect to",
+					Value: "http://localhost:8545",
+				},
+				&cli.StringFlag{
+					Name:  "password",
+					Usage: "Password to unlock the account",
+				},
+			},
+			Action: stealthSignRegistration,
+		},
+		{
+			Name:      "lookup",
+			Usage:     "Look up the meta-address an account registered",
+			ArgsUsage: "<account>",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "rpc",
+					Usage: "RPC endpoint to connect to",
+					Value: "http://localhost:8545",
+				},
+			},
+			Action: stealthLookup,
 		},
 	},
 }
@@ -451,21 +582,34 @@ var consoleCommand = &cli.Command{
 	},
 }
 
-// stealthGenerate generates a new stealth key pair
+// stealthGenerate generates a new stealth key pair. The private keys go to
+// the keystore encrypted and are never printed.
 func stealthGenerate(ctx *cli.Context) error {
-	keyPair, err := stealth.GenerateStealthKeyPair()
+	dataDir := ctx.String(dataDirFlag.Name)
+	keystoreDir := filepath.Join(dataDir, "keystore")
+	ks := keystore.NewKeyStore(keystoreDir)
+	defer ks.Close()
+
+	password := ctx.String("password")
+	if password == "" {
+		fmt.Print("Enter password: ")
+		if _, err := fmt.Scanln(&password); err != nil {
+			return fmt.Errorf("failed to read password: %v", err)
+		}
+	}
+
+	account, err := ks.NewStealthKey(password)
 	if err != nil {
 		return fmt.Errorf("failed to generate stealth key pair: %v", err)
 	}
-
-	metaAddr := keyPair.MetaAddress()
+	metaAddr, err := stealth.ParseMetaAddress(account.MetaAddress)
+	if err != nil {
+		return err
+	}
 
 	fmt.Println("=== Stealth Key Pair Generated ===")
 	fmt.Println()
-	fmt.Println("KEEP THESE PRIVATE KEYS SECURE!")
-	fmt.Println()
-	fmt.Printf("Spend Private Key: %s\n", hex.EncodeToString(keyPair.SpendPrivateKey.D.Bytes()))
-	fmt.Printf("View Private Key:  %s\n", hex.EncodeToString(keyPair.ViewPrivateKey.D.Bytes()))
+	fmt.Printf("Key file: %s\n", account.URL.Path)
 	fmt.Println()
 	fmt.Println("=== Public Meta-Address (share this) ===")
 	fmt.Println()
@@ -477,6 +621,27 @@ func stealthGenerate(ctx *cli.Context) error {
 	return nil
 }
 
+// stealthList lists the stealth meta-addresses in the keystore
+func stealthList(ctx *cli.Context) error {
+	dataDir := ctx.String(dataDirFlag.Name)
+	keystoreDir := filepath.Join(dataDir, "keystore")
+	ks := keystore.NewKeyStore(keystoreDir)
+	defer ks.Close()
+
+	accounts := ks.StealthAccounts()
+	if len(accounts) == 0 {
+		fmt.Println("No stealth keys found in keystore")
+		return nil
+	}
+
+	fmt.Printf("Keystore directory: %s\n", keystoreDir)
+	fmt.Printf("Found %d stealth key(s):\n", len(accounts))
+	for i, account := range accounts {
+		fmt.Printf("%d. %s (file: %s)\n", i+1, account.MetaAddress, filepath.Base(account.URL.Path))
+	}
+	return nil
+}
+
 // stealthAddress generates a one-time stealth address
 func stealthAddress(ctx *cli.Context) error {
 	metaAddrStr := ctx.Args().First()
@@ -508,15 +673,209 @@ func stealthAddress(ctx *cli.Context) error {
 
 // stealthScan scans for stealth payments
 func stealthScan(ctx *cli.Context) error {
-	viewKey := ctx.Args().First()
-	if viewKey == "" {
-		return fmt.Errorf("must provide view private key")
+	metaAddr := ctx.Args().First()
+	if metaAddr == "" {
+		return fmt.Errorf("must provide a meta-address")
+	}
+
+	dataDir := ctx.String(dataDirFlag.Name)
+	ks := keystore.NewKeyStore(filepath.Join(dataDir, "keystore"))
+	defer ks.Close()
+
+	password := ctx.String("password")
+	if password == "" {
+		fmt.Print("Enter password: ")
+		if _, err := fmt.Scanln(&password); err != nil {
+			return fmt.Errorf("failed to read password: %v", err)
+		}
+	}
+	// Scanning only needs the view key, the spend key stays encrypted
+	if err := ks.TimedUnlockStealthView(metaAddr, password, time.Minute); err != nil {
+		return fmt.Errorf("failed to unlock view key: %v", err)
 	}
 	fmt.Println("Scanning for stealth payments...")
 	fmt.Println("(This feature requires a running node with indexed transactions)")
 	return nil
 }
 
+// stealthRegister registers a meta-address in the stealth registry, for the
+// sending account or, given a signature, for the registrant that signed it
+func stealthRegister(ctx *cli.Context) error {
+	if ctx.Args().Len() < 2 {
+		return fmt.Errorf("usage: stealth register <account> <meta-address>")
+	}
+	from := common.HexToAddress(ctx.Args().Get(0))
+	metaAddr, err := stealth.ParseMetaAddress(ctx.Args().Get(1))
+	if err != nil {
+		return fmt.Errorf("invalid meta-address: %v", err)
+	}
+	raw := metaAddr.Bytes()
+	scheme := big.NewInt(registry.SchemeSecp256k1)
+
+	var input []byte
+	if registrant := ctx.String("registrant"); registrant != "" {
+		sig, err := hexutil.Decode(ctx.String("signature"))
+		if err != nil {
+			return fmt.Errorf("invalid signature: %v", err)
+		}
+		input, err = registry.ABI.Pack("registerKeysOnBehalf", common.HexToAddress(registrant), scheme, sig, raw)
+		if err != nil {
+			return err
+		}
+	} else if input, err = registry.ABI.Pack("registerKeys", scheme, raw); err != nil {
+		return err
+	}
+
+	client, err := ethrpc.Dial(ctx.String("rpc"))
+	if err != nil {
+		return fmt.Errorf("failed to connect to node: %v", err)
+	}
+	defer client.Close()
+
+	var nonce hexutil.Uint64
+	if err := client.Call(&nonce, "eth_getTransactionCount", from, "latest"); err != nil {
+		return fmt.Errorf("failed to get nonce: %v", err)
+	}
+	call := map[string]interface{}{"from": from, "to": registry.Address, "data": hexutil.Bytes(input)}
+	var gas hexutil.Uint64
+	if err := client.Call(&gas, "eth_estimateGas", call); err != nil {
+		return fmt.Errorf("failed to estimate gas: %v", err)
+	}
+	// Every transaction carries an ephemeral key, a throwaway one does here
+	ephemeral, err := crypto.GenerateKey()
+	if err != nil {
+		return err
+	}
+	tx := obstypes.NewStealthTransaction(
+		uint64(nonce),
+		registry.Address,
+		big.NewInt(0),
+		uint64(gas),
+		big.NewInt(1e9),
+		input,
+		crypto.CompressPubkey(&ephemeral.PublicKey),
+		0,
+	)
+
+	// Sign transaction
+	dataDir := ctx.String(dataDirFlag.Name)
+	ks := keystore.NewKeyStore(filepath.Join(dataDir, "keystore"))
+	defer ks.Close()
+
+	password := ctx.String("password")
+	if password == "" {
+		fmt.Print("Enter password: ")
+		if _, err := fmt.Scanln(&password); err != nil {
+			return fmt.Errorf("failed to read password: %v", err)
+		}
+	}
+
+	signedTx, err := ks.SignTxWithPassword(from, password, tx, big.NewInt(1719))
+	if err != nil {
+		return fmt.Errorf("failed to sign transaction: %v", err)
+	}
+	data, err := rlp.EncodeToBytes(signedTx)
+	if err != nil {
+		return fmt.Errorf("failed to encode transaction: %v", err)
+	}
+
+	var txHash common.Hash
+	if err := client.Call(&txHash, "eth_sendRawTransaction", hexutil.Encode(data)); err != nil {
+		return fmt.Errorf("failed to send transaction: %v", err)
+	}
+	fmt.Printf("Registration sent!\n")
+	fmt.Printf("Meta-Address:     %s\n", metaAddr.String())
+	fmt.Printf("Transaction hash: %s\n", txHash.Hex())
+	return nil
+}
+
+// stealthSignRegistration signs the registration of a meta-address for an
+// account, for a relayer to submit with stealth register --registrant
+func stealthSignRegistration(ctx *cli.Context) error {
+	if ctx.Args().Len() < 2 {
+		return fmt.Errorf("usage: stealth sign-registration <account> <meta-address>")
+	}
+	account := common.HexToAddress(ctx.Args().Get(0))
+	metaAddr, err := stealth.ParseMetaAddress(ctx.Args().Get(1))
+	if err != nil {
+		return fmt.Errorf("invalid meta-address: %v", err)
+	}
+	raw := metaAddr.Bytes()
+
+	client, err := ethrpc.Dial(ctx.String("rpc"))
+	if err != nil {
+		return fmt.Errorf("failed to connect to node: %v", err)
+	}
+	defer client.Close()
+
+	// The signature is only good for the account's current registry nonce
+	input, err := registry.ABI.Pack("nonceOf", account)
+	if err != nil {
+		return err
+	}
+	var out hexutil.Bytes
+	if err := client.Call(&out, "eth_call", map[string]interface{}{"to": registry.Address, "data": hexutil.Bytes(input)}, "latest"); err != nil {
+		return fmt.Errorf("failed to get registry nonce: %v", err)
+	}
+	values, err := registry.ABI.Unpack("nonceOf", out)
+	if err != nil {
+		return fmt.Errorf("failed to decode registry nonce: %v", err)
+	}
+	nonce := values[0].(*big.Int).Uint64()
+
+	dataDir := ctx.String(dataDirFlag.Name)
+	ks := keystore.NewKeyStore(filepath.Join(dataDir, "keystore"))
+	defer ks.Close()
+
+	password := ctx.String("password")
+	if password == "" {
+		fmt.Print("Enter password: ")
+		if _, err := fmt.Scanln(&password); err != nil {
+			return fmt.Errorf("failed to read password: %v", err)
+		}
+	}
+	if err := ks.TimedUnlock(account, password, time.Minute); err != nil {
+		return fmt.Errorf("failed to unlock account: %v", err)
+	}
+	hash := registry.RegistrationHash(big.NewInt(1719), big.NewInt(registry.SchemeSecp256k1), raw, nonce)
+	sig, err := ks.SignHash(account, hash.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to sign registration: %v", err)
+	}
+	sig[crypto.RecoveryIDOffset] += 27
+
+	fmt.Printf("Registrant: %s\n", account.Hex())
+	fmt.Printf("Nonce:      %d\n", nonce)
+	fmt.Printf("Signature:  %s\n", hexutil.Encode(sig))
+	return nil
+}
+
+// stealthLookup prints the meta-address an account registered
+func stealthLookup(ctx *cli.Context) error {
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("usage: stealth lookup <account>")
+	}
+	account := common.HexToAddress(ctx.Args().First())
+
+	client, err := ethrpc.Dial(ctx.String("rpc"))
+	if err != nil {
+		return fmt.Errorf("failed to connect to node: %v", err)
+	}
+	defer client.Close()
+
+	var metaAddr *string
+	if err := client.Call(&metaAddr, "obs_getMetaAddress", account, "latest"); err != nil {
+		return fmt.Errorf("failed to look up meta-address: %v", err)
+	}
+	if metaAddr == nil {
+		fmt.Printf("No meta-address registered for %s\n", account.Hex())
+		return nil
+	}
+	fmt.Printf("Account:      %s\n", account.Hex())
+	fmt.Printf("Meta-Address: %s\n", *metaAddr)
+	return nil
+}
+
 // accountNew creates a new account
 func accountNew(ctx *cli.Context) error {
 	keyPair, err := stealth.GenerateStealthKeyPair()
@@ -680,6 +1039,17 @@ func dialPeers(n *node.Node, nodes []*enode.Node) {
 	}
 }
 
+// splitAndTrim splits a comma separated flag value, dropping empty elements
+func splitAndTrim(input string) []string {
+	var list []string
+	for _, s := range strings.Split(input, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
 // walletCommand manages wallet operations
 var walletCommand = &cli.Command{
 	Name:  "wallet",
@@ -717,7 +1087,7 @@ var walletCommand = &cli.Command{
 		},
 		{
 			Name:      "stealth-send",
-			Usage:     "Send funds to a stealth meta-address",
+			Usage:     "Send funds or tokens to a stealth meta-address",
 			ArgsUsage: "<from> <meta-address> <amount>",
 			Flags: []cli.Flag{
 				&cli.StringFlag{
@@ -729,12 +1099,88 @@ var walletCommand = &cli.Command{
 					Name:  "password",
 					Usage: "Password to unlock the account",
 				},
+				&cli.StringFlag{
+					Name:  "token",
+					Usage: "ERC-20 token contract to send the amount of instead of OBS",
+				},
+				&cli.BoolFlag{
+					Name:  "erc721",
+					Usage: "Send the non-fungible token with the amount as its ID (requires --token)",
+				},
 			},
 			Action: walletStealthSend,
 		},
+		{
+			Name:      "stealth-withdraw",
+			Usage:     "Spend from a stealth address through a relayer paying the fees",
+			ArgsUsage: "<meta-address> <ephemeral-pubkey> <to> <amount>",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "rpc",
+					Usage: "RPC endpoint to connect to",
+					Value: "http://localhost:8545",
+				},
+				&cli.StringFlag{
+					Name:     "relay",
+					Usage:    "RPC endpoint of the relayer sponsoring the fees",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "password",
+					Usage: "Password to unlock the stealth key",
+				},
+				&cli.StringFlag{
+					Name:  "token",
+					Usage: "ERC-20 token contract to withdraw the amount of instead of OBS",
+				},
+				&cli.BoolFlag{
+					Name:  "erc721",
+					Usage: "Withdraw the non-fungible token with the amount as its ID (requires --token)",
+				},
+			},
+			Action: walletStealthWithdraw,
+		},
+		{
+			Name:      "speedup",
+			Usage:     "Replace a pending transaction with one paying higher fees",
+			ArgsUsage: "<tx-hash>",
+			Flags:     walletReplaceFlags(),
+			Action: func(ctx *cli.Context) error {
+				return walletReplace(ctx, false)
+			},
+		},
+		{
+			Name:      "cancel",
+			Usage:     "Cancel a pending transaction by replacing it with a zero-value self-transfer",
+			ArgsUsage: "<tx-hash>",
+			Flags:     walletReplaceFlags(),
+			Action: func(ctx *cli.Context) error {
+				return walletReplace(ctx, true)
+			},
+		},
 	},
 }
 
+// walletReplaceFlags returns the flags shared by the speedup and cancel commands
+func walletReplaceFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "rpc",
+			Usage: "RPC endpoint to connect to",
+			Value: "http://localhost:8545",
+		},
+		&cli.StringFlag{
+			Name:  "password",
+			Usage: "Password to unlock the account",
+		},
+		&cli.Uint64Flag{
+			Name:  "bump",
+			Usage: "Fee increase in percent over the pending transaction",
+			Value: txpool.DefaultConfig().PriceBump,
+		},
+	}
+}
+
 func walletBalance(ctx *cli.Context) error {
 	addrStr := ctx.Args().First()
 	if addrStr == "" {
@@ -839,6 +1285,19 @@ func walletStealthSend(ctx *cli.Context) error {
 		return fmt.Errorf("invalid amount")
 	}
 
+	asset := stealth.NativeAsset
+	if token := ctx.String("token"); token != "" {
+		if !common.IsHexAddress(token) {
+			return fmt.Errorf("invalid token address %q", token)
+		}
+		asset = stealth.Asset{Standard: stealth.ERC20Standard, Token: common.HexToAddress(token)}
+		if ctx.Bool("erc721") {
+			asset.Standard = stealth.ERC721Standard
+		}
+	} else if ctx.Bool("erc721") {
+		return fmt.Errorf("--erc721 requires --token")
+	}
+
 	metaAddr, err := stealth.ParseMetaAddress(metaAddrStr)
 	if err != nil {
 		return fmt.Errorf("invalid meta-address: %v", err)
@@ -862,14 +1321,22 @@ func walletStealthSend(ctx *cli.Context) error {
 		return fmt.Errorf("failed to get nonce: %v", err)
 	}
 
-	// Create stealth transaction
+	// Create stealth transaction. Tokens go out through a call to their
+	// contract, announced for the stealth address it transfers them to.
+	to, value, input := stealthAddr.Address, amount, []byte(nil)
+	if asset != stealth.NativeAsset {
+		if to, input, err = stealth.TransferData(asset, from, stealthAddr.Address, amount); err != nil {
+			return err
+		}
+		value = new(big.Int)
+	}
 	tx := obstypes.NewStealthTransaction(
 		uint64(nonce),
-		stealthAddr.Address,
-		amount,
+		to,
+		value,
 		100000,
 		big.NewInt(1e9),
-		nil,
+		input,
 		stealthAddr.EphemeralPubKey,
 		stealthAddr.ViewTag,
 	)
@@ -906,6 +1373,103 @@ func walletStealthSend(ctx *cli.Context) error {
 
 	fmt.Printf("Stealth transaction sent!\n")
 	fmt.Printf("One-time address: %s\n", stealthAddr.Address.Hex())
+	fmt.Printf("Asset: %s\n", asset)
+	if !asset.Verified() {
+		fmt.Printf("Token calls aren't executed by the chain, the recipient sees the payment as unverified\n")
+	}
+	fmt.Printf("Transaction hash: %s\n", txHash.Hex())
+	return nil
+}
+
+// walletReplace re-signs a pending transaction with higher fees and sends it
+// in its place. With cancel set the replacement is a zero-value transfer to
+// the sender instead of a copy of the original.
+func walletReplace(ctx *cli.Context, cancel bool) error {
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("usage: wallet %s <tx-hash>", ctx.Command.Name)
+	}
+	hash := common.HexToHash(ctx.Args().First())
+
+	client, err := ethrpc.Dial(ctx.String("rpc"))
+	if err != nil {
+		return fmt.Errorf("failed to connect to node: %v", err)
+	}
+	defer client.Close()
+
+	// Make sure the transaction is still waiting to be mined
+	var pending struct {
+		BlockHash *common.Hash `json:"blockHash"`
+	}
+	if err := client.Call(&pending, "eth_getTransactionByHash", hash); err != nil {
+		return fmt.Errorf("failed to get transaction: %v", err)
+	}
+	if pending.BlockHash != nil {
+		return fmt.Errorf("transaction %s is already mined", hash.Hex())
+	}
+
+	var raw hexutil.Bytes
+	if err := client.Call(&raw, "eth_getRawTransactionByHash", hash); err != nil {
+		return fmt.Errorf("failed to get transaction: %v", err)
+	}
+	if len(raw) == 0 {
+		return fmt.Errorf("transaction %s not found", hash.Hex())
+	}
+	tx := new(obstypes.StealthTransaction)
+	if err := rlp.DecodeBytes(raw, tx); err != nil {
+		return fmt.Errorf("failed to decode transaction: %v", err)
+	}
+
+	chainID := big.NewInt(1719)
+	from, err := obstypes.NewStealthEIP155Signer(chainID).Sender(tx)
+	if err != nil {
+		return fmt.Errorf("failed to recover sender: %v", err)
+	}
+
+	// Build the replacement
+	var replacement *obstypes.StealthTransaction
+	if cancel {
+		replacement = txpool.CancelTx(tx, from, ctx.Uint64("bump"))
+	} else {
+		replacement = txpool.SpeedUpTx(tx, ctx.Uint64("bump"))
+	}
+
+	// Sign transaction
+	dataDir := ctx.String(dataDirFlag.Name)
+	ks := keystore.NewKeyStore(filepath.Join(dataDir, "keystore"))
+	defer ks.Close()
+
+	password := ctx.String("password")
+	if password == "" {
+		fmt.Print("Enter password: ")
+		if _, err := fmt.Scanln(&password); err != nil {
+			return fmt.Errorf("failed to read password: %v", err)
+		}
+	}
+
+	signedTx, err := ks.SignTxWithPassword(from, password, replacement, chainID)
+	if err != nil {
+		return fmt.Errorf("failed to sign transaction: %v", err)
+	}
+
+	data, err := rlp.EncodeToBytes(signedTx)
+	if err != nil {
+		return fmt.Errorf("failed to encode transaction: %v", err)
+	}
+
+	var txHash common.Hash
+	if err := client.Call(&txHash, "eth_sendRawTransaction", hexutil.Encode(data)); err != nil {
+		return fmt.Errorf("failed to send transaction: %v", err)
+	}
+
+	if cancel {
+		fmt.Printf("Cancellation sent!\n")
+	} else {
+		fmt.Printf("Replacement sent!\n")
+	}
+	fmt.Printf("Replaced:         %s\n", hash.Hex())
+	if signedTx.GasPrice() != nil {
+		fmt.Printf("Gas price:        %s wei\n", signedTx.GasPrice())
+	}
 	fmt.Printf("Transaction hash: %s\n", txHash.Hex())
 	return nil
 }
@@ -0,0 +1,256 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of Obsidian.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	ethrpc "github.com/ethereum/go-ethereum/rpc"
+	"github.com/urfave/cli/v2"
+
+	"github.com/obsidian-chain/obsidian/accounts/keystore"
+	obstypes "github.com/obsidian-chain/obsidian/core/types"
+	"github.com/obsidian-chain/obsidian/relay"
+	"github.com/obsidian-chain/obsidian/stealth"
+)
+
+// relayCommand runs a local relayer paying the fees of sponsored stealth
+// transactions
+var relayCommand = &cli.Command{
+	Name:      "relay",
+	Usage:     "Run a relayer paying the fees of sponsored stealth transactions",
+	ArgsUsage: "<account>",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "rpc",
+			Usage: "RPC endpoint of the node to submit transactions to",
+			Value: "http://localhost:8545",
+		},
+		&cli.StringFlag{
+			Name:  "password",
+			Usage: "Password to unlock the account paying the fees",
+		},
+		&cli.StringFlag{
+			Name:  "http.addr",
+			Usage: "Relayer HTTP-RPC server listening interface",
+			Value: "localhost",
+		},
+		&cli.IntFlag{
+			Name:  "http.port",
+			Usage: "Relayer HTTP-RPC server listening port",
+			Value: 8555,
+		},
+		&cli.Uint64Flag{
+			Name:  "maxgas",
+			Usage: "Largest gas limit to sponsor",
+			Value: relay.DefaultConfig.MaxGas,
+		},
+		&cli.Uint64Flag{
+			Name:  "gasprice",
+			Usage: "Gas price in wei sponsored transactions pay",
+			Value: relay.DefaultConfig.GasPrice.Uint64(),
+		},
+	},
+	Action: relayRun,
+}
+
+// readPassword returns the password flag, prompting for it if unset
+func readPassword(ctx *cli.Context) (string, error) {
+	password := ctx.String("password")
+	if password == "" {
+		fmt.Print("Enter password: ")
+		if _, err := fmt.Scanln(&password); err != nil {
+			return "", fmt.Errorf("failed to read password: %v", err)
+		}
+	}
+	return password, nil
+}
+
+// nodeChainID asks a node for its chain ID
+func nodeChainID(client *ethrpc.Client) (*big.Int, error) {
+	var chainID hexutil.Big
+	if err := client.Call(&chainID, "eth_chainId"); err != nil {
+		return nil, fmt.Errorf("failed to get chain ID: %v", err)
+	}
+	return (*big.Int)(&chainID), nil
+}
+
+func relayRun(ctx *cli.Context) error {
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("usage: relay <account>")
+	}
+	account := common.HexToAddress(ctx.Args().First())
+
+	client, err := ethrpc.Dial(ctx.String("rpc"))
+	if err != nil {
+		return fmt.Errorf("failed to connect to node: %v", err)
+	}
+	defer client.Close()
+	chainID, err := nodeChainID(client)
+	if err != nil {
+		return err
+	}
+
+	ks := keystore.NewKeyStore(filepath.Join(ctx.String(dataDirFlag.Name), "keystore"))
+	defer ks.Close()
+	password, err := readPassword(ctx)
+	if err != nil {
+		return err
+	}
+	if err := ks.TimedUnlock(account, password, 0); err != nil {
+		return fmt.Errorf("failed to unlock account: %v", err)
+	}
+	key, err := ks.GetKey(account)
+	if err != nil {
+		return err
+	}
+	relayer := relay.New(relay.NewRPCBackend(client), key, chainID, relay.Config{
+		MaxGas:   ctx.Uint64("maxgas"),
+		GasPrice: new(big.Int).SetUint64(ctx.Uint64("gasprice")),
+	})
+
+	server := ethrpc.NewServer()
+	if err := server.RegisterName("relay", relay.NewAPI(relayer)); err != nil {
+		return err
+	}
+	defer server.Stop()
+	endpoint := fmt.Sprintf("%s:%d", ctx.String("http.addr"), ctx.Int("http.port"))
+	listener, err := net.Listen("tcp", endpoint)
+	if err != nil {
+		return err
+	}
+	httpServer := &http.Server{Handler: server, ReadHeaderTimeout: 10 * time.Second}
+	go func() { _ = httpServer.Serve(listener) }()
+	log.Info("Relayer started", "endpoint", endpoint, "sponsor", relayer.Address(), "chainid", chainID)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	<-sigCh
+
+	log.Info("Shutting down relayer...")
+	return httpServer.Shutdown(context.Background())
+}
+
+// walletStealthWithdraw spends from a stealth address through a relayer,
+// which pays the fees so the stealth address needs no OBS for gas
+func walletStealthWithdraw(ctx *cli.Context) error {
+	if ctx.Args().Len() < 4 {
+		return fmt.Errorf("usage: wallet stealth-withdraw <meta-address> <ephemeral-pubkey> <to> <amount>")
+	}
+	var (
+		metaAddrStr = ctx.Args().Get(0)
+		to          = common.HexToAddress(ctx.Args().Get(2))
+	)
+	ephPubKey, err := hexutil.Decode(ctx.Args().Get(1))
+	if err != nil {
+		return fmt.Errorf("invalid ephemeral public key: %v", err)
+	}
+	amount, ok := new(big.Int).SetString(ctx.Args().Get(3), 10)
+	if !ok {
+		return fmt.Errorf("invalid amount")
+	}
+	asset := stealth.NativeAsset
+	if token := ctx.String("token"); token != "" {
+		if !common.IsHexAddress(token) {
+			return fmt.Errorf("invalid token address %q", token)
+		}
+		asset = stealth.Asset{Standard: stealth.ERC20Standard, Token: common.HexToAddress(token)}
+		if ctx.Bool("erc721") {
+			asset.Standard = stealth.ERC721Standard
+		}
+	} else if ctx.Bool("erc721") {
+		return fmt.Errorf("--erc721 requires --token")
+	}
+	metaAddr, err := stealth.ParseMetaAddress(metaAddrStr)
+	if err != nil {
+		return fmt.Errorf("invalid meta-address: %v", err)
+	}
+	spendPubKey, err := stealth.DecompressPublicKey(metaAddr.SpendPubKey)
+	if err != nil {
+		return fmt.Errorf("invalid meta-address: %v", err)
+	}
+
+	ks := keystore.NewKeyStore(filepath.Join(ctx.String(dataDirFlag.Name), "keystore"))
+	defer ks.Close()
+	password, err := readPassword(ctx)
+	if err != nil {
+		return err
+	}
+	if err := ks.TimedUnlockStealth(metaAddrStr, password, time.Minute); err != nil {
+		return fmt.Errorf("failed to unlock stealth key: %v", err)
+	}
+	viewKey, err := ks.StealthViewKey(metaAddrStr)
+	if err != nil {
+		return err
+	}
+	from, err := stealth.ComputeStealthAddress(viewKey, spendPubKey, ephPubKey)
+	if err != nil {
+		return fmt.Errorf("failed to compute stealth address: %v", err)
+	}
+
+	client, err := ethrpc.Dial(ctx.String("rpc"))
+	if err != nil {
+		return fmt.Errorf("failed to connect to node: %v", err)
+	}
+	defer client.Close()
+	chainID, err := nodeChainID(client)
+	if err != nil {
+		return err
+	}
+	var nonce hexutil.Uint64
+	if err := client.Call(&nonce, "eth_getTransactionCount", from, "latest"); err != nil {
+		return fmt.Errorf("failed to get nonce: %v", err)
+	}
+
+	// Withdrawals pay a plain address, the ephemeral key only keeps the
+	// transaction well-formed
+	dest, value, input := to, amount, []byte(nil)
+	if asset != stealth.NativeAsset {
+		if dest, input, err = stealth.TransferData(asset, from, to, amount); err != nil {
+			return err
+		}
+		value = new(big.Int)
+	}
+	ephemeral, err := crypto.GenerateKey()
+	if err != nil {
+		return err
+	}
+	tx := obstypes.NewSponsoredTransaction(uint64(nonce), dest, value, input, crypto.CompressPubkey(&ephemeral.PublicKey), 0)
+	signed, err := ks.SignStealthTx(metaAddrStr, ephPubKey, tx, chainID)
+	if err != nil {
+		return fmt.Errorf("failed to sign transaction: %v", err)
+	}
+	data, err := rlp.EncodeToBytes(signed)
+	if err != nil {
+		return fmt.Errorf("failed to encode transaction: %v", err)
+	}
+
+	relayClient, err := ethrpc.Dial(ctx.String("relay"))
+	if err != nil {
+		return fmt.Errorf("failed to connect to relayer: %v", err)
+	}
+	defer relayClient.Close()
+	var txHash common.Hash
+	if err := relayClient.Call(&txHash, "relay_sendTransaction", hexutil.Bytes(data)); err != nil {
+		return fmt.Errorf("relayer refused transaction: %v", err)
+	}
+	fmt.Printf("Sponsored transaction sent!\n")
+	fmt.Printf("Stealth address: %s\n", from.Hex())
+	fmt.Printf("Transaction hash: %s\n", txHash.Hex())
+	return nil
+}
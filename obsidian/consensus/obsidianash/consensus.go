@@ -55,6 +55,7 @@ type ObsidianAsh struct {
 	hashrate *hashrate
 
 	// Testing hooks
+	fake      bool // Accept any seal
 	fakeFail  *uint64
 	fakeDelay *time.Duration
 	fakeFull  bool
@@ -77,6 +78,7 @@ func New(config *obsparams.ObsidianashConfig) *ObsidianAsh {
 func NewFaker() *ObsidianAsh {
 	return &ObsidianAsh{
 		config:   obsparams.DefaultObsidianashConfig(),
+		fake:     true,
 		fakeFull: false,
 	}
 }
@@ -85,10 +87,17 @@ func NewFaker() *ObsidianAsh {
 func NewFullFaker() *ObsidianAsh {
 	return &ObsidianAsh{
 		config:   obsparams.DefaultObsidianashConfig(),
+		fake:     true,
 		fakeFull: true,
 	}
 }
 
+// Fake reports whether the engine was created by NewFaker or NewFullFaker.
+// Fake engines accept any seal, so blocks need not be mined.
+func (o *ObsidianAsh) Fake() bool {
+	return o.fake
+}
+
 // Author returns the coinbase address (miner) of the block
 func (o *ObsidianAsh) Author(header *types.Header) (common.Address, error) {
 	return header.Coinbase, nil
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/log"
@@ -22,6 +23,8 @@ import (
 	obsstate "github.com/obsidian-chain/obsidian/core/state"
 	obstypes "github.com/obsidian-chain/obsidian/core/types"
 	"github.com/obsidian-chain/obsidian/params"
+	"github.com/obsidian-chain/obsidian/stealth"
+	"github.com/obsidian-chain/obsidian/stealth/registry"
 )
 
 var (
@@ -33,6 +36,13 @@ var (
 	ErrInvalidNumber        = errors.New("invalid block number")
 	ErrInvalidTerminalBlock = errors.New("invalid terminal block")
 	ErrSideChainReceipts    = errors.New("side chain receipts")
+	ErrMissingState         = errors.New("missing state")
+	ErrReceiptRootMismatch  = errors.New("receipt root mismatch")
+	ErrInvalidPoW           = errors.New("invalid proof of work")
+
+	// ErrInvalidBlock wraps every error caused by the block itself failing
+	// validation, as opposed to local failures such as missing state
+	ErrInvalidBlock = errors.New("invalid block")
 )
 
 // BlockChain represents the canonical chain
@@ -77,6 +87,14 @@ type ChainConfig struct {
 	EIP150Block    *big.Int
 	EIP155Block    *big.Int
 	EIP158Block    *big.Int
+
+	StealthRegistryBlock *big.Int // Stealth meta-address registry at 0x0B (nil = not scheduled)
+}
+
+// IsStealthRegistry returns whether the stealth meta-address registry is
+// active at the given block
+func (c *ChainConfig) IsStealthRegistry(num *big.Int) bool {
+	return c.StealthRegistryBlock != nil && num != nil && c.StealthRegistryBlock.Cmp(num) <= 0
 }
 
 // DefaultChainConfig returns the default chain configuration
@@ -87,6 +105,8 @@ func DefaultChainConfig() *ChainConfig {
 		EIP150Block:    big.NewInt(0),
 		EIP155Block:    big.NewInt(0),
 		EIP158Block:    big.NewInt(0),
+
+		StealthRegistryBlock: big.NewInt(0),
 	}
 }
 
@@ -122,9 +142,11 @@ func (sc *StateCache) OpenState(root common.Hash) (*obsstate.StateDB, error) {
 		return nil, err
 	}
 
-	// Cache if space available
+	// Cache if space available. Callers modify the state they're given, so
+	// the cached instance is never handed out itself.
 	if len(sc.states) < sc.maxSize {
 		sc.states[root] = state
+		return state.Copy(), nil
 	}
 
 	return state, nil
@@ -236,6 +258,8 @@ func NewBlockChain(db *rawdb.Database, config *ChainConfig, engine *obsidianash.
 		"head", bc.currentBlock.Load().NumberU64(),
 		"td", bc.GetTd(bc.currentBlock.Load().Hash(), bc.currentBlock.Load().NumberU64()),
 	)
+	bc.startStealthIndexer()
+	bc.startStealthFilterBuilder()
 
 	return bc, nil
 }
@@ -312,8 +336,8 @@ func (bc *BlockChain) WriteGenesis(genesis *Genesis) (*obstypes.ObsidianBlock, e
 	rawdb.WriteHeadBlockHash(bc.db, hash)
 	rawdb.WriteHeadHeaderHash(bc.db, hash)
 
-	// Write header
-	headerRLP, err := rlp.EncodeToBytes(header)
+	// Write header, as completed by NewBlock
+	headerRLP, err := rlp.EncodeToBytes(block.Header())
 	if err != nil {
 		return nil, err
 	}
@@ -322,6 +346,9 @@ func (bc *BlockChain) WriteGenesis(genesis *Genesis) (*obstypes.ObsidianBlock, e
 	// Write TD
 	rawdb.WriteTd(bc.db, hash, 0, genesis.Difficulty)
 
+	// Write the stealth filter, the root of the filter header chain
+	writeStealthFilter(bc.db, block, common.Hash{})
+
 	// Write state to database
 	if err := bc.writeState(stateDB, stateRoot); err != nil {
 		return nil, err
@@ -347,6 +374,12 @@ func (bc *BlockChain) CurrentBlock() *obstypes.ObsidianBlock {
 	return bc.currentBlock.Load()
 }
 
+// CurrentFastBlock returns the head of the blocks stored without state
+// during snap sync. Outside of snap sync it is the current block.
+func (bc *BlockChain) CurrentFastBlock() *obstypes.ObsidianBlock {
+	return bc.currentFastBlock.Load()
+}
+
 // CurrentHeader returns the current head header
 func (bc *BlockChain) CurrentHeader() *obstypes.ObsidianHeader {
 	return bc.currentBlock.Load().Header()
@@ -502,6 +535,85 @@ func (bc *BlockChain) InsertBlock(block *obstypes.ObsidianBlock) error {
 	return bc.insertBlock(block, true)
 }
 
+// InsertBlockWithoutState stores a block without executing it, as snap sync
+// does for the blocks up to the pivot whose state it downloads. The block
+// becomes canonical but the head block is left in place until the state is
+// available and SnapSyncCommitHead is called.
+func (bc *BlockChain) InsertBlockWithoutState(block *obstypes.ObsidianBlock) error {
+	bc.insertMu.Lock()
+	defer bc.insertMu.Unlock()
+
+	hash := block.Hash()
+	number := block.NumberU64()
+	if bc.HasBlock(hash, number) {
+		return ErrKnownBlock
+	}
+	parent := bc.GetBlock(block.ParentHash(), number-1)
+	if parent == nil {
+		return ErrUnknownAncestor
+	}
+	if err := bc.verifyHeader(block.Header(), parent.Header()); err != nil {
+		return fmt.Errorf("%w: header verification failed: %w", ErrInvalidBlock, err)
+	}
+	parentTd := bc.GetTd(parent.Hash(), parent.NumberU64())
+	if parentTd == nil {
+		return errors.New("parent total difficulty not found")
+	}
+	bc.writeBlock(block, nil, new(big.Int).Add(parentTd, block.Difficulty()))
+
+	rawdb.WriteCanonicalHash(bc.db, hash, number)
+	writeTxLookups(bc.db, block)
+	writeStealthIndex(bc.db, block)
+	rawdb.WriteHeadHeaderHash(bc.db, hash)
+	bc.currentFastBlock.Store(block)
+	return nil
+}
+
+// InsertReceipts stores the receipts of a block stored by
+// InsertBlockWithoutState, once they are verified against its receipt root
+func (bc *BlockChain) InsertReceipts(hash common.Hash, receipts obstypes.Receipts) error {
+	block := bc.GetBlockByHash(hash)
+	if block == nil {
+		return fmt.Errorf("non existent block %x", hash)
+	}
+	if len(receipts) != len(block.Transactions()) {
+		return fmt.Errorf("%w: %d receipts for %d transactions", ErrReceiptRootMismatch, len(receipts), len(block.Transactions()))
+	}
+	if root := obstypes.DeriveSha(receipts); root != block.ReceiptHash() {
+		return fmt.Errorf("%w: got %x, want %x", ErrReceiptRootMismatch, root, block.ReceiptHash())
+	}
+	if err := receipts.DeriveFields(hash, block.NumberU64(), block.BaseFee(), block.Transactions()); err != nil {
+		return err
+	}
+	receiptsRLP, err := rlp.EncodeToBytes(receipts)
+	if err != nil {
+		return err
+	}
+	rawdb.WriteReceiptsRLP(bc.db, hash, block.NumberU64(), receiptsRLP)
+	bc.receiptsCache.Add(hash, receipts)
+	return nil
+}
+
+// SnapSyncCommitHead makes a block stored by InsertBlockWithoutState the
+// head of the chain once its state has been synced
+func (bc *BlockChain) SnapSyncCommitHead(hash common.Hash) error {
+	bc.insertMu.Lock()
+	defer bc.insertMu.Unlock()
+
+	block := bc.GetBlockByHash(hash)
+	if block == nil {
+		return fmt.Errorf("non existent block %x", hash)
+	}
+	if !obsstate.HasState(bc.db, block.Root()) {
+		return fmt.Errorf("%w: block %d root %x", ErrMissingState, block.NumberU64(), block.Root())
+	}
+	bc.writeHeadBlock(block)
+	bc.chainHeadFeed.Send(ChainHeadEvent{Block: block})
+
+	log.Info("Committed new head block", "number", block.NumberU64(), "hash", hash.Hex())
+	return nil
+}
+
 // insertBlock is the internal block insertion function
 func (bc *BlockChain) insertBlock(block *obstypes.ObsidianBlock, validate bool) error {
 	// Check if already known
@@ -520,7 +632,7 @@ func (bc *BlockChain) insertBlock(block *obstypes.ObsidianBlock, validate bool)
 	// Verify header using our own validation
 	if validate {
 		if err := bc.verifyHeader(block.Header(), parent.Header()); err != nil {
-			return fmt.Errorf("header verification failed: %w", err)
+			return fmt.Errorf("%w: header verification failed: %w", ErrInvalidBlock, err)
 		}
 	}
 
@@ -533,12 +645,17 @@ func (bc *BlockChain) insertBlock(block *obstypes.ObsidianBlock, validate bool)
 	// Execute block transactions
 	receipts, logs, usedGas, err := bc.processor(block, parentState)
 	if err != nil {
-		return fmt.Errorf("block processing failed: %w", err)
+		return fmt.Errorf("%w: block processing failed: %w", ErrInvalidBlock, err)
 	}
 
 	// Verify gas used
 	if usedGas != block.GasUsed() {
-		return fmt.Errorf("gas used mismatch: got %d, want %d", usedGas, block.GasUsed())
+		return fmt.Errorf("%w: gas used mismatch: got %d, want %d", ErrInvalidBlock, usedGas, block.GasUsed())
+	}
+
+	// Verify receipts
+	if root := obstypes.DeriveSha(receipts); root != block.ReceiptHash() {
+		return fmt.Errorf("%w: %w: got %s, want %s", ErrInvalidBlock, ErrReceiptRootMismatch, root.Hex(), block.ReceiptHash().Hex())
 	}
 
 	// Commit state
@@ -549,12 +666,7 @@ func (bc *BlockChain) insertBlock(block *obstypes.ObsidianBlock, validate bool)
 
 	// Verify state root
 	if stateRoot != block.Root() {
-		return fmt.Errorf("state root mismatch: got %s, want %s", stateRoot.Hex(), block.Root().Hex())
-	}
-
-	// Persist state
-	if err := bc.writeState(parentState, stateRoot); err != nil {
-		return fmt.Errorf("state write failed: %w", err)
+		return fmt.Errorf("%w: state root mismatch: got %s, want %s", ErrInvalidBlock, stateRoot.Hex(), block.Root().Hex())
 	}
 
 	// Calculate total difficulty
@@ -564,12 +676,28 @@ func (bc *BlockChain) insertBlock(block *obstypes.ObsidianBlock, validate bool)
 	}
 	td := new(big.Int).Add(parentTd, block.Difficulty())
 
+	head := bc.currentBlock.Load()
+	newHead := td.Cmp(bc.GetTd(head.Hash(), head.NumberU64())) > 0
+
+	// Persist state. The flat data follows the head: side chain blocks only
+	// store their trie nodes, and a reorg rebuilds it from the new head's trie.
+	if newHead && parent.Hash() == head.Hash() {
+		err = bc.writeState(parentState, stateRoot)
+	} else {
+		err = parentState.CommitNodesToDB(bc.db)
+		if err == nil && newHead {
+			_, err = obsstate.RepairFlatState(bc.db, stateRoot)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("state write failed: %w", err)
+	}
+
 	// Write block to database
 	bc.writeBlock(block, receipts, td)
 
 	// Update chain head if this is the new canonical chain
-	currentTd := bc.GetTd(bc.currentBlock.Load().Hash(), bc.currentBlock.Load().NumberU64())
-	if td.Cmp(currentTd) > 0 {
+	if newHead {
 		bc.writeHeadBlock(block)
 		bc.chainHeadFeed.Send(ChainHeadEvent{Block: block})
 	}
@@ -625,6 +753,62 @@ func (bc *BlockChain) processor(block *obstypes.ObsidianBlock, state *obsstate.S
 	return receipts, allLogs, usedGas, nil
 }
 
+// AssembleBlock builds the block with the given header on top of its parent:
+// the transactions are executed on the parent state and the fields that
+// depend on the outcome are filled in. Transactions that can't be included,
+// because they're invalid on that state or don't fit in the gas limit, are
+// left out. The returned block still has to be sealed.
+func (bc *BlockChain) AssembleBlock(header *obstypes.ObsidianHeader, txs []*obstypes.StealthTransaction) (*obstypes.ObsidianBlock, error) {
+	header = obstypes.CopyHeader(header)
+	number := header.Number.Uint64()
+	if number == 0 {
+		return nil, ErrInvalidNumber
+	}
+	parent := bc.GetHeader(header.ParentHash, number-1)
+	if parent == nil {
+		return nil, ErrUnknownAncestor
+	}
+	state, err := bc.StateAt(parent.Root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get parent state: %w", err)
+	}
+
+	var (
+		included []*obstypes.StealthTransaction
+		receipts obstypes.Receipts
+		usedGas  uint64
+	)
+	for _, tx := range txs {
+		if usedGas+tx.Gas() > header.GasLimit {
+			continue
+		}
+		state.SetTxContext(tx.Hash(), len(included))
+		receipt, err := bc.applyTransaction(tx, state, header, &usedGas)
+		if err != nil {
+			log.Trace("Skipping transaction", "hash", tx.Hash(), "err", err)
+			continue
+		}
+		included = append(included, tx)
+		receipts = append(receipts, receipt)
+	}
+	bc.applyBlockReward(header, state)
+
+	root, err := state.Commit(true)
+	if err != nil {
+		return nil, fmt.Errorf("state commit failed: %w", err)
+	}
+	header.Root = root
+	header.GasUsed = usedGas
+	header.ReceiptHash = obstypes.DeriveSha(receipts)
+	header.Bloom = types.Bloom(obstypes.CreateBloom(receipts))
+
+	block := obstypes.NewBlock(header, included, nil, nil)
+	sealed := block.Header()
+	sealed.ReceiptHash = header.ReceiptHash
+	sealed.Bloom = header.Bloom
+	return block.WithSeal(sealed), nil
+}
+
 // applyTransaction executes a single transaction
 func (bc *BlockChain) applyTransaction(tx *obstypes.StealthTransaction, state *obsstate.StateDB, header *obstypes.ObsidianHeader, usedGas *uint64) (*obstypes.Receipt, error) {
 	// Get sender
@@ -640,21 +824,35 @@ func (bc *BlockChain) applyTransaction(tx *obstypes.StealthTransaction, state *o
 		return nil, fmt.Errorf("nonce mismatch: got %d, want %d", tx.Nonce(), nonce)
 	}
 
-	// Calculate gas cost
-	gasPrice := tx.GasPrice()
-	if gasPrice == nil {
-		gasPrice = big.NewInt(1e9) // Default 1 Gwei
+	// Sponsored transactions have their fees paid by the sponsor
+	payer := from
+	if tx.Sponsored() {
+		if payer, err = signer.Sponsor(tx); err != nil {
+			return nil, fmt.Errorf("invalid sponsor: %w", err)
+		}
 	}
+
+	// Calculate gas cost
+	gasPrice := tx.EffectiveGasPrice()
 	gasCost := new(big.Int).Mul(gasPrice, new(big.Int).SetUint64(tx.Gas()))
 
 	// Check balance for gas + value
-	totalCost := new(big.Int).Add(gasCost, tx.Value())
-	if state.GetBalance(from).Cmp(totalCost) < 0 {
-		return nil, fmt.Errorf("insufficient balance: have %s, need %s", state.GetBalance(from), totalCost)
+	if payer == from {
+		totalCost := new(big.Int).Add(gasCost, tx.Value())
+		if state.GetBalance(from).Cmp(totalCost) < 0 {
+			return nil, fmt.Errorf("insufficient balance: have %s, need %s", state.GetBalance(from), totalCost)
+		}
+	} else {
+		if state.GetBalance(payer).Cmp(gasCost) < 0 {
+			return nil, fmt.Errorf("insufficient sponsor balance: have %s, need %s", state.GetBalance(payer), gasCost)
+		}
+		if state.GetBalance(from).Cmp(tx.Value()) < 0 {
+			return nil, fmt.Errorf("insufficient balance: have %s, need %s", state.GetBalance(from), tx.Value())
+		}
 	}
 
 	// Deduct gas cost
-	state.SubBalance(from, gasCost)
+	state.SubBalance(payer, gasCost)
 	state.SetNonce(from, nonce+1)
 
 	// Execute transaction
@@ -665,6 +863,7 @@ func (bc *BlockChain) applyTransaction(tx *obstypes.StealthTransaction, state *o
 	)
 
 	to := tx.To()
+	registryCall := to != nil && *to == registry.Address && bc.chainConfig.IsStealthRegistry(header.Number)
 	if to == nil {
 		// Contract creation
 		contractAddr := CreateAddress(from, nonce)
@@ -673,6 +872,15 @@ func (bc *BlockChain) applyTransaction(tx *obstypes.StealthTransaction, state *o
 		state.AddBalance(contractAddr, tx.Value())
 		state.SubBalance(from, tx.Value())
 		gas = 21000 + uint64(len(tx.Data()))*200 // Simplified gas
+	} else if registryCall {
+		// Native stealth meta-address registry, which takes no value
+		gas = 21000 + uint64(len(tx.Data()))*68 + registry.RequiredGas(tx.Data())
+		if gas > tx.Gas() || tx.Value().Sign() > 0 {
+			failed = true
+		} else if _, logs, err = registry.Run(state, bc.chainConfig.ChainID, from, tx.Data()); err != nil {
+			log.Debug("Stealth registry call failed", "tx", tx.Hash(), "err", err)
+			failed = true
+		}
 	} else {
 		// Transfer or contract call
 		if len(state.GetCode(*to)) > 0 {
@@ -690,6 +898,13 @@ func (bc *BlockChain) applyTransaction(tx *obstypes.StealthTransaction, state *o
 			state.AddBalance(*to, tx.Value())
 		}
 	}
+	// Announce payments to stealth addresses the way ERC-5564 tooling
+	// expects, token transfers for the recipient of the tokens
+	if to != nil && !registryCall && !failed && len(tx.EphemeralPubKey()) == 33 {
+		transfer := stealth.DecodeTransfer(*to, tx.Value(), tx.Data())
+		metadata := transfer.Metadata(tx.ViewTag())
+		logs = append(logs, stealth.NewAnnouncementLog(stealth.SchemeSecp256k1, transfer.Recipient, from, tx.EphemeralPubKey(), metadata))
+	}
 
 	// Refund unused gas
 	gasUsed := gas
@@ -697,7 +912,7 @@ func (bc *BlockChain) applyTransaction(tx *obstypes.StealthTransaction, state *o
 		gasUsed = tx.Gas()
 	}
 	refund := new(big.Int).Mul(gasPrice, new(big.Int).SetUint64(tx.Gas()-gasUsed))
-	state.AddBalance(from, refund)
+	state.AddBalance(payer, refund)
 
 	*usedGas += gasUsed
 
@@ -749,16 +964,12 @@ func (bc *BlockChain) writeBlock(block *obstypes.ObsidianBlock, receipts obstype
 	receiptsRLP, _ := rlp.EncodeToBytes(receipts)
 	rawdb.WriteReceiptsRLP(bc.db, hash, number, receiptsRLP)
 
-	// Write tx lookup entries
-	txHashes := make([]common.Hash, len(block.Transactions()))
-	for i, tx := range block.Transactions() {
-		txHashes[i] = tx.Hash()
-	}
-	rawdb.WriteTxLookupEntriesByBlock(bc.db, txHashes, hash, number)
-
 	// Write total difficulty
 	rawdb.WriteTd(bc.db, hash, number, td)
 
+	// Write the stealth filter, unless its parent's is still being built
+	bc.ensureStealthFilter(block)
+
 	// Cache
 	bc.blockCache.Add(hash, block)
 	bc.headerCache.Add(hash, block.Header())
@@ -766,12 +977,65 @@ func (bc *BlockChain) writeBlock(block *obstypes.ObsidianBlock, receipts obstype
 	bc.receiptsCache.Add(hash, receipts)
 }
 
-// writeHeadBlock updates the head block
+// writeTxLookups points the lookup entries of a block's transactions at it.
+// Only canonical blocks have lookup entries.
+func writeTxLookups(db *rawdb.Database, block *obstypes.ObsidianBlock) {
+	txHashes := make([]common.Hash, len(block.Transactions()))
+	for i, tx := range block.Transactions() {
+		txHashes[i] = tx.Hash()
+	}
+	rawdb.WriteTxLookupEntriesByBlock(db, txHashes, block.Hash(), block.NumberU64())
+}
+
+// writeHeadBlock updates the head block. The canonical index is rewritten
+// from the new head back to where it joins the old chain, and entries of the
+// old chain above the new head are dropped. Transactions of the abandoned
+// blocks lose their lookup entries unless the new chain includes them.
 func (bc *BlockChain) writeHeadBlock(block *obstypes.ObsidianBlock) {
 	hash := block.Hash()
 	number := block.NumberU64()
 
-	rawdb.WriteCanonicalHash(bc.db, hash, number)
+	var abandoned []*obstypes.ObsidianBlock
+	for n := bc.currentBlock.Load().NumberU64(); n > number; n-- {
+		if old := bc.GetBlock(rawdb.ReadCanonicalHash(bc.db, n), n); old != nil {
+			abandoned = append(abandoned, old)
+		}
+		rawdb.DeleteCanonicalHash(bc.db, n)
+		rawdb.DeleteStealthIndex(bc.db, n)
+	}
+	var rewritten []*obstypes.ObsidianBlock
+	for b := block; b != nil; {
+		oldHash := rawdb.ReadCanonicalHash(bc.db, b.NumberU64())
+		if oldHash == b.Hash() {
+			break
+		}
+		if old := bc.GetBlock(oldHash, b.NumberU64()); old != nil {
+			abandoned = append(abandoned, old)
+		}
+		rewritten = append(rewritten, b)
+		if b.NumberU64() == 0 {
+			break
+		}
+		b = bc.GetBlock(b.ParentHash(), b.NumberU64()-1)
+	}
+	// Drop the old lookups before writing the new ones, as a transaction may
+	// have moved to a different height
+	for _, old := range abandoned {
+		for _, tx := range old.Transactions() {
+			rawdb.DeleteTxLookupEntry(bc.db, tx.Hash())
+		}
+	}
+	for _, b := range rewritten {
+		rawdb.WriteCanonicalHash(bc.db, b.Hash(), b.NumberU64())
+		writeTxLookups(bc.db, b)
+		writeStealthIndex(bc.db, b)
+	}
+	// Side chain blocks may have been stored before their parents' filters
+	for i := len(rewritten) - 1; i >= 0; i-- {
+		if !bc.ensureStealthFilter(rewritten[i]) {
+			break
+		}
+	}
 	rawdb.WriteHeadBlockHash(bc.db, hash)
 	rawdb.WriteHeadHeaderHash(bc.db, hash)
 
@@ -801,6 +1065,11 @@ func (bc *BlockChain) GetReceipts(hash common.Hash) obstypes.Receipts {
 	if err := rlp.DecodeBytes(receiptsRLP, &receipts); err != nil {
 		return nil
 	}
+	// Only the consensus fields are stored
+	block := bc.GetBlock(hash, *number)
+	if block == nil || len(receipts) != len(block.Transactions()) || receipts.DeriveFields(hash, *number, block.BaseFee(), block.Transactions()) != nil {
+		return nil
+	}
 
 	// Cache
 	bc.receiptsCache.Add(hash, receipts)
@@ -905,6 +1174,57 @@ func (bc *BlockChain) LastBlockTime() time.Time {
 	return time.Unix(int64(bc.CurrentBlock().Time()), 0)
 }
 
+// VerifyHeader checks a header against its parent and its proof of work
+// without executing the block, so that it can be relayed before import
+func (bc *BlockChain) VerifyHeader(header *obstypes.ObsidianHeader) error {
+	if err := header.SanityCheck(); err != nil {
+		return err
+	}
+	number := header.Number.Uint64()
+	if number == 0 {
+		return ErrInvalidNumber
+	}
+	parent := bc.GetHeader(header.ParentHash, number-1)
+	if parent == nil {
+		return ErrUnknownAncestor
+	}
+	if err := bc.verifyHeader(header, parent); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidBlock, err)
+	}
+	if err := bc.verifySeal(header); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidBlock, err)
+	}
+	return nil
+}
+
+// VerifySeal checks only the proof of work of a header, for blocks whose
+// parent isn't known yet
+func (bc *BlockChain) VerifySeal(header *obstypes.ObsidianHeader) error {
+	if err := header.SanityCheck(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidBlock, err)
+	}
+	if err := bc.verifySeal(header); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidBlock, err)
+	}
+	return nil
+}
+
+// verifySeal checks that the sealed header hash meets the difficulty target,
+// the same way the miner seals it. Fake engines accept any seal.
+func (bc *BlockChain) verifySeal(header *obstypes.ObsidianHeader) error {
+	if bc.engine != nil && bc.engine.Fake() {
+		return nil
+	}
+	target := new(big.Int).Div(two256, header.Difficulty)
+	if new(big.Int).SetBytes(header.Hash().Bytes()).Cmp(target) > 0 {
+		return ErrInvalidPoW
+	}
+	return nil
+}
+
+// two256 is 2^256
+var two256 = new(big.Int).Lsh(big.NewInt(1), 256)
+
 // verifyHeader validates a block header
 func (bc *BlockChain) verifyHeader(header, parent *obstypes.ObsidianHeader) error {
 	// Verify timestamp
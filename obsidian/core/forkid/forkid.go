@@ -0,0 +1,156 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+// Package forkid implements EIP-2124 fork identifiers for the Obsidian chain.
+package forkid
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/obsidian-chain/obsidian/core"
+)
+
+var (
+	// ErrRemoteStale is returned by the filter if a remote fork checksum is a
+	// subset of our already applied forks, but the announced next fork block is
+	// not on our already passed chain.
+	ErrRemoteStale = errors.New("remote needs update")
+
+	// ErrLocalIncompatibleOrStale is returned by the filter if a remote fork
+	// checksum does not match any local checksum variation, signalling that the
+	// two chains have diverged in the past at some point (possibly at genesis).
+	ErrLocalIncompatibleOrStale = errors.New("local incompatible or needs update")
+)
+
+// ID is a fork identifier as defined by EIP-2124
+type ID struct {
+	Hash [4]byte // CRC32 checksum of the genesis block and passed fork block numbers
+	Next uint64  // Block number of the next upcoming fork, or 0 if no forks are known
+}
+
+// Filter is a fork id filter to validate a remotely advertised ID
+type Filter func(id ID) error
+
+// NewID calculates the fork ID of a chain at the given head block
+func NewID(forks []uint64, genesis common.Hash, head uint64) ID {
+	hash := crc32.ChecksumIEEE(genesis[:])
+	for _, fork := range forks {
+		if fork <= head {
+			hash = checksumUpdate(hash, fork)
+			continue
+		}
+		return ID{Hash: checksumToBytes(hash), Next: fork}
+	}
+	return ID{Hash: checksumToBytes(hash), Next: 0}
+}
+
+// NewFilter creates a filter that validates remote fork IDs against the local
+// chain, whose head block number is reported by headfn at validation time.
+func NewFilter(forks []uint64, genesis common.Hash, headfn func() uint64) Filter {
+	// Calculate all the valid fork hash and fork next combos
+	sums := make([][4]byte, len(forks)+1)
+	hash := crc32.ChecksumIEEE(genesis[:])
+	sums[0] = checksumToBytes(hash)
+	for i, fork := range forks {
+		hash = checksumUpdate(hash, fork)
+		sums[i+1] = checksumToBytes(hash)
+	}
+	// Add a sentinel so the last known checksum is always followed by a fork
+	forks = append(append([]uint64{}, forks...), math.MaxUint64)
+
+	return func(id ID) error {
+		head := headfn()
+
+		for i, fork := range forks {
+			// Skip past forks we've already passed
+			if head >= fork {
+				continue
+			}
+			// Found the first unpassed fork block, check if our current state
+			// matches the remote checksum (rule #1)
+			if sums[i] == id.Hash {
+				// Fork checksum matched, check if a remote future fork block
+				// already passed locally without the local node being aware of it
+				// (rule #1a)
+				if id.Next > 0 && head >= id.Next {
+					return ErrLocalIncompatibleOrStale
+				}
+				// Haven't passed locally a remote-only fork, accept the
+				// connection (rule #1b)
+				return nil
+			}
+			// The remote checksum is a subset of our local forks (rule #2)
+			for j := 0; j < i; j++ {
+				if sums[j] == id.Hash {
+					// Remote checksum is a subset, validate based on the
+					// announced next fork
+					if forks[j] != id.Next {
+						return ErrRemoteStale
+					}
+					return nil
+				}
+			}
+			// The remote checksum is a superset of our local forks (rule #3)
+			for j := i + 1; j < len(sums); j++ {
+				if sums[j] == id.Hash {
+					// Yay, remote checksum is a superset, ignore upcoming forks
+					return nil
+				}
+			}
+			// No exact, subset or superset match. We are on differing chains,
+			// reject (rule #4)
+			return ErrLocalIncompatibleOrStale
+		}
+		// Unreachable thanks to the sentinel, but keep the compiler happy
+		return ErrLocalIncompatibleOrStale
+	}
+}
+
+// GatherForks returns the sorted, deduplicated fork block numbers of a chain
+// config. Forks active at genesis are left out as they don't change the ID.
+func GatherForks(config *core.ChainConfig) []uint64 {
+	if config == nil {
+		return nil
+	}
+	var forks []uint64
+	for _, block := range []*big.Int{
+		config.HomesteadBlock,
+		config.EIP150Block,
+		config.EIP155Block,
+		config.EIP158Block,
+		config.StealthRegistryBlock,
+	} {
+		if block != nil && block.Sign() > 0 && block.IsUint64() {
+			forks = append(forks, block.Uint64())
+		}
+	}
+	sort.Slice(forks, func(i, j int) bool { return forks[i] < forks[j] })
+	for i := 1; i < len(forks); i++ {
+		if forks[i] == forks[i-1] {
+			forks = append(forks[:i], forks[i+1:]...)
+			i--
+		}
+	}
+	return forks
+}
+
+// checksumUpdate calculates the next IEEE CRC32 checksum based on the previous
+// one and a fork block number (equivalent to CRC32(original-blob || fork)).
+func checksumUpdate(hash uint32, fork uint64) uint32 {
+	var blob [8]byte
+	binary.BigEndian.PutUint64(blob[:], fork)
+	return crc32.Update(hash, crc32.IEEETable, blob[:])
+}
+
+// checksumToBytes converts a uint32 checksum into a [4]byte array
+func checksumToBytes(hash uint32) [4]byte {
+	var blob [4]byte
+	binary.BigEndian.PutUint32(blob[:], hash)
+	return blob
+}
@@ -0,0 +1,92 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package forkid
+
+import (
+	"hash/crc32"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/obsidian-chain/obsidian/core"
+)
+
+var testGenesis = common.HexToHash("0x4f1dd23188aab3a76b463e4af801b52b1248ef073c648cbdc4c9333d3da79756")
+
+func TestGatherForks(t *testing.T) {
+	if forks := GatherForks(core.DefaultChainConfig()); len(forks) != 0 {
+		t.Fatalf("genesis forks should be skipped, have %v", forks)
+	}
+	config := &core.ChainConfig{
+		ChainID:        big.NewInt(1719),
+		HomesteadBlock: big.NewInt(200),
+		EIP150Block:    big.NewInt(100),
+		EIP155Block:    big.NewInt(200),
+		EIP158Block:    nil,
+
+		StealthRegistryBlock: big.NewInt(300),
+	}
+	if forks, want := GatherForks(config), []uint64{100, 200, 300}; !reflect.DeepEqual(forks, want) {
+		t.Fatalf("have %v, want %v", forks, want)
+	}
+}
+
+func TestNewID(t *testing.T) {
+	forks := []uint64{100, 200}
+	genesis := crc32.ChecksumIEEE(testGenesis[:])
+	first := checksumUpdate(genesis, 100)
+	second := checksumUpdate(first, 200)
+
+	tests := []struct {
+		head uint64
+		want ID
+	}{
+		{0, ID{Hash: checksumToBytes(genesis), Next: 100}},
+		{99, ID{Hash: checksumToBytes(genesis), Next: 100}},
+		{100, ID{Hash: checksumToBytes(first), Next: 200}},
+		{199, ID{Hash: checksumToBytes(first), Next: 200}},
+		{200, ID{Hash: checksumToBytes(second), Next: 0}},
+		{1000, ID{Hash: checksumToBytes(second), Next: 0}},
+	}
+	for i, tt := range tests {
+		if have := NewID(forks, testGenesis, tt.head); have != tt.want {
+			t.Errorf("test %d: fork ID mismatch: have %x/%d, want %x/%d", i, have.Hash, have.Next, tt.want.Hash, tt.want.Next)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	forks := []uint64{100, 200}
+	id := func(head uint64) ID { return NewID(forks, testGenesis, head) }
+
+	tests := []struct {
+		head uint64
+		id   ID
+		err  error
+	}{
+		// Same fork state, same next fork
+		{150, id(150), nil},
+		// Remote hasn't passed the first fork yet but knows about it
+		{150, id(50), nil},
+		// Remote is ahead of us but we know its forks
+		{150, id(250), nil},
+		// Remote announces a fork we've already passed without knowing about it
+		{150, ID{Hash: id(150).Hash, Next: 120}, ErrLocalIncompatibleOrStale},
+		// Remote is stuck after a fork we've passed, expecting a different next one
+		{250, ID{Hash: id(150).Hash, Next: 220}, ErrRemoteStale},
+		// Remote is stuck before a fork we've passed and doesn't know about it
+		{250, ID{Hash: id(50).Hash, Next: 0}, ErrRemoteStale},
+		// Remote is before our next fork and announces a future one of its own
+		{50, ID{Hash: id(50).Hash, Next: 300}, nil},
+		// Remote is on a different chain altogether
+		{150, ID{Hash: [4]byte{0xde, 0xad, 0xbe, 0xef}}, ErrLocalIncompatibleOrStale},
+	}
+	for i, tt := range tests {
+		filter := NewFilter(forks, testGenesis, func() uint64 { return tt.head })
+		if err := filter(tt.id); err != tt.err {
+			t.Errorf("test %d: validation error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+}
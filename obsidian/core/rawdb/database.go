@@ -15,6 +15,7 @@ import (
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/filter"
 	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
@@ -38,14 +39,36 @@ var (
 	accountPrefix = []byte("a") // accountPrefix + address hash -> account data
 	storagePrefix = []byte("o") // storagePrefix + address hash + key hash -> storage value
 
+	// State tries
+	trieNodePrefix = []byte("T") // trieNodePrefix + node hash -> trie node
+
 	// Total difficulty
 	tdSuffix = []byte("t") // headerPrefix + num + hash + tdSuffix -> total difficulty
+
+	// Networking
+	peerBanPrefix = []byte("B") // peerBanPrefix + node id -> peer ban
+
+	// Stealth announcements
+	stealthIndexPrefix  = []byte("x")                // stealthIndexPrefix + num (uint64 big endian) + view tag -> stealth announcements
+	stealthIndexTailKey = []byte("StealthIndexTail") // Lowest block from which all canonical blocks are indexed
+
+	// Stealth announcement filters
+	stealthFilterPrefix       = []byte("f")                   // stealthFilterPrefix + num (uint64 big endian) + hash -> stealth filter
+	stealthFilterHeaderPrefix = []byte("F")                   // stealthFilterHeaderPrefix + num (uint64 big endian) + hash -> stealth filter header
+	stealthFilterSyncedKey    = []byte("StealthFilterSynced") // Lowest block from which canonical blocks may lack filters
 )
 
 var (
 	ErrNotFound = errors.New("not found")
 )
 
+// KeyValueWriter is implemented by both the database and write batches, so
+// that accessors which take one can be used to fill a batch
+type KeyValueWriter interface {
+	Put(key, value []byte) error
+	Delete(key []byte) error
+}
+
 // Database wraps access to LevelDB
 type Database struct {
 	db   *leveldb.DB
@@ -74,6 +97,16 @@ func NewDatabase(path string) (*Database, error) {
 	}, nil
 }
 
+// NewMemoryDatabase creates a database that is held in memory and discarded
+// when closed, for tests and simulated networks
+func NewMemoryDatabase() *Database {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err) // Opening fresh memory storage can't fail
+	}
+	return &Database{db: db}
+}
+
 // Close closes the database
 func (d *Database) Close() error {
 	d.mu.Lock()
@@ -209,6 +242,31 @@ func storageKey(addressHash, keyHash common.Hash) []byte {
 	return append(append(storagePrefix, addressHash.Bytes()...), keyHash.Bytes()...)
 }
 
+// peerBanKey returns the peer ban key
+func peerBanKey(id string) []byte {
+	return append(append([]byte{}, peerBanPrefix...), id...)
+}
+
+// stealthIndexKey returns the key of a view tag bucket of stealth announcements
+func stealthIndexKey(number uint64, viewTag byte) []byte {
+	return append(append(append([]byte{}, stealthIndexPrefix...), encodeBlockNumber(number)...), viewTag)
+}
+
+// stealthFilterKey returns the stealth filter key
+func stealthFilterKey(number uint64, hash common.Hash) []byte {
+	return append(append(append([]byte{}, stealthFilterPrefix...), encodeBlockNumber(number)...), hash.Bytes()...)
+}
+
+// stealthFilterHeaderKey returns the stealth filter header key
+func stealthFilterHeaderKey(number uint64, hash common.Hash) []byte {
+	return append(append(append([]byte{}, stealthFilterHeaderPrefix...), encodeBlockNumber(number)...), hash.Bytes()...)
+}
+
+// trieNodeKey returns the trie node key
+func trieNodeKey(hash common.Hash) []byte {
+	return append(append([]byte{}, trieNodePrefix...), hash.Bytes()...)
+}
+
 // tdKey returns the total difficulty key
 func tdKey(number uint64, hash common.Hash) []byte {
 	return append(append(append(headerPrefix, encodeBlockNumber(number)...), hash.Bytes()...), tdSuffix...)
@@ -249,6 +307,13 @@ func WriteCanonicalHash(db *Database, hash common.Hash, number uint64) {
 	}
 }
 
+// DeleteCanonicalHash removes the canonical block hash for a number
+func DeleteCanonicalHash(db *Database, number uint64) {
+	if err := db.Delete(headerHashKey(number)); err != nil {
+		log.Crit("Failed to delete number to hash mapping", "err", err)
+	}
+}
+
 // ReadHeaderNumber retrieves the block number for a header hash
 func ReadHeaderNumber(db *Database, hash common.Hash) *uint64 {
 	data, err := db.Get(headerNumberKey(hash))
@@ -329,6 +394,13 @@ func WriteTxLookupEntry(db *Database, hash common.Hash, entry *TxLookupEntry) {
 	}
 }
 
+// DeleteTxLookupEntry removes a transaction's lookup entry
+func DeleteTxLookupEntry(db *Database, hash common.Hash) {
+	if err := db.Delete(txLookupKey(hash)); err != nil {
+		log.Crit("Failed to delete tx lookup entry", "err", err)
+	}
+}
+
 // WriteTxLookupEntriesByBlock stores tx lookup entries for all transactions in a block
 func WriteTxLookupEntriesByBlock(db *Database, txHashes []common.Hash, blockHash common.Hash, blockNumber uint64) {
 	batch := db.NewBatch()
@@ -356,7 +428,7 @@ func ReadCode(db *Database, codeHash common.Hash) []byte {
 }
 
 // WriteCode stores contract code
-func WriteCode(db *Database, codeHash common.Hash, code []byte) {
+func WriteCode(db KeyValueWriter, codeHash common.Hash, code []byte) {
 	if err := db.Put(codeKey(codeHash), code); err != nil {
 		log.Crit("Failed to store contract code", "err", err)
 	}
@@ -432,14 +504,14 @@ func ReadAccountData(db *Database, addressHash common.Hash) []byte {
 }
 
 // WriteAccountData stores the encoded account data
-func WriteAccountData(db *Database, addressHash common.Hash, data []byte) {
+func WriteAccountData(db KeyValueWriter, addressHash common.Hash, data []byte) {
 	if err := db.Put(accountKey(addressHash), data); err != nil {
 		log.Crit("Failed to store account data", "err", err)
 	}
 }
 
 // DeleteAccountData removes account data
-func DeleteAccountData(db *Database, addressHash common.Hash) {
+func DeleteAccountData(db KeyValueWriter, addressHash common.Hash) {
 	if err := db.Delete(accountKey(addressHash)); err != nil {
 		log.Crit("Failed to delete account data", "err", err)
 	}
@@ -455,15 +527,291 @@ func ReadStorageData(db *Database, addressHash, keyHash common.Hash) []byte {
 }
 
 // WriteStorageData stores storage data
-func WriteStorageData(db *Database, addressHash, keyHash common.Hash, value []byte) {
+func WriteStorageData(db KeyValueWriter, addressHash, keyHash common.Hash, value []byte) {
 	if err := db.Put(storageKey(addressHash, keyHash), value); err != nil {
 		log.Crit("Failed to store storage data", "err", err)
 	}
 }
 
 // DeleteStorageData removes storage data
-func DeleteStorageData(db *Database, addressHash, keyHash common.Hash) {
+func DeleteStorageData(db KeyValueWriter, addressHash, keyHash common.Hash) {
 	if err := db.Delete(storageKey(addressHash, keyHash)); err != nil {
 		log.Crit("Failed to delete storage data", "err", err)
 	}
 }
+
+// IterateAccountData calls fn for every account in the flat state, in address
+// hash order, starting at start. The slices passed to fn are only valid
+// until it returns. Iteration stops early if fn returns false.
+func IterateAccountData(db *Database, start common.Hash, fn func(addressHash common.Hash, data []byte) bool) {
+	r := util.BytesPrefix(accountPrefix)
+	r.Start = accountKey(start)
+
+	it := db.db.NewIterator(r, nil)
+	defer it.Release()
+	for it.Next() {
+		key := it.Key()
+		if len(key) != len(accountPrefix)+common.HashLength {
+			continue
+		}
+		if !fn(common.BytesToHash(key[len(accountPrefix):]), it.Value()) {
+			return
+		}
+	}
+}
+
+// IterateStorageData calls fn for every storage slot of an account in the flat
+// state, in key hash order, starting at start. The slices passed to fn are
+// only valid until it returns. Iteration stops early if fn returns false.
+func IterateStorageData(db *Database, addressHash, start common.Hash, fn func(keyHash common.Hash, value []byte) bool) {
+	r := util.BytesPrefix(append(append([]byte{}, storagePrefix...), addressHash.Bytes()...))
+	r.Start = storageKey(addressHash, start)
+
+	it := db.db.NewIterator(r, nil)
+	defer it.Release()
+	for it.Next() {
+		key := it.Key()
+		if len(key) != len(storagePrefix)+2*common.HashLength {
+			continue
+		}
+		if !fn(common.BytesToHash(key[len(storagePrefix)+common.HashLength:]), it.Value()) {
+			return
+		}
+	}
+}
+
+// Trie node accessors
+
+// ReadTrieNode retrieves a state trie node by hash
+func ReadTrieNode(db *Database, hash common.Hash) []byte {
+	data, err := db.Get(trieNodeKey(hash))
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// HasTrieNode checks if a state trie node is present
+func HasTrieNode(db *Database, hash common.Hash) bool {
+	has, err := db.Has(trieNodeKey(hash))
+	return err == nil && has
+}
+
+// WriteTrieNode stores a state trie node
+func WriteTrieNode(db KeyValueWriter, hash common.Hash, node []byte) {
+	if err := db.Put(trieNodeKey(hash), node); err != nil {
+		log.Crit("Failed to store trie node", "err", err)
+	}
+}
+
+// Peer ban accessors
+
+// PeerBan is a stored ban on a remote node
+type PeerBan struct {
+	Until    uint64 // Unix time the ban expires
+	Offences uint64 // Number of times the node has been banned
+	Reason   string
+}
+
+// ReadPeerBans retrieves all stored peer bans, keyed by node id
+func ReadPeerBans(db *Database) map[string]*PeerBan {
+	bans := make(map[string]*PeerBan)
+
+	it := db.db.NewIterator(util.BytesPrefix(peerBanPrefix), nil)
+	defer it.Release()
+	for it.Next() {
+		ban := new(PeerBan)
+		if err := rlp.DecodeBytes(it.Value(), ban); err != nil {
+			log.Error("Invalid peer ban RLP", "key", it.Key(), "err", err)
+			continue
+		}
+		bans[string(it.Key()[len(peerBanPrefix):])] = ban
+	}
+	return bans
+}
+
+// WritePeerBan stores a ban on a remote node
+func WritePeerBan(db *Database, id string, ban *PeerBan) {
+	data, err := rlp.EncodeToBytes(ban)
+	if err != nil {
+		log.Crit("Failed to encode peer ban", "err", err)
+	}
+	if err := db.Put(peerBanKey(id), data); err != nil {
+		log.Crit("Failed to store peer ban", "err", err)
+	}
+}
+
+// DeletePeerBan removes a ban on a remote node
+func DeletePeerBan(db *Database, id string) {
+	if err := db.Delete(peerBanKey(id)); err != nil {
+		log.Crit("Failed to delete peer ban", "err", err)
+	}
+}
+
+// Stealth announcement index accessors
+
+// StealthIndexEntry is a stealth payment announcement of a canonical block.
+// Entries are stored in buckets by view tag, so the tag is not encoded.
+// Token payments carry the token standard and contract, their value being
+// the amount or token ID transferred.
+type StealthIndexEntry struct {
+	TxHash          common.Hash
+	Recipient       common.Address
+	EphemeralPubKey []byte
+	Value           *big.Int
+	ViewTag         byte           `rlp:"-"`
+	Standard        uint8          `rlp:"optional"`
+	Token           common.Address `rlp:"optional"`
+}
+
+// WriteStealthIndex stores the stealth announcements of a canonical block,
+// bucketed by view tag. Blocks without announcements are not stored.
+func WriteStealthIndex(db KeyValueWriter, number uint64, entries []*StealthIndexEntry) {
+	buckets := make(map[byte][]*StealthIndexEntry)
+	for _, entry := range entries {
+		buckets[entry.ViewTag] = append(buckets[entry.ViewTag], entry)
+	}
+	for tag, bucket := range buckets {
+		data, err := rlp.EncodeToBytes(bucket)
+		if err != nil {
+			log.Crit("Failed to encode stealth announcements", "err", err)
+		}
+		if err := db.Put(stealthIndexKey(number, tag), data); err != nil {
+			log.Crit("Failed to store stealth announcements", "err", err)
+		}
+	}
+}
+
+// DeleteStealthIndex removes the stealth announcements of a block number
+func DeleteStealthIndex(db *Database, number uint64) {
+	prefix := append(append([]byte{}, stealthIndexPrefix...), encodeBlockNumber(number)...)
+	it := db.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer it.Release()
+	for it.Next() {
+		if err := db.Delete(it.Key()); err != nil {
+			log.Crit("Failed to delete stealth announcements", "err", err)
+		}
+	}
+}
+
+// IterateStealthIndex calls fn with the stealth announcements of every block
+// from from to to that has some, in block order. If viewTags is non-nil,
+// only the buckets of those view tags are read. Iteration stops early if fn
+// returns false.
+func IterateStealthIndex(db *Database, from, to uint64, viewTags []byte, fn func(number uint64, entries []*StealthIndexEntry) bool) {
+	var filter [256]bool
+	for _, tag := range viewTags {
+		filter[tag] = true
+	}
+	r := &util.Range{Start: stealthIndexKey(from, 0)}
+	if to < ^uint64(0) {
+		r.Limit = stealthIndexKey(to+1, 0)
+	} else {
+		r.Limit = util.BytesPrefix(stealthIndexPrefix).Limit
+	}
+	it := db.db.NewIterator(r, nil)
+	defer it.Release()
+
+	var (
+		current uint64
+		entries []*StealthIndexEntry
+	)
+	for it.Next() {
+		key := it.Key()
+		if len(key) != len(stealthIndexPrefix)+9 {
+			continue
+		}
+		number := binary.BigEndian.Uint64(key[len(stealthIndexPrefix):])
+		tag := key[len(key)-1]
+		if viewTags != nil && !filter[tag] {
+			continue
+		}
+		if number != current && len(entries) > 0 {
+			if !fn(current, entries) {
+				return
+			}
+			entries = nil
+		}
+		current = number
+
+		var bucket []*StealthIndexEntry
+		if err := rlp.DecodeBytes(it.Value(), &bucket); err != nil {
+			log.Error("Invalid stealth announcements RLP", "number", number, "err", err)
+			continue
+		}
+		for _, entry := range bucket {
+			entry.ViewTag = tag
+		}
+		entries = append(entries, bucket...)
+	}
+	if len(entries) > 0 {
+		fn(current, entries)
+	}
+}
+
+// ReadStealthIndexTail retrieves the lowest block from which all canonical
+// blocks are indexed, nil if the index was never started
+func ReadStealthIndexTail(db *Database) *uint64 {
+	data, err := db.Get(stealthIndexTailKey)
+	if err != nil || len(data) != 8 {
+		return nil
+	}
+	tail := binary.BigEndian.Uint64(data)
+	return &tail
+}
+
+// WriteStealthIndexTail stores the lowest block from which all canonical
+// blocks are indexed
+func WriteStealthIndexTail(db KeyValueWriter, tail uint64) {
+	if err := db.Put(stealthIndexTailKey, encodeBlockNumber(tail)); err != nil {
+		log.Crit("Failed to store stealth index tail", "err", err)
+	}
+}
+
+// Stealth filter accessors
+
+// ReadStealthFilter retrieves the stealth announcement filter of a block
+func ReadStealthFilter(db *Database, hash common.Hash, number uint64) []byte {
+	data, _ := db.Get(stealthFilterKey(number, hash))
+	return data
+}
+
+// ReadStealthFilterHeader retrieves the stealth filter header of a block,
+// the zero hash if the block has no filter yet
+func ReadStealthFilterHeader(db *Database, hash common.Hash, number uint64) common.Hash {
+	data, _ := db.Get(stealthFilterHeaderKey(number, hash))
+	if len(data) != common.HashLength {
+		return common.Hash{}
+	}
+	return common.BytesToHash(data)
+}
+
+// WriteStealthFilter stores the stealth announcement filter of a block along
+// with its filter header
+func WriteStealthFilter(db KeyValueWriter, hash common.Hash, number uint64, filter []byte, header common.Hash) {
+	if err := db.Put(stealthFilterKey(number, hash), filter); err != nil {
+		log.Crit("Failed to store stealth filter", "err", err)
+	}
+	if err := db.Put(stealthFilterHeaderKey(number, hash), header.Bytes()); err != nil {
+		log.Crit("Failed to store stealth filter header", "err", err)
+	}
+}
+
+// ReadStealthFilterSynced retrieves the lowest block from which canonical
+// blocks may lack filters, nil if filters were never built
+func ReadStealthFilterSynced(db *Database) *uint64 {
+	data, err := db.Get(stealthFilterSyncedKey)
+	if err != nil || len(data) != 8 {
+		return nil
+	}
+	synced := binary.BigEndian.Uint64(data)
+	return &synced
+}
+
+// WriteStealthFilterSynced stores the lowest block from which canonical
+// blocks may lack filters
+func WriteStealthFilterSynced(db KeyValueWriter, synced uint64) {
+	if err := db.Put(stealthFilterSyncedKey, encodeBlockNumber(synced)); err != nil {
+		log.Crit("Failed to store stealth filter progress", "err", err)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package rawdb
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestStealthIndex(t *testing.T) {
+	db := NewMemoryDatabase()
+	defer db.Close()
+
+	for n := uint64(1); n <= 10; n++ {
+		var entries []*StealthIndexEntry
+		for i := 0; i < 3; i++ {
+			entries = append(entries, &StealthIndexEntry{
+				TxHash:          common.Hash{byte(n), byte(i)},
+				Recipient:       common.Address{byte(n)},
+				EphemeralPubKey: []byte{0x02, byte(n), byte(i)},
+				Value:           big.NewInt(int64(n)),
+				ViewTag:         byte(n*3) + byte(i),
+			})
+		}
+		if n == 4 {
+			entries[1].Standard, entries[1].Token = 1, common.Address{0x20}
+		}
+		WriteStealthIndex(db, n, entries)
+	}
+	collect := func(from, to uint64, tags []byte) map[uint64][]*StealthIndexEntry {
+		found := make(map[uint64][]*StealthIndexEntry)
+		IterateStealthIndex(db, from, to, tags, func(number uint64, entries []*StealthIndexEntry) bool {
+			found[number] = entries
+			return true
+		})
+		return found
+	}
+
+	if found := collect(2, 5, nil); len(found) != 4 || len(found[2]) != 3 || len(found[5]) != 3 {
+		t.Fatalf("unexpected announcements in blocks 2-5: %v", found)
+	}
+	// Block 4 has tags 12, 13 and 14, block 5 has 15, 16 and 17
+	found := collect(1, 10, []byte{13, 15})
+	if len(found) != 2 || len(found[4]) != 1 || len(found[5]) != 1 {
+		t.Fatalf("unexpected announcements for view tags 13 and 15: %v", found)
+	}
+	if e := found[4][0]; e.ViewTag != 13 || e.TxHash != (common.Hash{4, 1}) || e.Value.Int64() != 4 ||
+		e.Standard != 1 || e.Token != (common.Address{0x20}) {
+		t.Fatalf("unexpected announcement %+v", e)
+	}
+	if found := collect(1, 10, []byte{}); len(found) != 0 {
+		t.Fatalf("announcements returned for an empty tag set: %v", found)
+	}
+
+	if e := found[5][0]; e.Standard != 0 || e.Token != (common.Address{}) {
+		t.Fatalf("native announcement decoded with a token %+v", e)
+	}
+
+	// Reorged blocks lose their announcements
+	DeleteStealthIndex(db, 5)
+	if found := collect(4, 6, nil); len(found) != 2 || found[5] != nil {
+		t.Fatalf("unexpected announcements after deleting block 5: %v", found)
+	}
+
+	if ReadStealthIndexTail(db) != nil {
+		t.Fatal("index tail set on a fresh database")
+	}
+	WriteStealthIndexTail(db, 7)
+	if tail := ReadStealthIndexTail(db); tail == nil || *tail != 7 {
+		t.Fatalf("index tail %v, want 7", tail)
+	}
+}
@@ -11,7 +11,9 @@ import (
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
 
 	"github.com/obsidian-chain/obsidian/core/rawdb"
 )
@@ -46,6 +48,14 @@ type StateDB struct {
 	// Logs
 	logs    map[common.Hash][]*Log
 	logSize uint
+
+	// Tries
+	trieMu     sync.Mutex
+	accounts   *trie.Trie             // Account trie at the origin root, opened on first read
+	flatReads  bool                   // Whether the account trie is missing
+	originRoot common.Hash            // Root the state was opened at
+	nodes      map[common.Hash][]byte // Trie nodes added by the last root computation
+	trieErr    error                  // Failure of the last root computation
 }
 
 // stateObject represents an account
@@ -59,6 +69,9 @@ type stateObject struct {
 	suicided bool
 	deleted  bool
 
+	// originRoot is the storage root the object was loaded with
+	originRoot common.Hash
+
 	// Storage changes
 	originStorage  map[common.Hash]common.Hash
 	pendingStorage map[common.Hash]common.Hash
@@ -102,6 +115,11 @@ func NewWithDB(root common.Hash, db *rawdb.Database) (*StateDB, error) {
 		deleted: make(map[common.Address]struct{}),
 		journal: &journal{},
 		logs:    make(map[common.Hash][]*Log),
+
+		originRoot: root,
+	}
+	if root == (common.Hash{}) {
+		sdb.originRoot = emptyRoot
 	}
 
 	// If root is not empty, try to load from database
@@ -132,6 +150,8 @@ func NewMemoryStateDB() *StateDB {
 		deleted: make(map[common.Address]struct{}),
 		journal: &journal{},
 		logs:    make(map[common.Hash][]*Log),
+
+		originRoot: emptyRoot,
 	}
 }
 
@@ -148,14 +168,13 @@ func (s *StateDB) SetTxContext(txHash common.Hash, txIndex int) {
 
 // GetOrNewStateObject returns the state object for an address, creating one if needed
 func (s *StateDB) GetOrNewStateObject(addr common.Address) *stateObject {
+	if obj := s.getStateObject(addr); obj != nil {
+		return obj
+	}
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	obj := s.objects[addr]
-	if obj == nil || obj.deleted {
-		obj = s.createObject(addr)
-	}
-	return obj
+	return s.createObject(addr)
 }
 
 // createObject creates a new state object
@@ -168,6 +187,7 @@ func (s *StateDB) createObject(addr common.Address) *stateObject {
 			CodeHash: emptyCodeHash.Bytes(),
 			Root:     emptyRoot,
 		},
+		originRoot:     emptyRoot,
 		originStorage:  make(map[common.Hash]common.Hash),
 		pendingStorage: make(map[common.Hash]common.Hash),
 		dirtyStorage:   make(map[common.Hash]common.Hash),
@@ -182,7 +202,10 @@ func (s *StateDB) getStateObject(addr common.Address) *stateObject {
 	obj := s.objects[addr]
 	s.lock.RUnlock()
 
-	if obj != nil && !obj.deleted {
+	if obj != nil {
+		if obj.deleted {
+			return nil
+		}
 		return obj
 	}
 
@@ -197,7 +220,7 @@ func (s *StateDB) getStateObject(addr common.Address) *stateObject {
 // loadStateObject loads a state object from the database
 func (s *StateDB) loadStateObject(addr common.Address) *stateObject {
 	addrHash := crypto.Keccak256Hash(addr[:])
-	data := rawdb.ReadAccountData(s.db, addrHash)
+	data := s.readAccount(addrHash)
 	if data == nil {
 		return nil
 	}
@@ -211,6 +234,7 @@ func (s *StateDB) loadStateObject(addr common.Address) *stateObject {
 		address:        addr,
 		addrHash:       addrHash,
 		data:           account,
+		originRoot:     account.Root,
 		originStorage:  make(map[common.Hash]common.Hash),
 		pendingStorage: make(map[common.Hash]common.Hash),
 		dirtyStorage:   make(map[common.Hash]common.Hash),
@@ -335,9 +359,7 @@ func (s *StateDB) GetState(addr common.Address, key common.Hash) common.Hash {
 		// Load from database
 		if s.db != nil {
 			keyHash := crypto.Keccak256Hash(key[:])
-			data := rawdb.ReadStorageData(s.db, obj.addrHash, keyHash)
-			if data != nil {
-				val := common.BytesToHash(data)
+			if val, ok := s.readStorage(obj, keyHash); ok {
 				obj.originStorage[key] = val
 				return val
 			}
@@ -489,41 +511,29 @@ func (s *StateDB) emptyObject(obj *stateObject) bool {
 	return obj.data.Nonce == 0 && obj.data.Balance.Sign() == 0 && len(obj.code) == 0
 }
 
-// IntermediateRoot computes the state root
+// IntermediateRoot computes the state root. Every change since the state was
+// opened is applied to the tries at the origin root, so it can be called
+// repeatedly as the state is modified further.
 func (s *StateDB) IntermediateRoot(deleteEmptyObjects bool) common.Hash {
 	s.Finalise(deleteEmptyObjects)
 
-	// Compute a simple hash of all accounts
-	// In production, this would be a proper Merkle Patricia Trie root
-	hasher := crypto.NewKeccakState()
-
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-
-	for addr, obj := range s.objects {
-		if obj.deleted {
-			continue
-		}
-		hasher.Write(addr[:])
-		data, _ := rlp.EncodeToBytes(&obj.data)
-		hasher.Write(data)
-	}
-
-	var root common.Hash
-	_, _ = hasher.Read(root[:])
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-	if root == (common.Hash{}) {
-		return emptyRoot
+	root, nodes, err := s.updateTries()
+	if err != nil {
+		log.Error("Failed to update state tries", "origin", s.originRoot, "err", err)
+		s.nodes, s.trieErr = nil, err
+		return common.Hash{}
 	}
-
-	s.root = root
+	s.root, s.nodes, s.trieErr = root, nodes, nil
 	return root
 }
 
 // Commit commits the state changes
 func (s *StateDB) Commit(deleteEmptyObjects bool) (common.Hash, error) {
 	root := s.IntermediateRoot(deleteEmptyObjects)
-	return root, nil
+	return root, s.trieErr
 }
 
 // CommitToDB persists state changes to the database
@@ -537,11 +547,17 @@ func (s *StateDB) CommitToDB(db *rawdb.Database, root common.Hash) error {
 
 	batch := db.NewBatch()
 
+	// Write the trie nodes behind the root
+	for hash, blob := range s.nodes {
+		rawdb.WriteTrieNode(batch, hash, blob)
+	}
+
 	// Write accounts
 	for _, obj := range s.objects {
 		if obj.deleted {
-			// Delete account
+			// Delete account along with its storage
 			rawdb.DeleteAccountData(db, obj.addrHash)
+			DeleteFlatStorage(db, obj.addrHash)
 			continue
 		}
 
@@ -572,6 +588,28 @@ func (s *StateDB) CommitToDB(db *rawdb.Database, root common.Hash) error {
 	return batch.Write()
 }
 
+// CommitNodesToDB persists the trie nodes and contract code of the state but
+// leaves the flat data alone, for states that don't become the chain head
+func (s *StateDB) CommitNodesToDB(db *rawdb.Database) error {
+	if db == nil {
+		return nil
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	batch := db.NewBatch()
+	for hash, blob := range s.nodes {
+		rawdb.WriteTrieNode(batch, hash, blob)
+	}
+	for _, obj := range s.objects {
+		if !obj.deleted && len(obj.code) > 0 && obj.dirty {
+			rawdb.WriteCode(batch, common.BytesToHash(obj.codeHash), obj.code)
+		}
+	}
+	return batch.Write()
+}
+
 // Copy creates a deep copy of the state
 func (s *StateDB) Copy() *StateDB {
 	s.lock.RLock()
@@ -585,6 +623,8 @@ func (s *StateDB) Copy() *StateDB {
 		deleted: make(map[common.Address]struct{}),
 		journal: &journal{},
 		logs:    make(map[common.Hash][]*Log),
+
+		originRoot: s.originRoot,
 	}
 
 	for addr, obj := range s.objects {
@@ -597,6 +637,7 @@ func (s *StateDB) Copy() *StateDB {
 			dirty:          obj.dirty,
 			suicided:       obj.suicided,
 			deleted:        obj.deleted,
+			originRoot:     obj.originRoot,
 			originStorage:  make(map[common.Hash]common.Hash),
 			pendingStorage: make(map[common.Hash]common.Hash),
 			dirtyStorage:   make(map[common.Hash]common.Hash),
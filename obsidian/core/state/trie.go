@@ -0,0 +1,426 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package state
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	ethrawdb "github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/ethereum/go-ethereum/triedb/database"
+
+	"github.com/obsidian-chain/obsidian/core/rawdb"
+)
+
+// The state root commits to a secure Merkle-Patricia trie of all accounts,
+// keyed by address hash. Each account's Root commits to a trie of its storage
+// slots, keyed by slot hash. Trie nodes are stored by hash, so the state of
+// any committed root can be read, proven and served to peers. The flat
+// account and storage data mirror the state of the chain head; reads fall
+// back to it when the tries of a root aren't stored, as during state sync.
+
+// nodeDatabase gives the trie package read access to the stored trie nodes
+type nodeDatabase struct {
+	db *rawdb.Database
+}
+
+// NewNodeDatabase returns a trie node source backed by the stored state tries
+func NewNodeDatabase(db *rawdb.Database) database.NodeDatabase {
+	return nodeDatabase{db: db}
+}
+
+// NodeReader implements database.NodeDatabase
+func (n nodeDatabase) NodeReader(stateRoot common.Hash) (database.NodeReader, error) {
+	return n, nil
+}
+
+// Node implements database.NodeReader
+func (n nodeDatabase) Node(owner common.Hash, path []byte, hash common.Hash) ([]byte, error) {
+	if n.db == nil {
+		return nil, nil
+	}
+	return rawdb.ReadTrieNode(n.db, hash), nil
+}
+
+// HasState reports whether the root node of a state trie is available
+func HasState(db *rawdb.Database, root common.Hash) bool {
+	return root == emptyRoot || rawdb.HasTrieNode(db, root)
+}
+
+// readAccount returns the encoded account with the given address hash in the
+// state the StateDB was opened at
+func (s *StateDB) readAccount(addrHash common.Hash) []byte {
+	s.trieMu.Lock()
+	defer s.trieMu.Unlock()
+
+	if tr := s.openAccountTrie(); tr != nil {
+		enc, err := tr.Get(addrHash[:])
+		if err == nil {
+			return enc
+		}
+		log.Debug("Failed to read account from trie", "root", s.originRoot, "account", addrHash, "err", err)
+	}
+	return rawdb.ReadAccountData(s.db, addrHash)
+}
+
+// readStorage returns a storage slot of an account loaded by the StateDB
+func (s *StateDB) readStorage(obj *stateObject, keyHash common.Hash) (common.Hash, bool) {
+	s.trieMu.Lock()
+	defer s.trieMu.Unlock()
+
+	if s.openAccountTrie() != nil {
+		if obj.originRoot == emptyRoot {
+			return common.Hash{}, false
+		}
+		tr, err := trie.New(trie.StorageTrieID(s.originRoot, obj.addrHash, obj.originRoot), nodeDatabase{s.db})
+		if err == nil {
+			var enc []byte
+			if enc, err = tr.Get(keyHash[:]); err == nil {
+				if enc == nil {
+					return common.Hash{}, false
+				}
+				if value, err := DecodeStorage(enc); err == nil {
+					return value, true
+				}
+			}
+		}
+		log.Debug("Failed to read storage from trie", "root", s.originRoot, "account", obj.addrHash, "err", err)
+	}
+	data := rawdb.ReadStorageData(s.db, obj.addrHash, keyHash)
+	if data == nil {
+		return common.Hash{}, false
+	}
+	return common.BytesToHash(data), true
+}
+
+// openAccountTrie returns the account trie at the origin root, or nil if it
+// isn't stored and reads have to use the flat data. It must be called with
+// trieMu held.
+func (s *StateDB) openAccountTrie() *trie.Trie {
+	if s.accounts != nil || s.flatReads {
+		return s.accounts
+	}
+	if HasState(s.db, s.originRoot) {
+		tr, err := trie.New(trie.StateTrieID(s.originRoot), nodeDatabase{s.db})
+		if err == nil {
+			s.accounts = tr
+			return tr
+		}
+		log.Debug("Failed to open account trie", "root", s.originRoot, "err", err)
+	}
+	s.flatReads = true
+	return nil
+}
+
+// EncodeStorage returns the trie encoding of a storage value
+func EncodeStorage(value common.Hash) []byte {
+	enc, _ := rlp.EncodeToBytes(common.TrimLeftZeroes(value[:]))
+	return enc
+}
+
+// DecodeStorage parses a storage value from its trie encoding
+func DecodeStorage(enc []byte) (common.Hash, error) {
+	_, content, _, err := rlp.Split(enc)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if len(content) > common.HashLength {
+		return common.Hash{}, errors.New("oversized storage value")
+	}
+	return common.BytesToHash(content), nil
+}
+
+// updateTries applies the in-memory objects to the tries of the state the
+// StateDB was opened at, returning the new root and the nodes it added
+func (s *StateDB) updateTries() (common.Hash, map[common.Hash][]byte, error) {
+	nodes := make(map[common.Hash][]byte)
+
+	tr, err := trie.New(trie.StateTrieID(s.originRoot), nodeDatabase{s.db})
+	if err != nil {
+		return common.Hash{}, nil, err
+	}
+	for _, obj := range s.objects {
+		if obj.deleted {
+			if err := tr.Delete(obj.addrHash[:]); err != nil {
+				return common.Hash{}, nil, err
+			}
+			continue
+		}
+		if len(obj.pendingStorage) > 0 {
+			root, err := s.updateStorageTrie(obj, nodes)
+			if err != nil {
+				return common.Hash{}, nil, fmt.Errorf("storage of %x: %w", obj.address, err)
+			}
+			obj.data.Root = root
+		}
+		data, err := rlp.EncodeToBytes(&obj.data)
+		if err != nil {
+			return common.Hash{}, nil, err
+		}
+		if err := tr.Update(obj.addrHash[:], data); err != nil {
+			return common.Hash{}, nil, err
+		}
+	}
+	root, set := tr.Commit(false)
+	if set != nil {
+		for hash, blob := range set.HashSet() {
+			nodes[hash] = blob
+		}
+	}
+	return root, nodes, nil
+}
+
+// updateStorageTrie applies an object's pending storage to its storage trie
+func (s *StateDB) updateStorageTrie(obj *stateObject, nodes map[common.Hash][]byte) (common.Hash, error) {
+	tr, err := trie.New(trie.StorageTrieID(s.originRoot, obj.addrHash, obj.originRoot), nodeDatabase{s.db})
+	if err != nil {
+		return common.Hash{}, err
+	}
+	for key, value := range obj.pendingStorage {
+		keyHash := crypto.Keccak256Hash(key[:])
+		if value == (common.Hash{}) {
+			err = tr.Delete(keyHash[:])
+		} else {
+			err = tr.Update(keyHash[:], EncodeStorage(value))
+		}
+		if err != nil {
+			return common.Hash{}, err
+		}
+	}
+	root, set := tr.Commit(false)
+	if set != nil {
+		for hash, blob := range set.HashSet() {
+			nodes[hash] = blob
+		}
+	}
+	return root, nil
+}
+
+// GenerateTries rebuilds the state tries from the flat account and storage
+// data and stores their nodes, as needed after the flat state was filled in
+// by state sync. It returns the resulting state root.
+func GenerateTries(db *rawdb.Database) (common.Hash, error) {
+	batch := db.NewBatch()
+	flush := func() error {
+		if batch.ValueSize() < 1024*1024 {
+			return nil
+		}
+		if err := batch.Write(); err != nil {
+			return err
+		}
+		batch.Reset()
+		return nil
+	}
+	var err error
+	collect := func(path []byte, hash common.Hash, blob []byte) {
+		rawdb.WriteTrieNode(batch, hash, common.CopyBytes(blob))
+		if err == nil {
+			err = flush()
+		}
+	}
+	accounts := trie.NewStackTrie(collect)
+	rawdb.IterateAccountData(db, common.Hash{}, func(addrHash common.Hash, data []byte) bool {
+		var account Account
+		if err = rlp.DecodeBytes(data, &account); err != nil {
+			err = fmt.Errorf("account %x: %w", addrHash, err)
+			return false
+		}
+		// Rebuild the storage trie, fixing up the account if the flat storage
+		// doesn't match the root it claims
+		slots := trie.NewStackTrie(collect)
+		rawdb.IterateStorageData(db, addrHash, common.Hash{}, func(keyHash common.Hash, value []byte) bool {
+			err = slots.Update(keyHash[:], EncodeStorage(common.BytesToHash(value)))
+			return err == nil
+		})
+		if err != nil {
+			return false
+		}
+		if root := slots.Hash(); root != account.Root {
+			account.Root = root
+			data, _ = rlp.EncodeToBytes(&account)
+			rawdb.WriteAccountData(batch, addrHash, data)
+		}
+		err = accounts.Update(addrHash[:], common.CopyBytes(data))
+		return err == nil
+	})
+	if err != nil {
+		return common.Hash{}, err
+	}
+	root := accounts.Hash()
+	if err := batch.Write(); err != nil {
+		return common.Hash{}, err
+	}
+	return root, nil
+}
+
+// NewStateSync creates a scheduler that retrieves the state trie with the
+// given root, along with the storage tries and code of its accounts, skipping
+// every subtrie already present in db
+func NewStateSync(root common.Hash, db *SyncDatabase) *trie.Sync {
+	var sched *trie.Sync
+	onAccount := func(keys [][]byte, path []byte, leaf []byte, parent common.Hash, parentPath []byte) error {
+		var account Account
+		if err := rlp.DecodeBytes(leaf, &account); err != nil {
+			return err
+		}
+		sched.AddSubTrie(account.Root, path, parent, parentPath, nil)
+		if len(account.CodeHash) > 0 {
+			sched.AddCodeEntry(common.BytesToHash(account.CodeHash), path, parent, parentPath)
+		}
+		return nil
+	}
+	sched = trie.NewSync(root, db, onAccount, ethrawdb.HashScheme)
+	return sched
+}
+
+// SyncDatabase adapts the database to the key layout the trie package's sync
+// scheduler expects: trie nodes keyed by their bare hash and contract code
+// under the same prefix the database uses
+type SyncDatabase struct {
+	db *rawdb.Database
+}
+
+// NewSyncDatabase wraps db for use with trie.Sync
+func NewSyncDatabase(db *rawdb.Database) *SyncDatabase {
+	return &SyncDatabase{db: db}
+}
+
+// Has implements ethdb.KeyValueReader
+func (s *SyncDatabase) Has(key []byte) (bool, error) {
+	if len(key) == common.HashLength {
+		return rawdb.HasTrieNode(s.db, common.BytesToHash(key)), nil
+	}
+	return s.db.Has(key)
+}
+
+// Get implements ethdb.KeyValueReader
+func (s *SyncDatabase) Get(key []byte) ([]byte, error) {
+	if len(key) == common.HashLength {
+		if blob := rawdb.ReadTrieNode(s.db, common.BytesToHash(key)); blob != nil {
+			return blob, nil
+		}
+		return nil, rawdb.ErrNotFound
+	}
+	return s.db.Get(key)
+}
+
+// Put implements ethdb.KeyValueWriter
+func (s *SyncDatabase) Put(key []byte, value []byte) error {
+	if len(key) == common.HashLength {
+		rawdb.WriteTrieNode(s.db, common.BytesToHash(key), value)
+		return nil
+	}
+	return s.db.Put(key, value)
+}
+
+// Delete implements ethdb.KeyValueWriter. Trie nodes are never deleted.
+func (s *SyncDatabase) Delete(key []byte) error {
+	if len(key) == common.HashLength {
+		return nil
+	}
+	return s.db.Delete(key)
+}
+
+// RepairFlatState makes the flat state match the state trie with the given
+// root, which must be complete in the database. Only subtries whose root
+// differs from the one the flat data hashes to are walked, so repairing a
+// mostly correct flat state is cheap. It returns the number of accounts and
+// storage slots written or deleted.
+func RepairFlatState(db *rawdb.Database, root common.Hash) (int, error) {
+	tr, err := trie.New(trie.StateTrieID(root), nodeDatabase{db})
+	if err != nil {
+		return 0, err
+	}
+	var (
+		repaired int
+		seen     = make(map[common.Hash]struct{})
+		it       = trie.NewIterator(tr.MustNodeIterator(nil))
+	)
+	for it.Next() {
+		addrHash := common.BytesToHash(it.Key)
+		seen[addrHash] = struct{}{}
+
+		var account Account
+		if err := rlp.DecodeBytes(it.Value, &account); err != nil {
+			return repaired, fmt.Errorf("account %x: %w", addrHash, err)
+		}
+		if !bytes.Equal(rawdb.ReadAccountData(db, addrHash), it.Value) {
+			rawdb.WriteAccountData(db, addrHash, it.Value)
+			repaired++
+		}
+		n, err := repairFlatStorage(db, root, addrHash, account.Root)
+		repaired += n
+		if err != nil {
+			return repaired, fmt.Errorf("storage of %x: %w", addrHash, err)
+		}
+	}
+	if it.Err != nil {
+		return repaired, it.Err
+	}
+	// Drop any accounts the trie doesn't have
+	var stale []common.Hash
+	rawdb.IterateAccountData(db, common.Hash{}, func(addrHash common.Hash, _ []byte) bool {
+		if _, ok := seen[addrHash]; !ok {
+			stale = append(stale, addrHash)
+		}
+		return true
+	})
+	for _, addrHash := range stale {
+		rawdb.DeleteAccountData(db, addrHash)
+		repaired++
+		repaired += DeleteFlatStorage(db, addrHash)
+	}
+	return repaired, nil
+}
+
+// repairFlatStorage makes the flat storage of an account match its storage
+// trie, skipping the walk if it already does
+func repairFlatStorage(db *rawdb.Database, stateRoot, addrHash, root common.Hash) (int, error) {
+	slots := trie.NewStackTrie(nil)
+	rawdb.IterateStorageData(db, addrHash, common.Hash{}, func(keyHash common.Hash, value []byte) bool {
+		slots.Update(keyHash[:], EncodeStorage(common.BytesToHash(value)))
+		return true
+	})
+	if slots.Hash() == root {
+		return 0, nil
+	}
+	repaired := DeleteFlatStorage(db, addrHash)
+	if root == emptyRoot {
+		return repaired, nil
+	}
+	tr, err := trie.New(trie.StorageTrieID(stateRoot, addrHash, root), nodeDatabase{db})
+	if err != nil {
+		return repaired, err
+	}
+	it := trie.NewIterator(tr.MustNodeIterator(nil))
+	for it.Next() {
+		value, err := DecodeStorage(it.Value)
+		if err != nil {
+			return repaired, err
+		}
+		rawdb.WriteStorageData(db, addrHash, common.BytesToHash(it.Key), value[:])
+		repaired++
+	}
+	return repaired, it.Err
+}
+
+// DeleteFlatStorage removes all flat storage of an account, returning the
+// number of slots deleted
+func DeleteFlatStorage(db *rawdb.Database, addrHash common.Hash) int {
+	var keys []common.Hash
+	rawdb.IterateStorageData(db, addrHash, common.Hash{}, func(keyHash common.Hash, _ []byte) bool {
+		keys = append(keys, keyHash)
+		return true
+	})
+	for _, keyHash := range keys {
+		rawdb.DeleteStorageData(db, addrHash, keyHash)
+	}
+	return len(keys)
+}
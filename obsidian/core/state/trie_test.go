@@ -0,0 +1,115 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package state
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/obsidian-chain/obsidian/core/rawdb"
+)
+
+func newTestDatabase(t *testing.T) *rawdb.Database {
+	t.Helper()
+
+	db, err := rawdb.NewDatabase(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// commitState commits a state and persists it, returning the new root
+func commitState(t *testing.T, db *rawdb.Database, s *StateDB) common.Hash {
+	t.Helper()
+
+	root, err := s.Commit(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CommitToDB(db, root); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestStateRootIncremental(t *testing.T) {
+	db := newTestDatabase(t)
+
+	// Build the same state in two different orders
+	a, b := NewMemoryStateDB(), NewMemoryStateDB()
+	for i := 0; i < 50; i++ {
+		a.SetBalance(common.Address{byte(i)}, big.NewInt(int64(i+1)))
+		a.SetState(common.Address{byte(i)}, common.Hash{1}, common.Hash{byte(i + 1)})
+	}
+	for i := 49; i >= 0; i-- {
+		b.SetState(common.Address{byte(i)}, common.Hash{1}, common.Hash{byte(i + 1)})
+		b.SetBalance(common.Address{byte(i)}, big.NewInt(int64(i+1)))
+	}
+	genesis := commitState(t, db, a)
+	if root := b.IntermediateRoot(true); root != genesis {
+		t.Fatalf("root depends on update order: %x != %x", root, genesis)
+	}
+	if !HasState(db, genesis) {
+		t.Fatal("root node not stored")
+	}
+
+	// Modify the persisted state: the incremental root must match a rebuild
+	// of the tries from the flat data
+	s, err := New(genesis, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AddBalance(common.Address{1}, big.NewInt(5))
+	s.SetState(common.Address{2}, common.Hash{1}, common.Hash{})
+	s.SetState(common.Address{3}, common.Hash{2}, common.Hash{0xff})
+	s.Suicide(common.Address{4})
+	root := commitState(t, db, s)
+
+	if root == genesis {
+		t.Fatal("root did not change")
+	}
+	if have := s.IntermediateRoot(true); have != root {
+		t.Fatalf("repeated root computation mismatch: %x != %x", have, root)
+	}
+	regenerated, err := GenerateTries(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if regenerated != root {
+		t.Fatalf("regenerated root mismatch: have %x, want %x", regenerated, root)
+	}
+	if balance := s.GetBalance(common.Address{1}); balance.Int64() != 7 {
+		t.Fatalf("balance of existing account reset: %v", balance)
+	}
+}
+
+func TestRepairFlatState(t *testing.T) {
+	db := newTestDatabase(t)
+
+	s := NewMemoryStateDB()
+	for i := 0; i < 20; i++ {
+		s.SetBalance(common.Address{byte(i)}, big.NewInt(int64(i+1)))
+		s.SetState(common.Address{byte(i)}, common.Hash{byte(i)}, common.Hash{1})
+	}
+	root := commitState(t, db, s)
+
+	// Corrupt the flat state and let the trie put it right
+	s, _ = New(root, db)
+	s.SetBalance(common.Address{1}, big.NewInt(100))
+	s.SetState(common.Address{2}, common.Hash{2}, common.Hash{})
+	s.SetBalance(common.Address{0xaa}, big.NewInt(1))
+	s.SetState(common.Address{0xaa}, common.Hash{1}, common.Hash{1})
+	s.Suicide(common.Address{3})
+	commitState(t, db, s)
+
+	if _, err := RepairFlatState(db, root); err != nil {
+		t.Fatal(err)
+	}
+	if regenerated, err := GenerateTries(db); err != nil || regenerated != root {
+		t.Fatalf("flat state not repaired: have %x, want %x (err %v)", regenerated, root, err)
+	}
+}
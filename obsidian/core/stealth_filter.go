@@ -0,0 +1,169 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package core
+
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/obsidian-chain/obsidian/core/rawdb"
+	obstypes "github.com/obsidian-chain/obsidian/core/types"
+	"github.com/obsidian-chain/obsidian/stealth/filter"
+)
+
+// stealthFilterBatch is the number of blocks the background filter builder
+// processes at a time, holding off block insertion meanwhile
+const stealthFilterBatch = 1000
+
+// stealthFilterItems returns the elements of the stealth filter of a block
+func stealthFilterItems(block *obstypes.ObsidianBlock) [][]byte {
+	var items [][]byte
+	for _, entry := range stealthIndexEntries(block) {
+		items = append(items, filter.AnnouncementItems(entry.EphemeralPubKey, entry.ViewTag, entry.Recipient)...)
+	}
+	return items
+}
+
+// writeStealthFilter builds and stores the stealth filter of a block on top
+// of the filter header of its parent, returning the block's filter header
+func writeStealthFilter(db rawdb.KeyValueWriter, block *obstypes.ObsidianBlock, prev common.Hash) common.Hash {
+	raw := filter.New(block.Hash(), stealthFilterItems(block)).Bytes()
+	header := filter.Header(filter.Hash(raw), prev)
+	rawdb.WriteStealthFilter(db, block.Hash(), block.NumberU64(), raw, header)
+	return header
+}
+
+// ensureStealthFilter builds the stealth filter of a block unless it already
+// has one. It returns false if the parent's filter is missing too, which
+// happens while the filters of an old chain are still being built.
+func (bc *BlockChain) ensureStealthFilter(block *obstypes.ObsidianBlock) bool {
+	number := block.NumberU64()
+	if rawdb.ReadStealthFilterHeader(bc.db, block.Hash(), number) != (common.Hash{}) {
+		return true
+	}
+	var prev common.Hash
+	if number > 0 {
+		if prev = rawdb.ReadStealthFilterHeader(bc.db, block.ParentHash(), number-1); prev == (common.Hash{}) {
+			return false
+		}
+	}
+	writeStealthFilter(bc.db, block, prev)
+	return true
+}
+
+// startStealthFilterBuilder builds the stealth filters the canonical chain
+// is missing. Filter headers chain up from the genesis block, so this goes
+// from the lowest block that may lack a filter up to the head. Blocks
+// inserted meanwhile are picked up as the head moves.
+func (bc *BlockChain) startStealthFilterBuilder() {
+	synced := uint64(0)
+	if s := rawdb.ReadStealthFilterSynced(bc.db); s != nil {
+		synced = *s
+	}
+	if synced > bc.currentBlock.Load().NumberU64() {
+		return
+	}
+	bc.wg.Add(1)
+	go bc.buildStealthFilters(synced)
+}
+
+// buildStealthFilters builds the missing stealth filters of the canonical
+// blocks from number next upwards
+func (bc *BlockChain) buildStealthFilters(next uint64) {
+	defer bc.wg.Done()
+
+	var (
+		start  = time.Now()
+		logged = time.Now()
+		built  uint64
+	)
+	for {
+		select {
+		case <-bc.quit:
+			log.Info("Stealth filter building interrupted", "next", next)
+			return
+		default:
+		}
+		bc.insertMu.Lock()
+		head := bc.currentBlock.Load().NumberU64()
+		if next > head {
+			rawdb.WriteStealthFilterSynced(bc.db, next)
+			bc.insertMu.Unlock()
+			break
+		}
+		var prev common.Hash
+		if next > 0 {
+			prev = rawdb.ReadStealthFilterHeader(bc.db, rawdb.ReadCanonicalHash(bc.db, next-1), next-1)
+		}
+		batch := bc.db.NewBatch()
+		for end := next + stealthFilterBatch; next <= head && next < end; next++ {
+			hash := rawdb.ReadCanonicalHash(bc.db, next)
+			if header := rawdb.ReadStealthFilterHeader(bc.db, hash, next); header != (common.Hash{}) {
+				prev = header
+				continue
+			}
+			block := bc.GetBlock(hash, next)
+			if block == nil || (next > 0 && prev == (common.Hash{})) {
+				bc.insertMu.Unlock()
+				log.Error("Missing canonical block, stealth filter building stopped", "number", next)
+				return
+			}
+			prev = writeStealthFilter(batch, block, prev)
+			built++
+		}
+		rawdb.WriteStealthFilterSynced(batch, next)
+		if err := batch.Write(); err != nil {
+			log.Crit("Failed to write stealth filters", "err", err)
+		}
+		bc.insertMu.Unlock()
+
+		if time.Since(logged) > 8*time.Second {
+			log.Info("Building stealth filters", "built", built, "next", next, "head", head, "elapsed", time.Since(start))
+			logged = time.Now()
+		}
+	}
+	if built > 0 {
+		log.Info("Built stealth filters", "blocks", built, "elapsed", time.Since(start))
+	}
+}
+
+// StealthFilterRange returns the stealth filters of the blocks from number
+// start up to the block stop, on the chain ending at stop, along with the
+// filter header of the block before them. It returns nil if stop is
+// unknown, the range holds more than max blocks or some filters aren't
+// built yet.
+func (bc *BlockChain) StealthFilterRange(start uint64, stop common.Hash, max uint64) *filter.Range {
+	header := bc.GetHeaderByHash(stop)
+	if header == nil {
+		return nil
+	}
+	number := header.Number.Uint64()
+	if start > number || number-start >= max {
+		return nil
+	}
+	r := &filter.Range{
+		Blocks:  make([]common.Hash, number-start+1),
+		Filters: make([][]byte, number-start+1),
+	}
+	for n := number; ; n-- {
+		raw := rawdb.ReadStealthFilter(bc.db, header.Hash(), n)
+		if raw == nil {
+			return nil
+		}
+		r.Blocks[n-start], r.Filters[n-start] = header.Hash(), raw
+		if n == 0 {
+			return r
+		}
+		if n == start {
+			if r.Prev = rawdb.ReadStealthFilterHeader(bc.db, header.ParentHash, n-1); r.Prev == (common.Hash{}) {
+				return nil
+			}
+			return r
+		}
+		if header = bc.GetHeader(header.ParentHash, n-1); header == nil {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package core
+
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/obsidian-chain/obsidian/core/rawdb"
+	obstypes "github.com/obsidian-chain/obsidian/core/types"
+	"github.com/obsidian-chain/obsidian/stealth"
+)
+
+// stealthIndexBatch is the number of blocks the background indexer indexes
+// at a time, holding off block insertion meanwhile
+const stealthIndexBatch = 1000
+
+// stealthIndexEntries returns the stealth payment announcements of a block.
+// Token transfers are announced for the recipient of the tokens.
+func stealthIndexEntries(block *obstypes.ObsidianBlock) []*rawdb.StealthIndexEntry {
+	var entries []*rawdb.StealthIndexEntry
+	for _, tx := range block.Transactions() {
+		if (tx.Type() != obstypes.StealthTxType && tx.Type() != obstypes.SponsoredTxType) || tx.To() == nil || len(tx.EphemeralPubKey()) == 0 {
+			continue
+		}
+		transfer := stealth.DecodeTransfer(*tx.To(), tx.Value(), tx.Data())
+		entries = append(entries, &rawdb.StealthIndexEntry{
+			TxHash:          tx.Hash(),
+			Recipient:       transfer.Recipient,
+			EphemeralPubKey: tx.EphemeralPubKey(),
+			Value:           transfer.Amount,
+			ViewTag:         tx.ViewTag(),
+			Standard:        uint8(transfer.Asset.Standard),
+			Token:           transfer.Asset.Token,
+		})
+	}
+	return entries
+}
+
+// writeStealthIndex indexes the announcements of a block that just became
+// canonical, replacing those of the block it displaced
+func writeStealthIndex(db *rawdb.Database, block *obstypes.ObsidianBlock) {
+	rawdb.DeleteStealthIndex(db, block.NumberU64())
+	rawdb.WriteStealthIndex(db, block.NumberU64(), stealthIndexEntries(block))
+}
+
+// startStealthIndexer makes sure the whole canonical chain gets indexed. New
+// blocks are indexed as they are inserted, so on a chain that predates the
+// index the blocks below the head are indexed in the background, from the
+// head down.
+func (bc *BlockChain) startStealthIndexer() {
+	tail := rawdb.ReadStealthIndexTail(bc.db)
+	if tail == nil {
+		head := bc.currentBlock.Load().NumberU64()
+		if head == 0 {
+			// Genesis has no transactions
+			rawdb.WriteStealthIndexTail(bc.db, 0)
+			return
+		}
+		tail = new(uint64)
+		*tail = head + 1
+		rawdb.WriteStealthIndexTail(bc.db, *tail)
+	}
+	if *tail == 0 {
+		return
+	}
+	bc.wg.Add(1)
+	go bc.indexStealthAnnouncements(*tail)
+}
+
+// indexStealthAnnouncements indexes the canonical blocks below tail
+func (bc *BlockChain) indexStealthAnnouncements(tail uint64) {
+	defer bc.wg.Done()
+
+	var (
+		start   = time.Now()
+		logged  = time.Now()
+		indexed uint64
+	)
+	log.Info("Indexing stealth announcements", "blocks", tail)
+	for tail > 0 {
+		select {
+		case <-bc.quit:
+			log.Info("Stealth announcement indexing interrupted", "tail", tail)
+			return
+		default:
+		}
+		bc.insertMu.Lock()
+		batch := bc.db.NewBatch()
+		for n := tail; n > 0 && tail-n < stealthIndexBatch; n-- {
+			block := bc.GetBlockByNumber(n - 1)
+			if block == nil {
+				bc.insertMu.Unlock()
+				log.Error("Missing canonical block, stealth indexing stopped", "number", n-1)
+				return
+			}
+			rawdb.WriteStealthIndex(batch, n-1, stealthIndexEntries(block))
+			indexed++
+		}
+		tail -= min(tail, stealthIndexBatch)
+		rawdb.WriteStealthIndexTail(batch, tail)
+		if err := batch.Write(); err != nil {
+			log.Crit("Failed to write stealth announcement index", "err", err)
+		}
+		bc.insertMu.Unlock()
+
+		if time.Since(logged) > 8*time.Second {
+			log.Info("Indexing stealth announcements", "indexed", indexed, "tail", tail, "elapsed", time.Since(start))
+			logged = time.Now()
+		}
+	}
+	log.Info("Indexed stealth announcements", "blocks", indexed, "elapsed", time.Since(start))
+}
+
+// IterateStealthAnnouncements calls fn with the stealth announcements of
+// every canonical block from from to to that has some, in block order. If
+// viewTags is non-nil, only announcements with those view tags are returned.
+// Blocks the background indexer hasn't reached yet are read from their
+// bodies. Iteration stops early if fn returns false.
+func (bc *BlockChain) IterateStealthAnnouncements(from, to uint64, viewTags []byte, fn func(number uint64, entries []*rawdb.StealthIndexEntry) bool) {
+	tail := uint64(0)
+	if t := rawdb.ReadStealthIndexTail(bc.db); t != nil {
+		tail = *t
+	}
+	var filter [256]bool
+	for _, tag := range viewTags {
+		filter[tag] = true
+	}
+	for ; from <= to && from < tail; from++ {
+		block := bc.GetBlockByNumber(from)
+		if block == nil {
+			return
+		}
+		var entries []*rawdb.StealthIndexEntry
+		for _, entry := range stealthIndexEntries(block) {
+			if viewTags == nil || filter[entry.ViewTag] {
+				entries = append(entries, entry)
+			}
+		}
+		if len(entries) > 0 && !fn(from, entries) {
+			return
+		}
+	}
+	if from <= to {
+		rawdb.IterateStealthIndex(bc.db, from, to, viewTags, fn)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package txpool
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	obstypes "github.com/obsidian-chain/obsidian/core/types"
+)
+
+// cancelGas is the gas limit of a cancellation, a plain value transfer
+const cancelGas = 21000
+
+// bumpPrice returns the lowest price at least priceBump percent above price.
+// The result is always strictly higher than price.
+func bumpPrice(price *big.Int, priceBump uint64) *big.Int {
+	bumped := new(big.Int).Mul(price, new(big.Int).SetUint64(100+priceBump))
+	bumped.Div(bumped, big.NewInt(100))
+	if bumped.Cmp(price) <= 0 {
+		bumped.Add(price, common.Big1)
+	}
+	return bumped
+}
+
+// canReplace reports whether tx pays enough more than old to replace it: its
+// gas price must be at least priceBump percent higher. Only the gas price is
+// compared, as it is the only fee covered by the sender's signature and the
+// only one execution charges.
+func canReplace(old, tx *obstypes.StealthTransaction, priceBump uint64) bool {
+	return tx.EffectiveGasPrice().Cmp(bumpPrice(old.EffectiveGasPrice(), priceBump)) >= 0
+}
+
+// ReplacementPrice returns the lowest gas price a transaction must carry to
+// replace old in a pool configured with priceBump.
+func ReplacementPrice(old *obstypes.StealthTransaction, priceBump uint64) *big.Int {
+	return bumpPrice(old.EffectiveGasPrice(), priceBump)
+}
+
+// SpeedUpTx returns an unsigned copy of old with its gas price raised just
+// enough to replace it in the pool.
+func SpeedUpTx(old *obstypes.StealthTransaction, priceBump uint64) *obstypes.StealthTransaction {
+	return old.WithGasPrice(ReplacementPrice(old, priceBump))
+}
+
+// CancelTx returns an unsigned zero-value transfer from the sender to itself
+// that reuses the nonce of old, so that once mined old can no longer be
+// included. The ephemeral key of old is kept so the replacement stays
+// well-formed, but it carries no view tag as it announces no payment.
+func CancelTx(old *obstypes.StealthTransaction, from common.Address, priceBump uint64) *obstypes.StealthTransaction {
+	gas := uint64(cancelGas)
+	if old.Gas() < gas {
+		gas = old.Gas()
+	}
+	tx := obstypes.NewStealthTransaction(
+		old.Nonce(),
+		from,
+		new(big.Int),
+		gas,
+		ReplacementPrice(old, priceBump),
+		nil,
+		old.EphemeralPubKey(),
+		0,
+	)
+	return tx
+}
@@ -0,0 +1,146 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package txpool
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	obstypes "github.com/obsidian-chain/obsidian/core/types"
+)
+
+func feeTx(gasPrice int64) *obstypes.StealthTransaction {
+	var price *big.Int
+	if gasPrice > 0 {
+		price = big.NewInt(gasPrice)
+	}
+	return obstypes.NewStealthTransaction(0, common.Address{0x01}, big.NewInt(1), 21000, price, nil, nil, 0)
+}
+
+// withUnsignedFees returns a copy of tx with a tip and fee cap set the way a
+// relaying peer could, keeping the sender's signature
+func withUnsignedFees(t *testing.T, tx *obstypes.StealthTransaction, tip, feeCap int64) *obstypes.StealthTransaction {
+	t.Helper()
+	enc, err := tx.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var inner obstypes.StealthTxData
+	if err := rlp.DecodeBytes(enc[1:], &inner); err != nil {
+		t.Fatal(err)
+	}
+	inner.GasTipCap, inner.GasFeeCap = big.NewInt(tip), big.NewInt(feeCap)
+	body, err := rlp.EncodeToBytes(&inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpy := new(obstypes.StealthTransaction)
+	if err := cpy.UnmarshalBinary(append([]byte{enc[0]}, body...)); err != nil {
+		t.Fatal(err)
+	}
+	return cpy
+}
+
+func TestCanReplace(t *testing.T) {
+	tests := []struct {
+		old, tx *obstypes.StealthTransaction
+		want    bool
+	}{
+		// A 10% bump is required
+		{feeTx(100), feeTx(109), false},
+		{feeTx(100), feeTx(110), true},
+		// Tiny prices still need a strictly higher replacement
+		{feeTx(1), feeTx(1), false},
+		{feeTx(1), feeTx(2), true},
+		// Transactions without a price pay the default one
+		{feeTx(0), feeTx(obstypes.DefaultGasPrice.Int64()), false},
+		{feeTx(0), feeTx(2 * obstypes.DefaultGasPrice.Int64()), true},
+	}
+	for i, tt := range tests {
+		if have := canReplace(tt.old, tt.tx, 10); have != tt.want {
+			t.Errorf("test %d: replacement allowed %v, want %v", i, have, tt.want)
+		}
+	}
+}
+
+// Raising the unsigned tip and fee cap of a transaction mustn't let the copy
+// replace the original
+func TestUnsignedFeesIgnored(t *testing.T) {
+	old := feeTx(100)
+	if canReplace(old, withUnsignedFees(t, old, 1e18, 1e18), 10) {
+		t.Fatal("copy with raised fee cap and tip replaces the original")
+	}
+}
+
+func TestReplacementPriceAccepted(t *testing.T) {
+	for _, old := range []*obstypes.StealthTransaction{feeTx(0), feeTx(1), feeTx(1e9), feeTx(7)} {
+		speedup := SpeedUpTx(old, 10)
+		if !canReplace(old, speedup, 10) {
+			t.Errorf("speed-up of %v not accepted", old.GasPrice())
+		}
+		cancel := CancelTx(old, common.Address{0x02}, 10)
+		if !canReplace(old, cancel, 10) {
+			t.Errorf("cancellation of %v not accepted", old.GasPrice())
+		}
+		if cancel.Nonce() != old.Nonce() || cancel.Value().Sign() != 0 || *cancel.To() != (common.Address{0x02}) {
+			t.Errorf("cancellation is not a zero-value self-transfer with the same nonce")
+		}
+	}
+}
+
+// A pooled stealth payment carrying a view tag can be cancelled
+func TestCancelTaggedPayment(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool := newTestPool(t, from)
+
+	old := signedStealthTx(t, key, 0, 1e9, ephemeralKey(t))
+	if err := pool.Add(old, false); err != nil {
+		t.Fatal(err)
+	}
+	cancel, err := obstypes.SignStealthTx(CancelTx(old, from, pool.PriceBump()), obstypes.NewStealthEIP155Signer(testChainID), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Add(cancel, false); err != nil {
+		t.Fatalf("cancellation rejected: %v", err)
+	}
+	if pool.Get(old.Hash()) != nil {
+		t.Fatal("cancelled transaction still pooled")
+	}
+}
+
+// An unset gas price arrives from peers as zero, which must be priced the
+// same as on the node that created the transaction
+func TestDecodedTxFees(t *testing.T) {
+	tx := feeTx(0)
+	enc, err := tx.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := new(obstypes.StealthTransaction)
+	if err := dec.UnmarshalBinary(enc); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := dec.EffectiveGasPrice(), tx.EffectiveGasPrice(); have.Cmp(want) != 0 {
+		t.Errorf("decoded price %v, want %v", have, want)
+	}
+}
+
+func TestTxListReplacement(t *testing.T) {
+	list := newTxList(true)
+	if inserted, _ := list.Add(feeTx(100), 10); !inserted {
+		t.Fatal("failed to insert first transaction")
+	}
+	if inserted, _ := list.Add(feeTx(105), 10); inserted {
+		t.Fatal("underpriced replacement accepted")
+	}
+	inserted, old := list.Add(feeTx(110), 10)
+	if !inserted || old == nil || old.GasPrice().Int64() != 100 {
+		t.Fatal("replacement not accepted")
+	}
+}
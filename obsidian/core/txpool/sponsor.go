@@ -0,0 +1,53 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package txpool
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/obsidian-chain/obsidian/core/state"
+	obstypes "github.com/obsidian-chain/obsidian/core/types"
+)
+
+// validateSponsored checks that both parties of a sponsored transaction can
+// pay their share: the sender its value, the sponsor the fees on top of those
+// of every other transaction it sponsors in the pool. Fees are counted at the
+// gas price the sponsor signed (must be called with lock held)
+func (pool *TxPool) validateSponsored(tx *obstypes.StealthTransaction, from common.Address, stateDB state.StateDBInterface) error {
+	sponsor, err := pool.signer.Sponsor(tx)
+	if err != nil {
+		return ErrInvalidSponsor
+	}
+	if tx.Value() != nil && stateDB.GetBalance(from).Cmp(tx.Value()) < 0 {
+		return ErrInsufficientFunds
+	}
+	cost := new(big.Int).Mul(tx.EffectiveGasPrice(), new(big.Int).SetUint64(tx.Gas()))
+	cost.Add(cost, pool.sponsorCommitted(sponsor, from, tx.Nonce()))
+	if stateDB.GetBalance(sponsor).Cmp(cost) < 0 {
+		return ErrSponsorFunds
+	}
+	return nil
+}
+
+// sponsorCommitted returns the fees a sponsor is on the hook for across the
+// pool, leaving out the transaction of the sender with the given nonce that
+// a replacement would evict (must be called with lock held)
+func (pool *TxPool) sponsorCommitted(sponsor, from common.Address, nonce uint64) *big.Int {
+	committed := new(big.Int)
+	for _, lists := range []map[common.Address]*txList{pool.pending, pool.queue} {
+		for sender, list := range lists {
+			for _, tx := range list.items {
+				if !tx.Sponsored() || (sender == from && tx.Nonce() == nonce) {
+					continue
+				}
+				if payer, err := pool.signer.Sponsor(tx); err != nil || payer != sponsor {
+					continue
+				}
+				committed.Add(committed, new(big.Int).Mul(tx.EffectiveGasPrice(), new(big.Int).SetUint64(tx.Gas())))
+			}
+		}
+	}
+	return committed
+}
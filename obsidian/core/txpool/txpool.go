@@ -36,8 +36,31 @@ var (
 	ErrOversizedData = errors.New("oversized data")
 	// ErrAlreadyKnown is returned when a transaction is already in the pool
 	ErrAlreadyKnown = errors.New("already known")
+	// ErrUnsignedFees is returned when a transaction sets a tip or fee cap.
+	// The sender's signature doesn't cover them and execution charges only
+	// the gas price, so anyone could change them in transit.
+	ErrUnsignedFees = errors.New("tip and fee cap are not supported")
+	// ErrInvalidEphemeralKey is returned when a stealth transaction's ephemeral
+	// public key is not a valid compressed secp256k1 point
+	ErrInvalidEphemeralKey = errors.New("invalid ephemeral public key")
+	// ErrInvalidViewTag is returned when a transaction carries a view tag but
+	// pays no stealth recipient
+	ErrInvalidViewTag = errors.New("view tag set on transaction that pays no stealth recipient")
+	// ErrStealthLimit is returned when a sender has too many stealth payments
+	// waiting in the pool
+	ErrStealthLimit = errors.New("too many pending stealth payments from sender")
+	// ErrInvalidSponsor is returned when the sponsor of a sponsored
+	// transaction can't be recovered from its signature
+	ErrInvalidSponsor = errors.New("invalid sponsor")
+	// ErrSponsorFunds is returned when a sponsor can't pay the fees of a
+	// transaction along with those of the others it sponsors in the pool
+	ErrSponsorFunds = errors.New("insufficient sponsor funds for gas * price")
 )
 
+// txMaxSize is the maximum encoded size of a single transaction accepted into
+// the pool
+const txMaxSize = 4 * 32 * 1024
+
 // Config contains the configuration for the transaction pool
 type Config struct {
 	Journal      string        // Path to the transaction journal file
@@ -49,6 +72,7 @@ type Config struct {
 	AccountQueue uint64        // Maximum number of non-executable transaction slots
 	GlobalQueue  uint64        // Maximum number of non-executable transaction slots
 	Lifetime     time.Duration // Maximum duration for non-executable transactions
+	StealthSlots uint64        // Maximum number of announced stealth payments per sender
 }
 
 // DefaultConfig returns the default configuration
@@ -63,6 +87,7 @@ func DefaultConfig() Config {
 		AccountQueue: 64,
 		GlobalQueue:  1024,
 		Lifetime:     3 * time.Hour,
+		StealthSlots: 16,
 	}
 }
 
@@ -117,6 +142,14 @@ type txPoolResetRequest struct {
 
 // NewTxPool creates a new transaction pool
 func NewTxPool(config Config, chain BlockChain, signer obstypes.StealthSigner) *TxPool {
+	if config.StealthSlots < 1 {
+		log.Warn("Sanitizing invalid txpool stealth slots", "provided", config.StealthSlots, "updated", DefaultConfig().StealthSlots)
+		config.StealthSlots = DefaultConfig().StealthSlots
+	}
+	if config.PriceBump < 1 {
+		log.Warn("Sanitizing invalid txpool price bump", "provided", config.PriceBump, "updated", DefaultConfig().PriceBump)
+		config.PriceBump = DefaultConfig().PriceBump
+	}
 	pool := &TxPool{
 		config:          config,
 		chain:           chain,
@@ -264,17 +297,28 @@ func (pool *TxPool) Add(tx *obstypes.StealthTransaction, local bool) error {
 	return pool.add(tx, local)
 }
 
-// add adds a transaction to the pool (must be called with lock held)
-func (pool *TxPool) add(tx *obstypes.StealthTransaction, local bool) error {
+// validateTx checks whether a transaction is valid according to the consensus
+// rules and adheres to the local node's pool policy (must be called with lock
+// held)
+func (pool *TxPool) validateTx(tx *obstypes.StealthTransaction) error {
 	// Validate basic transaction fields
 	if err := tx.ValidateBasic(); err != nil {
 		return err
 	}
 
-	// Check if already known
-	hash := tx.Hash()
-	if pool.all.Get(hash) != nil {
-		return ErrAlreadyKnown
+	// Reject transactions over the size limit to prevent DoS attacks
+	if tx.Size() > txMaxSize {
+		return ErrOversizedData
+	}
+
+	// Reject malformed stealth fields before they reach scanning wallets
+	if err := validateStealthFields(tx); err != nil {
+		return err
+	}
+
+	// Only the gas price is signed and charged
+	if tip, feeCap := tx.GasTipCap(), tx.GasFeeCap(); (tip != nil && tip.Sign() != 0) || (feeCap != nil && feeCap.Sign() != 0) {
+		return ErrUnsignedFees
 	}
 
 	// Validate the transaction sender via signature recovery
@@ -292,23 +336,25 @@ func (pool *TxPool) add(tx *obstypes.StealthTransaction, local bool) error {
 	}
 
 	// Check nonce - must be >= current nonce
-	currentNonce := stateDB.GetNonce(from)
-	if tx.Nonce() < currentNonce {
+	if tx.Nonce() < stateDB.GetNonce(from) {
 		return ErrNonceTooLow
 	}
 
-	// Check balance - must have enough for gas * price + value
-	balance := stateDB.GetBalance(from)
-	gasPrice := tx.GasPrice()
-	if gasPrice == nil {
-		gasPrice = big.NewInt(0)
-	}
-	cost := new(big.Int).Mul(gasPrice, new(big.Int).SetUint64(tx.Gas()))
-	if tx.Value() != nil {
-		cost.Add(cost, tx.Value())
-	}
-	if balance.Cmp(cost) < 0 {
-		return ErrInsufficientFunds
+	// Check balance - must have enough for gas * price + value, unless a
+	// sponsor pays the gas
+	gasPrice := tx.EffectiveGasPrice()
+	if tx.Sponsored() {
+		if err := pool.validateSponsored(tx, from, stateDB); err != nil {
+			return err
+		}
+	} else {
+		cost := new(big.Int).Mul(gasPrice, new(big.Int).SetUint64(tx.Gas()))
+		if tx.Value() != nil {
+			cost.Add(cost, tx.Value())
+		}
+		if stateDB.GetBalance(from).Cmp(cost) < 0 {
+			return ErrInsufficientFunds
+		}
 	}
 
 	// Check gas limit against block gas limit
@@ -331,6 +377,39 @@ func (pool *TxPool) add(tx *obstypes.StealthTransaction, local bool) error {
 		return ErrOversizedData
 	}
 
+	// Limit how many stealth payments a single sender can have waiting, since
+	// every announcement costs each scanning wallet an ECDH operation.
+	// Contract creations aren't announced, and replacements don't take up a
+	// new slot.
+	if announced(tx) && !pool.hasNonce(from, tx.Nonce()) {
+		if pool.stealthCount(from) >= pool.config.StealthSlots {
+			return ErrStealthLimit
+		}
+	}
+	return nil
+}
+
+// add adds a transaction to the pool (must be called with lock held)
+func (pool *TxPool) add(tx *obstypes.StealthTransaction, local bool) error {
+	// Check if already known
+	hash := tx.Hash()
+	if pool.all.Get(hash) != nil {
+		return ErrAlreadyKnown
+	}
+
+	if err := pool.validateTx(tx); err != nil {
+		log.Trace("Discarding invalid transaction", "hash", hash, "err", err)
+		return err
+	}
+
+	from, _ := pool.signer.Sender(tx) // already validated
+	currentHead := pool.chain.CurrentBlock()
+	stateDB, err := pool.chain.StateAt(currentHead.Root)
+	if err != nil {
+		return err
+	}
+	currentNonce := stateDB.GetNonce(from)
+
 	// If nonce matches current, add to pending directly
 	if tx.Nonce() == currentNonce {
 		if pool.pending[from] == nil {
@@ -364,6 +443,41 @@ func (pool *TxPool) add(tx *obstypes.StealthTransaction, local bool) error {
 	return nil
 }
 
+// hasNonce reports whether the sender already has a transaction with the
+// given nonce in the pool (must be called with lock held)
+func (pool *TxPool) hasNonce(from common.Address, nonce uint64) bool {
+	if list := pool.pending[from]; list != nil && list.items[nonce] != nil {
+		return true
+	}
+	if list := pool.queue[from]; list != nil && list.items[nonce] != nil {
+		return true
+	}
+	return false
+}
+
+// stealthCount returns the number of announced stealth payments the sender
+// has in the pool (must be called with lock held)
+func (pool *TxPool) stealthCount(from common.Address) uint64 {
+	var count uint64
+	for _, list := range []*txList{pool.pending[from], pool.queue[from]} {
+		if list == nil {
+			continue
+		}
+		for _, tx := range list.items {
+			if announced(tx) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// PriceBump returns the minimum fee increase, in percent, a replacement
+// transaction must offer
+func (pool *TxPool) PriceBump() uint64 {
+	return pool.config.PriceBump
+}
+
 // Get returns a transaction by hash
 func (pool *TxPool) Get(hash common.Hash) *obstypes.StealthTransaction {
 	return pool.all.Get(hash)
@@ -477,13 +591,8 @@ func newTxList(strict bool) *txList {
 
 func (l *txList) Add(tx *obstypes.StealthTransaction, priceBump uint64) (bool, *obstypes.StealthTransaction) {
 	old := l.items[tx.Nonce()]
-	if old != nil {
-		// Check if replacement
-		threshold := new(big.Int).Mul(old.GasPrice(), big.NewInt(100+int64(priceBump)))
-		threshold.Div(threshold, big.NewInt(100))
-		if tx.GasPrice().Cmp(threshold) < 0 {
-			return false, nil
-		}
+	if old != nil && !canReplace(old, tx, priceBump) {
+		return false, nil
 	}
 	l.items[tx.Nonce()] = tx
 	return true, old
@@ -0,0 +1,45 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package txpool
+
+import (
+	"github.com/ethereum/go-ethereum/crypto"
+	obstypes "github.com/obsidian-chain/obsidian/core/types"
+	"github.com/obsidian-chain/obsidian/stealth"
+)
+
+// announced reports whether the chain announces a transaction to scanning
+// wallets as a stealth payment. Every transaction carries an ephemeral key,
+// but only those with a recipient are indexed.
+func announced(tx *obstypes.StealthTransaction) bool {
+	return tx.To() != nil
+}
+
+// validateStealthFields checks that the stealth announcement carried by a
+// transaction is something a scanning wallet can actually process: the
+// ephemeral key must decompress to a point on the curve, and a view tag only
+// makes sense on an announced payment that transfers something to the address
+// it was derived for.
+func validateStealthFields(tx *obstypes.StealthTransaction) error {
+	key := tx.EphemeralPubKey()
+	if len(key) != 33 {
+		return obstypes.ErrMissingEphemeralKey
+	}
+	if key[0] != 0x02 && key[0] != 0x03 {
+		return ErrInvalidEphemeralKey
+	}
+	if _, err := crypto.DecompressPubkey(key); err != nil {
+		return ErrInvalidEphemeralKey
+	}
+	if tx.ViewTag() != 0 {
+		if !announced(tx) {
+			return ErrInvalidViewTag
+		}
+		transfer := stealth.DecodeTransfer(*tx.To(), tx.Value(), tx.Data())
+		if transfer.Asset == stealth.NativeAsset && transfer.Amount.Sign() == 0 {
+			return ErrInvalidViewTag
+		}
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package txpool
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/obsidian-chain/obsidian/core/state"
+	obstypes "github.com/obsidian-chain/obsidian/core/types"
+	"github.com/obsidian-chain/obsidian/stealth"
+)
+
+var testChainID = big.NewInt(1719)
+
+// testChain serves a single funded state for pool tests
+type testChain struct {
+	head  *obstypes.ObsidianHeader
+	state *state.StateDB
+}
+
+func (c *testChain) CurrentBlock() *obstypes.ObsidianHeader { return c.head }
+func (c *testChain) GetBlock(common.Hash, uint64) *obstypes.ObsidianBlock {
+	return nil
+}
+func (c *testChain) StateAt(common.Hash) (state.StateDBInterface, error) { return c.state, nil }
+
+func newTestPool(t *testing.T, funded common.Address) *TxPool {
+	t.Helper()
+
+	statedb := state.NewMemoryStateDB()
+	statedb.AddBalance(funded, new(big.Int).Mul(big.NewInt(1000), big.NewInt(1e18)))
+	chain := &testChain{
+		head:  &obstypes.ObsidianHeader{Number: big.NewInt(0), Difficulty: big.NewInt(1), GasLimit: 30_000_000},
+		state: statedb,
+	}
+	pool := NewTxPool(DefaultConfig(), chain, obstypes.NewStealthEIP155Signer(testChainID))
+	t.Cleanup(pool.Stop)
+	return pool
+}
+
+func ephemeralKey(t *testing.T) []byte {
+	t.Helper()
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crypto.CompressPubkey(&key.PublicKey)
+}
+
+func signedStealthTx(t *testing.T, key *ecdsa.PrivateKey, nonce uint64, gasPrice int64, ephemeral []byte) *obstypes.StealthTransaction {
+	t.Helper()
+	tx := obstypes.NewStealthTransaction(nonce, common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(gasPrice), nil, ephemeral, 0x42)
+	signed, err := obstypes.SignStealthTx(tx, obstypes.NewStealthEIP155Signer(testChainID), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestValidateEphemeralKey(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	pool := newTestPool(t, crypto.PubkeyToAddress(key.PublicKey))
+
+	// Uncompressed prefix with the right length
+	bad := ephemeralKey(t)
+	bad[0] = 0x04
+	if err := pool.Add(signedStealthTx(t, key, 0, 1e9, bad), false); !errors.Is(err, ErrInvalidEphemeralKey) {
+		t.Fatalf("bad prefix: have %v, want %v", err, ErrInvalidEphemeralKey)
+	}
+
+	// Compressed prefix, but the x coordinate is not on the curve
+	offCurve := make([]byte, 33)
+	offCurve[0] = 0x02
+	offCurve[32] = 0x05
+	if err := pool.Add(signedStealthTx(t, key, 0, 1e9, offCurve), false); !errors.Is(err, ErrInvalidEphemeralKey) {
+		t.Fatalf("off-curve point: have %v, want %v", err, ErrInvalidEphemeralKey)
+	}
+
+	if err := pool.Add(signedStealthTx(t, key, 0, 1e9, ephemeralKey(t)), false); err != nil {
+		t.Fatalf("valid transaction rejected: %v", err)
+	}
+}
+
+func TestValidateViewTagWithoutRecipient(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	pool := newTestPool(t, crypto.PubkeyToAddress(key.PublicKey))
+
+	tx := obstypes.NewStealthContractCreation(0, big.NewInt(0), 100000, big.NewInt(1e9), nil, ephemeralKey(t), 0x42)
+	signed, err := obstypes.SignStealthTx(tx, obstypes.NewStealthEIP155Signer(testChainID), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Add(signed, false); !errors.Is(err, ErrInvalidViewTag) {
+		t.Fatalf("have %v, want %v", err, ErrInvalidViewTag)
+	}
+}
+
+// A view tag only makes sense on a payment, of OBS or of tokens
+func TestValidateViewTagWithoutPayment(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	pool := newTestPool(t, crypto.PubkeyToAddress(key.PublicKey))
+	signer := obstypes.NewStealthEIP155Signer(testChainID)
+
+	empty := obstypes.NewStealthTransaction(0, common.Address{0x01}, big.NewInt(0), 21000, big.NewInt(1e9), nil, ephemeralKey(t), 0x42)
+	signed, err := obstypes.SignStealthTx(empty, signer, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Add(signed, false); !errors.Is(err, ErrInvalidViewTag) {
+		t.Fatalf("have %v, want %v", err, ErrInvalidViewTag)
+	}
+
+	token, data, err := stealth.TransferData(stealth.Asset{Standard: stealth.ERC20Standard, Token: common.Address{0x02}}, common.Address{}, common.Address{0x01}, big.NewInt(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer := obstypes.NewStealthTransaction(0, token, big.NewInt(0), 100000, big.NewInt(1e9), data, ephemeralKey(t), 0x42)
+	if signed, err = obstypes.SignStealthTx(transfer, signer, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Add(signed, false); err != nil {
+		t.Fatalf("token payment rejected: %v", err)
+	}
+}
+
+func TestStealthSlotsPerSender(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	pool := newTestPool(t, crypto.PubkeyToAddress(key.PublicKey))
+
+	limit := pool.config.StealthSlots
+	for nonce := uint64(0); nonce < limit; nonce++ {
+		if err := pool.Add(signedStealthTx(t, key, nonce, 1e9, ephemeralKey(t)), false); err != nil {
+			t.Fatalf("transaction %d rejected: %v", nonce, err)
+		}
+	}
+	if err := pool.Add(signedStealthTx(t, key, limit, 1e9, ephemeralKey(t)), false); !errors.Is(err, ErrStealthLimit) {
+		t.Fatalf("have %v, want %v", err, ErrStealthLimit)
+	}
+
+	// Replacing one of the existing transactions doesn't need a new slot
+	if err := pool.Add(signedStealthTx(t, key, 0, 2e9, ephemeralKey(t)), false); err != nil {
+		t.Fatalf("replacement rejected: %v", err)
+	}
+
+	// Contract creations aren't announced, so they don't count
+	create := obstypes.NewStealthContractCreation(limit, big.NewInt(0), 100000, big.NewInt(1e9), nil, ephemeralKey(t), 0)
+	signed, err := obstypes.SignStealthTx(create, obstypes.NewStealthEIP155Signer(testChainID), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Add(signed, false); err != nil {
+		t.Fatalf("contract creation rejected: %v", err)
+	}
+}
+
+// The tip and fee cap aren't signed, so a pool can't accept them
+func TestValidateUnsignedFees(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	pool := newTestPool(t, crypto.PubkeyToAddress(key.PublicKey))
+
+	tx := signedStealthTx(t, key, 0, 1e9, ephemeralKey(t))
+	if err := pool.Add(withUnsignedFees(t, tx, 1, 1), false); !errors.Is(err, ErrUnsignedFees) {
+		t.Fatalf("have %v, want %v", err, ErrUnsignedFees)
+	}
+	if err := pool.Add(tx, false); err != nil {
+		t.Fatalf("original transaction rejected: %v", err)
+	}
+}
+
+// sponsoredTx returns a transaction sent by key and sponsored by sponsor. Like
+// the relay's, it carries no view tag, so it may pay nothing.
+func sponsoredTx(t *testing.T, key, sponsor *ecdsa.PrivateKey, nonce uint64, value int64) *obstypes.StealthTransaction {
+	t.Helper()
+	signer := obstypes.NewStealthEIP155Signer(testChainID)
+	tx := obstypes.NewSponsoredTransaction(nonce, common.Address{0x01}, big.NewInt(value), nil, ephemeralKey(t), 0)
+	tx, err := obstypes.SignStealthTx(tx, signer, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx, err = obstypes.SignSponsorTx(tx.WithSponsorFees(21000, big.NewInt(1e9)), signer, sponsor); err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func TestValidateSponsored(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	sponsor, _ := crypto.GenerateKey()
+	pool := newTestPool(t, crypto.PubkeyToAddress(sponsor.PublicKey))
+	pool.chain.(*testChain).state.AddBalance(crypto.PubkeyToAddress(key.PublicKey), big.NewInt(10))
+
+	// The sender has no funds for gas, but the sponsor pays it
+	if err := pool.Add(sponsoredTx(t, key, sponsor, 0, 10), false); err != nil {
+		t.Fatalf("sponsored transaction rejected: %v", err)
+	}
+	// The value is still the sender's to pay
+	if err := pool.Add(sponsoredTx(t, key, sponsor, 1, 11), false); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("have %v, want %v", err, ErrInsufficientFunds)
+	}
+	// Both signatures are needed
+	unsponsored := sponsoredTx(t, key, sponsor, 1, 0).WithSponsorFees(21000, big.NewInt(1e9))
+	if err := pool.Add(unsponsored, false); !errors.Is(err, obstypes.ErrMissingSponsor) {
+		t.Fatalf("have %v, want %v", err, obstypes.ErrMissingSponsor)
+	}
+	// An unfunded sponsor can't pay the fees
+	broke, _ := crypto.GenerateKey()
+	if err := pool.Add(sponsoredTx(t, key, broke, 1, 0), false); !errors.Is(err, ErrSponsorFunds) {
+		t.Fatalf("have %v, want %v", err, ErrSponsorFunds)
+	}
+}
+
+// The sponsor signs only the gas limit and price, so a sponsored transaction
+// carrying a tip or fee cap doesn't decode
+func TestSponsoredUnsignedFees(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	sponsor, _ := crypto.GenerateKey()
+	tx := sponsoredTx(t, key, sponsor, 0, 0)
+
+	enc, err := tx.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var inner obstypes.StealthTxData
+	if err := rlp.DecodeBytes(enc[1:], &inner); err != nil {
+		t.Fatal(err)
+	}
+	inner.GasFeeCap = big.NewInt(1)
+	body, err := rlp.EncodeToBytes(&inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := new(obstypes.StealthTransaction).UnmarshalBinary(append([]byte{enc[0]}, body...)); !errors.Is(err, obstypes.ErrInvalidStealthTx) {
+		t.Fatalf("have %v, want %v", err, obstypes.ErrInvalidStealthTx)
+	}
+}
+
+func TestSponsorCommittedFees(t *testing.T) {
+	sponsor, _ := crypto.GenerateKey()
+	pool := newTestPool(t, common.Address{})
+	// Enough to sponsor two transactions, but not three
+	pool.chain.(*testChain).state.AddBalance(crypto.PubkeyToAddress(sponsor.PublicKey), big.NewInt(2*21000*1e9))
+
+	for i := 0; i < 2; i++ {
+		key, _ := crypto.GenerateKey()
+		if err := pool.Add(sponsoredTx(t, key, sponsor, 0, 0), false); err != nil {
+			t.Fatalf("transaction %d rejected: %v", i, err)
+		}
+	}
+	key, _ := crypto.GenerateKey()
+	if err := pool.Add(sponsoredTx(t, key, sponsor, 0, 0), false); !errors.Is(err, ErrSponsorFunds) {
+		t.Fatalf("have %v, want %v", err, ErrSponsorFunds)
+	}
+}
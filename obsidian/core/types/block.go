@@ -6,6 +6,7 @@ package types
 import (
 	"bytes"
 	"encoding/binary"
+	"io"
 	"math/big"
 	"sync/atomic"
 	"time"
@@ -143,15 +144,33 @@ func NewBlock(header *ObsidianHeader, txs []*StealthTransaction, uncles []*Obsid
 	return b
 }
 
-// DeriveSha computes the Merkle root of a list of items
-func DeriveSha(list StealthTransactions) common.Hash {
+// DerivableList is a list of items that can be committed to by DeriveSha
+type DerivableList interface {
+	Len() int
+	EncodeIndex(int, *bytes.Buffer)
+}
+
+// DeriveSha computes the Merkle root of a list of items, keyed by the RLP
+// encoding of their index
+func DeriveSha(list DerivableList) common.Hash {
 	hasher := trie.NewStackTrie(nil)
 	var buf bytes.Buffer
-	for i := 0; i < list.Len(); i++ {
+	update := func(i int) {
 		buf.Reset()
 		list.EncodeIndex(i, &buf)
 		_ = hasher.Update(rlp.AppendUint64(nil, uint64(i)), buf.Bytes())
 	}
+	// The stack trie needs ascending keys: rlp(0) = 0x80 sorts after the
+	// single byte encodings of 1..127 but before everything from 128 on
+	for i := 1; i < list.Len() && i <= 0x7f; i++ {
+		update(i)
+	}
+	if list.Len() > 0 {
+		update(0)
+	}
+	for i := 0x80; i < list.Len(); i++ {
+		update(i)
+	}
 	return hasher.Hash()
 }
 
@@ -332,6 +351,39 @@ func (b *ObsidianBlock) Size() uint64 {
 	return size
 }
 
+// extblock is the wire and storage encoding of a block
+type extblock struct {
+	Header      *ObsidianHeader
+	Txs         []*StealthTransaction
+	Uncles      []*ObsidianHeader
+	Withdrawals types.Withdrawals `rlp:"optional"`
+}
+
+// EncodeRLP implements rlp.Encoder
+func (b *ObsidianBlock) EncodeRLP(w io.Writer) error {
+	return rlp.Encode(w, &extblock{
+		Header:      b.header,
+		Txs:         b.transactions,
+		Uncles:      b.uncles,
+		Withdrawals: b.withdrawals,
+	})
+}
+
+// DecodeRLP implements rlp.Decoder
+func (b *ObsidianBlock) DecodeRLP(s *rlp.Stream) error {
+	var eb extblock
+	_, size, _ := s.Kind()
+	if err := s.Decode(&eb); err != nil {
+		return err
+	}
+	if eb.Header == nil {
+		return errMissingHeader
+	}
+	b.header, b.uncles, b.transactions, b.withdrawals = eb.Header, eb.Uncles, eb.Txs, eb.Withdrawals
+	b.size.Store(rlp.ListSize(size))
+	return nil
+}
+
 // WithSeal returns a new block with the sealed header
 func (b *ObsidianBlock) WithSeal(header *ObsidianHeader) *ObsidianBlock {
 	cpy := *header
@@ -394,6 +446,7 @@ var (
 	errMissingNumber     = &headerError{"missing number"}
 	errMissingDifficulty = &headerError{"missing difficulty"}
 	errExtraDataTooLong  = &headerError{"extra data too long"}
+	errMissingHeader     = &headerError{"missing header"}
 )
 
 type headerError struct {
@@ -5,6 +5,7 @@ package types
 
 import (
 	"bytes"
+	"io"
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -83,17 +84,19 @@ func NewReceipt(root []byte, failed bool, cumulativeGasUsed uint64) *Receipt {
 	return r
 }
 
-// EncodeRLP implements rlp.Encoder
-func (r *Receipt) EncodeRLP(w *rlp.EncoderBuffer) error {
-	data := &receiptRLP{r.statusEncoding(), r.Status, r.CumulativeGasUsed, r.Bloom, r.Logs}
+// EncodeRLP implements rlp.Encoder. Only the consensus fields are encoded, the
+// same way EncodeIndex does for the receipt root, with typed receipts wrapped
+// in a byte string.
+func (r *Receipt) EncodeRLP(w io.Writer) error {
+	data := &receiptRLP{r.PostState, r.Status, r.CumulativeGasUsed, r.Bloom, r.Logs}
 	if r.Type == LegacyTxType {
 		return rlp.Encode(w, data)
 	}
-	buf := w.List()
-	w.WriteBytes([]byte{r.Type})
-	_ = rlp.Encode(w, data)
-	w.ListEnd(buf)
-	return nil
+	enc, err := rlp.EncodeToBytes(data)
+	if err != nil {
+		return err
+	}
+	return rlp.Encode(w, append([]byte{r.Type}, enc...))
 }
 
 // DecodeRLP implements rlp.Decoder
@@ -144,16 +147,6 @@ func (r *Receipt) setStatus(postStateOrStatus []byte, status uint64) error {
 	return nil
 }
 
-func (r *Receipt) statusEncoding() []byte {
-	if len(r.PostState) == 0 {
-		if r.Status == ReceiptStatusFailed {
-			return []byte{}
-		}
-		return []byte{0x01}
-	}
-	return r.PostState
-}
-
 // Size returns the approximate memory used by all internal contents
 func (r *Receipt) Size() uint64 {
 	size := uint64(len(r.PostState))
@@ -181,15 +174,7 @@ func (rs Receipts) DeriveFields(hash common.Hash, number uint64, baseFee *big.In
 		rs[i].TransactionIndex = uint(i)
 
 		// Effective gas price
-		if txs[i].GasPrice() != nil {
-			rs[i].EffectiveGasPrice = txs[i].GasPrice()
-		} else if baseFee != nil && txs[i].GasFeeCap() != nil && txs[i].GasTipCap() != nil {
-			tip := new(big.Int).Sub(txs[i].GasFeeCap(), baseFee)
-			if tip.Cmp(txs[i].GasTipCap()) > 0 {
-				tip = txs[i].GasTipCap()
-			}
-			rs[i].EffectiveGasPrice = new(big.Int).Add(baseFee, tip)
-		}
+		rs[i].EffectiveGasPrice = txs[i].EffectiveGasPrice()
 
 		// Gas used
 		if i == 0 {
@@ -218,15 +203,15 @@ type Log struct {
 	Topics  []common.Hash  `json:"topics" gencodec:"required"`
 	Data    []byte         `json:"data" gencodec:"required"`
 
-	// Derived fields
-	BlockNumber uint64      `json:"blockNumber"`
-	TxHash      common.Hash `json:"transactionHash" gencodec:"required"`
-	TxIndex     uint        `json:"transactionIndex"`
-	BlockHash   common.Hash `json:"blockHash"`
-	Index       uint        `json:"logIndex"`
+	// Derived fields, not part of the encoding
+	BlockNumber uint64      `json:"blockNumber" rlp:"-"`
+	TxHash      common.Hash `json:"transactionHash" gencodec:"required" rlp:"-"`
+	TxIndex     uint        `json:"transactionIndex" rlp:"-"`
+	BlockHash   common.Hash `json:"blockHash" rlp:"-"`
+	Index       uint        `json:"logIndex" rlp:"-"`
 
 	// Removed is true if this log was reverted due to a chain reorganisation.
-	Removed bool `json:"removed"`
+	Removed bool `json:"removed" rlp:"-"`
 }
 
 // Size returns the approximate memory used by all internal contents
@@ -238,7 +223,7 @@ func (l *Log) Size() uint64 {
 type LogForStorage Log
 
 // EncodeRLP implements rlp.Encoder
-func (l *LogForStorage) EncodeRLP(w *rlp.EncoderBuffer) error {
+func (l *LogForStorage) EncodeRLP(w io.Writer) error {
 	return rlp.Encode(w, []interface{}{l.Address, l.Topics, l.Data})
 }
 
@@ -6,6 +6,7 @@ package types
 import (
 	"crypto/ecdsa"
 	"errors"
+	"io"
 	"math/big"
 	"sync/atomic"
 
@@ -24,15 +25,28 @@ const (
 	DynamicFeeTxType = 0x02
 	// StealthTxType is the type identifier for Obsidian stealth transactions
 	StealthTxType = 0x10
+	// SponsoredTxType is the type identifier for stealth transactions whose
+	// fees are paid by a sponsor
+	SponsoredTxType = 0x11
 )
 
+// DefaultGasPrice is the price per gas charged to transactions that don't set
+// a gas price
+var DefaultGasPrice = big.NewInt(1e9)
+
 var (
 	// ErrInvalidStealthTx is returned when stealth transaction validation fails
 	ErrInvalidStealthTx = errors.New("invalid stealth transaction")
+	// ErrTxTypeNotSupported is returned when decoding a typed envelope of an
+	// unknown transaction type
+	ErrTxTypeNotSupported = errors.New("transaction type not supported")
 	// ErrMissingEphemeralKey is returned when ephemeral key is missing
 	ErrMissingEphemeralKey = errors.New("missing ephemeral public key")
 	// ErrInvalidViewTag is returned when view tag doesn't match
 	ErrInvalidViewTag = errors.New("invalid view tag")
+	// ErrMissingSponsor is returned for sponsored transactions the sponsor
+	// hasn't signed yet
+	ErrMissingSponsor = errors.New("missing sponsor signature")
 )
 
 // StealthTxData represents a stealth transaction
@@ -56,11 +70,17 @@ type StealthTxData struct {
 	V *big.Int `json:"v" gencodec:"required"`
 	R *big.Int `json:"r" gencodec:"required"`
 	S *big.Int `json:"s" gencodec:"required"`
+
+	// Sponsor signature values, only set on sponsored transactions
+	SponsorV *big.Int `json:"sponsorV" rlp:"optional"`
+	SponsorR *big.Int `json:"sponsorR" rlp:"optional"`
+	SponsorS *big.Int `json:"sponsorS" rlp:"optional"`
 }
 
 // StealthTransaction wraps a stealth transaction with caching
 type StealthTransaction struct {
-	inner StealthTxData
+	inner     StealthTxData
+	sponsored bool // Whether this is a SponsoredTxType transaction
 
 	// caches
 	hash atomic.Value
@@ -92,6 +112,22 @@ func NewStealthTransaction(
 	}
 }
 
+// NewSponsoredTransaction creates a stealth transaction whose fees are paid
+// by a sponsor. The sender signs it as is, then the sponsor sets the gas limit
+// and price with WithSponsorFees and signs those.
+func NewSponsoredTransaction(
+	nonce uint64,
+	to common.Address,
+	amount *big.Int,
+	data []byte,
+	ephemeralPubKey []byte,
+	viewTag byte,
+) *StealthTransaction {
+	tx := NewStealthTransaction(nonce, to, amount, 0, nil, data, ephemeralPubKey, viewTag)
+	tx.sponsored = true
+	return tx
+}
+
 // NewStealthContractCreation creates a new stealth contract creation transaction
 func NewStealthContractCreation(
 	nonce uint64,
@@ -118,9 +154,17 @@ func NewStealthContractCreation(
 
 // Type returns the transaction type
 func (tx *StealthTransaction) Type() uint8 {
+	if tx.sponsored {
+		return SponsoredTxType
+	}
 	return StealthTxType
 }
 
+// Sponsored reports whether the fees of the transaction are paid by a sponsor
+func (tx *StealthTransaction) Sponsored() bool {
+	return tx.sponsored
+}
+
 // ChainId returns the chain ID of the transaction
 func (tx *StealthTransaction) ChainId() *big.Int {
 	return tx.inner.ChainID
@@ -146,6 +190,17 @@ func (tx *StealthTransaction) GasPrice() *big.Int {
 	return tx.inner.GasPrice
 }
 
+// EffectiveGasPrice returns the price per gas execution charges for the
+// transaction: its gas price, or DefaultGasPrice if it has none. A zero
+// price encodes like an unset one, so both get the default. The tip and fee
+// caps aren't covered by the sender's signature and never count.
+func (tx *StealthTransaction) EffectiveGasPrice() *big.Int {
+	if tx.inner.GasPrice == nil || tx.inner.GasPrice.Sign() == 0 {
+		return new(big.Int).Set(DefaultGasPrice)
+	}
+	return tx.inner.GasPrice
+}
+
 // GasTipCap returns the gas tip cap
 func (tx *StealthTransaction) GasTipCap() *big.Int {
 	return tx.inner.GasTipCap
@@ -186,6 +241,11 @@ func (tx *StealthTransaction) RawSignatureValues() (v, r, s *big.Int) {
 	return tx.inner.V, tx.inner.R, tx.inner.S
 }
 
+// RawSponsorSignatureValues returns the raw signature values of the sponsor
+func (tx *StealthTransaction) RawSponsorSignatureValues() (v, r, s *big.Int) {
+	return tx.inner.SponsorV, tx.inner.SponsorR, tx.inner.SponsorS
+}
+
 // Hash returns the hash of the transaction
 func (tx *StealthTransaction) Hash() common.Hash {
 	if hash := tx.hash.Load(); hash != nil {
@@ -214,20 +274,56 @@ func (tx *StealthTransaction) WithSignature(signer StealthSigner, sig []byte) (*
 	if err != nil {
 		return nil, err
 	}
-	cpy := &StealthTransaction{inner: tx.inner}
+	cpy := &StealthTransaction{inner: tx.inner, sponsored: tx.sponsored}
 	cpy.inner.R, cpy.inner.S, cpy.inner.V = r, s, v
 	return cpy, nil
 }
 
-// EncodeRLP encodes the transaction to RLP
-func (tx *StealthTransaction) EncodeRLP(w *rlp.EncoderBuffer) error {
-	buf := w.List()
-	w.WriteUint64(uint64(StealthTxType))
-	if err := rlp.Encode(w, &tx.inner); err != nil {
+// WithSponsorSignature returns a new transaction with the given sponsor
+// signature
+func (tx *StealthTransaction) WithSponsorSignature(signer StealthSigner, sig []byte) (*StealthTransaction, error) {
+	if !tx.sponsored {
+		return nil, ErrInvalidStealthTx
+	}
+	r, s, v, err := signer.SignatureValues(tx, sig)
+	if err != nil {
+		return nil, err
+	}
+	cpy := &StealthTransaction{inner: tx.inner, sponsored: true}
+	cpy.inner.SponsorR, cpy.inner.SponsorS, cpy.inner.SponsorV = r, s, v
+	return cpy, nil
+}
+
+// WithSponsorFees returns a copy of a sponsored transaction with the gas
+// limit and price set by its sponsor. The sender's signature doesn't cover
+// them so it is kept, the sponsor's is dropped.
+func (tx *StealthTransaction) WithSponsorFees(gas uint64, gasPrice *big.Int) *StealthTransaction {
+	cpy := &StealthTransaction{inner: tx.inner, sponsored: tx.sponsored}
+	cpy.inner.Gas, cpy.inner.GasPrice = gas, gasPrice
+	cpy.inner.SponsorR, cpy.inner.SponsorS, cpy.inner.SponsorV = nil, nil, nil
+	return cpy
+}
+
+// WithGasPrice returns an unsigned copy of the transaction with the given gas
+// price, keeping everything else (including the nonce) unchanged
+func (tx *StealthTransaction) WithGasPrice(gasPrice *big.Int) *StealthTransaction {
+	cpy := &StealthTransaction{inner: tx.inner, sponsored: tx.sponsored}
+	cpy.inner.GasPrice = gasPrice
+	cpy.inner.R, cpy.inner.S, cpy.inner.V = nil, nil, nil
+	cpy.inner.SponsorR, cpy.inner.SponsorS, cpy.inner.SponsorV = nil, nil, nil
+	return cpy
+}
+
+// EncodeRLP implements rlp.Encoder
+func (tx *StealthTransaction) EncodeRLP(w io.Writer) error {
+	buf := rlp.NewEncoderBuffer(w)
+	l := buf.List()
+	buf.WriteUint64(uint64(tx.Type()))
+	if err := rlp.Encode(buf, &tx.inner); err != nil {
 		return err
 	}
-	w.ListEnd(buf)
-	return nil
+	buf.ListEnd(l)
+	return buf.Flush()
 }
 
 // DecodeRLP decodes the transaction from RLP
@@ -240,15 +336,67 @@ func (tx *StealthTransaction) DecodeRLP(s *rlp.Stream) error {
 	if err := s.Decode(&txType); err != nil {
 		return err
 	}
-	if txType != StealthTxType {
+	if txType != StealthTxType && txType != SponsoredTxType {
 		return ErrInvalidStealthTx
 	}
-	if err := s.Decode(&tx.inner); err != nil {
+	var inner StealthTxData
+	if err := s.Decode(&inner); err != nil {
+		return err
+	}
+	if err := checkSponsorFields(txType, &inner); err != nil {
 		return err
 	}
+	tx.inner, tx.sponsored = inner, txType == SponsoredTxType
 	return s.ListEnd()
 }
 
+// MarshalBinary returns the typed envelope of the transaction: the type byte
+// followed by the RLP encoding of its fields
+func (tx *StealthTransaction) MarshalBinary() ([]byte, error) {
+	enc, err := rlp.EncodeToBytes(&tx.inner)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{tx.Type()}, enc...), nil
+}
+
+// UnmarshalBinary decodes a typed envelope produced by MarshalBinary
+func (tx *StealthTransaction) UnmarshalBinary(b []byte) error {
+	if len(b) == 0 {
+		return ErrInvalidStealthTx
+	}
+	if b[0] != StealthTxType && b[0] != SponsoredTxType {
+		return ErrTxTypeNotSupported
+	}
+	var inner StealthTxData
+	if err := rlp.DecodeBytes(b[1:], &inner); err != nil {
+		return err
+	}
+	if err := checkSponsorFields(uint64(b[0]), &inner); err != nil {
+		return err
+	}
+	tx.inner, tx.sponsored = inner, b[0] == SponsoredTxType
+	return nil
+}
+
+// checkSponsorFields rejects sponsor signatures on transactions of a type
+// that has no sponsor, and tips or fee caps on sponsored transactions: the
+// sponsor signs only the gas limit and price, so anyone could change them.
+func checkSponsorFields(txType uint64, inner *StealthTxData) error {
+	if txType == StealthTxType && (inner.SponsorV != nil || inner.SponsorR != nil || inner.SponsorS != nil) {
+		return ErrInvalidStealthTx
+	}
+	if txType == SponsoredTxType && (feeSet(inner.GasTipCap) || feeSet(inner.GasFeeCap)) {
+		return ErrInvalidStealthTx
+	}
+	return nil
+}
+
+// feeSet reports whether a fee field is set. Unset fields encode like zero.
+func feeSet(fee *big.Int) bool {
+	return fee != nil && fee.Sign() != 0
+}
+
 // ValidateBasic performs basic validation
 func (tx *StealthTransaction) ValidateBasic() error {
 	if len(tx.inner.EphemeralPubKey) != 33 {
@@ -260,6 +408,12 @@ func (tx *StealthTransaction) ValidateBasic() error {
 	if tx.inner.Gas == 0 {
 		return errors.New("gas is zero")
 	}
+	if tx.sponsored && (tx.inner.SponsorV == nil || tx.inner.SponsorR == nil || tx.inner.SponsorS == nil) {
+		return ErrMissingSponsor
+	}
+	if err := checkSponsorFields(uint64(tx.Type()), &tx.inner); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -271,6 +425,10 @@ type StealthSigner interface {
 	SignatureValues(tx *StealthTransaction, sig []byte) (r, s, v *big.Int, err error)
 	// Hash returns the hash to be signed
 	Hash(tx *StealthTransaction) common.Hash
+	// Sponsor returns the address paying the fees of a sponsored transaction
+	Sponsor(tx *StealthTransaction) (common.Address, error)
+	// SponsorHash returns the hash the sponsor of a transaction signs
+	SponsorHash(tx *StealthTransaction) common.Hash
 	// Equal checks if two signers are equal
 	Equal(StealthSigner) bool
 }
@@ -314,6 +472,21 @@ func (s StealthEIP155Signer) Sender(tx *StealthTransaction) (common.Address, err
 	return recoverPlain(s.Hash(tx), R, S, V, true)
 }
 
+// Sponsor returns the address paying the fees of a sponsored transaction
+func (s StealthEIP155Signer) Sponsor(tx *StealthTransaction) (common.Address, error) {
+	if !tx.sponsored {
+		return common.Address{}, ErrInvalidStealthTx
+	}
+	V, R, S := tx.RawSponsorSignatureValues()
+	if V == nil || R == nil || S == nil {
+		return common.Address{}, ErrMissingSponsor
+	}
+	V = new(big.Int).Sub(V, s.chainIdMul)
+	V.Sub(V, big.NewInt(8))
+
+	return recoverPlain(s.SponsorHash(tx), R, S, V, true)
+}
+
 // SignatureValues returns signature values
 func (s StealthEIP155Signer) SignatureValues(tx *StealthTransaction, sig []byte) (R, S, V *big.Int, err error) {
 	if len(sig) != crypto.SignatureLength {
@@ -326,8 +499,21 @@ func (s StealthEIP155Signer) SignatureValues(tx *StealthTransaction, sig []byte)
 	return R, S, V, nil
 }
 
-// Hash returns the hash to be signed
+// Hash returns the hash to be signed. The sender of a sponsored transaction
+// signs everything but the fees, which are up to the sponsor.
 func (s StealthEIP155Signer) Hash(tx *StealthTransaction) common.Hash {
+	if tx.sponsored {
+		return rlpHash([]interface{}{
+			uint(SponsoredTxType),
+			tx.inner.Nonce,
+			tx.inner.To,
+			tx.inner.Value,
+			tx.inner.Data,
+			tx.inner.EphemeralPubKey,
+			tx.inner.ViewTag,
+			s.chainId,
+		})
+	}
 	return rlpHash([]interface{}{
 		tx.inner.Nonce,
 		tx.inner.GasPrice,
@@ -341,6 +527,18 @@ func (s StealthEIP155Signer) Hash(tx *StealthTransaction) common.Hash {
 	})
 }
 
+// SponsorHash returns the hash the sponsor of a transaction signs: the fees it
+// pays and the transaction they are paid for
+func (s StealthEIP155Signer) SponsorHash(tx *StealthTransaction) common.Hash {
+	return rlpHash([]interface{}{
+		uint(SponsoredTxType),
+		s.Hash(tx),
+		tx.inner.GasPrice,
+		tx.inner.Gas,
+		s.chainId,
+	})
+}
+
 // SignStealthTx signs a stealth transaction with the given private key
 func SignStealthTx(tx *StealthTransaction, s StealthSigner, prv *ecdsa.PrivateKey) (*StealthTransaction, error) {
 	h := s.Hash(tx)
@@ -351,6 +549,17 @@ func SignStealthTx(tx *StealthTransaction, s StealthSigner, prv *ecdsa.PrivateKe
 	return tx.WithSignature(s, sig)
 }
 
+// SignSponsorTx signs the fees of a sponsored transaction with the private key
+// of its sponsor
+func SignSponsorTx(tx *StealthTransaction, s StealthSigner, prv *ecdsa.PrivateKey) (*StealthTransaction, error) {
+	h := s.SponsorHash(tx)
+	sig, err := crypto.Sign(h[:], prv)
+	if err != nil {
+		return nil, err
+	}
+	return tx.WithSponsorSignature(s, sig)
+}
+
 // Helper functions
 
 type writeCounter uint64
@@ -14,6 +14,7 @@ import (
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/eth/ethconfig"
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/rlp"
@@ -30,9 +31,12 @@ import (
 	"github.com/obsidian-chain/obsidian/health"
 	"github.com/obsidian-chain/obsidian/metrics"
 	"github.com/obsidian-chain/obsidian/miner"
+	obsp2p "github.com/obsidian-chain/obsidian/p2p"
 	"github.com/obsidian-chain/obsidian/params"
 	"github.com/obsidian-chain/obsidian/shutdown"
 	"github.com/obsidian-chain/obsidian/stealth"
+	"github.com/obsidian-chain/obsidian/stealth/filter"
+	"github.com/obsidian-chain/obsidian/stealth/registry"
 )
 
 var (
@@ -40,10 +44,15 @@ var (
 	ErrNotFound = errors.New("not found")
 )
 
-// BlockBroadcaster interface for P2P block broadcasting
+// BlockBroadcaster interface for P2P block and transaction broadcasting
 type BlockBroadcaster interface {
 	BroadcastBlock(block *obstypes.ObsidianBlock)
+	BroadcastTxs(txs []*obstypes.StealthTransaction)
+	SendLocalTxs(txs []*obstypes.StealthTransaction)
 	PeerCount() int
+	PeersInfo() []*obsp2p.PeerInfo
+	PeerBans() []obsp2p.PeerBan
+	UnbanPeer(id string) bool
 }
 
 // Backend implements the full Obsidian backend
@@ -85,6 +94,15 @@ type Config struct {
 	TxPoolConfig    txpool.Config
 	ConsensusConfig *params.ObsidianashConfig
 	Genesis         *Genesis
+	SyncMode        ethconfig.SyncMode
+
+	// StealthRegistryBlock activates the stealth meta-address registry at
+	// 0x0B, nil leaves it unscheduled
+	StealthRegistryBlock *big.Int
+
+	// Testing and simulation
+	InMemory bool // Keep the chain database in memory instead of DataDir
+	FakePoW  bool // Accept any seal and mine blocks without proof of work
 }
 
 // Genesis represents the genesis block configuration
@@ -110,6 +128,7 @@ func DefaultConfig() *Config {
 		MinerConfig:     miner.DefaultConfig(),
 		TxPoolConfig:    txpool.DefaultConfig(),
 		ConsensusConfig: params.DefaultObsidianashConfig(),
+		SyncMode:        ethconfig.SnapSync,
 		Genesis: &Genesis{
 			GasLimit:   30000000,
 			Difficulty: big.NewInt(131072),
@@ -125,18 +144,27 @@ func New(config *Config) (*Backend, error) {
 	}
 
 	// Initialize database
-	dbPath := filepath.Join(config.DataDir, "chaindata")
-	db, err := rawdb.NewDatabase(dbPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %v", err)
+	var db *rawdb.Database
+	if config.InMemory {
+		db = rawdb.NewMemoryDatabase()
+	} else {
+		var err error
+		db, err = rawdb.NewDatabase(filepath.Join(config.DataDir, "chaindata"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open database: %v", err)
+		}
 	}
 
 	// Create consensus engine
 	engine := obsidianash.New(config.ConsensusConfig)
+	if config.FakePoW {
+		engine = obsidianash.NewFaker()
+	}
 
 	// Create blockchain
 	chainCfg := &core.ChainConfig{
-		ChainID: config.ChainID,
+		ChainID:              config.ChainID,
+		StealthRegistryBlock: config.StealthRegistryBlock,
 	}
 	genesis := &core.Genesis{
 		GasLimit:   config.Genesis.GasLimit,
@@ -164,10 +192,13 @@ func New(config *Config) (*Backend, error) {
 
 	// Create stealth service
 	stealthSvc := stealth.NewStealthService()
+	if !config.InMemory {
+		stealthSvc.SetDataDir(filepath.Join(config.DataDir, "stealth"))
+	}
 
 	// Create production components
 	shutdownMgr := shutdown.New(30 * time.Second)
-	metricsReg := metrics.NewMetricsRegistry()
+	metricsReg := metrics.GetGlobalRegistry()
 	healthMon := health.New()
 	backupMgr := backup.New(config.DataDir, 5) // Keep last 5 backups
 
@@ -186,6 +217,8 @@ func New(config *Config) (*Backend, error) {
 		shutdownCh:  make(chan struct{}),
 	}
 
+	stealthSvc.SetBackend(b)
+
 	// Create transaction pool
 	signer := obstypes.NewStealthEIP155Signer(config.ChainID)
 	b.txPool = txpool.NewTxPool(config.TxPoolConfig, b, signer)
@@ -220,6 +253,7 @@ func (b *Backend) Stop() error {
 
 	close(b.shutdownCh)
 	b.scope.Close()
+	b.stealthSvc.Stop()
 
 	b.miner.Close()
 	b.txPool.Stop()
@@ -314,11 +348,17 @@ func (b *Backend) ChainID() *big.Int {
 	return b.config.ChainID
 }
 
+// ChainConfig returns the chain configuration, including its fork blocks
+func (b *Backend) ChainConfig() *core.ChainConfig {
+	return b.blockchain.Config()
+}
+
 // SendTransaction sends a transaction
 func (b *Backend) SendTransaction(ctx context.Context, tx *obstypes.StealthTransaction) (common.Hash, error) {
 	if err := b.txPool.Add(tx, true); err != nil {
 		return common.Hash{}, err
 	}
+	b.broadcastTx(tx)
 	return tx.Hash(), nil
 }
 
@@ -411,10 +451,22 @@ func (b *Backend) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
 func (b *Backend) EstimateGas(ctx context.Context, args obstypes.CallArgs) (uint64, error) {
 	// Basic gas estimation - 21000 for simple transfers
 	// Would be more complex for contract calls
-	if args.Data != nil && len(*args.Data) > 0 {
-		return 21000 + uint64(len(*args.Data))*68, nil
+	var data []byte
+	if args.Data != nil {
+		data = *args.Data
 	}
-	return 21000, nil
+	gas := 21000 + uint64(len(data))*68
+	if args.To != nil && *args.To == registry.Address && b.registryActive() {
+		gas += registry.RequiredGas(data)
+	}
+	return gas, nil
+}
+
+// registryActive returns whether the stealth meta-address registry is active
+// in the block after the head
+func (b *Backend) registryActive() bool {
+	next := new(big.Int).Add(b.blockchain.CurrentBlock().Number(), common.Big1)
+	return b.blockchain.Config().IsStealthRegistry(next)
 }
 
 // StartMining starts the miner
@@ -427,12 +479,38 @@ func (b *Backend) StopMining() error {
 	return b.miner.Stop()
 }
 
+// AssembleBlock executes transactions on top of a header's parent and
+// returns the block ready to be sealed
+func (b *Backend) AssembleBlock(header *obstypes.ObsidianHeader, txs []*obstypes.StealthTransaction) (*obstypes.ObsidianBlock, error) {
+	return b.blockchain.AssembleBlock(header, txs)
+}
+
 // InsertBlock inserts a new block into the chain
 func (b *Backend) InsertBlock(block *obstypes.ObsidianBlock) error {
 	// Let the blockchain core handle the insertion and persistence
 	return b.blockchain.InsertBlock(block)
 }
 
+// InsertBlockWithoutState stores a block whose state is being synced
+func (b *Backend) InsertBlockWithoutState(block *obstypes.ObsidianBlock) error {
+	return b.blockchain.InsertBlockWithoutState(block)
+}
+
+// InsertReceipts stores the verified receipts of a block inserted without state
+func (b *Backend) InsertReceipts(hash common.Hash, receipts obstypes.Receipts) error {
+	return b.blockchain.InsertReceipts(hash, receipts)
+}
+
+// SnapSyncCommitHead moves the head to a block whose state has been synced
+func (b *Backend) SnapSyncCommitHead(hash common.Hash) error {
+	return b.blockchain.SnapSyncCommitHead(hash)
+}
+
+// SyncMode returns how the chain should be synchronised with the network
+func (b *Backend) SyncMode() ethconfig.SyncMode {
+	return b.config.SyncMode
+}
+
 // MinedBlockEvent is sent when a block is mined and ready to broadcast
 type MinedBlockEvent struct {
 	Block *obstypes.ObsidianBlock
@@ -480,6 +558,11 @@ func (b *Backend) GetBlockByHash(hash common.Hash) *obstypes.ObsidianBlock {
 	return b.blockchain.GetBlockByHash(hash)
 }
 
+// GetReceipts returns the receipts of a block
+func (b *Backend) GetReceipts(hash common.Hash) obstypes.Receipts {
+	return b.blockchain.GetReceipts(hash)
+}
+
 // GetBlockByNumber returns a block by number
 func (b *Backend) GetBlockByNumber(number uint64) *obstypes.ObsidianBlock {
 	return b.blockchain.GetBlockByNumber(number)
@@ -494,6 +577,16 @@ func (b *Backend) GetTD(hash common.Hash) *big.Int {
 	return b.blockchain.GetTd(hash, *number)
 }
 
+// VerifyHeader checks a header and its proof of work without importing it
+func (b *Backend) VerifyHeader(header *obstypes.ObsidianHeader) error {
+	return b.blockchain.VerifyHeader(header)
+}
+
+// VerifySeal checks the proof of work of a header whose parent may be unknown
+func (b *Backend) VerifySeal(header *obstypes.ObsidianHeader) error {
+	return b.blockchain.VerifySeal(header)
+}
+
 // HasBlock checks if a block exists
 func (b *Backend) HasBlock(hash common.Hash) bool {
 	number := rawdb.ReadHeaderNumber(b.db, hash)
@@ -529,6 +622,13 @@ func (b *Backend) BroadcastBlock(block *obstypes.ObsidianBlock) {
 	}
 }
 
+// broadcastTx propagates a locally submitted transaction to peers
+func (b *Backend) broadcastTx(tx *obstypes.StealthTransaction) {
+	if b.p2pHandler != nil {
+		b.p2pHandler.SendLocalTxs([]*obstypes.StealthTransaction{tx})
+	}
+}
+
 // SendRawTransaction sends a raw encoded transaction
 func (b *Backend) SendRawTransaction(ctx context.Context, encodedTx []byte) (common.Hash, error) {
 	tx := new(obstypes.StealthTransaction)
@@ -538,6 +638,7 @@ func (b *Backend) SendRawTransaction(ctx context.Context, encodedTx []byte) (com
 	if err := b.txPool.Add(tx, true); err != nil {
 		return common.Hash{}, err
 	}
+	b.broadcastTx(tx)
 	return tx.Hash(), nil
 }
 
@@ -551,6 +652,11 @@ func (b *Backend) GetPoolTransactions() []*obstypes.StealthTransaction {
 	return txs
 }
 
+// PriceBump returns the minimum fee increase for replacing a pool transaction
+func (b *Backend) PriceBump() uint64 {
+	return b.txPool.PriceBump()
+}
+
 // GetPoolTransaction returns a specific transaction from the pool
 func (b *Backend) GetPoolTransaction(hash common.Hash) *obstypes.StealthTransaction {
 	return b.txPool.Get(hash)
@@ -579,6 +685,19 @@ func (b *Backend) Call(ctx context.Context, args obstypes.CallArgs, blockNr rpc.
 		return nil, err
 	}
 
+	if *args.To == registry.Address && b.registryActive() {
+		var from common.Address
+		if args.From != nil {
+			from = *args.From
+		}
+		var data []byte
+		if args.Data != nil {
+			data = *args.Data
+		}
+		out, _, err := registry.Run(state, b.config.ChainID, from, data)
+		return out, err
+	}
+
 	// Get code at the address
 	code := state.GetCode(*args.To)
 	if len(code) == 0 {
@@ -640,6 +759,8 @@ func (b *Backend) GetKeystore() interface{} {
 	return b.keystore
 }
 
+var _ stealth.BlockchainBackend = (*Backend)(nil)
+
 // GetStealthService returns the stealth service
 func (b *Backend) GetStealthService() *stealth.StealthService {
 	return b.stealthSvc
@@ -647,29 +768,64 @@ func (b *Backend) GetStealthService() *stealth.StealthService {
 
 // GetStealthTransactions implements stealth.BlockchainBackend
 func (b *Backend) GetStealthTransactions(ctx context.Context, blockNumber uint64) ([]stealth.StealthTxData, error) {
-	block := b.blockchain.GetBlockByNumber(blockNumber)
-	if block == nil {
+	if b.blockchain.GetHeaderByNumber(blockNumber) == nil {
 		return nil, ErrNotFound
 	}
 
 	var stealthTxs []stealth.StealthTxData
-	for _, tx := range block.Transactions() {
-		// Check if this is a stealth transaction
-		ephemeralPubKey := tx.EphemeralPubKey()
-		if len(ephemeralPubKey) == 0 {
-			continue
+	b.blockchain.IterateStealthAnnouncements(blockNumber, blockNumber, nil, func(_ uint64, entries []*rawdb.StealthIndexEntry) bool {
+		for _, entry := range entries {
+			stealthTxs = append(stealthTxs, stealth.StealthTxData{
+				TxHash:          entry.TxHash,
+				ToAddress:       entry.Recipient,
+				EphemeralPubKey: entry.EphemeralPubKey,
+				ViewTag:         entry.ViewTag,
+				Amount:          entry.Value.String(),
+				Asset:           stealth.Asset{Standard: stealth.TokenStandard(entry.Standard), Token: entry.Token},
+			})
 		}
+		return true
+	})
+	return stealthTxs, nil
+}
 
-		stealthTxs = append(stealthTxs, stealth.StealthTxData{
-			TxHash:          tx.Hash(),
-			ToAddress:       *tx.To(),
-			EphemeralPubKey: ephemeralPubKey,
-			ViewTag:         tx.ViewTag(),
-			Amount:          tx.Value().String(),
-		})
-	}
+// StealthAnnouncements calls fn with the stealth announcements of the
+// canonical blocks from from to to, block by block, as served by the index
+func (b *Backend) StealthAnnouncements(ctx context.Context, from, to uint64, viewTags []byte, fn func(number uint64, announcements []stealth.Announcement) bool) error {
+	b.blockchain.IterateStealthAnnouncements(from, to, viewTags, func(number uint64, entries []*rawdb.StealthIndexEntry) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		announcements := make([]stealth.Announcement, len(entries))
+		for i, entry := range entries {
+			announcements[i] = stealth.Announcement{
+				EphemeralPubKey: entry.EphemeralPubKey,
+				ViewTag:         entry.ViewTag,
+				Recipient:       entry.Recipient,
+				Value:           entry.Value,
+				TxHash:          entry.TxHash,
+				BlockNumber:     number,
+				Asset:           stealth.Asset{Standard: stealth.TokenStandard(entry.Standard), Token: entry.Token},
+			}
+		}
+		return fn(number, announcements)
+	})
+	return ctx.Err()
+}
 
-	return stealthTxs, nil
+// StealthFilterRange returns the stealth filters of the blocks from number
+// start up to the block stop, nil if they can't all be served
+func (b *Backend) StealthFilterRange(start uint64, stop common.Hash, max uint64) *filter.Range {
+	return b.blockchain.StealthFilterRange(start, stop, max)
+}
+
+// GetBlockHashes implements stealth.BlockchainBackend
+func (b *Backend) GetBlockHashes(ctx context.Context, blockNumber uint64) (common.Hash, common.Hash, error) {
+	header := b.blockchain.GetHeaderByNumber(blockNumber)
+	if header == nil {
+		return common.Hash{}, common.Hash{}, nil
+	}
+	return header.Hash(), header.ParentHash, nil
 }
 
 // CurrentBlockNumber returns the current block number (for stealth.BlockchainBackend)
@@ -786,3 +942,32 @@ func (b *Backend) GetHealthMonitor() *health.Monitor {
 func (b *Backend) GetMetrics() *metrics.MetricsRegistry {
 	return b.metricsReg
 }
+
+// ChainDb returns the chain database
+func (b *Backend) ChainDb() *rawdb.Database {
+	return b.db
+}
+
+// PeersInfo returns the status and score of every connected peer
+func (b *Backend) PeersInfo() []*obsp2p.PeerInfo {
+	if b.p2pHandler == nil {
+		return nil
+	}
+	return b.p2pHandler.PeersInfo()
+}
+
+// PeerBans returns the active peer bans
+func (b *Backend) PeerBans() []obsp2p.PeerBan {
+	if b.p2pHandler == nil {
+		return nil
+	}
+	return b.p2pHandler.PeerBans()
+}
+
+// UnbanPeer lifts the ban on a node, reporting whether it was banned
+func (b *Backend) UnbanPeer(id string) bool {
+	if b.p2pHandler == nil {
+		return false
+	}
+	return b.p2pHandler.UnbanPeer(id)
+}
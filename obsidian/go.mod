@@ -3,6 +3,7 @@ module github.com/obsidian-chain/obsidian
 go 1.24.0
 
 require (
+	github.com/dchest/siphash v1.2.3
 	github.com/deckarep/golang-set/v2 v2.8.0
 	github.com/ethereum/go-ethereum v1.16.8
 	github.com/google/uuid v1.6.0
@@ -11,6 +12,7 @@ require (
 	github.com/syndtr/goleveldb v1.0.1-0.20210819022825-2ae1ddf74ef7
 	github.com/urfave/cli/v2 v2.27.5
 	golang.org/x/crypto v0.36.0
+	golang.org/x/time v0.9.0
 )
 
 require (
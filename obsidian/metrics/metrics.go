@@ -30,6 +30,10 @@ type Metrics struct {
 	BytesOut         int64
 	MessagesSent     int64
 	MessagesReceived int64
+	PeerPenalties    int64
+	PeerBans         int64
+	PeersBanned      int64
+	ThrottledServes  int64
 
 	// RPC metrics
 	RPCRequestsTotal   int64
@@ -192,6 +196,10 @@ type MetricsRegistry struct {
 	TxPoolSize       *Gauge
 	MessagesSent     *Counter
 	MessagesReceived *Counter
+	PeerPenalties    *Counter
+	PeerBans         *Counter
+	PeersBanned      *Gauge
+	ThrottledServes  *Counter
 
 	startTime   time.Time
 	lastMetrics *Metrics
@@ -211,6 +219,10 @@ func NewMetricsRegistry() *MetricsRegistry {
 		TxPoolSize:       NewGauge(),
 		MessagesSent:     NewCounter(),
 		MessagesReceived: NewCounter(),
+		PeerPenalties:    NewCounter(),
+		PeerBans:         NewCounter(),
+		PeersBanned:      NewGauge(),
+		ThrottledServes:  NewCounter(),
 		startTime:        time.Now(),
 		lastMetrics:      &Metrics{},
 	}
@@ -231,6 +243,10 @@ func (mr *MetricsRegistry) GetMetrics() *Metrics {
 		RPCRequestsTotal:     mr.RPCRequests.Get(),
 		MessagesSent:         mr.MessagesSent.Get(),
 		MessagesReceived:     mr.MessagesReceived.Get(),
+		PeerPenalties:        mr.PeerPenalties.Get(),
+		PeerBans:             mr.PeerBans.Get(),
+		PeersBanned:          mr.PeersBanned.Get(),
+		ThrottledServes:      mr.ThrottledServes.Get(),
 		TxPoolSize:           mr.TxPoolSize.Get(),
 		BlockProcessTime:     time.Duration(int64(mr.BlockProcessTime.Mean())) * time.Millisecond,
 		LastBlockTime:        time.Now(),
@@ -250,6 +266,9 @@ func (mr *MetricsRegistry) Reset() {
 	mr.RPCRequests.Reset()
 	mr.MessagesSent.Reset()
 	mr.MessagesReceived.Reset()
+	mr.PeerPenalties.Reset()
+	mr.PeerBans.Reset()
+	mr.ThrottledServes.Reset()
 }
 
 // Global metrics registry
@@ -312,6 +331,27 @@ func RecordMessageReceived() {
 	globalRegistry.MessagesReceived.Inc()
 }
 
+// RecordPeerPenalty records a misbehaviour penalty applied to a peer
+func RecordPeerPenalty() {
+	globalRegistry.PeerPenalties.Inc()
+}
+
+// RecordPeerBan records a peer being banned
+func RecordPeerBan() {
+	globalRegistry.PeerBans.Inc()
+}
+
+// SetPeersBanned sets the number of currently banned peers
+func SetPeersBanned(count int64) {
+	globalRegistry.PeersBanned.Set(count)
+}
+
+// RecordThrottledServe records a peer request that was delayed or refused
+// for exceeding the serving limits
+func RecordThrottledServe() {
+	globalRegistry.ThrottledServes.Inc()
+}
+
 // RecordBlockProcessTime records block processing time
 func RecordBlockProcessTime(duration time.Duration) {
 	globalRegistry.BlockProcessTime.Record(int64(duration.Milliseconds()))
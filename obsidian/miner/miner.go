@@ -24,6 +24,8 @@ var (
 	ErrMinerNotRunning = errors.New("miner not running")
 	// ErrMinerAlreadyRunning is returned when trying to start already running miner
 	ErrMinerAlreadyRunning = errors.New("miner already running")
+	// ErrMinerClosed is returned when the miner shuts down while sealing
+	ErrMinerClosed = errors.New("miner closed")
 )
 
 // Config is the configuration for the miner
@@ -59,8 +61,10 @@ type Backend interface {
 	// Transaction pool methods
 	PendingTransactions(enforceTips bool) map[common.Address][]*obstypes.StealthTransaction
 
-	// Block insertion
+	// Block assembly, insertion and propagation
+	AssembleBlock(header *obstypes.ObsidianHeader, txs []*obstypes.StealthTransaction) (*obstypes.ObsidianBlock, error)
 	InsertBlock(block *obstypes.ObsidianBlock) error
+	BroadcastBlock(block *obstypes.ObsidianBlock)
 
 	// Event subscription
 	SubscribeChainHeadEvent(ch chan<- ChainHeadEvent) event.Subscription
@@ -204,21 +208,11 @@ func (m *Miner) resultLoop() {
 				continue
 			}
 
-			// Insert block into chain
-			if err := m.backend.InsertBlock(block); err != nil {
+			if err := m.insertBlock(block); err != nil {
 				log.Error("Failed to insert mined block", "error", err)
 				continue
 			}
 
-			log.Info("Successfully mined and inserted block",
-				"number", block.NumberU64(),
-				"hash", block.Hash().Hex(),
-				"txs", len(block.Transactions()),
-				"difficulty", block.Difficulty(),
-			)
-
-			atomic.AddUint64(&m.minedBlocks, 1)
-
 			// Create new work for next block
 			m.commit()
 
@@ -228,6 +222,24 @@ func (m *Miner) resultLoop() {
 	}
 }
 
+// insertBlock imports a sealed block and propagates it to the network
+func (m *Miner) insertBlock(block *obstypes.ObsidianBlock) error {
+	if err := m.backend.InsertBlock(block); err != nil {
+		return err
+	}
+
+	log.Info("Successfully mined and inserted block",
+		"number", block.NumberU64(),
+		"hash", block.Hash().Hex(),
+		"txs", len(block.Transactions()),
+		"difficulty", block.Difficulty(),
+	)
+
+	atomic.AddUint64(&m.minedBlocks, 1)
+	m.backend.BroadcastBlock(block)
+	return nil
+}
+
 // commit creates new work and starts mining
 func (m *Miner) commit() {
 	m.workMu.Lock()
@@ -239,13 +251,27 @@ func (m *Miner) commit() {
 		m.abortCh = make(chan struct{})
 	}
 
+	work, err := m.prepareWork()
+	if err != nil {
+		log.Error("Failed to prepare mining work", "error", err)
+		return
+	}
+	m.currentWork = work
+
+	// Start mining with current abort channel
+	go m.mine(work, m.abortCh)
+}
+
+// prepareWork assembles a block on top of the current head from the pending
+// transactions. It must be called with workMu held.
+func (m *Miner) prepareWork() (*Work, error) {
 	parent := m.backend.CurrentBlock()
 	if parent == nil {
-		log.Error("Current block is nil")
-		return
+		return nil, errors.New("current block is nil")
 	}
 
-	// Create new block header
+	// Create new block header. Timestamps have to increase even when blocks
+	// come faster than one per second.
 	header := &obstypes.ObsidianHeader{
 		ParentHash: parent.Hash(),
 		Number:     new(big.Int).Add(parent.Number, big.NewInt(1)),
@@ -254,24 +280,47 @@ func (m *Miner) commit() {
 		Coinbase:   m.coinbase,
 		Extra:      m.extraData,
 	}
+	if header.Time <= parent.Time {
+		header.Time = parent.Time + 1
+	}
 
 	// Calculate difficulty using local calculation
 	header.Difficulty = calcDifficulty(header.Time, parent)
 
-	// Get pending transactions
+	// Execute the pending transactions to fill in the state dependent fields
 	pending := m.backend.PendingTransactions(true)
-
-	// Create work
-	work := &Work{
-		Header:    header,
-		Txs:       flattenTxs(pending),
-		CreatedAt: time.Now(),
+	block, err := m.backend.AssembleBlock(header, flattenTxs(pending))
+	if err != nil {
+		return nil, err
 	}
+	return &Work{
+		Block:     block,
+		Header:    block.Header(),
+		Txs:       block.Transactions(),
+		CreatedAt: time.Now(),
+	}, nil
+}
 
-	m.currentWork = work
-
-	// Start mining with current abort channel
-	go m.mine(work, m.abortCh)
+// MineBlock assembles a block on the current head, seals it and imports it
+// without going through the mining loop. With a fake engine sealing is
+// instant, which lets tests produce blocks one at a time.
+func (m *Miner) MineBlock() (*obstypes.ObsidianBlock, error) {
+	m.workMu.Lock()
+	work, err := m.prepareWork()
+	m.workMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	block := work.Block
+	if !m.engine.Fake() {
+		if block = sealBlock(block, m.exitCh); block == nil {
+			return nil, ErrMinerClosed
+		}
+	}
+	if err := m.insertBlock(block); err != nil {
+		return nil, err
+	}
+	return block, nil
 }
 
 // mine performs the actual PoW mining
@@ -286,14 +335,15 @@ func (m *Miner) mine(work *Work, abort chan struct{}) {
 	}
 	defer atomic.StoreInt32(&m.mining, 0)
 
-	// Prepare block for sealing
-	block := obstypes.NewBlock(work.Header, work.Txs, nil, nil)
-
-	// Seal the block using our internal sealer
+	// Seal the block using our internal sealer, unless the engine is fake
+	block := work.Block
 	resultCh := make(chan *obstypes.ObsidianBlock, 1)
 
 	go func() {
-		sealedBlock := sealBlock(block, abort)
+		sealedBlock := block
+		if !m.engine.Fake() {
+			sealedBlock = sealBlock(block, abort)
+		}
 		if sealedBlock != nil {
 			select {
 			case resultCh <- sealedBlock:
@@ -460,6 +460,14 @@ func (n *Node) RegisterAPIs(apis []rpc.API) {
 	n.rpcAPIs = append(n.rpcAPIs, apis...)
 }
 
+// RegisterProtocols adds sub-protocols to the P2P server. It must be called
+// before the node is started.
+func (n *Node) RegisterProtocols(protocols []p2p.Protocol) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.config.P2P.Protocols = append(n.config.P2P.Protocols, protocols...)
+}
+
 // RegisterService registers a service
 func (n *Node) RegisterService(name string, service Lifecycle) error {
 	n.lock.Lock()
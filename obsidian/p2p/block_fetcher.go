@@ -0,0 +1,255 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package p2p
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// Block fetcher configuration
+const (
+	// maxBlockAnnounces is the maximum number of blocks a peer may have
+	// announced but not yet delivered.
+	maxBlockAnnounces = 256
+
+	// blockFetchTimeout is how long a peer gets to deliver a block it was
+	// asked for before another announcer is tried.
+	blockFetchTimeout = 3 * time.Second
+
+	// blockTimeoutCheckInterval is how often outstanding requests are checked
+	// for expiry.
+	blockTimeoutCheckInterval = 250 * time.Millisecond
+)
+
+// blockRequest is an outstanding GetBlockByHashMsg sent to a peer
+type blockRequest struct {
+	peer string
+	time time.Time
+}
+
+// BlockFetcher retrieves blocks that peers announced by hash. Every block is
+// requested from one announcer at a time; if that peer doesn't deliver in
+// time the next announcer is asked instead.
+type BlockFetcher struct {
+	hasBlock   func(hash common.Hash) bool
+	fetchBlock func(peer string, hash common.Hash) error
+
+	// scorePeer, if set, is told about peers that fail to deliver
+	scorePeer func(peer string, ev PeerEvent) error
+
+	mu        sync.Mutex
+	announces map[string]map[common.Hash]struct{} // peer -> announced but not delivered
+	announced map[common.Hash]map[string]struct{} // hash -> peers that announced it
+	fetching  map[common.Hash]*blockRequest       // hash -> outstanding request
+
+	timeout time.Duration
+	quitCh  chan struct{}
+	log     log.Logger
+}
+
+// NewBlockFetcher creates a block fetcher. hasBlock reports whether the chain
+// already holds a block and fetchBlock asks a peer for one by hash.
+func NewBlockFetcher(hasBlock func(hash common.Hash) bool, fetchBlock func(peer string, hash common.Hash) error) *BlockFetcher {
+	return &BlockFetcher{
+		hasBlock:   hasBlock,
+		fetchBlock: fetchBlock,
+		announces:  make(map[string]map[common.Hash]struct{}),
+		announced:  make(map[common.Hash]map[string]struct{}),
+		fetching:   make(map[common.Hash]*blockRequest),
+		timeout:    blockFetchTimeout,
+		quitCh:     make(chan struct{}),
+		log:        log.New("module", "blockfetcher"),
+	}
+}
+
+// Start begins the request expiry loop
+func (f *BlockFetcher) Start() {
+	go f.loop()
+}
+
+// Stop terminates the request expiry loop
+func (f *BlockFetcher) Stop() {
+	close(f.quitCh)
+}
+
+// loop periodically expires requests that peers failed to answer in time
+func (f *BlockFetcher) loop() {
+	ticker := time.NewTicker(blockTimeoutCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			f.expire(time.Now())
+		case <-f.quitCh:
+			return
+		}
+	}
+}
+
+// Notify records a block announcement from a peer and requests the block
+// unless we have it already or somebody else is delivering it.
+func (f *BlockFetcher) Notify(peer string, hash common.Hash) {
+	if f.hasBlock(hash) {
+		return
+	}
+	f.mu.Lock()
+	announces := f.announces[peer]
+	if announces == nil {
+		announces = make(map[common.Hash]struct{})
+		f.announces[peer] = announces
+	}
+	if _, ok := announces[hash]; ok || len(announces) >= maxBlockAnnounces {
+		f.mu.Unlock()
+		return
+	}
+	announces[hash] = struct{}{}
+	if f.announced[hash] == nil {
+		f.announced[hash] = make(map[string]struct{})
+	}
+	f.announced[hash][peer] = struct{}{}
+
+	var reqs map[common.Hash]string
+	if _, ok := f.fetching[hash]; !ok {
+		reqs = f.schedule(time.Now())
+	}
+	f.mu.Unlock()
+
+	f.send(reqs)
+}
+
+// Deliver marks a block as received, from whichever peer, so that it is
+// neither requested nor waited for any longer.
+func (f *BlockFetcher) Deliver(hash common.Hash) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.forget(hash)
+}
+
+// Drop removes all state held about a disconnected peer and asks other
+// announcers for the blocks it was supposed to deliver.
+func (f *BlockFetcher) Drop(peer string) {
+	f.mu.Lock()
+	for hash := range f.announces[peer] {
+		f.unannounce(peer, hash)
+		if req := f.fetching[hash]; req != nil && req.peer == peer {
+			delete(f.fetching, hash)
+		}
+	}
+	delete(f.announces, peer)
+	reqs := f.schedule(time.Now())
+	f.mu.Unlock()
+
+	f.send(reqs)
+}
+
+// expire abandons requests older than the fetch timeout. The slow peer is not
+// asked for the same block again; other announcers are tried instead.
+func (f *BlockFetcher) expire(now time.Time) {
+	f.mu.Lock()
+	var expired []string
+	for hash, req := range f.fetching {
+		if now.Sub(req.time) < f.timeout {
+			continue
+		}
+		// The block may have arrived some other way, e.g. through sync
+		if f.hasBlock(hash) {
+			f.forget(hash)
+			continue
+		}
+		delete(f.fetching, hash)
+		f.unannounce(req.peer, hash)
+		expired = append(expired, req.peer)
+		f.log.Debug("Block request timed out", "peer", req.peer, "hash", hash)
+	}
+	var reqs map[common.Hash]string
+	if len(expired) > 0 {
+		reqs = f.schedule(now)
+	}
+	f.mu.Unlock()
+
+	for _, peer := range expired {
+		f.score(peer, EventTimeout)
+	}
+	f.send(reqs)
+}
+
+// schedule picks an announcer for every announced block that nobody is
+// retrieving. It must be called with the lock held; the returned requests
+// are sent by the caller after releasing it.
+func (f *BlockFetcher) schedule(now time.Time) map[common.Hash]string {
+	reqs := make(map[common.Hash]string)
+	for hash, peers := range f.announced {
+		if _, ok := f.fetching[hash]; ok || len(peers) == 0 {
+			continue
+		}
+		if f.hasBlock(hash) {
+			f.forget(hash)
+			continue
+		}
+		candidates := make([]string, 0, len(peers))
+		for peer := range peers {
+			candidates = append(candidates, peer)
+		}
+		sort.Strings(candidates)
+
+		f.fetching[hash] = &blockRequest{peer: candidates[0], time: now}
+		reqs[hash] = candidates[0]
+	}
+	return reqs
+}
+
+// send dispatches scheduled requests without blocking the caller on slow
+// peers. A request that can't be sent is left to expire.
+func (f *BlockFetcher) send(reqs map[common.Hash]string) {
+	for hash, peer := range reqs {
+		go func(peer string, hash common.Hash) {
+			if err := f.fetchBlock(peer, hash); err != nil {
+				f.log.Debug("Failed to request block", "peer", peer, "hash", hash, "err", err)
+			}
+		}(peer, hash)
+	}
+}
+
+// score reports a peer event to the scorer, if there is one
+func (f *BlockFetcher) score(peer string, ev PeerEvent) {
+	if f.scorePeer != nil {
+		f.scorePeer(peer, ev)
+	}
+}
+
+// forget removes every trace of a block that has been delivered. It must be
+// called with the lock held.
+func (f *BlockFetcher) forget(hash common.Hash) {
+	for peer := range f.announced[hash] {
+		delete(f.announces[peer], hash)
+	}
+	delete(f.announced, hash)
+	delete(f.fetching, hash)
+}
+
+// unannounce removes a single peer's announcement of a hash. It must be
+// called with the lock held.
+func (f *BlockFetcher) unannounce(peer string, hash common.Hash) {
+	delete(f.announces[peer], hash)
+	if peers := f.announced[hash]; peers != nil {
+		delete(peers, peer)
+		if len(peers) == 0 {
+			delete(f.announced, hash)
+		}
+	}
+}
+
+// Stats returns the number of announced blocks and the number being retrieved
+func (f *BlockFetcher) Stats() (announced, fetching int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.announced), len(f.fetching)
+}
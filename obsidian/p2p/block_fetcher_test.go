@@ -0,0 +1,166 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package p2p
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/p2p"
+)
+
+// newRecordingBlockFetcher creates a block fetcher whose requests are
+// delivered on the returned channel instead of the network
+func newRecordingBlockFetcher(known map[common.Hash]bool) (*BlockFetcher, chan fetchCall) {
+	calls := make(chan fetchCall, 64)
+	f := NewBlockFetcher(
+		func(hash common.Hash) bool { return known[hash] },
+		func(peer string, hash common.Hash) error {
+			calls <- fetchCall{peer: peer, hashes: []common.Hash{hash}}
+			return nil
+		},
+	)
+	return f, calls
+}
+
+func TestBlockFetcherNoDuplicateRequests(t *testing.T) {
+	f, calls := newRecordingBlockFetcher(map[common.Hash]bool{{0xff}: true})
+
+	f.Notify("a", common.Hash{0xff})
+	expectNoFetch(t, calls)
+
+	f.Notify("a", common.Hash{0x01})
+	if call := expectFetch(t, calls); call.peer != "a" || call.hashes[0] != (common.Hash{0x01}) {
+		t.Fatalf("unexpected request: peer %s, hash %x", call.peer, call.hashes[0])
+	}
+	// Other announcers wait for the first request to fail
+	f.Notify("b", common.Hash{0x01})
+	f.Notify("a", common.Hash{0x01})
+	expectNoFetch(t, calls)
+
+	// A delivery from anybody settles the block
+	f.Deliver(common.Hash{0x01})
+	f.Drop("a")
+	f.expire(time.Now().Add(blockFetchTimeout))
+	expectNoFetch(t, calls)
+	if announced, fetching := f.Stats(); announced != 0 || fetching != 0 {
+		t.Fatalf("stale state: %d announced, %d fetching", announced, fetching)
+	}
+}
+
+func TestBlockFetcherTimeout(t *testing.T) {
+	f, calls := newRecordingBlockFetcher(nil)
+
+	var (
+		mu     sync.Mutex
+		scored = make(map[string]PeerEvent)
+	)
+	f.scorePeer = func(peer string, ev PeerEvent) error {
+		mu.Lock()
+		defer mu.Unlock()
+		scored[peer] = ev
+		return nil
+	}
+	hash := common.Hash{0x01}
+	f.Notify("a", hash)
+	expectFetch(t, calls)
+	f.Notify("b", hash)
+
+	f.expire(time.Now())
+	expectNoFetch(t, calls)
+
+	f.expire(time.Now().Add(blockFetchTimeout))
+	if call := expectFetch(t, calls); call.peer != "b" {
+		t.Fatalf("request sent to %s, want b", call.peer)
+	}
+	mu.Lock()
+	ev, ok := scored["a"]
+	mu.Unlock()
+	if !ok || ev != EventTimeout {
+		t.Fatalf("slow peer not penalised: %v", ev)
+	}
+
+	// A disconnecting announcer hands nothing on if nobody else has the block
+	f.Drop("b")
+	expectNoFetch(t, calls)
+	if announced, fetching := f.Stats(); announced != 0 || fetching != 0 {
+		t.Fatalf("stale state: %d announced, %d fetching", announced, fetching)
+	}
+}
+
+func TestHandlerBlockPropagation(t *testing.T) {
+	backend := newTestBackend()
+	h := NewHandler(1719, backend)
+	defer h.Stop()
+
+	const numPeers = 9
+	peers := make([]*testPeer, numPeers)
+	for i := range peers {
+		peers[i] = newTestPeer(t, h, backend)
+		waitFor(t, func() bool { return h.PeerCount() == i+1 })
+	}
+	block := makeTestChain(1)[0]
+	h.BroadcastBlock(block)
+
+	codes := make(chan uint64, numPeers)
+	for _, peer := range peers {
+		go func(peer *testPeer) {
+			msg, err := peer.rw.ReadMsg()
+			if err != nil {
+				codes <- 0
+				return
+			}
+			msg.Discard()
+			codes <- msg.Code
+		}(peer)
+	}
+	var full, announced int
+	for range peers {
+		select {
+		case code := <-codes:
+			switch code {
+			case NewBlockMsg:
+				full++
+			case NewBlockHashesMsg:
+				announced++
+			default:
+				t.Fatalf("unexpected message %d", code)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for block propagation")
+		}
+	}
+	if full != 3 || announced != numPeers-3 {
+		t.Fatalf("propagation mismatch: %d full, %d announced", full, announced)
+	}
+}
+
+func TestHandlerFetchesAnnouncedBlock(t *testing.T) {
+	chain := makeTestChain(6)
+	backend := newTestChainBackend(chain[:5])
+	backend.held = true
+	h := NewHandler(1719, backend)
+	defer h.Stop()
+
+	peer := newTestPeer(t, h, backend.testBackend)
+	block := chain[5]
+	if err := p2p.Send(peer.rw, NewBlockHashesMsg, NewBlockHashesPacket{{Hash: block.Hash(), Number: block.NumberU64()}}); err != nil {
+		t.Fatal(err)
+	}
+	var hash common.Hash
+	id, err := peer.decode(peer.expectMsg(t, GetBlockByHashMsg), &hash)
+	if err != nil || hash != block.Hash() {
+		t.Fatalf("unexpected block request: %x, %v", hash, err)
+	}
+	if err := peer.send(BlockMsg, id, &NewBlockPacket{Block: block, TD: block.Difficulty()}); err != nil {
+		t.Fatal(err)
+	}
+	waitForHead(t, backend, 6, 2*time.Second)
+
+	if announced, fetching := h.blockFetcher.Stats(); announced != 0 || fetching != 0 {
+		t.Fatalf("stale fetcher state: %d announced, %d fetching", announced, fetching)
+	}
+}
@@ -0,0 +1,358 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package p2p
+
+import (
+	"fmt"
+	mrand "math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/rlp"
+	obstypes "github.com/obsidian-chain/obsidian/core/types"
+)
+
+// stemRelays is the number of peers a node forwards stem transactions to
+// during an epoch. Each source of stem transactions is routed to one of them.
+const stemRelays = 2
+
+// DandelionConfig configures the Dandelion++ transaction relay. Instead of
+// being broadcast right away, transactions first travel along a random path
+// of single hops, the stem, and are only broadcast, fluffed, from wherever
+// the path ends. Observers of the broadcast can't tell who sent them.
+type DandelionConfig struct {
+	// Epoch is how long a node keeps its stem relays and routes
+	Epoch time.Duration
+
+	// FluffProbability is the chance a node fluffs every stem transaction it
+	// receives during an epoch, rather than relaying them along the stem. It
+	// sets the expected length of the stem. Local transactions always start
+	// on the stem.
+	FluffProbability float64
+
+	// Embargo is the minimum time a node waits for a transaction it stemmed
+	// to be fluffed by others before fluffing it itself. A random delay is
+	// added on top so that the nodes of a stem don't all time out together.
+	Embargo time.Duration
+}
+
+// DefaultDandelionConfig are the Dandelion++ settings suggested by the paper,
+// giving stems of ten hops on average
+var DefaultDandelionConfig = DandelionConfig{
+	Epoch:            10 * time.Minute,
+	FluffProbability: 0.1,
+	Embargo:          30 * time.Second,
+}
+
+// dandelion keeps the stem routes of the current epoch and the transactions
+// that were stemmed but not fluffed yet
+type dandelion struct {
+	config DandelionConfig
+	rand   *mrand.Rand
+
+	mu        sync.Mutex
+	epochEnd  time.Time
+	fluff     bool                      // Whether stem transactions are fluffed this epoch
+	relays    []string                  // Stem relays of the epoch
+	routes    map[string]string         // Relay of each source, "" being ourselves
+	embargoes map[common.Hash]time.Time // Stemmed transactions and when to fluff them
+}
+
+// newDandelion creates the relay state of a node
+func newDandelion(config DandelionConfig) *dandelion {
+	return &dandelion{
+		config:    config,
+		rand:      mrand.New(mrand.NewSource(time.Now().UnixNano())),
+		routes:    make(map[string]string),
+		embargoes: make(map[common.Hash]time.Time),
+	}
+}
+
+// route returns the peer to forward stem transactions from source to, or ""
+// if they should be fluffed. Local transactions have an empty source. peers
+// are the connected peers able to relay stem transactions.
+func (d *dandelion) route(source string, peers []string, now time.Time) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if now.After(d.epochEnd) || !d.relaysConnected(peers) {
+		d.newEpoch(peers, now)
+	}
+	if source != "" && d.fluff {
+		return ""
+	}
+	if relay, ok := d.routes[source]; ok {
+		return relay
+	}
+	// Never send transactions back where they came from
+	var candidates []string
+	for _, relay := range d.relays {
+		if relay != source {
+			candidates = append(candidates, relay)
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	relay := candidates[d.rand.Intn(len(candidates))]
+	d.routes[source] = relay
+	return relay
+}
+
+// relaysConnected reports whether the relays of the epoch are all still
+// connected. An epoch without relays is only kept while there are no peers.
+func (d *dandelion) relaysConnected(peers []string) bool {
+	if len(d.relays) == 0 {
+		return len(peers) == 0
+	}
+	connected := make(map[string]bool, len(peers))
+	for _, id := range peers {
+		connected[id] = true
+	}
+	for _, relay := range d.relays {
+		if !connected[relay] {
+			return false
+		}
+	}
+	return true
+}
+
+// newEpoch picks new stem relays among peers and decides whether the node
+// fluffs during the epoch. It must be called with the lock held.
+func (d *dandelion) newEpoch(peers []string, now time.Time) {
+	d.relays = d.relays[:0]
+	for _, i := range d.rand.Perm(len(peers)) {
+		if len(d.relays) == stemRelays {
+			break
+		}
+		d.relays = append(d.relays, peers[i])
+	}
+	d.fluff = d.rand.Float64() < d.config.FluffProbability
+	d.routes = make(map[string]string)
+	d.epochEnd = now.Add(d.config.Epoch)
+
+	log.Debug("New Dandelion epoch", "relays", len(d.relays), "fluff", d.fluff, "until", d.epochEnd)
+}
+
+// embargo records transactions as stemmed, to be fluffed once their embargo
+// runs out unless they are seen fluffed before
+func (d *dandelion) embargo(txs []*obstypes.StealthTransaction, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, tx := range txs {
+		jitter := time.Duration(d.rand.ExpFloat64() * float64(d.config.Embargo) / 4)
+		d.embargoes[tx.Hash()] = now.Add(d.config.Embargo + jitter)
+	}
+}
+
+// stemmed reports whether a transaction is stemmed and not yet public
+func (d *dandelion) stemmed(hash common.Hash) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, ok := d.embargoes[hash]
+	return ok
+}
+
+// release lifts the embargo of the given transactions and returns the ones
+// that were stemmed
+func (d *dandelion) release(hashes []common.Hash) []common.Hash {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var released []common.Hash
+	for _, hash := range hashes {
+		if _, ok := d.embargoes[hash]; ok {
+			delete(d.embargoes, hash)
+			released = append(released, hash)
+		}
+	}
+	return released
+}
+
+// expired lifts the embargoes that ran out and returns their transactions
+func (d *dandelion) expired(now time.Time) []common.Hash {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var expired []common.Hash
+	for hash, deadline := range d.embargoes {
+		if now.After(deadline) {
+			delete(d.embargoes, hash)
+			expired = append(expired, hash)
+		}
+	}
+	return expired
+}
+
+// EnableDandelion switches the node to Dandelion++ relay: transactions
+// submitted locally or received over a stem are forwarded to a single peer
+// until a node on the path decides to broadcast them. It must be called
+// before the handler is started.
+func (h *Handler) EnableDandelion(config DandelionConfig) error {
+	if config.Epoch <= 0 || config.Embargo <= 0 {
+		return fmt.Errorf("invalid Dandelion epoch %v or embargo %v", config.Epoch, config.Embargo)
+	}
+	if config.FluffProbability < 0 || config.FluffProbability > 1 {
+		return fmt.Errorf("invalid Dandelion fluff probability %v", config.FluffProbability)
+	}
+	h.dandelion = newDandelion(config)
+	go h.embargoLoop(config.Embargo / 4)
+	return nil
+}
+
+// embargoLoop fluffs the stemmed transactions whose embargo ran out, which
+// means the stem was broken somewhere down the path
+func (h *Handler) embargoLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if hashes := h.dandelion.expired(now); len(hashes) > 0 {
+				log.Debug("Embargo expired, fluffing transactions", "count", len(hashes))
+				h.fluffTxs(hashes)
+			}
+		case <-h.quitCh:
+			return
+		}
+	}
+}
+
+// SendLocalTxs relays transactions submitted to this node. With Dandelion
+// they start on the stem, otherwise they are broadcast.
+func (h *Handler) SendLocalTxs(txs []*obstypes.StealthTransaction) {
+	if h.dandelion == nil {
+		h.BroadcastTxs(txs)
+		return
+	}
+	h.stemTxs("", txs)
+}
+
+// stemTxs forwards transactions from source to its stem relay, or fluffs
+// them if they have reached the end of the stem
+func (h *Handler) stemTxs(source string, txs []*obstypes.StealthTransaction) {
+	if len(txs) == 0 {
+		return
+	}
+	relay := h.dandelion.route(source, h.stemPeers(), time.Now())
+
+	h.peersMu.RLock()
+	p := h.peers[relay]
+	h.peersMu.RUnlock()
+
+	if p == nil {
+		h.BroadcastTxs(txs)
+		return
+	}
+	h.dandelion.embargo(txs, time.Now())
+	for _, tx := range txs {
+		p.knownTxs.Add(tx.Hash())
+	}
+	select {
+	case p.queuedStemTxs <- txs:
+	default:
+		// The embargo will fluff them
+		log.Debug("Dropping stem transactions", "peer", p.id[:16], "count", len(txs))
+	}
+}
+
+// stemPeers returns the IDs of the peers that understand stem transactions
+func (h *Handler) stemPeers() []string {
+	h.peersMu.RLock()
+	defer h.peersMu.RUnlock()
+
+	ids := make([]string, 0, len(h.peers))
+	for id, p := range h.peers {
+		if p.version >= OBS3 {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// fluffTxs broadcasts stemmed transactions that are still pooled. The ones
+// that are gone have been included or dropped already.
+func (h *Handler) fluffTxs(hashes []common.Hash) {
+	txs := make([]*obstypes.StealthTransaction, 0, len(hashes))
+	for _, hash := range hashes {
+		if tx := h.backend.GetPoolTransaction(hash); tx != nil {
+			txs = append(txs, tx)
+		}
+	}
+	h.BroadcastTxs(txs)
+}
+
+// seenFluffed lifts the embargo of stemmed transactions that a peer sent or
+// announced normally. They are public now, so we broadcast them as well.
+func (h *Handler) seenFluffed(hashes []common.Hash) {
+	if h.dandelion == nil {
+		return
+	}
+	if released := h.dandelion.release(hashes); len(released) > 0 {
+		h.fluffTxs(released)
+	}
+}
+
+// sendStemTxs forwards transactions to a peer along the stem
+func (h *Handler) sendStemTxs(p *Peer, txs []*obstypes.StealthTransaction) error {
+	atomic.AddUint64(&h.txsSent, uint64(len(txs)))
+	packet, err := p.encodeTxs(txs)
+	if err != nil {
+		return err
+	}
+	return p2p.Send(p.rw, StemTxMsg, packet)
+}
+
+// handleStemTransactions handles transactions relayed to us along a stem.
+// They are validated and pooled, but not announced to anyone, and then
+// either passed on to our relay for the peer or fluffed. Nodes that don't
+// run Dandelion treat them as ordinary transactions and fluff them.
+func (h *Handler) handleStemTransactions(p *Peer, msg p2p.Msg) error {
+	var raw rlp.RawValue
+	if err := msg.Decode(&raw); err != nil {
+		return fmt.Errorf("decode error: %v", err)
+	}
+	txs, err := p.decodeTxs(raw)
+	if err != nil {
+		return err
+	}
+	for _, tx := range txs {
+		p.knownTxs.Add(tx.Hash())
+	}
+	atomic.AddUint64(&h.txsReceived, uint64(len(txs)))
+
+	if h.dandelion == nil {
+		return h.txFetcher.Enqueue(p.id, 0, txs, false)
+	}
+	// Transactions we already know came around a loop in the stem, which
+	// ends there. Their embargoes will fluff them if nobody else does.
+	fresh := make([]*obstypes.StealthTransaction, 0, len(txs))
+	for _, tx := range txs {
+		if !h.hasPoolTx(tx.Hash()) {
+			fresh = append(fresh, tx)
+		}
+	}
+	accepted := make([]*obstypes.StealthTransaction, 0, len(fresh))
+	for i, err := range h.backend.AddRemoteTxs(fresh) {
+		if err != nil {
+			log.Debug("Failed to add stem transaction", "hash", fresh[i].Hash().Hex()[:16], "err", err)
+			if invalidTx(err) {
+				if err := h.scorePeer(p.id, EventInvalidTx); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		accepted = append(accepted, fresh[i])
+	}
+	h.stemTxs(p.id, accepted)
+	return nil
+}
@@ -0,0 +1,206 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/p2p"
+	obstypes "github.com/obsidian-chain/obsidian/core/types"
+)
+
+var testDandelionConfig = DandelionConfig{
+	Epoch:            time.Minute,
+	FluffProbability: 0,
+	Embargo:          time.Minute,
+}
+
+func TestDandelionRoutes(t *testing.T) {
+	d := newDandelion(testDandelionConfig)
+	peers := []string{"a", "b", "c", "d"}
+	now := time.Now()
+
+	// Every source sticks to a single relay, which is never the source
+	local := d.route("", peers, now)
+	if local == "" {
+		t.Fatal("local transactions fluffed")
+	}
+	relays := make(map[string]bool)
+	for _, source := range peers {
+		relay := d.route(source, peers, now)
+		if relay == "" || relay == source {
+			t.Fatalf("source %s routed to %q", source, relay)
+		}
+		if again := d.route(source, peers, now); again != relay {
+			t.Fatalf("source %s switched relay from %s to %s", source, relay, again)
+		}
+		relays[relay] = true
+	}
+	if d.route("", peers, now) != local {
+		t.Fatal("local relay changed within the epoch")
+	}
+	if len(relays) > stemRelays {
+		t.Fatalf("%d relays used in an epoch, want at most %d", len(relays), stemRelays)
+	}
+
+	// Losing a relay starts a new epoch without it
+	var remaining []string
+	for _, id := range peers {
+		if id != local {
+			remaining = append(remaining, id)
+		}
+	}
+	if relay := d.route("", remaining, now); relay == local || relay == "" {
+		t.Fatalf("routed to %q after the relay disconnected", relay)
+	}
+
+	// A lone peer can't relay its own transactions back
+	if relay := d.route("a", []string{"a"}, now.Add(time.Hour)); relay != "" {
+		t.Fatalf("transaction sent back to its source %s", relay)
+	}
+}
+
+func TestDandelionFluffEpoch(t *testing.T) {
+	config := testDandelionConfig
+	config.FluffProbability = 1
+	d := newDandelion(config)
+	peers := []string{"a", "b", "c"}
+
+	if relay := d.route("a", peers, time.Now()); relay != "" {
+		t.Fatalf("stem transaction relayed to %s in a fluff epoch", relay)
+	}
+	if relay := d.route("", peers, time.Now()); relay == "" {
+		t.Fatal("local transaction fluffed right away")
+	}
+}
+
+func TestDandelionEmbargo(t *testing.T) {
+	d := newDandelion(testDandelionConfig)
+	a, b := newTestTx(0), newTestTx(1)
+	now := time.Now()
+	d.embargo([]*obstypes.StealthTransaction{a, b}, now)
+
+	if !d.stemmed(a.Hash()) || !d.stemmed(b.Hash()) {
+		t.Fatal("embargoed transactions not stemmed")
+	}
+	if expired := d.expired(now.Add(testDandelionConfig.Embargo / 2)); len(expired) != 0 {
+		t.Fatalf("%d embargoes expired early", len(expired))
+	}
+	if released := d.release([]common.Hash{a.Hash(), {0x01}}); len(released) != 1 || released[0] != a.Hash() {
+		t.Fatalf("released %v, want only the stemmed transaction", released)
+	}
+	if d.stemmed(a.Hash()) {
+		t.Fatal("released transaction still stemmed")
+	}
+	if expired := d.expired(now.Add(time.Hour)); len(expired) != 1 || expired[0] != b.Hash() {
+		t.Fatalf("expired %v, want the remaining transaction", expired)
+	}
+}
+
+// sendStemTx relays a transaction to the handler along a stem
+func sendStemTx(t *testing.T, peer *testPeer, tx *obstypes.StealthTransaction) {
+	t.Helper()
+
+	env, err := tx.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p2p.Send(peer.rw, StemTxMsg, TxEnvelopes{env}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandlerRelaysStem(t *testing.T) {
+	backend := newTestBackend()
+	h := NewHandler(1719, backend)
+	defer h.Stop()
+	if err := h.EnableDandelion(testDandelionConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	peers := make(map[string]*testPeer)
+	for i := 0; i < 3; i++ {
+		peer := newTestPeer(t, h, backend)
+		peers[peer.id.String()] = peer
+		waitFor(t, func() bool { return h.PeerCount() == i+1 })
+	}
+	var source *testPeer
+	for _, peer := range peers {
+		source = peer
+		break
+	}
+	tx := newTestTx(0)
+	sendStemTx(t, source, tx)
+	waitFor(t, func() bool { return h.dandelion.stemmed(tx.Hash()) })
+
+	// The transaction moves on to the source's relay and nowhere else
+	h.dandelion.mu.Lock()
+	relay := peers[h.dandelion.routes[source.id.String()]]
+	h.dandelion.mu.Unlock()
+	if relay == nil || relay == source {
+		t.Fatal("stem transaction not routed to another peer")
+	}
+	relay.expectMsg(t, StemTxMsg).Discard()
+
+	var other *testPeer
+	for _, peer := range peers {
+		if peer != source && peer != relay {
+			other = peer
+		}
+	}
+	if err := other.send(GetPooledTxMsg, 1, GetPooledTxPacket{tx.Hash()}); err != nil {
+		t.Fatal(err)
+	}
+	var envs TxEnvelopes
+	if _, err := other.decode(other.expectMsg(t, PooledTransactionsMsg), &envs); err != nil {
+		t.Fatal(err)
+	}
+	if len(envs) != 0 {
+		t.Fatal("stemmed transaction served before being fluffed")
+	}
+
+	// Once the relay announces it, the transaction is public and fluffed
+	ann := NewPooledTxHashesPacket{Types: []byte{tx.Type()}, Sizes: []uint32{uint32(tx.Size())}, Hashes: []common.Hash{tx.Hash()}}
+	if err := p2p.Send(relay.rw, NewPooledTxHashesMsg, &ann); err != nil {
+		t.Fatal(err)
+	}
+	other.expectMsg(t, TransactionsMsg).Discard()
+	if h.dandelion.stemmed(tx.Hash()) {
+		t.Fatal("fluffed transaction still stemmed")
+	}
+}
+
+// Only obs/3 peers understand stem transactions
+func TestStemPeersVersion(t *testing.T) {
+	backend := newTestBackend()
+	h := NewHandler(1719, backend)
+	defer h.Stop()
+
+	newTestPeerVersion(t, h, backend, OBS2)
+	peer := newTestPeer(t, h, backend)
+	waitFor(t, func() bool { return h.PeerCount() == 2 })
+
+	if ids := h.stemPeers(); len(ids) != 1 || ids[0] != peer.id.String() {
+		t.Fatalf("stem peers %v, want only %s", ids, peer.id)
+	}
+}
+
+func TestHandlerFluffsStemWithoutDandelion(t *testing.T) {
+	backend := newTestBackend()
+	h := NewHandler(1719, backend)
+	defer h.Stop()
+
+	source := newTestPeer(t, h, backend)
+	other := newTestPeer(t, h, backend)
+	waitFor(t, func() bool { return h.PeerCount() == 2 })
+
+	tx := newTestTx(0)
+	sendStemTx(t, source, tx)
+	other.expectMsg(t, TransactionsMsg).Discard()
+	if backend.GetPoolTransaction(tx.Hash()) == nil {
+		t.Fatal("stem transaction not pooled")
+	}
+}
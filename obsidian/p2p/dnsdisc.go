@@ -0,0 +1,32 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package p2p
+
+import (
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/dnsdisc"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+// EnableDNSDiscovery makes the handler offer the nodes of EIP-1459 DNS trees
+// to the P2P server as dial candidates. Only nodes whose ENR advertises a
+// compatible obs fork ID are dialed. A nil resolver uses the system DNS.
+//
+// It must be called before the handler's protocols are registered with the
+// server.
+func (h *Handler) EnableDNSDiscovery(urls []string, resolver dnsdisc.Resolver) error {
+	if len(urls) == 0 {
+		return nil
+	}
+	client := dnsdisc.NewClient(dnsdisc.Config{
+		Resolver: resolver,
+		Logger:   log.New("module", "dnsdisc"),
+	})
+	iter, err := client.NewIterator(urls...)
+	if err != nil {
+		return err
+	}
+	h.dialCandidates = enode.Filter(iter, h.NodeFilter())
+	return nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/dnsdisc"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/obsidian-chain/obsidian/core/forkid"
+)
+
+// mapResolver is an in-memory DNS resolver serving the TXT records of a tree
+type mapResolver map[string]string
+
+func (r mapResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if record, ok := r[name]; ok {
+		return []string{record}, nil
+	}
+	return nil, fmt.Errorf("no TXT record for %s", name)
+}
+
+func newTestNode(t *testing.T, entries ...enr.Entry) *enode.Node {
+	t.Helper()
+
+	key, _ := crypto.GenerateKey()
+	var r enr.Record
+	for _, entry := range entries {
+		r.Set(entry)
+	}
+	if err := enode.SignV4(&r, key); err != nil {
+		t.Fatal(err)
+	}
+	n, err := enode.New(enode.ValidSchemes, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestDNSDiscovery(t *testing.T) {
+	backend := newTestBackend()
+	h := NewHandler(1719, backend)
+	defer h.Stop()
+
+	// The tree lists obs nodes, a node of another chain and a non-obs node
+	want := make(map[enode.ID]bool)
+	var nodes []*enode.Node
+	for i := 0; i < 4; i++ {
+		n := newTestNode(t, &enrEntry{ForkID: h.forkID()})
+		want[n.ID()] = true
+		nodes = append(nodes, n)
+	}
+	other := &enrEntry{ForkID: forkid.ID{Hash: [4]byte{0xde, 0xad, 0xbe, 0xef}}}
+	nodes = append(nodes, newTestNode(t, other), newTestNode(t))
+
+	tree, err := dnsdisc.MakeTree(1, nodes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := crypto.GenerateKey()
+	url, err := tree.Sign(key, "nodes.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := mapResolver(tree.ToTXT("nodes.example.org"))
+
+	if err := h.EnableDNSDiscovery([]string{url}, resolver); err != nil {
+		t.Fatalf("failed to enable DNS discovery: %v", err)
+	}
+	iter := h.Protocols()[0].DialCandidates
+	if iter == nil {
+		t.Fatal("protocol offers no dial candidates")
+	}
+	defer iter.Close()
+
+	found := make(chan enode.ID, len(nodes))
+	go func() {
+		for iter.Next() {
+			found <- iter.Node().ID()
+		}
+		close(found)
+	}()
+	seen := make(map[enode.ID]bool)
+	for len(seen) < len(want) {
+		select {
+		case id := <-found:
+			if !want[id] {
+				t.Fatalf("incompatible node %v offered for dialing", id)
+			}
+			seen[id] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("found %d of %d nodes", len(seen), len(want))
+		}
+	}
+}
+
+func TestDNSDiscoveryInvalidURL(t *testing.T) {
+	backend := newTestBackend()
+	h := NewHandler(1719, backend)
+	defer h.Stop()
+
+	if err := h.EnableDNSDiscovery([]string{"enrtree://bad@nodes.example.org"}, mapResolver{}); err == nil {
+		t.Fatal("invalid tree URL was accepted")
+	}
+	if h.Protocols()[0].DialCandidates != nil {
+		t.Fatal("dial candidates set after failure")
+	}
+}
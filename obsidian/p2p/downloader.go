@@ -7,23 +7,29 @@ import (
 	"errors"
 	"fmt"
 	"math/big"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/eth/ethconfig"
 	"github.com/ethereum/go-ethereum/log"
-	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/obsidian-chain/obsidian/core"
 	obstypes "github.com/obsidian-chain/obsidian/core/types"
 )
 
 // Sync configuration
 const (
-	maxBlockFetch     = 128 // Maximum blocks to request at once
-	maxHeaderFetch    = 192 // Maximum headers to fetch per request
+	maxBlockFetch     = 128  // Maximum block bodies to request from a peer at once
+	maxReceiptFetch   = 256  // Maximum block receipts to request from a peer at once
+	maxHeaderFetch    = 192  // Number of headers in a skeleton segment
+	maxSkeletonSize   = 128  // Maximum skeleton headers to request in one round
+	maxResultsCache   = 2048 // Maximum blocks downloaded ahead of the import point
+	maxSegmentRetries = 3    // Failed fills of a segment before its skeleton is blamed
 	syncCheckInterval = 10 * time.Second
 	requestTimeout    = 15 * time.Second
-	maxSyncRetries    = 3
+	timeoutCheckTick  = 100 * time.Millisecond
 )
 
 var (
@@ -32,6 +38,12 @@ var (
 	ErrBadPeer        = errors.New("bad peer")
 	ErrAlreadySyncing = errors.New("already syncing")
 	ErrNoSyncPeer     = errors.New("no peer available for sync")
+
+	errBadSkeleton    = errors.New("skeleton could not be filled")
+	errInvalidChain   = errors.New("retrieved headers do not form a chain")
+	errNoAncestor     = errors.New("no common ancestor")
+	errStalledPeers   = errors.New("no peer can serve the remaining data")
+	errEmptyHeaderSet = errors.New("empty header set")
 )
 
 // SyncProgress represents current sync progress
@@ -42,7 +54,14 @@ type SyncProgress struct {
 	Syncing       bool
 }
 
-// Downloader manages blockchain synchronization
+// Downloader synchronises the chain headers-first. The best peer provides a
+// skeleton of every maxHeaderFetch-th header, the gaps in between are filled
+// by all available peers in parallel, and the block bodies are then spread
+// over the peers according to their measured throughput. Blocks are imported
+// in order as soon as a contiguous run of them has been verified. In snap
+// mode a fresh node stores the blocks up to a pivot near the head without
+// executing them along with their receipts, downloads the pivot state from
+// the snap peers and then carries on with full sync.
 type Downloader struct {
 	backend Backend
 	handler *Handler
@@ -52,49 +71,117 @@ type Downloader struct {
 	syncProgress SyncProgress
 	syncMu       sync.RWMutex
 
-	// Request tracking
-	pendingRequests map[uint64]*syncRequest
-
 	// Channels for received data
-	headerCh chan headerResponse
-	bodyCh   chan bodyResponse
-	blockCh  chan blockResponse
+	headerCh  chan headerResponse
+	bodyCh    chan bodyResponse
+	receiptCh chan receiptResponse
+	blockCh   chan blockResponse
 
 	// Control
-	cancelCh chan struct{}
+	cancelCh   chan struct{}
+	cancelOnce sync.Once
 
 	log log.Logger
 }
 
-type syncRequest struct {
-}
-
 type headerResponse struct {
 	peer    *Peer
+	id      uint64
 	headers []*obstypes.ObsidianHeader
 }
 
 type bodyResponse struct {
 	peer   *Peer
+	id     uint64
 	bodies []BlockBody
 }
 
+type receiptResponse struct {
+	peer     *Peer
+	id       uint64
+	receipts []obstypes.Receipts
+}
+
 type blockResponse struct {
 	peer  *Peer
 	block *obstypes.ObsidianBlock
 	td    *big.Int
 }
 
+// fetchRequest is a retrieval in flight with one peer
+type fetchRequest struct {
+	peer     *Peer
+	id       uint64
+	tasks    []int // Segment or block indices the request covers
+	sent     time.Time
+	deadline time.Time
+}
+
+// answeredBy reports whether a response from a peer is the reply to the
+// request. obs/1 responses carry no request ID, so they are attributed to
+// whatever the peer was last asked.
+func (r *fetchRequest) answeredBy(peer *Peer, id uint64) bool {
+	return r != nil && r.peer.id == peer.id && (peer.version < OBS2 || r.id == id)
+}
+
+// fetchQueue holds the task indices waiting to be retrieved, along with the
+// peers that already failed each of them
+type fetchQueue struct {
+	pending []int
+	failed  map[int]map[string]struct{}
+}
+
+func newFetchQueue(tasks []int) *fetchQueue {
+	return &fetchQueue{
+		pending: tasks,
+		failed:  make(map[int]map[string]struct{}),
+	}
+}
+
+// reserve takes up to max of the lowest tasks below limit that peer hasn't
+// failed before
+func (q *fetchQueue) reserve(peer string, max int, limit int) []int {
+	var (
+		taken []int
+		kept  = q.pending[:0]
+	)
+	for _, task := range q.pending {
+		_, failed := q.failed[task][peer]
+		if len(taken) < max && task < limit && !failed {
+			taken = append(taken, task)
+			continue
+		}
+		kept = append(kept, task)
+	}
+	q.pending = kept
+	return taken
+}
+
+// requeue puts tasks back, optionally recording that peer failed them
+func (q *fetchQueue) requeue(tasks []int, peer string, failed bool) {
+	for _, task := range tasks {
+		if failed {
+			if q.failed[task] == nil {
+				q.failed[task] = make(map[string]struct{})
+			}
+			q.failed[task][peer] = struct{}{}
+		}
+		q.pending = append(q.pending, task)
+	}
+	sort.Ints(q.pending)
+}
+
 // NewDownloader creates a new synchronization manager
 func NewDownloader(backend Backend, handler *Handler) *Downloader {
 	d := &Downloader{
-		backend:         backend,
-		handler:         handler,
-		pendingRequests: make(map[uint64]*syncRequest),
-		headerCh:        make(chan headerResponse, 16),
-		bodyCh:          make(chan bodyResponse, 16),
-		blockCh:         make(chan blockResponse, 64),
-		log:             log.New("module", "downloader"),
+		backend:   backend,
+		handler:   handler,
+		headerCh:  make(chan headerResponse, 64),
+		bodyCh:    make(chan bodyResponse, 64),
+		receiptCh: make(chan receiptResponse, 64),
+		blockCh:   make(chan blockResponse, 64),
+		cancelCh:  make(chan struct{}),
+		log:       log.New("module", "downloader"),
 	}
 	return d
 }
@@ -104,11 +191,9 @@ func (d *Downloader) Start() {
 	go d.syncLoop()
 }
 
-// Stop stops the downloader
+// Stop stops the downloader, aborting any sync in progress
 func (d *Downloader) Stop() {
-	if d.cancelCh != nil {
-		close(d.cancelCh)
-	}
+	d.cancelOnce.Do(func() { close(d.cancelCh) })
 }
 
 // syncLoop periodically checks if we need to sync
@@ -150,12 +235,16 @@ func (d *Downloader) CheckAndSync() {
 	peerNum := bestPeer.number
 	bestPeer.lock.RUnlock()
 
-	if peerTD.Cmp(ourTD) <= 0 {
+	if peerTD == nil || peerTD.Cmp(ourTD) <= 0 {
 		return
 	}
 
 	// Start sync
-	go func() { _ = d.synchronise(bestPeer, peerNum) }()
+	go func() {
+		if err := d.synchronise(bestPeer, peerNum); err != nil && !errors.Is(err, ErrAlreadySyncing) {
+			d.log.Warn("Synchronisation failed", "peer", bestPeer.id[:16], "err", err)
+		}
+	}()
 }
 
 // findBestPeer finds the peer with the highest TD
@@ -186,8 +275,8 @@ func (d *Downloader) findBestPeer() *Peer {
 	return best
 }
 
-// synchronise syncs with a peer
-func (d *Downloader) synchronise(peer *Peer, targetNum uint64) error {
+// synchronise syncs the chain up to the head announced by the master peer
+func (d *Downloader) synchronise(master *Peer, targetNum uint64) error {
 	if !atomic.CompareAndSwapInt32(&d.syncing, 0, 1) {
 		return ErrAlreadySyncing
 	}
@@ -215,218 +304,604 @@ func (d *Downloader) synchronise(peer *Peer, targetNum uint64) error {
 		d.syncMu.Unlock()
 	}()
 
+	ancestor, err := d.findAncestor(master, ourNum)
+	if err != nil {
+		return err
+	}
 	d.log.Info("Starting block synchronization",
-		"peer", peer.id[:16],
-		"from", ourNum+1,
+		"peer", master.id[:16],
+		"ancestor", ancestor.Number,
 		"to", targetNum,
 	)
 
-	startTime := time.Now()
-	blocksDownloaded := uint64(0)
-
-	// Download blocks in batches
-	for num := ourNum + 1; num <= targetNum; {
-		// Calculate batch size
-		batchSize := uint64(maxBlockFetch)
-		if num+batchSize-1 > targetNum {
-			batchSize = targetNum - num + 1
+	// A fresh node far enough behind downloads the state of a recent pivot
+	// block instead of executing the whole chain
+	var pivot uint64
+	if d.backend.SyncMode() == ethconfig.SnapSync && ourNum == 0 && targetNum > snapPivotDistance && len(d.handler.snapPeerList()) > 0 {
+		pivot = targetNum - snapPivotDistance
+		d.log.Info("Snap syncing to pivot", "pivot", pivot)
+	}
+	var (
+		startTime = time.Now()
+		parent    = ancestor
+		imported  uint64
+	)
+	for parent.Number.Uint64() < targetNum {
+		from := parent.Number.Uint64() + 1
+		limit := targetNum
+		if pivot > 0 {
+			limit = pivot
 		}
 
-		// Request blocks
-		blocks, err := d.fetchBlockRange(peer, num, batchSize)
-		if err != nil {
-			d.log.Error("Failed to fetch blocks", "from", num, "err", err)
+		var headers []*obstypes.ObsidianHeader
+		if limit-from+1 >= maxHeaderFetch {
+			// Far from the head: have the master sketch the chain and let
+			// everyone fill in the details
+			count := (limit - from + 1) / maxHeaderFetch
+			if count > maxSkeletonSize {
+				count = maxSkeletonSize
+			}
+			skeleton, err := d.requestHeaders(master, from+maxHeaderFetch-1, count, maxHeaderFetch-1)
+			if err != nil {
+				return err
+			}
+			if err := checkSkeleton(skeleton, from); err != nil {
+				d.scorePeer(master, EventInvalidResponse)
+				return err
+			}
+			headers, err = d.fillSkeleton(master, parent, skeleton)
+			if err != nil {
+				return err
+			}
+		} else {
+			// Close to the head: fetch the remainder straight from the master
+			headers, err = d.requestHeaders(master, from, limit-from+1, 0)
+			if err != nil {
+				return err
+			}
+			if err := checkSegment(headers, parent, nil); err != nil {
+				d.scorePeer(master, EventInvalidResponse)
+				return err
+			}
+		}
+		if err := d.fetchBodies(master, headers, pivot); err != nil {
 			return err
 		}
-
-		if len(blocks) == 0 {
-			d.log.Warn("No blocks received", "from", num)
-			return fmt.Errorf("no blocks received from peer")
+		if pivot > 0 {
+			// Receipts of blocks that aren't executed come from the network
+			if err := d.fetchReceipts(headers); err != nil {
+				return err
+			}
 		}
+		imported += uint64(len(headers))
+		parent = headers[len(headers)-1]
 
-		// Insert blocks
-		for _, block := range blocks {
-			if err := d.backend.InsertBlock(block); err != nil {
-				d.log.Error("Failed to insert block",
-					"number", block.NumberU64(),
-					"hash", block.Hash().Hex()[:16],
-					"err", err,
-				)
+		if pivot > 0 && parent.Number.Uint64() == pivot {
+			if err := d.handler.stateSync.Sync(parent.Root, d.cancelCh); err != nil {
 				return err
 			}
-			blocksDownloaded++
-
-			d.syncMu.Lock()
-			d.syncProgress.CurrentBlock = block.NumberU64()
-			d.syncMu.Unlock()
+			if err := d.backend.SnapSyncCommitHead(parent.Hash()); err != nil {
+				return err
+			}
+			pivot = 0
 		}
 
-		num += uint64(len(blocks))
-
-		// Log progress
-		if blocksDownloaded%100 == 0 || num > targetNum {
-			progress := float64(num-ourNum-1) / float64(targetNum-ourNum) * 100
-			d.log.Info("Sync progress",
-				"current", num-1,
-				"target", targetNum,
-				"progress", fmt.Sprintf("%.2f%%", progress),
-			)
-		}
+		d.log.Info("Sync progress",
+			"current", parent.Number,
+			"target", targetNum,
+			"progress", fmt.Sprintf("%.2f%%", float64(parent.Number.Uint64()-ourNum)/float64(targetNum-ourNum)*100),
+		)
 	}
 
 	duration := time.Since(startTime)
-	blocksPerSec := float64(blocksDownloaded) / duration.Seconds()
-
 	d.log.Info("Synchronization completed",
-		"blocks", blocksDownloaded,
+		"blocks", imported,
 		"duration", duration,
-		"blocks/sec", fmt.Sprintf("%.2f", blocksPerSec),
+		"blocks/sec", fmt.Sprintf("%.2f", float64(imported)/duration.Seconds()),
 	)
-
 	return nil
 }
 
-// fetchBlockRange fetches a range of blocks from a peer
-func (d *Downloader) fetchBlockRange(peer *Peer, from uint64, count uint64) ([]*obstypes.ObsidianBlock, error) {
-	blocks := make([]*obstypes.ObsidianBlock, 0, count)
+// findAncestor returns the header of the newest block we share with the
+// master peer, starting from our head and bisecting towards genesis if the
+// peer is on a different branch.
+func (d *Downloader) findAncestor(master *Peer, ourNum uint64) (*obstypes.ObsidianHeader, error) {
+	known := func(number uint64) (*obstypes.ObsidianHeader, error) {
+		headers, err := d.requestHeaders(master, number, 1, 0)
+		if err != nil {
+			return nil, err
+		}
+		if len(headers) != 1 || headers[0].Number == nil || headers[0].Number.Uint64() != number {
+			return nil, nil
+		}
+		if block := d.backend.GetBlockByNumber(number); block != nil && block.Hash() == headers[0].Hash() {
+			return block.Header(), nil
+		}
+		return nil, nil
+	}
+	if header, err := known(ourNum); header != nil || err != nil {
+		return header, err
+	}
 
-	// First, get headers
-	headers, err := d.fetchHeaders(peer, from, count)
-	if err != nil {
-		return nil, err
+	// Our head isn't on the master's chain, find where we diverged. The
+	// genesis is always shared, the handshake made sure of that.
+	genesis := d.backend.GetBlockByNumber(0)
+	if genesis == nil {
+		return nil, errNoAncestor
+	}
+	var (
+		ancestor = genesis.Header()
+		lo, hi   = uint64(0), ourNum // lo is known to be shared, hi is not
+	)
+	for lo+1 < hi {
+		mid := (lo + hi) / 2
+		header, err := known(mid)
+		if err != nil {
+			return nil, err
+		}
+		if header != nil {
+			lo, ancestor = mid, header
+		} else {
+			hi = mid
+		}
 	}
+	return ancestor, nil
+}
 
-	if len(headers) == 0 {
-		return nil, nil
+// fillSkeleton retrieves the headers between the skeleton headers from all
+// idle peers concurrently. A segment that doesn't link up with the skeleton
+// is rescheduled with a different peer, and the peer that served it is
+// penalised. If no peer manages to fill a segment the skeleton itself is
+// assumed bad and the master is penalised instead.
+func (d *Downloader) fillSkeleton(master *Peer, parent *obstypes.ObsidianHeader, skeleton []*obstypes.ObsidianHeader) ([]*obstypes.ObsidianHeader, error) {
+	var (
+		segments = make([][]*obstypes.ObsidianHeader, len(skeleton))
+		tasks    = make([]int, len(skeleton))
+		pending  = make(map[string]*fetchRequest)
+		failures = make(map[int]int)
+		filled   int
+	)
+	for i := range tasks {
+		tasks[i] = i
 	}
+	queue := newFetchQueue(tasks)
 
-	// Then get bodies
-	hashes := make([]common.Hash, len(headers))
-	for i, h := range headers {
-		hashes[i] = h.Hash()
+	// segmentParent returns the header a segment must build on
+	segmentParent := func(i int) *obstypes.ObsidianHeader {
+		if i == 0 {
+			return parent
+		}
+		return skeleton[i-1]
 	}
+	ticker := time.NewTicker(timeoutCheckTick)
+	defer ticker.Stop()
 
-	bodies, err := d.fetchBodies(peer, hashes)
-	if err != nil {
-		return nil, err
+	for filled < len(skeleton) {
+		// Hand out segments to every idle peer that can serve them
+		for _, p := range d.idlePeers(pending, headerFetch) {
+			var limit int
+			for limit < len(skeleton) && skeleton[limit].Number.Uint64() <= p.headNumber() {
+				limit++
+			}
+			reserved := queue.reserve(p.id, 1, limit)
+			if len(reserved) == 0 {
+				continue
+			}
+			from := segmentParent(reserved[0]).Number.Uint64() + 1
+			req := d.newRequest(p, reserved)
+			if err := d.sendHeaderRequest(p, req.id, from, maxHeaderFetch, 0); err != nil {
+				queue.requeue(reserved, p.id, true)
+				continue
+			}
+			pending[p.id] = req
+		}
+		if len(pending) == 0 {
+			return nil, errStalledPeers
+		}
+
+		select {
+		case res := <-d.headerCh:
+			req := pending[res.peer.id]
+			if !req.answeredBy(res.peer, res.id) {
+				continue // Stale or unsolicited
+			}
+			delete(pending, res.peer.id)
+			res.peer.rates.Update(headerFetch, time.Since(req.sent), len(res.headers))
+
+			i := req.tasks[0]
+			if err := checkSegment(res.headers, segmentParent(i), skeleton[i]); err != nil {
+				d.log.Debug("Bad skeleton segment", "peer", res.peer.id[:16], "from", segmentParent(i).Number.Uint64()+1, "err", err)
+				queue.requeue(req.tasks, res.peer.id, true)
+				if failures[i]++; failures[i] >= maxSegmentRetries {
+					d.scorePeer(master, EventInvalidResponse)
+					return nil, errBadSkeleton
+				}
+				d.scorePeer(res.peer, EventInvalidResponse)
+				continue
+			}
+			segments[i] = res.headers
+			filled++
+
+		case <-ticker.C:
+			d.expireRequests(pending, headerFetch, queue)
+
+		case <-d.cancelCh:
+			return nil, ErrCancelled
+		}
 	}
 
-	// Assemble blocks
+	headers := make([]*obstypes.ObsidianHeader, 0, len(skeleton)*maxHeaderFetch)
+	for _, segment := range segments {
+		headers = append(headers, segment...)
+	}
+	return headers, nil
+}
+
+// fetchBodies retrieves the bodies of a verified header chain from all idle
+// peers, sizing each request by the peer's measured throughput, and imports
+// the blocks in order as soon as they are complete. Blocks up to a non-zero
+// snap sync pivot are stored without executing them.
+func (d *Downloader) fetchBodies(master *Peer, headers []*obstypes.ObsidianHeader, pivot uint64) error {
+	var (
+		blocks   = make([]*obstypes.ObsidianBlock, len(headers))
+		tasks    []int
+		pending  = make(map[string]*fetchRequest)
+		imported int
+	)
 	for i, header := range headers {
-		var txs []*obstypes.StealthTransaction
-		var uncles []*obstypes.ObsidianHeader
+		if header.TxHash == obstypes.EmptyTxsHash && header.UncleHash == obstypes.EmptyUncleHash {
+			blocks[i] = obstypes.NewBlockWithHeader(header)
+			continue
+		}
+		tasks = append(tasks, i)
+	}
+	queue := newFetchQueue(tasks)
 
-		if i < len(bodies) {
-			txs = bodies[i].Transactions
-			uncles = bodies[i].Uncles
+	ticker := time.NewTicker(timeoutCheckTick)
+	defer ticker.Stop()
+
+	for {
+		// Import whatever is complete at the front of the queue
+		for imported < len(blocks) && blocks[imported] != nil {
+			block := blocks[imported]
+			var err error
+			if block.NumberU64() <= pivot {
+				// The state below the pivot is never executed, and a resumed
+				// sync finds many of the blocks stored already
+				if err = d.backend.InsertBlockWithoutState(block); errors.Is(err, core.ErrKnownBlock) {
+					err = nil
+				}
+			} else if err = d.backend.InsertBlock(block); err == nil {
+				// Blocks announced while we were behind may build on it
+				d.handler.importOrphans(block.Hash())
+			}
+			if err != nil {
+				// Bodies are checked against their headers and the headers
+				// against the master's skeleton, so a block failing validation
+				// means the chain itself is bad. Local failures are not the
+				// master's fault.
+				d.log.Warn("Failed to import synced block", "number", block.NumberU64(), "hash", block.Hash().Hex()[:16], "err", err)
+				if errors.Is(err, core.ErrInvalidBlock) {
+					d.scorePeer(master, EventInvalidBlock)
+				}
+				return err
+			}
+			blocks[imported] = nil // The chain has it now
+			imported++
+
+			d.syncMu.Lock()
+			d.syncProgress.CurrentBlock = block.NumberU64()
+			d.syncMu.Unlock()
+		}
+		if imported == len(blocks) {
+			return nil
 		}
 
-		block := obstypes.NewBlockWithHeader(header).WithBody(txs, uncles)
-		blocks = append(blocks, block)
-	}
+		// Hand out bodies to every idle peer, but don't run too far ahead of
+		// the import or the memory use is unbounded
+		targetRTT := d.handler.rates.TargetRoundTrip()
+		for _, p := range d.idlePeers(pending, bodyFetch) {
+			limit := imported + maxResultsCache
+			if limit > len(headers) {
+				limit = len(headers)
+			}
+			for limit > imported && headers[limit-1].Number.Uint64() > p.headNumber() {
+				limit--
+			}
+			capacity := p.rates.Capacity(bodyFetch, targetRTT)
+			if capacity > maxBlockFetch {
+				capacity = maxBlockFetch
+			}
+			reserved := queue.reserve(p.id, capacity, limit)
+			if len(reserved) == 0 {
+				continue
+			}
+			hashes := make([]common.Hash, len(reserved))
+			for i, task := range reserved {
+				hashes[i] = headers[task].Hash()
+			}
+			req := d.newRequest(p, reserved)
+			if err := p.sendPacket(GetBlockBodiesMsg, req.id, GetBlockBodiesPacket(hashes)); err != nil {
+				queue.requeue(reserved, p.id, true)
+				continue
+			}
+			pending[p.id] = req
+		}
+		if len(pending) == 0 {
+			return errStalledPeers
+		}
 
-	return blocks, nil
-}
+		select {
+		case res := <-d.bodyCh:
+			req := pending[res.peer.id]
+			if !req.answeredBy(res.peer, res.id) {
+				continue // Stale or unsolicited
+			}
+			delete(pending, res.peer.id)
+			res.peer.rates.Update(bodyFetch, time.Since(req.sent), len(res.bodies))
+
+			for i, task := range req.tasks {
+				if i >= len(res.bodies) {
+					// Peers may serve partial replies, others get the rest
+					queue.requeue(req.tasks[i:], res.peer.id, true)
+					break
+				}
+				body, header := res.bodies[i], headers[task]
+				if obstypes.DeriveSha(obstypes.StealthTransactions(body.Transactions)) != header.TxHash ||
+					obstypes.CalcUncleHash(body.Uncles) != header.UncleHash {
+					d.log.Debug("Peer delivered mismatching block body", "peer", res.peer.id[:16], "number", header.Number)
+					queue.requeue(req.tasks[i:], res.peer.id, true)
+					d.scorePeer(res.peer, EventInvalidResponse)
+					break
+				}
+				blocks[task] = obstypes.NewBlockWithHeader(header).WithBody(body.Transactions, body.Uncles)
+			}
 
-// fetchHeaders requests block headers from a peer
-func (d *Downloader) fetchHeaders(peer *Peer, from uint64, count uint64) ([]*obstypes.ObsidianHeader, error) {
-	req := GetBlockHeadersPacket{
-		Origin:  HashOrNumber{Number: from},
-		Amount:  count,
-		Skip:    0,
-		Reverse: false,
+		case <-ticker.C:
+			d.expireRequests(pending, bodyFetch, queue)
+
+		case <-d.cancelCh:
+			return ErrCancelled
+		}
 	}
+}
 
-	// Send request
-	if err := p2p.Send(peer.rw, GetBlockHeadersMsg, &req); err != nil {
-		return nil, err
+// fetchReceipts retrieves the receipts of blocks stored without executing
+// them from all idle peers, and stores each block's receipts once they match
+// its receipt root.
+func (d *Downloader) fetchReceipts(headers []*obstypes.ObsidianHeader) error {
+	var tasks []int
+	for i, header := range headers {
+		if header.ReceiptHash != obstypes.EmptyReceiptsHash {
+			tasks = append(tasks, i)
+		}
 	}
+	var (
+		queue   = newFetchQueue(tasks)
+		pending = make(map[string]*fetchRequest)
+		stored  int
+	)
+	ticker := time.NewTicker(timeoutCheckTick)
+	defer ticker.Stop()
 
-	// Wait for response with timeout
-	select {
-	case res := <-d.headerCh:
-		if res.peer.id != peer.id {
-			// This is from a different peer, we should probably put it back or handle it
-			// For simplicity, we just ignore it and hope for the best
-			return d.fetchHeadersOneByOne(peer, from, count)
+	for stored < len(tasks) {
+		targetRTT := d.handler.rates.TargetRoundTrip()
+		for _, p := range d.idlePeers(pending, receiptFetch) {
+			limit := len(headers)
+			for limit > 0 && headers[limit-1].Number.Uint64() > p.headNumber() {
+				limit--
+			}
+			capacity := p.rates.Capacity(receiptFetch, targetRTT)
+			if capacity > maxReceiptFetch {
+				capacity = maxReceiptFetch
+			}
+			reserved := queue.reserve(p.id, capacity, limit)
+			if len(reserved) == 0 {
+				continue
+			}
+			hashes := make([]common.Hash, len(reserved))
+			for i, task := range reserved {
+				hashes[i] = headers[task].Hash()
+			}
+			req := d.newRequest(p, reserved)
+			if err := p.sendPacket(GetReceiptsMsg, req.id, GetReceiptsPacket(hashes)); err != nil {
+				queue.requeue(reserved, p.id, true)
+				continue
+			}
+			pending[p.id] = req
+		}
+		if len(pending) == 0 {
+			return errStalledPeers
+		}
+
+		select {
+		case res := <-d.receiptCh:
+			req := pending[res.peer.id]
+			if !req.answeredBy(res.peer, res.id) {
+				continue // Stale or unsolicited
+			}
+			delete(pending, res.peer.id)
+			res.peer.rates.Update(receiptFetch, time.Since(req.sent), len(res.receipts))
+
+			for i, task := range req.tasks {
+				if i >= len(res.receipts) {
+					queue.requeue(req.tasks[i:], res.peer.id, true)
+					break
+				}
+				header := headers[task]
+				if err := d.backend.InsertReceipts(header.Hash(), res.receipts[i]); err != nil {
+					if !errors.Is(err, core.ErrReceiptRootMismatch) {
+						return err
+					}
+					d.log.Debug("Peer delivered mismatching receipts", "peer", res.peer.id[:16], "number", header.Number)
+					queue.requeue(req.tasks[i:], res.peer.id, true)
+					d.scorePeer(res.peer, EventInvalidResponse)
+					break
+				}
+				stored++
+			}
+
+		case <-ticker.C:
+			d.expireRequests(pending, receiptFetch, queue)
+
+		case <-d.cancelCh:
+			return ErrCancelled
 		}
-		return res.headers, nil
-	case <-time.After(requestTimeout):
-		// On timeout, try to get blocks directly one by one
-		return d.fetchHeadersOneByOne(peer, from, count)
 	}
+	return nil
 }
 
-// fetchHeadersOneByOne fetches headers one at a time (fallback)
-func (d *Downloader) fetchHeadersOneByOne(peer *Peer, from uint64, count uint64) ([]*obstypes.ObsidianHeader, error) {
-	headers := make([]*obstypes.ObsidianHeader, 0, count)
+// idlePeers returns the connected peers without a request in flight, the
+// fastest ones first
+func (d *Downloader) idlePeers(pending map[string]*fetchRequest, kind msgKind) []*Peer {
+	targetRTT := d.handler.rates.TargetRoundTrip()
 
-	for i := uint64(0); i < count; i++ {
-		num := from + i
-
-		req := GetBlockHeadersPacket{
-			Origin: HashOrNumber{Number: num},
-			Amount: 1,
+	var idle []*Peer
+	for _, p := range d.handler.Peers() {
+		if _, busy := pending[p.id]; !busy && p.rates != nil {
+			idle = append(idle, p)
 		}
+	}
+	sort.Slice(idle, func(i, j int) bool {
+		return idle[i].rates.Capacity(kind, targetRTT) > idle[j].rates.Capacity(kind, targetRTT)
+	})
+	return idle
+}
+
+// newRequest records a request that is about to be sent
+func (d *Downloader) newRequest(p *Peer, tasks []int) *fetchRequest {
+	now := time.Now()
+	return &fetchRequest{
+		peer:     p,
+		id:       d.handler.nextRequestID(),
+		tasks:    tasks,
+		sent:     now,
+		deadline: now.Add(d.handler.rates.TargetTimeout()),
+	}
+}
 
-		if err := p2p.Send(peer.rw, GetBlockHeadersMsg, &req); err != nil {
-			return headers, err
+// expireRequests abandons requests past their deadline, penalising the peers
+// and making their tasks available to others
+func (d *Downloader) expireRequests(pending map[string]*fetchRequest, kind msgKind, queue *fetchQueue) {
+	now := time.Now()
+	for id, req := range pending {
+		if now.Before(req.deadline) {
+			continue
 		}
+		delete(pending, id)
+		req.peer.rates.Update(kind, now.Sub(req.sent), 0)
+		queue.requeue(req.tasks, id, true)
+		d.log.Debug("Sync request timed out", "peer", id[:16], "items", len(req.tasks))
+		d.scorePeer(req.peer, EventTimeout)
+	}
+}
+
+// sendHeaderRequest asks a peer for headers without waiting for the reply
+func (d *Downloader) sendHeaderRequest(p *Peer, id, origin, amount, skip uint64) error {
+	req := GetBlockHeadersPacket{
+		Origin: HashOrNumber{Number: origin},
+		Amount: amount,
+		Skip:   skip,
+	}
+	return p.sendPacket(GetBlockHeadersMsg, id, &req)
+}
 
+// requestHeaders fetches headers from a single peer and waits for the reply.
+// It's only used while no concurrent retrievals are in flight.
+func (d *Downloader) requestHeaders(p *Peer, origin, amount, skip uint64) ([]*obstypes.ObsidianHeader, error) {
+	req := d.newRequest(p, nil)
+	if err := d.sendHeaderRequest(p, req.id, origin, amount, skip); err != nil {
+		return nil, err
+	}
+	timeout := time.NewTimer(requestTimeout)
+	defer timeout.Stop()
+
+	for {
 		select {
 		case res := <-d.headerCh:
-			if res.peer.id == peer.id && len(res.headers) > 0 {
-				headers = append(headers, res.headers[0])
+			if !req.answeredBy(res.peer, res.id) {
+				continue // Late reply to an abandoned request
+			}
+			p.rates.Update(headerFetch, time.Since(req.sent), len(res.headers))
+			if len(res.headers) == 0 {
+				return nil, errEmptyHeaderSet
 			}
-		case <-time.After(requestTimeout):
-			d.log.Debug("Header request timeout", "number", num)
+			return res.headers, nil
+		case <-timeout.C:
+			p.rates.Update(headerFetch, requestTimeout, 0)
+			d.scorePeer(p, EventTimeout)
+			return nil, ErrTimeout
+		case <-d.cancelCh:
+			return nil, ErrCancelled
 		}
 	}
-
-	return headers, nil
 }
 
-// fetchBodies requests block bodies from a peer
-func (d *Downloader) fetchBodies(peer *Peer, hashes []common.Hash) ([]BlockBody, error) {
-	if len(hashes) == 0 {
-		return nil, nil
+// checkSkeleton verifies that skeleton headers sit exactly maxHeaderFetch
+// blocks apart, starting from the end of the first segment after from
+func checkSkeleton(skeleton []*obstypes.ObsidianHeader, from uint64) error {
+	for i, header := range skeleton {
+		want := from + uint64(i+1)*maxHeaderFetch - 1
+		if header.Number == nil || header.Number.Uint64() != want {
+			return fmt.Errorf("%w: skeleton header %d is not block %d", errInvalidChain, i, want)
+		}
 	}
+	return nil
+}
 
-	// Send request
-	if err := p2p.Send(peer.rw, GetBlockBodiesMsg, GetBlockBodiesPacket(hashes)); err != nil {
-		return nil, err
+// checkSegment verifies that headers form a chain on top of parent and, if a
+// skeleton header is given, that they end in it
+func checkSegment(headers []*obstypes.ObsidianHeader, parent, last *obstypes.ObsidianHeader) error {
+	if len(headers) == 0 {
+		return errEmptyHeaderSet
 	}
-
-	// Wait for response with timeout
-	select {
-	case res := <-d.bodyCh:
-		if res.peer.id != peer.id {
-			return nil, fmt.Errorf("response from wrong peer")
+	for i, header := range headers {
+		if header.Number == nil || header.Number.Uint64() != parent.Number.Uint64()+1 || header.ParentHash != parent.Hash() {
+			return fmt.Errorf("%w: header %d doesn't build on block %d", errInvalidChain, i, parent.Number)
 		}
-		return res.bodies, nil
-	case <-time.After(requestTimeout):
-		return nil, ErrTimeout
+		parent = header
+	}
+	if last != nil && parent.Hash() != last.Hash() {
+		return fmt.Errorf("%w: segment doesn't end in skeleton header %d", errInvalidChain, last.Number)
 	}
+	return nil
+}
+
+// scorePeer reports a peer event to the handler's scorer
+func (d *Downloader) scorePeer(peer *Peer, ev PeerEvent) error {
+	if d.handler == nil {
+		return nil
+	}
+	return d.handler.scorePeer(peer.id, ev)
 }
 
 // DeliverHeaders is called when headers are received from a peer
-func (d *Downloader) DeliverHeaders(peer *Peer, headers []*obstypes.ObsidianHeader) {
+func (d *Downloader) DeliverHeaders(peer *Peer, id uint64, headers []*obstypes.ObsidianHeader) {
 	select {
-	case d.headerCh <- headerResponse{peer: peer, headers: headers}:
+	case d.headerCh <- headerResponse{peer: peer, id: id, headers: headers}:
 	default:
 		d.log.Debug("Header channel full, dropping response")
 	}
 }
 
 // DeliverBodies is called when bodies are received from a peer
-func (d *Downloader) DeliverBodies(peer *Peer, bodies []BlockBody) {
+func (d *Downloader) DeliverBodies(peer *Peer, id uint64, bodies []BlockBody) {
 	select {
-	case d.bodyCh <- bodyResponse{peer: peer, bodies: bodies}:
+	case d.bodyCh <- bodyResponse{peer: peer, id: id, bodies: bodies}:
 	default:
 		d.log.Debug("Body channel full, dropping response")
 	}
 }
 
+// DeliverReceipts is called when block receipts are received from a peer
+func (d *Downloader) DeliverReceipts(peer *Peer, id uint64, receipts []obstypes.Receipts) {
+	select {
+	case d.receiptCh <- receiptResponse{peer: peer, id: id, receipts: receipts}:
+	default:
+		d.log.Debug("Receipt channel full, dropping response")
+	}
+}
+
 // DeliverBlock is called when a complete block is received from a peer
 func (d *Downloader) DeliverBlock(peer *Peer, block *obstypes.ObsidianBlock, td *big.Int) {
 	select {
@@ -450,9 +925,5 @@ func (d *Downloader) Syncing() bool {
 
 // SyncWithPeer manually triggers sync with a specific peer
 func (d *Downloader) SyncWithPeer(peer *Peer) error {
-	peer.lock.RLock()
-	targetNum := peer.number
-	peer.lock.RUnlock()
-
-	return d.synchronise(peer, targetNum)
+	return d.synchronise(peer, peer.headNumber())
 }
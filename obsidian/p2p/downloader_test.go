@@ -0,0 +1,287 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package p2p
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/obsidian-chain/obsidian/core"
+	obstypes "github.com/obsidian-chain/obsidian/core/types"
+)
+
+// testChainBackend extends testBackend with a linear chain of blocks
+type testChainBackend struct {
+	*testBackend
+
+	chainMu sync.RWMutex
+	blocks  []*obstypes.ObsidianBlock
+	hashes  map[common.Hash]uint64
+
+	// forge, if set, replaces the blocks served by number
+	forge func(*obstypes.ObsidianBlock) *obstypes.ObsidianBlock
+
+	// held reports an unbeatable total difficulty, so nobody syncs us and
+	// we don't sync from anybody
+	held bool
+
+	bodiesMu     sync.Mutex
+	bodiesServed int
+}
+
+func newTestChainBackend(blocks []*obstypes.ObsidianBlock) *testChainBackend {
+	b := &testChainBackend{
+		testBackend: newTestBackend(),
+		hashes:      make(map[common.Hash]uint64),
+	}
+	b.blocks = append(b.blocks, b.genesis)
+	b.hashes[b.genesis.Hash()] = 0
+	for _, block := range blocks {
+		if err := b.InsertBlock(block); err != nil {
+			panic(err)
+		}
+	}
+	return b
+}
+
+// makeTestChain generates n blocks on top of the test genesis, every other
+// one carrying a transaction so that it has a body to download
+func makeTestChain(n int) []*obstypes.ObsidianBlock {
+	parent := newTestBackend().genesis
+	blocks := make([]*obstypes.ObsidianBlock, n)
+	for i := range blocks {
+		header := &obstypes.ObsidianHeader{
+			ParentHash: parent.Hash(),
+			Number:     big.NewInt(int64(i + 1)),
+			Difficulty: big.NewInt(1),
+			GasLimit:   30_000_000,
+			Time:       uint64(i + 1),
+		}
+		var txs []*obstypes.StealthTransaction
+		if i%2 == 0 {
+			txs = append(txs, obstypes.NewStealthTransaction(uint64(i), common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(1), nil, nil, 0))
+		}
+		blocks[i] = obstypes.NewBlock(header, txs, nil, nil)
+		parent = blocks[i]
+	}
+	return blocks
+}
+
+func (b *testChainBackend) CurrentBlock() *obstypes.ObsidianHeader {
+	b.chainMu.RLock()
+	defer b.chainMu.RUnlock()
+	return b.blocks[len(b.blocks)-1].Header()
+}
+
+func (b *testChainBackend) GetBlockByHash(hash common.Hash) *obstypes.ObsidianBlock {
+	b.chainMu.RLock()
+	defer b.chainMu.RUnlock()
+
+	number, ok := b.hashes[hash]
+	if !ok {
+		return nil
+	}
+	b.bodiesMu.Lock()
+	b.bodiesServed++
+	b.bodiesMu.Unlock()
+	return b.blocks[number]
+}
+
+func (b *testChainBackend) GetBlockByNumber(number uint64) *obstypes.ObsidianBlock {
+	b.chainMu.RLock()
+	defer b.chainMu.RUnlock()
+
+	if number >= uint64(len(b.blocks)) {
+		return nil
+	}
+	if b.forge != nil {
+		return b.forge(b.blocks[number])
+	}
+	return b.blocks[number]
+}
+
+func (b *testChainBackend) GetTD(hash common.Hash) *big.Int {
+	b.chainMu.RLock()
+	defer b.chainMu.RUnlock()
+
+	if b.held {
+		return new(big.Int).Lsh(common.Big1, 128)
+	}
+	number, ok := b.hashes[hash]
+	if !ok {
+		return nil
+	}
+	return new(big.Int).SetUint64(number + 1)
+}
+
+func (b *testChainBackend) HasBlock(hash common.Hash) bool {
+	b.chainMu.RLock()
+	defer b.chainMu.RUnlock()
+
+	_, ok := b.hashes[hash]
+	return ok
+}
+
+func (b *testChainBackend) VerifyHeader(header *obstypes.ObsidianHeader) error {
+	if !b.HasBlock(header.ParentHash) {
+		return core.ErrUnknownAncestor
+	}
+	return nil
+}
+
+func (b *testChainBackend) InsertBlock(block *obstypes.ObsidianBlock) error {
+	b.chainMu.Lock()
+	defer b.chainMu.Unlock()
+
+	head := b.blocks[len(b.blocks)-1]
+	if block.ParentHash() != head.Hash() || block.NumberU64() != head.NumberU64()+1 {
+		return fmt.Errorf("block %d does not extend head %d", block.NumberU64(), head.NumberU64())
+	}
+	b.blocks = append(b.blocks, block)
+	b.hashes[block.Hash()] = block.NumberU64()
+	return nil
+}
+
+// release lets a held backend sync from its peers
+func (b *testChainBackend) release() {
+	b.chainMu.Lock()
+	b.held = false
+	b.chainMu.Unlock()
+}
+
+func (b *testChainBackend) served() int {
+	b.bodiesMu.Lock()
+	defer b.bodiesMu.Unlock()
+	return b.bodiesServed
+}
+
+// connectHandlers runs the protocol between two handlers over a message pipe
+func connectHandlers(t *testing.T, a, b *Handler) (aID, bID string) {
+	t.Helper()
+	return connectHandlersVersion(t, a, b, ProtocolVersion)
+}
+
+// connectHandlersVersion connects two handlers speaking the given protocol
+// version
+func connectHandlersVersion(t *testing.T, a, b *Handler, version uint) (aID, bID string) {
+	t.Helper()
+
+	var ida, idb enode.ID
+	rand.Read(ida[:])
+	rand.Read(idb[:])
+
+	ra, rb := p2p.MsgPipe()
+	t.Cleanup(func() { ra.Close() })
+
+	go a.runPeer(version, p2p.NewPeer(idb, "b", nil), ra)
+	go b.runPeer(version, p2p.NewPeer(ida, "a", nil), rb)
+	return ida.String(), idb.String()
+}
+
+// startSync releases a held backend once all its peers are connected
+func startSync(t *testing.T, h *Handler, b *testChainBackend, peers int) {
+	t.Helper()
+
+	waitFor(t, func() bool { return h.PeerCount() == peers })
+	b.release()
+	h.downloader.CheckAndSync()
+}
+
+// waitForHead waits until a backend's chain reaches the given number
+func waitForHead(t *testing.T, b *testChainBackend, number uint64, timeout time.Duration) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if b.CurrentBlock().Number.Uint64() >= number {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("sync stalled at block %d, want %d", b.CurrentBlock().Number.Uint64(), number)
+}
+
+func TestSkeletonSyncMultiplePeers(t *testing.T) {
+	const length = 1000
+	chain := makeTestChain(length)
+
+	sink := newTestChainBackend(nil)
+	sink.held = true
+	h := NewHandler(1719, sink)
+	defer h.Stop()
+
+	var sources []*testChainBackend
+	for i := 0; i < 3; i++ {
+		source := newTestChainBackend(chain)
+		sh := NewHandler(1719, source)
+		defer sh.Stop()
+
+		connectHandlers(t, h, sh)
+		sources = append(sources, source)
+	}
+	startSync(t, h, sink, 3)
+	waitForHead(t, sink, length, 20*time.Second)
+
+	if head := sink.CurrentBlock(); head.Hash() != chain[length-1].Hash() {
+		t.Fatalf("synced to the wrong head: %x", head.Hash())
+	}
+	var serving int
+	for _, source := range sources {
+		if source.served() > 0 {
+			serving++
+		}
+	}
+	if serving < 2 {
+		t.Fatalf("bodies were served by %d peers, want at least 2", serving)
+	}
+}
+
+func TestSyncRecoversFromBadSegment(t *testing.T) {
+	const length = 1000
+	chain := makeTestChain(length)
+
+	sink := newTestChainBackend(nil)
+	sink.held = true
+	h := NewHandler(1719, sink)
+	defer h.Stop()
+
+	for i := 0; i < 2; i++ {
+		sh := NewHandler(1719, newTestChainBackend(chain))
+		defer sh.Stop()
+		connectHandlers(t, h, sh)
+	}
+
+	// The bad peer is a little behind, so it's never picked to provide the
+	// skeleton, but it serves headers that don't link up for most of the
+	// chain it does have
+	bad := newTestChainBackend(chain[:length-10])
+	bad.forge = func(block *obstypes.ObsidianBlock) *obstypes.ObsidianBlock {
+		if n := block.NumberU64(); n == 0 || n > 900 {
+			return block
+		}
+		header := block.Header()
+		header.Extra = []byte("forged")
+		return obstypes.NewBlockWithHeader(header)
+	}
+	bh := NewHandler(1719, bad)
+	defer bh.Stop()
+	_, badID := connectHandlers(t, h, bh)
+
+	startSync(t, h, sink, 3)
+	waitForHead(t, sink, length, 20*time.Second)
+
+	if head := sink.CurrentBlock(); head.Hash() != chain[length-1].Hash() {
+		t.Fatalf("synced to the wrong head: %x", head.Hash())
+	}
+	if score := h.scorer.Score(badID); score >= 0 {
+		t.Fatalf("bad peer not penalised: score %d", score)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/rlp"
+	obstypes "github.com/obsidian-chain/obsidian/core/types"
+)
+
+// requestEnvelope wraps the requests and responses of obs/2, so that every
+// response can be matched with the request it answers
+type requestEnvelope struct {
+	ID     uint64
+	Packet interface{}
+}
+
+// rawEnvelope is a received requestEnvelope whose packet is yet to be decoded
+type rawEnvelope struct {
+	ID     uint64
+	Packet rlp.RawValue
+}
+
+// TxEnvelopes is the obs/2 encoding of a batch of transactions. Every
+// transaction is an opaque typed envelope, so that a peer can skip the types
+// it doesn't know instead of rejecting the whole batch.
+type TxEnvelopes [][]byte
+
+// nextRequestID returns a fresh request ID. IDs start at one: a zero ID
+// marks the untagged responses of obs/1 peers.
+func (h *Handler) nextRequestID() uint64 {
+	return atomic.AddUint64(&h.reqID, 1)
+}
+
+// sendPacket sends a request or response to the peer, tagged with the
+// request ID if the peer speaks obs/2
+func (p *Peer) sendPacket(code uint64, id uint64, data interface{}) error {
+	if p.version < OBS2 {
+		return p2p.Send(p.rw, code, data)
+	}
+	return p2p.Send(p.rw, code, &requestEnvelope{ID: id, Packet: data})
+}
+
+// decodePacket decodes a request or response from the peer into v and
+// returns its request ID, which is zero for obs/1 peers
+func (p *Peer) decodePacket(msg p2p.Msg, v interface{}) (uint64, error) {
+	if p.version < OBS2 {
+		if err := msg.Decode(v); err != nil {
+			return 0, fmt.Errorf("decode error: %v", err)
+		}
+		return 0, nil
+	}
+	var env rawEnvelope
+	if err := msg.Decode(&env); err != nil {
+		return 0, fmt.Errorf("decode error: %v", err)
+	}
+	if err := rlp.DecodeBytes(env.Packet, v); err != nil {
+		return 0, fmt.Errorf("decode error: request %d: %v", env.ID, err)
+	}
+	return env.ID, nil
+}
+
+// encodeTxs prepares a batch of transactions for the wire: typed envelopes
+// on obs/2, plain RLP on obs/1
+func (p *Peer) encodeTxs(txs []*obstypes.StealthTransaction) (interface{}, error) {
+	if p.version < OBS2 {
+		return TransactionsPacket(txs), nil
+	}
+	envs := make(TxEnvelopes, len(txs))
+	for i, tx := range txs {
+		env, err := tx.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		envs[i] = env
+	}
+	return envs, nil
+}
+
+// decodeTxs decodes a batch of transactions encoded by encodeTxs. Envelopes
+// of unsupported types are skipped.
+func (p *Peer) decodeTxs(raw rlp.RawValue) ([]*obstypes.StealthTransaction, error) {
+	if p.version < OBS2 {
+		var txs TransactionsPacket
+		if err := rlp.DecodeBytes(raw, &txs); err != nil {
+			return nil, fmt.Errorf("decode error: %v", err)
+		}
+		return txs, nil
+	}
+	var envs TxEnvelopes
+	if err := rlp.DecodeBytes(raw, &envs); err != nil {
+		return nil, fmt.Errorf("decode error: %v", err)
+	}
+	txs := make([]*obstypes.StealthTransaction, 0, len(envs))
+	for i, env := range envs {
+		tx := new(obstypes.StealthTransaction)
+		if err := tx.UnmarshalBinary(env); err != nil {
+			if errors.Is(err, obstypes.ErrTxTypeNotSupported) {
+				log.Trace("Skipping unsupported transaction type", "peer", p.id[:16], "type", env[0])
+				continue
+			}
+			return nil, fmt.Errorf("decode error: transaction %d: %v", i, err)
+		}
+		txs = append(txs, tx)
+	}
+	return txs, nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/rlp"
+	obstypes "github.com/obsidian-chain/obsidian/core/types"
+)
+
+func TestDecodeTxsSkipsUnknownTypes(t *testing.T) {
+	p := &Peer{id: "0123456789abcdef0123", version: OBS2}
+
+	tx := newTestTx(0)
+	env, err := tx.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := rlp.EncodeToBytes(TxEnvelopes{{0x7f, 0xc0}, env})
+
+	txs, err := p.decodeTxs(raw)
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if len(txs) != 1 || txs[0].Hash() != tx.Hash() {
+		t.Fatalf("unexpected transactions: %d", len(txs))
+	}
+
+	// A malformed envelope of a known type still fails the batch
+	raw, _ = rlp.EncodeToBytes(TxEnvelopes{{obstypes.StealthTxType, 0x01}})
+	if _, err := p.decodeTxs(raw); err == nil {
+		t.Fatal("malformed envelope was accepted")
+	}
+}
+
+func TestTxFetcherIgnoresStaleResponse(t *testing.T) {
+	f, calls := newRecordingFetcher(nil)
+
+	f.Notify("a", []byte{obstypes.StealthTxType}, []uint32{100}, []common.Hash{{0x01}})
+	call := expectFetch(t, calls)
+
+	// An empty reply to some older request doesn't settle the current one
+	f.Enqueue("a", call.id+1, nil, true)
+	if _, fetching, _ := f.Stats(); fetching != 1 {
+		t.Fatalf("stale response settled the request: %d fetching", fetching)
+	}
+	f.Enqueue("a", call.id, nil, true)
+	if _, fetching, _ := f.Stats(); fetching != 0 {
+		t.Fatalf("response left %d hashes fetching", fetching)
+	}
+}
+
+func TestHandlerServesObs1Peer(t *testing.T) {
+	chain := makeTestChain(3)
+	backend := newTestChainBackend(chain)
+	h := NewHandler(1719, backend)
+	defer h.Stop()
+
+	peer := newTestPeerVersion(t, h, backend.testBackend, OBS1)
+
+	// obs/1 requests are plain packets and block replies use NewBlockMsg
+	if err := p2p.Send(peer.rw, GetBlockByNumberMsg, uint64(2)); err != nil {
+		t.Fatal(err)
+	}
+	var packet NewBlockPacket
+	if err := peer.expectMsg(t, NewBlockMsg).Decode(&packet); err != nil {
+		t.Fatalf("failed to decode block: %v", err)
+	}
+	if packet.Block.Hash() != chain[1].Hash() {
+		t.Fatalf("unexpected block %x", packet.Block.Hash())
+	}
+}
+
+func TestHandlerRepliesWithRequestID(t *testing.T) {
+	chain := makeTestChain(3)
+	backend := newTestChainBackend(chain)
+	h := NewHandler(1719, backend)
+	defer h.Stop()
+
+	peer := newTestPeerVersion(t, h, backend.testBackend, OBS2)
+	if err := peer.send(GetBlockByNumberMsg, 42, uint64(2)); err != nil {
+		t.Fatal(err)
+	}
+	var packet NewBlockPacket
+	id, err := peer.decode(peer.expectMsg(t, BlockMsg), &packet)
+	if err != nil {
+		t.Fatalf("failed to decode block: %v", err)
+	}
+	if id != 42 || packet.Block.Hash() != chain[1].Hash() {
+		t.Fatalf("unexpected reply to request %d: block %x", id, packet.Block.Hash())
+	}
+}
+
+func TestSyncWithObs1Peer(t *testing.T) {
+	const length = 200
+	chain := makeTestChain(length)
+
+	sink := newTestChainBackend(nil)
+	sink.held = true
+	h := NewHandler(1719, sink)
+	defer h.Stop()
+
+	source := NewHandler(1719, newTestChainBackend(chain))
+	defer source.Stop()
+
+	connectHandlersVersion(t, h, source, OBS1)
+	startSync(t, h, sink, 1)
+	waitForHead(t, sink, length, 10*time.Second)
+}
@@ -0,0 +1,176 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package p2p
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Throughput estimation configuration
+const (
+	// measurementImpact is the weight of a new measurement in the running
+	// capacity and round trip averages.
+	measurementImpact = 0.1
+
+	// capacityOverestimation makes peers a little more loaded than their
+	// measured capacity, so that they get a chance to prove they can do more.
+	capacityOverestimation = 1.01
+
+	// rttMinEstimate and rttMaxEstimate bound the target round trip time that
+	// requests are sized for.
+	rttMinEstimate = 2 * time.Second
+	rttMaxEstimate = 20 * time.Second
+
+	// ttlScaling is the multiple of the target round trip a request may take
+	// before it is considered timed out.
+	ttlScaling = 3
+
+	// ttlLimit is the maximum timeout allowance for a request.
+	ttlLimit = time.Minute
+)
+
+// msgKind is a type of data retrieval whose throughput is tracked separately
+type msgKind int
+
+const (
+	headerFetch msgKind = iota
+	bodyFetch
+	receiptFetch
+)
+
+// rateTracker estimates how many items of each kind a peer can deliver per
+// second, and how long its round trips take
+type rateTracker struct {
+	mu        sync.RWMutex
+	capacity  map[msgKind]float64 // items per second
+	roundtrip time.Duration
+}
+
+// Capacity returns the number of items of a kind the peer is estimated to be
+// able to deliver within the target round trip time. It is always at least one.
+func (t *rateTracker) Capacity(kind msgKind, targetRTT time.Duration) int {
+	t.mu.RLock()
+	throughput := t.capacity[kind]
+	t.mu.RUnlock()
+
+	capacity := 1 + capacityOverestimation*throughput*targetRTT.Seconds()
+	if capacity >= math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int(capacity)
+}
+
+// Update folds a finished retrieval into the estimates. A timed out request
+// should be reported with zero items, which lowers the peer's capacity.
+func (t *rateTracker) Update(kind msgKind, elapsed time.Duration, items int) {
+	if elapsed <= 0 {
+		elapsed = time.Nanosecond
+	}
+	measured := float64(items) / elapsed.Seconds()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.capacity[kind] = (1-measurementImpact)*t.capacity[kind] + measurementImpact*measured
+	t.roundtrip = time.Duration((1-measurementImpact)*float64(t.roundtrip) + measurementImpact*float64(elapsed))
+}
+
+// roundTrip returns the estimated round trip time of the peer
+func (t *rateTracker) roundTrip() time.Duration {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.roundtrip
+}
+
+// rateTrackers holds the trackers of all connected peers. New peers start off
+// with the median estimates of the existing ones, so that they get useful work
+// straight away without being trusted with more than an average peer.
+type rateTrackers struct {
+	mu       sync.RWMutex
+	trackers map[string]*rateTracker
+}
+
+func newRateTrackers() *rateTrackers {
+	return &rateTrackers{trackers: make(map[string]*rateTracker)}
+}
+
+// Track creates the tracker of a newly connected peer
+func (ts *rateTrackers) Track(id string) *rateTracker {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	t := &rateTracker{
+		capacity:  make(map[msgKind]float64),
+		roundtrip: rttMaxEstimate,
+	}
+	if len(ts.trackers) > 0 {
+		for _, kind := range []msgKind{headerFetch, bodyFetch, receiptFetch} {
+			t.capacity[kind] = ts.medianCapacity(kind)
+		}
+		t.roundtrip = ts.medianRoundTrip()
+	}
+	ts.trackers[id] = t
+	return t
+}
+
+// Untrack removes the tracker of a disconnected peer
+func (ts *rateTrackers) Untrack(id string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	delete(ts.trackers, id)
+}
+
+// TargetRoundTrip returns the round trip time requests should be sized for
+func (ts *rateTrackers) TargetRoundTrip() time.Duration {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	if len(ts.trackers) == 0 {
+		return rttMaxEstimate
+	}
+	// Aim slightly below the median so that most peers finish early
+	rtt := time.Duration(0.9 * float64(ts.medianRoundTrip()))
+	if rtt < rttMinEstimate {
+		rtt = rttMinEstimate
+	}
+	if rtt > rttMaxEstimate {
+		rtt = rttMaxEstimate
+	}
+	return rtt
+}
+
+// TargetTimeout returns how long a request sized for the target round trip
+// may take before it is abandoned
+func (ts *rateTrackers) TargetTimeout() time.Duration {
+	ttl := ttlScaling * ts.TargetRoundTrip()
+	if ttl > ttlLimit {
+		ttl = ttlLimit
+	}
+	return ttl
+}
+
+// medianCapacity must be called with the lock held
+func (ts *rateTrackers) medianCapacity(kind msgKind) float64 {
+	caps := make([]float64, 0, len(ts.trackers))
+	for _, t := range ts.trackers {
+		t.mu.RLock()
+		caps = append(caps, t.capacity[kind])
+		t.mu.RUnlock()
+	}
+	sort.Float64s(caps)
+	return caps[len(caps)/2]
+}
+
+// medianRoundTrip must be called with the lock held
+func (ts *rateTrackers) medianRoundTrip() time.Duration {
+	rtts := make([]time.Duration, 0, len(ts.trackers))
+	for _, t := range ts.trackers {
+		rtts = append(rtts, t.roundTrip())
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	return rtts[len(rtts)/2]
+}
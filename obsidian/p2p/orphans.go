@@ -0,0 +1,233 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package p2p
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	obstypes "github.com/obsidian-chain/obsidian/core/types"
+)
+
+// Orphan pool configuration
+const (
+	// maxOrphanBlocks and maxOrphanBytes bound the pool. The orphans of the
+	// peer holding the most are evicted to make room for new ones, oldest
+	// first.
+	maxOrphanBlocks = 512
+	maxOrphanBytes  = 32 * 1024 * 1024
+
+	// maxOrphansPerPeer is how many orphans a single peer may have pooled, so
+	// one peer can't crowd out the blocks of everybody else.
+	maxOrphansPerPeer = 64
+
+	// orphanExpiry is how long an orphan waits for its ancestors.
+	orphanExpiry = 10 * time.Minute
+
+	// maxAncestorFetch is the largest gap to our head that is closed by
+	// fetching missing ancestors by hash. Larger gaps are left to the
+	// downloader.
+	maxAncestorFetch = 32
+
+	// ancestorRefetch is how long to wait for a requested ancestor before
+	// asking again.
+	ancestorRefetch = 5 * time.Second
+)
+
+var (
+	errOrphanKnown     = errors.New("orphan already pooled")
+	errOrphanTooLarge  = errors.New("orphan exceeds the pool size")
+	errOrphanPeerQuota = errors.New("peer orphan quota exceeded")
+)
+
+// orphanBlock is a pooled block along with who sent it
+type orphanBlock struct {
+	block *obstypes.ObsidianBlock
+	peer  string
+	size  uint64
+	added time.Time
+}
+
+// orphanPool holds blocks whose parent is unknown until their ancestors
+// arrive. Any number of children may wait on the same parent, so competing
+// blocks during a chain split are all kept.
+type orphanPool struct {
+	mu        sync.Mutex
+	blocks    map[common.Hash]*orphanBlock  // Block hash -> orphan
+	children  map[common.Hash][]common.Hash // Parent hash -> orphan hashes
+	perPeer   map[string]int                // Peer ID -> pooled orphans
+	requested map[common.Hash]time.Time     // Ancestor hash -> last request
+	bytes     uint64
+
+	now func() time.Time
+}
+
+func newOrphanPool() *orphanPool {
+	return &orphanPool{
+		blocks:    make(map[common.Hash]*orphanBlock),
+		children:  make(map[common.Hash][]common.Hash),
+		perPeer:   make(map[string]int),
+		requested: make(map[common.Hash]time.Time),
+		now:       time.Now,
+	}
+}
+
+// add pools a block received from peer, evicting orphans if the pool is full
+func (p *orphanPool) add(block *obstypes.ObsidianBlock, peer string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	hash, size := block.Hash(), block.Size()
+	if _, ok := p.blocks[hash]; ok {
+		return errOrphanKnown
+	}
+	if size > maxOrphanBytes {
+		return errOrphanTooLarge
+	}
+	now := p.now()
+	p.expire(now)
+
+	if p.perPeer[peer] >= maxOrphansPerPeer {
+		return errOrphanPeerQuota
+	}
+	for len(p.blocks) >= maxOrphanBlocks || p.bytes+size > maxOrphanBytes {
+		p.evict()
+	}
+	p.blocks[hash] = &orphanBlock{block: block, peer: peer, size: size, added: now}
+	p.children[block.ParentHash()] = append(p.children[block.ParentHash()], hash)
+	p.perPeer[peer]++
+	p.bytes += size
+	delete(p.requested, hash)
+	return nil
+}
+
+// take removes and returns the orphans waiting on parent, along with the
+// peers that sent them
+func (p *orphanPool) take(parent common.Hash) []*orphanBlock {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var taken []*orphanBlock
+	for _, hash := range append([]common.Hash(nil), p.children[parent]...) {
+		taken = append(taken, p.blocks[hash])
+		p.remove(hash)
+	}
+	return taken
+}
+
+// discard drops an orphan and everything pooled on top of it
+func (p *orphanPool) discard(hash common.Hash) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	queue := []common.Hash{hash}
+	for len(queue) > 0 {
+		hash, queue = queue[0], queue[1:]
+		queue = append(queue, p.children[hash]...)
+		if _, ok := p.blocks[hash]; ok {
+			p.remove(hash)
+		}
+		delete(p.children, hash)
+	}
+}
+
+// missingAncestor follows the pooled ancestry of a block down to the first
+// block the pool doesn't hold, returning its hash and the number of pooled
+// blocks on top of it
+func (p *orphanPool) missingAncestor(hash common.Hash) (common.Hash, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var depth int
+	for {
+		orphan, ok := p.blocks[hash]
+		if !ok {
+			return hash, depth
+		}
+		hash = orphan.block.ParentHash()
+		depth++
+	}
+}
+
+// request reports whether an ancestor should be fetched now, recording the
+// request if so
+func (p *orphanPool) request(hash common.Hash) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	if last, ok := p.requested[hash]; ok && now.Sub(last) < ancestorRefetch {
+		return false
+	}
+	p.requested[hash] = now
+	return true
+}
+
+// len returns the number of pooled orphans
+func (p *orphanPool) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.blocks)
+}
+
+// expire drops the orphans that waited too long, along with stale ancestor
+// requests. The caller must hold the lock.
+func (p *orphanPool) expire(now time.Time) {
+	for hash, orphan := range p.blocks {
+		if now.Sub(orphan.added) > orphanExpiry {
+			p.remove(hash)
+		}
+	}
+	for hash, last := range p.requested {
+		if now.Sub(last) > orphanExpiry {
+			delete(p.requested, hash)
+		}
+	}
+}
+
+// evict drops the oldest orphan of the peer holding the most, so that a peer
+// filling the pool displaces its own blocks rather than everybody else's. The
+// caller must hold the lock.
+func (p *orphanPool) evict() {
+	var (
+		victim common.Hash
+		chosen *orphanBlock
+	)
+	for hash, orphan := range p.blocks {
+		if chosen != nil {
+			share, most := p.perPeer[orphan.peer], p.perPeer[chosen.peer]
+			if share < most || (share == most && !orphan.added.Before(chosen.added)) {
+				continue
+			}
+		}
+		victim, chosen = hash, orphan
+	}
+	p.remove(victim)
+}
+
+// remove drops a single orphan. The caller must hold the lock.
+func (p *orphanPool) remove(hash common.Hash) {
+	orphan := p.blocks[hash]
+	delete(p.blocks, hash)
+
+	parent := orphan.block.ParentHash()
+	siblings := p.children[parent]
+	for i, sibling := range siblings {
+		if sibling == hash {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(p.children, parent)
+	} else {
+		p.children[parent] = siblings
+	}
+	if p.perPeer[orphan.peer]--; p.perPeer[orphan.peer] == 0 {
+		delete(p.perPeer, orphan.peer)
+	}
+	p.bytes -= orphan.size
+}
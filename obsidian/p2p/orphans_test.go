@@ -0,0 +1,193 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/p2p"
+	obstypes "github.com/obsidian-chain/obsidian/core/types"
+)
+
+// makeOrphan creates a block on top of parent, distinguished by extra
+func makeOrphan(parent common.Hash, number uint64, extra byte) *obstypes.ObsidianBlock {
+	return obstypes.NewBlockWithHeader(&obstypes.ObsidianHeader{
+		ParentHash: parent,
+		Number:     new(big.Int).SetUint64(number),
+		Difficulty: big.NewInt(1),
+		Extra:      []byte{extra},
+	})
+}
+
+func TestOrphanPoolSiblings(t *testing.T) {
+	pool := newOrphanPool()
+
+	parent := common.Hash{1}
+	a, b := makeOrphan(parent, 5, 1), makeOrphan(parent, 5, 2)
+	grandchild := makeOrphan(a.Hash(), 6, 0)
+	for _, block := range []*obstypes.ObsidianBlock{a, b, grandchild} {
+		if err := pool.add(block, "peer"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pool.add(a, "other"); !errors.Is(err, errOrphanKnown) {
+		t.Fatalf("duplicate orphan accepted: %v", err)
+	}
+	if ancestor, depth := pool.missingAncestor(grandchild.Hash()); ancestor != parent || depth != 2 {
+		t.Fatalf("missing ancestor mismatch: have %x/%d, want %x/2", ancestor, depth, parent)
+	}
+	if taken := pool.take(parent); len(taken) != 2 {
+		t.Fatalf("competing children lost: took %d", len(taken))
+	}
+	if taken := pool.take(a.Hash()); len(taken) != 1 || taken[0].block != grandchild {
+		t.Fatal("grandchild not kept")
+	}
+	if pool.len() != 0 || pool.bytes != 0 || len(pool.perPeer) != 0 {
+		t.Fatalf("pool not empty: %d blocks, %d bytes", pool.len(), pool.bytes)
+	}
+}
+
+func TestOrphanPoolLimits(t *testing.T) {
+	pool := newOrphanPool()
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+
+	// A single peer can only take up its quota
+	for i := 0; i < maxOrphansPerPeer; i++ {
+		now = now.Add(time.Second)
+		if err := pool.add(makeOrphan(common.Hash{byte(i)}, 10, 0), "greedy"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pool.add(makeOrphan(common.Hash{0xff}, 10, 0), "greedy"); !errors.Is(err, errOrphanPeerQuota) {
+		t.Fatalf("peer quota not enforced: %v", err)
+	}
+	// Once full, the pool evicts the oldest orphans of the greedy peer
+	first := makeOrphan(common.BigToHash(big.NewInt(1000)), 10, 0)
+	now = now.Add(time.Second)
+	if err := pool.add(first, "peer0"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; pool.len() < maxOrphanBlocks; i++ {
+		now = now.Add(time.Second)
+		pool.add(makeOrphan(common.BigToHash(big.NewInt(int64(1000+i))), 10, 0), string(rune('a'+i%26))+"peer")
+	}
+	now = now.Add(time.Second)
+	if err := pool.add(makeOrphan(common.Hash{0xfe}, 10, 0), "late"); err != nil {
+		t.Fatal(err)
+	}
+	if pool.len() != maxOrphanBlocks {
+		t.Fatalf("pool size mismatch: have %d, want %d", pool.len(), maxOrphanBlocks)
+	}
+	if _, ok := pool.blocks[makeOrphan(common.Hash{0}, 10, 0).Hash()]; ok {
+		t.Fatal("oldest orphan not evicted")
+	}
+	// Everything expires eventually
+	now = now.Add(orphanExpiry + time.Hour)
+	pool.add(makeOrphan(common.Hash{0xfd}, 10, 0), "late")
+	if pool.len() != 1 {
+		t.Fatalf("expired orphans kept: %d", pool.len())
+	}
+}
+
+// A full pool evicts from the peer holding the most orphans, even when other
+// peers' orphans are older
+func TestOrphanPoolEvictsLargestShare(t *testing.T) {
+	pool := newOrphanPool()
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+
+	old := makeOrphan(common.Hash{0xff}, 10, 0)
+	if err := pool.add(old, "honest"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; pool.len() < maxOrphanBlocks; i++ {
+		now = now.Add(time.Second)
+		peer := fmt.Sprintf("peer%d", i%(maxOrphanBlocks/maxOrphansPerPeer))
+		if err := pool.add(makeOrphan(common.BigToHash(big.NewInt(int64(i))), 10, 0), peer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now = now.Add(time.Second)
+	if err := pool.add(makeOrphan(common.Hash{0xfe}, 10, 0), "honest"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pool.blocks[old.Hash()]; !ok {
+		t.Fatal("orphan of the smallest share evicted")
+	}
+	if _, ok := pool.blocks[makeOrphan(common.BigToHash(big.NewInt(0)), 10, 0).Hash()]; ok {
+		t.Fatal("oldest orphan of the largest share not evicted")
+	}
+}
+
+func TestOrphanPoolDiscard(t *testing.T) {
+	pool := newOrphanPool()
+
+	bad := makeOrphan(common.Hash{1}, 5, 0)
+	child := makeOrphan(bad.Hash(), 6, 0)
+	unrelated := makeOrphan(common.Hash{2}, 5, 0)
+	for _, block := range []*obstypes.ObsidianBlock{bad, child, unrelated} {
+		pool.add(block, "peer")
+	}
+	pool.discard(bad.Hash())
+	if pool.len() != 1 {
+		t.Fatalf("descendants of a bad block kept: %d orphans", pool.len())
+	}
+}
+
+func TestHandlerFetchesOrphanAncestors(t *testing.T) {
+	chain := makeTestChain(10)
+
+	sink := newTestChainBackend(chain[:5])
+	sink.held = true
+	h := NewHandler(1719, sink)
+	defer h.Stop()
+
+	source := newTestChainBackend(chain)
+	source.held = true
+	sh := NewHandler(1719, source)
+	defer sh.Stop()
+
+	sinkID, _ := connectHandlers(t, h, sh)
+	waitFor(t, func() bool { return h.PeerCount() == 1 && sh.PeerCount() == 1 })
+
+	// Announce the head: the sink has to fetch the blocks in between by hash
+	sh.peersMu.RLock()
+	p := sh.peers[sinkID]
+	sh.peersMu.RUnlock()
+	if err := sh.sendNewBlock(p, chain[9]); err != nil {
+		t.Fatal(err)
+	}
+	waitForHead(t, sink, 10, 5*time.Second)
+
+	if n := h.orphans.len(); n != 0 {
+		t.Fatalf("orphans left after import: %d", n)
+	}
+}
+
+func TestHandlerRejectsUnsealedOrphan(t *testing.T) {
+	backend := newTestBackend()
+	h := NewHandler(1719, backend)
+	defer h.Stop()
+
+	peer := newTestPeer(t, h, backend)
+	header := makeOrphan(common.Hash{1}, 5, 0).Header()
+	header.Difficulty = new(big.Int)
+	orphan := obstypes.NewBlockWithHeader(header)
+	if err := p2p.Send(peer.rw, NewBlockMsg, &NewBlockPacket{Block: orphan, TD: big.NewInt(10)}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		_, banned := h.scorer.Banned(peer.id.String())
+		return banned
+	})
+	if n := h.orphans.len(); n != 0 {
+		t.Fatalf("unsealed orphan pooled: %d orphans", n)
+	}
+}
@@ -0,0 +1,346 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package p2p
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/obsidian-chain/obsidian/core/rawdb"
+	"github.com/obsidian-chain/obsidian/metrics"
+)
+
+// Peer scoring configuration
+const (
+	// maxPeerScore caps the credit a peer can build up with useful responses,
+	// so a long-lived peer can't buy itself immunity from bans.
+	maxPeerScore = 100
+
+	// peerDropScore is the score at or below which a peer is disconnected and
+	// banned.
+	peerDropScore = -100
+
+	// peerScoreRecovery is how long it takes for a score to move one point
+	// back towards zero.
+	peerScoreRecovery = 30 * time.Second
+
+	// peerBanDuration is the length of a first ban. Every repeated offence
+	// doubles it, up to maxPeerBanDuration.
+	peerBanDuration    = 30 * time.Minute
+	maxPeerBanDuration = 7 * 24 * time.Hour
+
+	// peerBanMemory is how long an expired ban is remembered, so that a
+	// repeat offence gets a longer ban. Older bans are deleted.
+	peerBanMemory = 30 * 24 * time.Hour
+
+	// maxTrackedScores is the number of peer scores kept before neutral ones
+	// are pruned.
+	maxTrackedScores = 4096
+)
+
+// errPeerBanned is returned when a banned peer connects or a peer's score
+// drops low enough to get it banned
+var errPeerBanned = errors.New("peer banned")
+
+// PeerEvent is a peer behaviour that affects its score
+type PeerEvent int
+
+const (
+	EventUsefulResponse PeerEvent = iota
+	EventDuplicateAnnounce
+	EventTimeout
+	EventInvalidTx
+	EventUnknownMessage
+	EventOversizedMessage
+	EventInvalidResponse
+	EventInvalidBlock
+)
+
+// peerEventWeights is the score change caused by each event
+var peerEventWeights = map[PeerEvent]int{
+	EventUsefulResponse:    1,
+	EventDuplicateAnnounce: -2,
+	EventTimeout:           -10,
+	EventInvalidTx:         -10,
+	EventUnknownMessage:    -20,
+	EventOversizedMessage:  -50,
+	EventInvalidResponse:   -50,
+	EventInvalidBlock:      -100,
+}
+
+// String implements fmt.Stringer
+func (e PeerEvent) String() string {
+	switch e {
+	case EventUsefulResponse:
+		return "useful response"
+	case EventDuplicateAnnounce:
+		return "duplicate announcement"
+	case EventTimeout:
+		return "timeout"
+	case EventInvalidTx:
+		return "invalid transaction"
+	case EventUnknownMessage:
+		return "unknown message"
+	case EventOversizedMessage:
+		return "oversized message"
+	case EventInvalidResponse:
+		return "invalid response"
+	case EventInvalidBlock:
+		return "invalid block"
+	default:
+		return "unknown event"
+	}
+}
+
+// PeerBan describes a ban on a remote node
+type PeerBan struct {
+	ID       string    `json:"id"`
+	Until    time.Time `json:"until"`
+	Offences uint64    `json:"offences"`
+	Reason   string    `json:"reason"`
+}
+
+// peerScore is the running score of a node
+type peerScore struct {
+	score   int
+	updated time.Time
+}
+
+// PeerScorer tracks peer behaviour across connections and bans nodes whose
+// score drops too low. Bans are persisted so they survive restarts.
+type PeerScorer struct {
+	db *rawdb.Database // Ban persistence, nil for in-memory only
+
+	mu     sync.Mutex
+	scores map[string]*peerScore
+	bans   map[string]*rawdb.PeerBan
+
+	now func() time.Time
+	log log.Logger
+}
+
+// NewPeerScorer creates a peer scorer, loading any unexpired bans from db.
+// A nil db keeps bans in memory only.
+func NewPeerScorer(db *rawdb.Database) *PeerScorer {
+	s := &PeerScorer{
+		db:     db,
+		scores: make(map[string]*peerScore),
+		bans:   make(map[string]*rawdb.PeerBan),
+		now:    time.Now,
+		log:    log.New("module", "peerscore"),
+	}
+	if db != nil {
+		s.bans = rawdb.ReadPeerBans(db)
+	}
+	s.pruneBans(s.now())
+	// Offence counts are kept after a ban expires so repeat offenders get
+	// longer bans, only the active ones count towards the gauge
+	metrics.SetPeersBanned(int64(s.activeBans()))
+	return s
+}
+
+// Record applies an event to a peer's score. It returns the new score and
+// whether the event got the peer banned.
+func (s *PeerScorer) Record(id string, ev PeerEvent) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	ps := s.scores[id]
+	if ps == nil {
+		if len(s.scores) >= maxTrackedScores {
+			s.prune(now)
+		}
+		ps = &peerScore{updated: now}
+		s.scores[id] = ps
+	}
+	s.recover(ps, now)
+
+	weight := peerEventWeights[ev]
+	ps.score += weight
+	if ps.score > maxPeerScore {
+		ps.score = maxPeerScore
+	}
+	if weight < 0 {
+		metrics.RecordPeerPenalty()
+	}
+	if ps.score > peerDropScore {
+		return ps.score, false
+	}
+	score := ps.score
+	s.ban(id, ev.String(), now)
+	return score, true
+}
+
+// Score returns the current score of a peer
+func (s *PeerScorer) Score(id string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ps := s.scores[id]
+	if ps == nil {
+		return 0
+	}
+	s.recover(ps, s.now())
+	return ps.score
+}
+
+// Ban bans a node for a duration that grows with every offence
+func (s *PeerScorer) Ban(id string, reason string) PeerBan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.ban(id, reason, s.now())
+}
+
+// Banned returns the ban on a node, if there is an active one
+func (s *PeerScorer) Banned(id string) (PeerBan, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ban := s.bans[id]
+	if ban == nil || uint64(s.now().Unix()) >= ban.Until {
+		return PeerBan{}, false
+	}
+	return newPeerBan(id, ban), true
+}
+
+// Unban lifts the ban on a node and resets its score. The offence count is
+// kept. It reports whether the node was banned.
+func (s *PeerScorer) Unban(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ban := s.bans[id]
+	if ban == nil || uint64(s.now().Unix()) >= ban.Until {
+		return false
+	}
+	ban.Until = uint64(s.now().Unix())
+	if s.db != nil {
+		rawdb.WritePeerBan(s.db, id, ban)
+	}
+	delete(s.scores, id)
+	metrics.SetPeersBanned(int64(s.activeBans()))
+	return true
+}
+
+// Bans returns all active bans, soonest to expire first
+func (s *PeerScorer) Bans() []PeerBan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := uint64(s.now().Unix())
+	bans := make([]PeerBan, 0, len(s.bans))
+	for id, ban := range s.bans {
+		if now < ban.Until {
+			bans = append(bans, newPeerBan(id, ban))
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Until.Before(bans[j].Until)
+	})
+	return bans
+}
+
+// ban records a ban and persists it. It must be called with the lock held.
+func (s *PeerScorer) ban(id string, reason string, now time.Time) PeerBan {
+	s.pruneBans(now)
+
+	ban := s.bans[id]
+	if ban == nil {
+		ban = new(rawdb.PeerBan)
+		s.bans[id] = ban
+	}
+	duration := peerBanDuration
+	for i := uint64(0); i < ban.Offences && duration < maxPeerBanDuration; i++ {
+		duration *= 2
+	}
+	if duration > maxPeerBanDuration {
+		duration = maxPeerBanDuration
+	}
+	ban.Offences++
+	ban.Until = uint64(now.Add(duration).Unix())
+	ban.Reason = reason
+
+	if s.db != nil {
+		rawdb.WritePeerBan(s.db, id, ban)
+	}
+	// Start from a clean slate once the ban expires
+	delete(s.scores, id)
+
+	metrics.RecordPeerBan()
+	metrics.SetPeersBanned(int64(s.activeBans()))
+	s.log.Info("Banned peer", "id", id, "reason", reason, "offences", ban.Offences, "duration", duration)
+	return newPeerBan(id, ban)
+}
+
+// recover moves a score back towards zero for the time passed since its last
+// update. It must be called with the lock held.
+func (s *PeerScorer) recover(ps *peerScore, now time.Time) {
+	steps := int(now.Sub(ps.updated) / peerScoreRecovery)
+	if steps <= 0 {
+		return
+	}
+	ps.updated = ps.updated.Add(time.Duration(steps) * peerScoreRecovery)
+
+	switch {
+	case ps.score > steps:
+		ps.score -= steps
+	case ps.score < -steps:
+		ps.score += steps
+	default:
+		ps.score = 0
+	}
+}
+
+// prune drops the scores that have recovered to neutral. It must be called
+// with the lock held.
+func (s *PeerScorer) prune(now time.Time) {
+	for id, ps := range s.scores {
+		s.recover(ps, now)
+		if ps.score == 0 {
+			delete(s.scores, id)
+		}
+	}
+}
+
+// pruneBans deletes the bans that expired longer than peerBanMemory ago. It
+// must be called with the lock held.
+func (s *PeerScorer) pruneBans(now time.Time) {
+	cutoff := now.Add(-peerBanMemory).Unix()
+	for id, ban := range s.bans {
+		if int64(ban.Until) > cutoff {
+			continue
+		}
+		delete(s.bans, id)
+		if s.db != nil {
+			rawdb.DeletePeerBan(s.db, id)
+		}
+	}
+}
+
+// activeBans counts the unexpired bans. It must be called with the lock held.
+func (s *PeerScorer) activeBans() int {
+	now := uint64(s.now().Unix())
+
+	var count int
+	for _, ban := range s.bans {
+		if now < ban.Until {
+			count++
+		}
+	}
+	return count
+}
+
+func newPeerBan(id string, ban *rawdb.PeerBan) PeerBan {
+	return PeerBan{
+		ID:       id,
+		Until:    time.Unix(int64(ban.Until), 0),
+		Offences: ban.Offences,
+		Reason:   ban.Reason,
+	}
+}
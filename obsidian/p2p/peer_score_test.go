@@ -0,0 +1,270 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package p2p
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/obsidian-chain/obsidian/core/rawdb"
+)
+
+// newTestScorer creates a scorer with a controllable clock, starting at the
+// current second so that loading doesn't prune fresh bans
+func newTestScorer(db *rawdb.Database) (*PeerScorer, *time.Time) {
+	now := time.Now().Truncate(time.Second)
+	s := NewPeerScorer(db)
+	s.now = func() time.Time { return now }
+	return s, &now
+}
+
+func TestPeerScoreBan(t *testing.T) {
+	s, now := newTestScorer(nil)
+
+	for i := 0; i < 9; i++ {
+		if _, banned := s.Record("a", EventInvalidTx); banned {
+			t.Fatalf("banned after %d invalid transactions", i+1)
+		}
+	}
+	if _, banned := s.Record("a", EventInvalidTx); !banned {
+		t.Fatal("peer not banned after reaching the drop score")
+	}
+	ban, ok := s.Banned("a")
+	if !ok {
+		t.Fatal("ban not recorded")
+	}
+	if want := now.Add(peerBanDuration); !ban.Until.Equal(want) {
+		t.Fatalf("ban expiry mismatch: have %v, want %v", ban.Until, want)
+	}
+	if s.Score("a") != 0 {
+		t.Fatalf("score not reset after ban: %d", s.Score("a"))
+	}
+
+	// Once the ban runs out a second offence is punished twice as long
+	*now = now.Add(peerBanDuration)
+	if _, ok := s.Banned("a"); ok {
+		t.Fatal("ban did not expire")
+	}
+	if _, banned := s.Record("a", EventInvalidBlock); !banned {
+		t.Fatal("invalid block did not get the peer banned")
+	}
+	ban, _ = s.Banned("a")
+	if want := now.Add(2 * peerBanDuration); ban.Offences != 2 || !ban.Until.Equal(want) {
+		t.Fatalf("repeat ban mismatch: have %d offences until %v, want 2 until %v", ban.Offences, ban.Until, want)
+	}
+}
+
+func TestPeerScoreRecovery(t *testing.T) {
+	s, now := newTestScorer(nil)
+
+	for i := 0; i < 5; i++ {
+		s.Record("a", EventTimeout)
+	}
+	if score := s.Score("a"); score != -50 {
+		t.Fatalf("score mismatch: have %d, want -50", score)
+	}
+	*now = now.Add(20 * peerScoreRecovery)
+	if score := s.Score("a"); score != -30 {
+		t.Fatalf("partially recovered score mismatch: have %d, want -30", score)
+	}
+	*now = now.Add(time.Hour)
+	if score := s.Score("a"); score != 0 {
+		t.Fatalf("score did not recover to neutral: %d", score)
+	}
+
+	// Useful responses can't build up unlimited credit
+	for i := 0; i < 2*maxPeerScore; i++ {
+		s.Record("b", EventUsefulResponse)
+	}
+	if score := s.Score("b"); score != maxPeerScore {
+		t.Fatalf("score not capped: have %d, want %d", score, maxPeerScore)
+	}
+}
+
+func TestPeerBanPersistence(t *testing.T) {
+	db, err := rawdb.NewDatabase(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	s, _ := newTestScorer(db)
+	s.Ban("a", "test")
+
+	// A fresh scorer on the same database still knows about the ban
+	reloaded, _ := newTestScorer(db)
+	ban, ok := reloaded.Banned("a")
+	if !ok || ban.Reason != "test" || ban.Offences != 1 {
+		t.Fatalf("ban not restored: %+v (banned %v)", ban, ok)
+	}
+	if !reloaded.Unban("a") {
+		t.Fatal("unban reported no active ban")
+	}
+	if _, ok := NewPeerScorer(db).Banned("a"); ok {
+		t.Fatal("unban was not persisted")
+	}
+}
+
+func TestPeerBanPruning(t *testing.T) {
+	db, err := rawdb.NewDatabase(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	s, now := newTestScorer(db)
+	s.Ban("a", "test")
+	s.Ban("b", "test")
+
+	// Long after the bans expired, the next ban forgets the old ones
+	*now = now.Add(peerBanDuration + peerBanMemory)
+	if ban := s.Ban("b", "test"); ban.Offences != 1 {
+		t.Fatalf("offences of a forgotten ban counted: have %d, want 1", ban.Offences)
+	}
+	bans := rawdb.ReadPeerBans(db)
+	if _, ok := bans["a"]; ok || len(bans) != 1 {
+		t.Fatalf("expired ban not deleted: %v", bans)
+	}
+}
+
+func TestHandlerBansMisbehavingPeer(t *testing.T) {
+	backend := newTestBackend()
+	h := NewHandler(1719, backend)
+	defer h.Stop()
+
+	peer := newTestPeer(t, h, backend)
+
+	// Keep sending messages the protocol doesn't define until the peer is
+	// dropped
+	const unknownMsg = StealthFilterHeadersMsg + 1
+	go func() {
+		for i := 0; i < 5; i++ {
+			if err := p2p.Send(peer.rw, unknownMsg, []uint{}); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case err := <-peer.errc:
+		if !errors.Is(err, errPeerBanned) {
+			t.Fatalf("unexpected disconnect reason: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("misbehaving peer was not dropped")
+	}
+	bans := h.PeerBans()
+	if len(bans) != 1 || bans[0].Reason != EventUnknownMessage.String() {
+		t.Fatalf("unexpected bans: %+v", bans)
+	}
+
+	// Reconnecting is refused until the ban is lifted
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	if err := h.runPeer(ProtocolVersion, p2p.NewPeer(peer.id, "test", nil), net); !errors.Is(err, errPeerBanned) {
+		t.Fatalf("banned peer reconnected: %v", err)
+	}
+}
+
+// A block that can't be imported for local reasons is not the peer's fault
+func TestHandlerLocalImportFailure(t *testing.T) {
+	backend := newTestBackend() // Fails every import
+	h := NewHandler(1719, backend)
+	defer h.Stop()
+
+	peer := newTestPeer(t, h, backend)
+	block := makeTestChain(1)[0]
+	if err := p2p.Send(peer.rw, NewBlockMsg, &NewBlockPacket{Block: block, TD: big.NewInt(2)}); err != nil {
+		t.Fatal(err)
+	}
+	// Messages are handled in order, so once a later request is answered the
+	// block has been processed. A dropped peer never reads the request, so it
+	// is sent in the background.
+	replied := make(chan struct{})
+	go func() {
+		if err := peer.send(GetBlockByNumberMsg, 1, uint64(0)); err != nil {
+			return
+		}
+		for {
+			msg, err := peer.rw.ReadMsg()
+			if err != nil {
+				return
+			}
+			msg.Discard()
+			if msg.Code == BlockMsg {
+				close(replied)
+				return
+			}
+		}
+	}()
+	select {
+	case <-replied:
+	case err := <-peer.errc:
+		t.Fatalf("peer dropped: %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for reply")
+	}
+	if score := h.scorer.Score(peer.id.String()); score < 0 {
+		t.Fatalf("peer penalised for a local failure: score %d", score)
+	}
+	if bans := h.PeerBans(); len(bans) != 0 {
+		t.Fatalf("peer banned for a local failure: %+v", bans)
+	}
+}
+
+// Announcements crossing on the wire aren't duplicates, but a peer repeating
+// its own announcement is penalised
+func TestHandlerCrossingAnnouncements(t *testing.T) {
+	backend := newTestBackend()
+	h := NewHandler(1719, backend)
+	defer h.Stop()
+
+	peer := newTestPeer(t, h, backend)
+	h.peersMu.RLock()
+	p := h.peers[peer.id.String()]
+	h.peersMu.RUnlock()
+
+	block := makeTestChain(1)[0]
+	announce := NewBlockHashesPacket{{Hash: block.Hash(), Number: block.NumberU64()}}
+	handled := func() {
+		t.Helper()
+		// Messages are handled in order, so once a later request is answered
+		// the announcement has been processed
+		if err := peer.send(GetBlockByNumberMsg, 1, uint64(0)); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			msg, err := peer.rw.ReadMsg()
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg.Discard()
+			if msg.Code == BlockMsg {
+				return
+			}
+		}
+	}
+
+	// We announce the block to the peer while it announces it to us
+	go h.sendNewBlockHashes(p, block)
+	waitFor(t, func() bool { return p.knownBlocks.Has(block.Hash()) })
+	if err := p2p.Send(peer.rw, NewBlockHashesMsg, announce); err != nil {
+		t.Fatal(err)
+	}
+	handled()
+	if score := h.scorer.Score(peer.id.String()); score != 0 {
+		t.Fatalf("peer penalised for a crossing announcement: score %d", score)
+	}
+
+	// Announcing it again is a duplicate
+	if err := p2p.Send(peer.rw, NewBlockHashesMsg, announce); err != nil {
+		t.Fatal(err)
+	}
+	handled()
+	if score := h.scorer.Score(peer.id.String()); score >= 0 {
+		t.Fatalf("repeated announcement not penalised: score %d", score)
+	}
+}
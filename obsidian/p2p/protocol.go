@@ -4,31 +4,61 @@
 package p2p
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"math/big"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/eth/ethconfig"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/obsidian-chain/obsidian/core"
+	"github.com/obsidian-chain/obsidian/core/forkid"
+	"github.com/obsidian-chain/obsidian/core/rawdb"
+	"github.com/obsidian-chain/obsidian/core/txpool"
 	obstypes "github.com/obsidian-chain/obsidian/core/types"
+	"github.com/obsidian-chain/obsidian/stealth/filter"
 )
 
 const (
 	// ProtocolName is the name of the Obsidian protocol
 	ProtocolName = "obs"
-	// ProtocolVersion is the version of the protocol
-	ProtocolVersion = 1
-	// ProtocolLength is the number of message types
-	ProtocolLength = 20
+	// ProtocolVersion is the latest version of the protocol
+	ProtocolVersion = OBS3
 
 	// Timeouts
 	handshakeTimeout = 5 * time.Second
 	syncTimeout      = 30 * time.Second
+
+	// softResponseLimit is the target maximum size of replies to data retrievals
+	softResponseLimit = 2 * 1024 * 1024
+)
+
+// Supported versions of the obs protocol. obs/2 tags every request and
+// response with a request ID, sends transactions as typed envelopes and
+// answers block requests with BlockMsg. obs/3 relays Dandelion++ stem
+// transactions and serves stealth filters.
+const (
+	OBS1 = 1
+	OBS2 = 2
+	OBS3 = 3
 )
 
+// ProtocolVersions are the supported versions of the obs protocol, newest
+// first. Peers run the highest version both sides support.
+var ProtocolVersions = []uint{OBS3, OBS2, OBS1}
+
+// ProtocolLengths are the number of message codes of every protocol version
+var ProtocolLengths = map[uint]uint64{OBS1: 20, OBS2: 20, OBS3: 25}
+
 // Message codes
 const (
 	StatusMsg             = 0x00
@@ -50,8 +80,18 @@ const (
 	PongMsg               = 0x10
 	GetBlockByNumberMsg   = 0x11
 	GetBlockByHashMsg     = 0x12
+	BlockMsg              = 0x13 // obs/2 and later
+	StemTxMsg             = 0x14 // obs/3 and later
+
+	GetStealthFiltersMsg       = 0x15 // obs/3 and later
+	StealthFiltersMsg          = 0x16 // obs/3 and later
+	GetStealthFilterHeadersMsg = 0x17 // obs/3 and later
+	StealthFilterHeadersMsg    = 0x18 // obs/3 and later
 )
 
+// errForkIDRejected is returned when a peer's fork ID doesn't match our chain
+var errForkIDRejected = errors.New("fork ID rejected")
+
 // StatusPacket is the network status packet
 type StatusPacket struct {
 	ProtocolVersion uint32
@@ -60,6 +100,21 @@ type StatusPacket struct {
 	HeadHash        common.Hash
 	HeadNumber      uint64
 	GenesisHash     common.Hash
+	ForkID          forkid.ID `rlp:"optional"` // Not sent on obs/1
+}
+
+// enrEntry is the ENR entry which advertises the obs protocol and the fork ID
+// of the node on the discovery network
+type enrEntry struct {
+	ForkID forkid.ID
+
+	// Ignore additional fields (for forward compatibility)
+	Rest []rlp.RawValue `rlp:"tail"`
+}
+
+// ENRKey implements enr.Entry
+func (e enrEntry) ENRKey() string {
+	return ProtocolName
 }
 
 // NewBlockHashesPacket is the block hash announcement packet
@@ -71,7 +126,8 @@ type BlockHashNumber struct {
 	Number uint64
 }
 
-// NewBlockPacket is the new block propagation packet
+// NewBlockPacket is the new block propagation packet. On obs/2 it's also
+// the payload of BlockMsg, the reply to GetBlockByHash and GetBlockByNumber.
 type NewBlockPacket struct {
 	Block *obstypes.ObsidianBlock
 	TD    *big.Int
@@ -106,9 +162,37 @@ type BlockBody struct {
 	Uncles       []*obstypes.ObsidianHeader
 }
 
+// GetReceiptsPacket is the request for the receipts of blocks by hash
+type GetReceiptsPacket []common.Hash
+
+// ReceiptsPacket is the response with the receipts of each requested block,
+// in request order up to the first block the peer couldn't serve
+type ReceiptsPacket []obstypes.Receipts
+
+// GetNodeDataPacket is the request for state trie nodes and contract code by
+// hash
+type GetNodeDataPacket []common.Hash
+
+// NodeDataPacket is the response with the known requested entries
+type NodeDataPacket [][]byte
+
 // TransactionsPacket is a batch of transactions
 type TransactionsPacket []*obstypes.StealthTransaction
 
+// NewPooledTxHashesPacket announces transactions by hash along with their
+// type and encoded size, so receivers can decide what to fetch
+type NewPooledTxHashesPacket struct {
+	Types  []byte
+	Sizes  []uint32
+	Hashes []common.Hash
+}
+
+// GetPooledTxPacket is the request for pooled transactions by hash
+type GetPooledTxPacket []common.Hash
+
+// PooledTransactionsPacket is the response with pooled transactions
+type PooledTransactionsPacket []*obstypes.StealthTransaction
+
 // Backend interface for blockchain operations
 type Backend interface {
 	// Chain information
@@ -118,14 +202,29 @@ type Backend interface {
 	GetTD(hash common.Hash) *big.Int
 	GenesisHash() common.Hash
 	ChainID() *big.Int
+	ChainConfig() *core.ChainConfig
+	ChainDb() *rawdb.Database
 
 	// Block operations
+	VerifyHeader(header *obstypes.ObsidianHeader) error
+	VerifySeal(header *obstypes.ObsidianHeader) error
 	InsertBlock(block *obstypes.ObsidianBlock) error
 	HasBlock(hash common.Hash) bool
+	GetReceipts(hash common.Hash) obstypes.Receipts
+
+	// State sync
+	SyncMode() ethconfig.SyncMode
+	InsertBlockWithoutState(block *obstypes.ObsidianBlock) error
+	InsertReceipts(hash common.Hash, receipts obstypes.Receipts) error
+	SnapSyncCommitHead(hash common.Hash) error
 
 	// Transaction pool
 	AddRemoteTxs(txs []*obstypes.StealthTransaction) []error
 	PendingTxs() []*obstypes.StealthTransaction
+	GetPoolTransaction(hash common.Hash) *obstypes.StealthTransaction
+
+	// Stealth filters
+	StealthFilterRange(start uint64, stop common.Hash, max uint64) *filter.Range
 }
 
 // Handler manages P2P protocol connections and message handling
@@ -133,6 +232,8 @@ type Handler struct {
 	networkID   uint64
 	genesisHash common.Hash
 	backend     Backend
+	forks       []uint64
+	forkFilter  forkid.Filter
 
 	// Peer management
 	peers     map[string]*Peer
@@ -140,24 +241,49 @@ type Handler struct {
 	maxPeers  int
 	peerCount int32
 
+	// Nodes offered to the P2P server for dialing
+	dialCandidates enode.Iterator
+
 	// Synchronization
-	syncing      int32
-	synchronizer *Synchronizer
-	downloader   *Downloader
+	downloader *Downloader
+	rates      *rateTrackers
+
+	// State sync
+	snapPeers map[string]*snapPeer // Guarded by peersMu
+	stateSync *stateSyncer
+
+	// Block and transaction retrieval
+	blockFetcher *BlockFetcher
+	txFetcher    *TxFetcher
+
+	// Misbehaviour tracking
+	scorer *PeerScorer
+
+	// Budget for answering peer requests
+	serving *serveLimiter
 
-	// Pending blocks (blocks waiting for parent to arrive)
-	pendingBlocks   map[common.Hash]*obstypes.ObsidianBlock // parentHash -> block
-	pendingBlocksMu sync.RWMutex
+	// Blocks waiting for their ancestors to arrive
+	orphans *orphanPool
+
+	// Dandelion++ transaction relay, nil unless enabled
+	dandelion *dandelion
+
+	// Stealth filter requests waiting for a reply
+	filterReqs *filterRequests
 
 	// Channels
 	quitCh          chan struct{}
 	blockAnnounceCh chan *obstypes.ObsidianBlock
 
+	// Last request ID handed out
+	reqID uint64
+
 	// Stats
 	blocksReceived uint64
 	blocksSent     uint64
 	txsReceived    uint64
 	txsSent        uint64
+	throttled      uint64
 }
 
 // Peer represents a connected peer
@@ -173,17 +299,33 @@ type Peer struct {
 	number uint64
 	lock   sync.RWMutex
 
+	// Measured retrieval throughput
+	rates *rateTracker
+
 	// Known blocks/txs (to avoid re-sending)
 	knownBlocks *knownCache
 	knownTxs    *knownCache
 
+	// Blocks the peer announced or sent to us, to catch repeated announcements
+	receivedBlocks *knownCache
+
 	// Queues
-	queuedBlocks chan *obstypes.ObsidianBlock
-	queuedTxs    chan []*obstypes.StealthTransaction
+	queuedBlocks    chan *obstypes.ObsidianBlock
+	queuedBlockAnns chan *obstypes.ObsidianBlock
+	queuedTxs       chan []*obstypes.StealthTransaction
+	queuedTxAnns    chan []*obstypes.StealthTransaction
+	queuedStemTxs   chan []*obstypes.StealthTransaction
 
 	term chan struct{}
 }
 
+// headNumber returns the number of the peer's head block
+func (p *Peer) headNumber() uint64 {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.number
+}
+
 // knownCache tracks known hashes
 type knownCache struct {
 	cache map[common.Hash]struct{}
@@ -225,12 +367,25 @@ func NewHandler(networkID uint64, backend Backend) *Handler {
 		backend:         backend,
 		genesisHash:     backend.GenesisHash(),
 		peers:           make(map[string]*Peer),
+		snapPeers:       make(map[string]*snapPeer),
 		maxPeers:        50,
-		pendingBlocks:   make(map[common.Hash]*obstypes.ObsidianBlock),
+		orphans:         newOrphanPool(),
+		filterReqs:      newFilterRequests(),
 		quitCh:          make(chan struct{}),
 		blockAnnounceCh: make(chan *obstypes.ObsidianBlock, 10),
 	}
+	h.setForks()
+	h.scorer = NewPeerScorer(backend.ChainDb())
+	h.serving = newServeLimiter(peerServeRate, peerServeBurst, globalServeRate, globalServeBurst)
+	h.rates = newRateTrackers()
 	h.downloader = NewDownloader(backend, h)
+	h.stateSync = newStateSyncer(h, backend.ChainDb())
+	h.blockFetcher = NewBlockFetcher(backend.HasBlock, h.requestBlockByHash)
+	h.blockFetcher.scorePeer = h.scorePeer
+	h.blockFetcher.Start()
+	h.txFetcher = NewTxFetcher(h.hasPoolTx, h.addPoolTxs, h.requestTxs)
+	h.txFetcher.scorePeer = h.scorePeer
+	h.txFetcher.Start()
 	return h
 }
 
@@ -238,60 +393,107 @@ func NewHandler(networkID uint64, backend Backend) *Handler {
 func (h *Handler) SetBackend(backend Backend) {
 	h.backend = backend
 	h.genesisHash = backend.GenesisHash()
+	h.setForks()
 }
 
-// SetSynchronizer sets the blockchain synchronizer
-func (h *Handler) SetSynchronizer(sync *Synchronizer) {
-	// Synchronizer is deprecated in favor of Downloader
-	h.synchronizer = sync
+// setForks derives the fork schedule and the fork ID filter from the backend
+func (h *Handler) setForks() {
+	h.forks = forkid.GatherForks(h.backend.ChainConfig())
+	h.forkFilter = forkid.NewFilter(h.forks, h.genesisHash, func() uint64 {
+		return h.backend.CurrentBlock().Number.Uint64()
+	})
 }
 
-// StartSync starts the blockchain synchronizer
-func (h *Handler) StartSync() error {
-	if h.downloader != nil {
-		h.downloader.Start()
+// forkID returns the fork ID of the local chain at its current head
+func (h *Handler) forkID() forkid.ID {
+	return forkid.NewID(h.forks, h.genesisHash, h.backend.CurrentBlock().Number.Uint64())
+}
+
+// checkForkID validates a fork ID advertised by a peer. obs/1 statuses carry
+// none, so there is nothing to check.
+func (h *Handler) checkForkID(id forkid.ID) error {
+	if id == (forkid.ID{}) {
 		return nil
 	}
-	if h.synchronizer == nil {
-		h.synchronizer = NewSynchronizer(h.backend, h)
+	if err := h.forkFilter(id); err != nil {
+		return fmt.Errorf("%w: %x/%d: %v", errForkIDRejected, id.Hash, id.Next, err)
 	}
-	return h.synchronizer.Start()
+	return nil
 }
 
-// StopSync stops the blockchain synchronizer
-func (h *Handler) StopSync() {
-	if h.downloader != nil {
-		h.downloader.Stop()
-	}
-	if h.synchronizer != nil {
-		h.synchronizer.Stop()
+// NodeFilter returns a predicate accepting nodes whose ENR advertises the obs
+// protocol with a fork ID compatible with the local chain. Discovery sources
+// can be wrapped with enode.Filter to only dial useful peers.
+func (h *Handler) NodeFilter() func(*enode.Node) bool {
+	return func(n *enode.Node) bool {
+		var entry enrEntry
+		if err := n.Load(&entry); err != nil {
+			return false
+		}
+		return h.forkFilter(entry.ForkID) == nil
 	}
 }
 
+// StartENRUpdater keeps the fork ID advertised in the local node record in
+// step with the chain. heads delivers the number of every new head; the
+// record is only re-signed when the head crosses a fork.
+func (h *Handler) StartENRUpdater(ln *enode.LocalNode, heads <-chan uint64) {
+	current := h.forkID()
+	ln.Set(&enrEntry{ForkID: current})
+
+	go func() {
+		for {
+			select {
+			case number := <-heads:
+				if id := forkid.NewID(h.forks, h.genesisHash, number); id != current {
+					current = id
+					ln.Set(&enrEntry{ForkID: id})
+				}
+			case <-h.quitCh:
+				return
+			}
+		}
+	}()
+}
+
+// StartSync starts the periodic sync checks of the downloader
+func (h *Handler) StartSync() error {
+	h.downloader.Start()
+	return nil
+}
+
+// StopSync stops the downloader, aborting any sync in progress
+func (h *Handler) StopSync() {
+	h.downloader.Stop()
+}
+
 // SyncProgress returns the current sync progress
 func (h *Handler) SyncProgress() (start, current, target uint64, syncing bool) {
-	if h.downloader != nil {
-		p := h.downloader.Progress()
-		return p.StartingBlock, p.CurrentBlock, p.HighestBlock, p.Syncing
-	}
-	if h.synchronizer != nil {
-		return h.synchronizer.Progress()
-	}
-	head := h.backend.CurrentBlock()
-	return head.Number.Uint64(), head.Number.Uint64(), head.Number.Uint64(), false
+	p := h.downloader.Progress()
+	return p.StartingBlock, p.CurrentBlock, p.HighestBlock, p.Syncing
 }
 
-// Protocol returns the P2P protocol descriptor
-func (h *Handler) Protocol() p2p.Protocol {
-	return p2p.Protocol{
-		Name:    ProtocolName,
-		Version: ProtocolVersion,
-		Length:  ProtocolLength,
-		Run:     h.runPeer,
-		NodeInfo: func() interface{} {
-			return h.NodeInfo()
-		},
+// Protocols returns a P2P protocol descriptor for every supported version of
+// the protocol. The P2P server runs the highest version a peer also supports.
+func (h *Handler) Protocols() []p2p.Protocol {
+	protocols := make([]p2p.Protocol, len(ProtocolVersions))
+	for i, version := range ProtocolVersions {
+		version := version
+		protocols[i] = p2p.Protocol{
+			Name:    ProtocolName,
+			Version: version,
+			Length:  ProtocolLengths[version],
+			Run: func(p *p2p.Peer, rw p2p.MsgReadWriter) error {
+				return h.runPeer(version, p, rw)
+			},
+			NodeInfo: func() interface{} {
+				return h.NodeInfo()
+			},
+			DialCandidates: h.dialCandidates,
+			Attributes:     []enr.Entry{&enrEntry{ForkID: h.forkID()}},
+		}
 	}
+	return protocols
 }
 
 // NodeInfo returns information about this node
@@ -302,6 +504,7 @@ func (h *Handler) NodeInfo() interface{} {
 		"genesis":    h.genesisHash.Hex(),
 		"head":       head.Hash().Hex(),
 		"headNumber": head.Number.Uint64(),
+		"forkId":     h.forkID(),
 	}
 }
 
@@ -316,27 +519,43 @@ func (h *Handler) PeerInfo(id string) interface{} {
 			"version": p.version,
 			"head":    p.head.Hex(),
 			"number":  p.number,
+			"score":   h.scorer.Score(id),
 		}
 	}
 	return nil
 }
 
-// runPeer handles a new peer connection
-func (h *Handler) runPeer(p *p2p.Peer, rw p2p.MsgReadWriter) error {
+// runPeer handles a new peer connection on the given protocol version
+func (h *Handler) runPeer(version uint, p *p2p.Peer, rw p2p.MsgReadWriter) error {
 	peer := &Peer{
-		Peer:         p,
-		rw:           rw,
-		id:           p.ID().String(),
-		knownBlocks:  newKnownCache(1024),
-		knownTxs:     newKnownCache(4096),
-		queuedBlocks: make(chan *obstypes.ObsidianBlock, 4),
-		queuedTxs:    make(chan []*obstypes.StealthTransaction, 4),
-		term:         make(chan struct{}),
-		td:           big.NewInt(0),
+		Peer:            p,
+		rw:              rw,
+		id:              p.ID().String(),
+		version:         uint32(version),
+		knownBlocks:     newKnownCache(1024),
+		knownTxs:        newKnownCache(4096),
+		receivedBlocks:  newKnownCache(1024),
+		queuedBlocks:    make(chan *obstypes.ObsidianBlock, 4),
+		queuedBlockAnns: make(chan *obstypes.ObsidianBlock, 4),
+		queuedTxs:       make(chan []*obstypes.StealthTransaction, 4),
+		queuedTxAnns:    make(chan []*obstypes.StealthTransaction, 4),
+		queuedStemTxs:   make(chan []*obstypes.StealthTransaction, 4),
+		term:            make(chan struct{}),
+		td:              big.NewInt(0),
+	}
+
+	// Refuse banned nodes before spending anything on them
+	if ban, banned := h.scorer.Banned(peer.id); banned {
+		log.Debug("Rejected banned peer", "peer", peer.id[:16], "until", ban.Until, "reason", ban.Reason)
+		return fmt.Errorf("%w until %v: %s", errPeerBanned, ban.Until.Format(time.RFC3339), ban.Reason)
 	}
 
 	// Perform handshake
 	if err := h.handshake(peer); err != nil {
+		if errors.Is(err, errForkIDRejected) {
+			log.Info("Dropping peer on a different fork", "peer", peer.id[:16], "err", err)
+			return err
+		}
 		log.Debug("Handshake failed", "peer", peer.id[:16], "err", err)
 		return err
 	}
@@ -383,13 +602,16 @@ func (h *Handler) sendStatus(p *Peer) error {
 	}
 
 	status := StatusPacket{
-		ProtocolVersion: ProtocolVersion,
+		ProtocolVersion: p.version,
 		NetworkID:       h.networkID,
 		TD:              td,
 		HeadHash:        head.Hash(),
 		HeadNumber:      head.Number.Uint64(),
 		GenesisHash:     h.genesisHash,
 	}
+	if p.version >= OBS2 {
+		status.ForkID = h.forkID()
+	}
 
 	return p2p.Send(p.rw, StatusMsg, &status)
 }
@@ -404,13 +626,16 @@ func (h *Handler) handshake(p *Peer) error {
 	}
 
 	ourStatus := StatusPacket{
-		ProtocolVersion: ProtocolVersion,
+		ProtocolVersion: p.version,
 		NetworkID:       h.networkID,
 		TD:              td,
 		HeadHash:        head.Hash(),
 		HeadNumber:      head.Number.Uint64(),
 		GenesisHash:     h.genesisHash,
 	}
+	if p.version >= OBS2 {
+		ourStatus.ForkID = h.forkID()
+	}
 
 	// Send our status
 	errc := make(chan error, 2)
@@ -453,19 +678,24 @@ func (h *Handler) handshake(p *Peer) error {
 	}
 
 	// Validate peer status
+	if peerStatus.ProtocolVersion != p.version {
+		return fmt.Errorf("protocol version mismatch: %d vs %d", peerStatus.ProtocolVersion, p.version)
+	}
 	if peerStatus.NetworkID != h.networkID {
 		return fmt.Errorf("network mismatch: %d vs %d", peerStatus.NetworkID, h.networkID)
 	}
 	if peerStatus.GenesisHash != h.genesisHash {
 		return fmt.Errorf("genesis mismatch: %s vs %s", peerStatus.GenesisHash.Hex()[:16], h.genesisHash.Hex()[:16])
 	}
+	if err := h.checkForkID(peerStatus.ForkID); err != nil {
+		return err
+	}
 	if peerStatus.HeadNumber > 0 && peerStatus.HeadHash == (common.Hash{}) {
 		return fmt.Errorf("invalid head hash for block %d", peerStatus.HeadNumber)
 	}
 
 	// Update peer state
 	p.lock.Lock()
-	p.version = peerStatus.ProtocolVersion
 	p.head = peerStatus.HeadHash
 	p.td = peerStatus.TD
 	p.number = peerStatus.HeadNumber
@@ -473,6 +703,7 @@ func (h *Handler) handshake(p *Peer) error {
 
 	log.Info("Peer handshake completed",
 		"peer", p.id[:16],
+		"version", p.version,
 		"head", p.number,
 		"td", p.td,
 	)
@@ -493,6 +724,7 @@ func (h *Handler) registerPeer(p *Peer) error {
 	}
 
 	h.peers[p.id] = p
+	p.rates = h.rates.Track(p.id)
 	atomic.AddInt32(&h.peerCount, 1)
 
 	log.Info("Peer registered",
@@ -502,11 +734,7 @@ func (h *Handler) registerPeer(p *Peer) error {
 	)
 
 	// Trigger sync if peer has higher TD
-	if h.downloader != nil {
-		go h.downloader.CheckAndSync()
-	} else {
-		go h.checkSync(p)
-	}
+	go h.downloader.CheckAndSync()
 
 	return nil
 }
@@ -514,18 +742,84 @@ func (h *Handler) registerPeer(p *Peer) error {
 // unregisterPeer removes a peer from the handler
 func (h *Handler) unregisterPeer(id string) {
 	h.peersMu.Lock()
-	defer h.peersMu.Unlock()
-
 	if p, ok := h.peers[id]; ok {
 		close(p.term)
 		delete(h.peers, id)
+		h.rates.Untrack(id)
 		atomic.AddInt32(&h.peerCount, -1)
 		log.Info("Peer unregistered", "peer", id[:16], "total", len(h.peers))
 	}
+	h.peersMu.Unlock()
+
+	// Hand any blocks and transactions we were fetching from this peer to
+	// other announcers
+	h.blockFetcher.Drop(id)
+	h.txFetcher.Drop(id)
+	h.serving.prune(time.Now())
+}
+
+// msgHandler handles a single protocol message from a peer
+type msgHandler func(h *Handler, p *Peer, msg p2p.Msg) error
+
+// obs1 maps the message codes of obs/1 to their handlers
+var obs1 = map[uint64]msgHandler{
+	StatusMsg:             (*Handler).handleStatus,
+	NewBlockHashesMsg:     (*Handler).handleNewBlockHashes,
+	TransactionsMsg:       (*Handler).handleTransactions,
+	GetBlockHeadersMsg:    (*Handler).handleGetBlockHeaders,
+	BlockHeadersMsg:       (*Handler).handleBlockHeaders,
+	GetBlockBodiesMsg:     (*Handler).handleGetBlockBodies,
+	BlockBodiesMsg:        (*Handler).handleBlockBodies,
+	NewBlockMsg:           (*Handler).handleNewBlock,
+	GetNodeDataMsg:        (*Handler).handleGetNodeData,
+	NodeDataMsg:           (*Handler).handleNodeData,
+	GetReceiptsMsg:        (*Handler).handleGetReceipts,
+	ReceiptsMsg:           (*Handler).handleReceipts,
+	NewPooledTxHashesMsg:  (*Handler).handleNewPooledTxHashes,
+	GetPooledTxMsg:        (*Handler).handleGetPooledTransactions,
+	PooledTransactionsMsg: (*Handler).handlePooledTransactions,
+	PingMsg:               (*Handler).handlePing,
+	PongMsg:               (*Handler).handlePong,
+	GetBlockByNumberMsg:   (*Handler).handleGetBlockByNumber,
+	GetBlockByHashMsg:     (*Handler).handleGetBlockByHash,
+}
+
+// obs2 maps the message codes of obs/2 to their handlers. The handlers of
+// messages shared with obs/1 unwrap the request envelopes themselves.
+var obs2 = map[uint64]msgHandler{
+	BlockMsg: (*Handler).handleBlock,
+}
+
+// obs3 maps the message codes obs/3 adds to obs/2 to their handlers
+var obs3 = map[uint64]msgHandler{
+	StemTxMsg:                  (*Handler).handleStemTransactions,
+	GetStealthFiltersMsg:       (*Handler).handleGetStealthFilters,
+	StealthFiltersMsg:          (*Handler).handleStealthFilters,
+	GetStealthFilterHeadersMsg: (*Handler).handleGetStealthFilterHeaders,
+	StealthFilterHeadersMsg:    (*Handler).handleStealthFilterHeaders,
+}
+
+func init() {
+	// Every version handles the messages of the one before it
+	for _, versions := range [][2]map[uint64]msgHandler{{obs2, obs1}, {obs3, obs2}} {
+		for code, handler := range versions[1] {
+			if _, ok := versions[0][code]; !ok {
+				versions[0][code] = handler
+			}
+		}
+	}
+}
+
+// msgHandlers are the message handlers of every supported protocol version
+var msgHandlers = map[uint32]map[uint64]msgHandler{
+	OBS1: obs1,
+	OBS2: obs2,
+	OBS3: obs3,
 }
 
 // handlePeer handles messages from a peer
 func (h *Handler) handlePeer(p *Peer) error {
+	handlers := msgHandlers[p.version]
 	for {
 		msg, err := p.rw.ReadMsg()
 		if err != nil {
@@ -533,87 +827,66 @@ func (h *Handler) handlePeer(p *Peer) error {
 		}
 
 		if msg.Size > 10*1024*1024 { // 10MB max message size
+			h.scorePeer(p.id, EventOversizedMessage)
 			return fmt.Errorf("message too large: %d", msg.Size)
 		}
 
-		switch msg.Code {
-		case StatusMsg:
-			var status StatusPacket
-			if err := msg.Decode(&status); err != nil {
-				return err
-			}
-			p.lock.Lock()
-			if status.TD != nil && (p.td == nil || status.TD.Cmp(p.td) > 0) {
-				p.head = status.HeadHash
-				p.td = status.TD
-				p.number = status.HeadNumber
-				log.Debug("Peer updated status", "peer", p.id[:16], "head", p.number, "td", p.td)
-			}
-			p.lock.Unlock()
-
-			// Trigger sync check if needed
-			if h.downloader != nil {
-				go h.downloader.CheckAndSync()
-			}
-
-		case NewBlockHashesMsg:
-			if err := h.handleNewBlockHashes(p, msg); err != nil {
-				return err
-			}
-
-		case TransactionsMsg:
-			if err := h.handleTransactions(p, msg); err != nil {
-				return err
-			}
-
-		case GetBlockHeadersMsg:
-			if err := h.handleGetBlockHeaders(p, msg); err != nil {
-				return err
-			}
-
-		case BlockHeadersMsg:
-			if err := h.handleBlockHeaders(p, msg); err != nil {
-				return err
-			}
-
-		case GetBlockBodiesMsg:
-			if err := h.handleGetBlockBodies(p, msg); err != nil {
-				return err
-			}
-
-		case BlockBodiesMsg:
-			if err := h.handleBlockBodies(p, msg); err != nil {
-				return err
-			}
-
-		case NewBlockMsg:
-			if err := h.handleNewBlock(p, msg); err != nil {
+		handler := handlers[msg.Code]
+		if handler == nil {
+			log.Debug("Unknown message", "code", msg.Code, "version", p.version)
+			_ = msg.Discard()
+			if err := h.scorePeer(p.id, EventUnknownMessage); err != nil {
 				return err
 			}
+			continue
+		}
+		if err := handler(h, p, msg); err != nil {
+			return err
+		}
+	}
+}
 
-		case GetBlockByNumberMsg:
-			if err := h.handleGetBlockByNumber(p, msg); err != nil {
-				return err
-			}
+// handleStatus handles the periodic status updates of a peer
+func (h *Handler) handleStatus(p *Peer, msg p2p.Msg) error {
+	var status StatusPacket
+	if err := msg.Decode(&status); err != nil {
+		return err
+	}
+	// The peer may have crossed a fork we don't know about
+	if err := h.checkForkID(status.ForkID); err != nil {
+		return err
+	}
+	p.lock.Lock()
+	if status.TD != nil && (p.td == nil || status.TD.Cmp(p.td) > 0) {
+		p.head = status.HeadHash
+		p.td = status.TD
+		p.number = status.HeadNumber
+		log.Debug("Peer updated status", "peer", p.id[:16], "head", p.number, "td", p.td)
+	}
+	p.lock.Unlock()
 
-		case GetBlockByHashMsg:
-			if err := h.handleGetBlockByHash(p, msg); err != nil {
-				return err
-			}
+	// Trigger sync check if needed
+	if h.downloader != nil {
+		go h.downloader.CheckAndSync()
+	}
+	return nil
+}
 
-		case PingMsg:
-			if err := p2p.Send(p.rw, PongMsg, nil); err != nil {
-				return err
-			}
+// handlePing answers a ping
+func (h *Handler) handlePing(p *Peer, msg p2p.Msg) error {
+	return p2p.Send(p.rw, PongMsg, nil)
+}
 
-		case PongMsg:
-			// Ignore pong
+// handlePong ignores a pong
+func (h *Handler) handlePong(p *Peer, msg p2p.Msg) error {
+	return nil
+}
 
-		default:
-			log.Debug("Unknown message", "code", msg.Code)
-			_ = msg.Discard()
-		}
-	}
+// handleNodeData drops node data replies, nothing is requested by hash alone
+// since state sync runs over obssnap
+func (h *Handler) handleNodeData(p *Peer, msg p2p.Msg) error {
+	log.Debug("Unsolicited node data", "peer", p.id[:16])
+	return msg.Discard()
 }
 
 // handleNewBlockHashes handles new block hash announcements
@@ -624,6 +897,18 @@ func (h *Handler) handleNewBlockHashes(p *Peer, msg p2p.Msg) error {
 	}
 
 	for _, announce := range announces {
+		// Only the peer repeating itself is at fault: a block we announced to
+		// it may cross its own announcement on the wire
+		if p.receivedBlocks.Has(announce.Hash) {
+			if err := h.scorePeer(p.id, EventDuplicateAnnounce); err != nil {
+				return err
+			}
+			continue
+		}
+		p.receivedBlocks.Add(announce.Hash)
+		if p.knownBlocks.Has(announce.Hash) {
+			continue
+		}
 		p.knownBlocks.Add(announce.Hash)
 
 		p.lock.Lock()
@@ -633,62 +918,193 @@ func (h *Handler) handleNewBlockHashes(p *Peer, msg p2p.Msg) error {
 		}
 		p.lock.Unlock()
 
-		if !h.backend.HasBlock(announce.Hash) {
-			log.Debug("New block hash announced",
-				"peer", p.id[:16],
-				"number", announce.Number,
-				"hash", announce.Hash.Hex()[:16],
-			)
-			// Request the block
-			go h.requestBlock(p, announce.Hash)
-		}
+		log.Debug("New block hash announced",
+			"peer", p.id[:16],
+			"number", announce.Number,
+			"hash", announce.Hash.Hex()[:16],
+		)
+		h.blockFetcher.Notify(p.id, announce.Hash)
 	}
 	return nil
 }
 
 // handleTransactions handles incoming transactions
 func (h *Handler) handleTransactions(p *Peer, msg p2p.Msg) error {
-	var txs TransactionsPacket
-	if err := msg.Decode(&txs); err != nil {
+	var raw rlp.RawValue
+	if err := msg.Decode(&raw); err != nil {
+		return fmt.Errorf("decode error: %v", err)
+	}
+	txs, err := p.decodeTxs(raw)
+	if err != nil {
+		return err
+	}
+
+	hashes := make([]common.Hash, len(txs))
+	for i, tx := range txs {
+		hashes[i] = tx.Hash()
+		p.knownTxs.Add(hashes[i])
+	}
+	h.seenFluffed(hashes)
+
+	log.Debug("Received transactions", "peer", p.id[:16], "count", len(txs))
+	return h.txFetcher.Enqueue(p.id, 0, txs, false)
+}
+
+// handleNewPooledTxHashes handles transaction announcements
+func (h *Handler) handleNewPooledTxHashes(p *Peer, msg p2p.Msg) error {
+	var ann NewPooledTxHashesPacket
+	if err := msg.Decode(&ann); err != nil {
 		return fmt.Errorf("decode error: %v", err)
 	}
 
+	for _, hash := range ann.Hashes {
+		p.knownTxs.Add(hash)
+	}
+	h.seenFluffed(ann.Hashes)
+	return h.txFetcher.Notify(p.id, ann.Types, ann.Sizes, ann.Hashes)
+}
+
+// handleGetPooledTransactions serves pooled transactions requested by hash
+func (h *Handler) handleGetPooledTransactions(p *Peer, msg p2p.Msg) error {
+	var query GetPooledTxPacket
+	id, err := p.decodePacket(msg, &query)
+	if err != nil {
+		return err
+	}
+
+	var (
+		limit = serveCaps[GetPooledTxMsg]
+		txs   = make(PooledTransactionsPacket, 0, len(query))
+		bytes uint64
+	)
+	if !h.throttle(p.id, serveCost(GetPooledTxMsg, len(query))) {
+		query = nil
+	}
+	for _, hash := range query {
+		if bytes >= limit.bytes || len(txs) >= limit.items {
+			break
+		}
+		// Stemmed transactions are kept secret until fluffed
+		tx := h.backend.GetPoolTransaction(hash)
+		if tx == nil || (h.dandelion != nil && h.dandelion.stemmed(hash)) {
+			continue
+		}
+		txs = append(txs, tx)
+		bytes += tx.Size()
+		p.knownTxs.Add(hash)
+	}
+
+	atomic.AddUint64(&h.txsSent, uint64(len(txs)))
+	packet, err := p.encodeTxs(txs)
+	if err != nil {
+		return err
+	}
+	return p.sendPacket(PooledTransactionsMsg, id, packet)
+}
+
+// handlePooledTransactions handles replies to our pooled transaction requests
+func (h *Handler) handlePooledTransactions(p *Peer, msg p2p.Msg) error {
+	var raw rlp.RawValue
+	id, err := p.decodePacket(msg, &raw)
+	if err != nil {
+		return err
+	}
+	txs, err := p.decodeTxs(raw)
+	if err != nil {
+		return err
+	}
+
 	for _, tx := range txs {
 		p.knownTxs.Add(tx.Hash())
 	}
 
+	log.Debug("Received pooled transactions", "peer", p.id[:16], "count", len(txs))
+	return h.txFetcher.Enqueue(p.id, id, txs, true)
+}
+
+// hasPoolTx reports whether a transaction is already in the pool
+func (h *Handler) hasPoolTx(hash common.Hash) bool {
+	return h.backend.GetPoolTransaction(hash) != nil
+}
+
+// addPoolTxs adds transactions received from a peer to the pool and relays the
+// ones that were accepted
+func (h *Handler) addPoolTxs(peer string, txs []*obstypes.StealthTransaction) []error {
 	errs := h.backend.AddRemoteTxs(txs)
+
+	accepted := make([]*obstypes.StealthTransaction, 0, len(txs))
 	for i, err := range errs {
 		if err != nil {
 			log.Debug("Failed to add transaction", "hash", txs[i].Hash().Hex()[:16], "err", err)
+			if invalidTx(err) {
+				h.scorePeer(peer, EventInvalidTx)
+			}
+			continue
 		}
+		accepted = append(accepted, txs[i])
 	}
 
 	atomic.AddUint64(&h.txsReceived, uint64(len(txs)))
-	log.Debug("Received transactions", "peer", p.id[:16], "count", len(txs))
-	return nil
+	h.BroadcastTxs(accepted)
+	return errs
+}
+
+// requestTxs asks a peer for the given pooled transactions
+func (h *Handler) requestTxs(peer string, id uint64, hashes []common.Hash) error {
+	h.peersMu.RLock()
+	p, ok := h.peers[peer]
+	h.peersMu.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("peer %s not registered", peer)
+	}
+	return p.sendPacket(GetPooledTxMsg, id, GetPooledTxPacket(hashes))
+}
+
+// requestBlockByHash asks a peer for an announced block
+func (h *Handler) requestBlockByHash(peer string, hash common.Hash) error {
+	h.peersMu.RLock()
+	p, ok := h.peers[peer]
+	h.peersMu.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("peer %s not registered", peer)
+	}
+	return p.sendPacket(GetBlockByHashMsg, h.nextRequestID(), hash)
 }
 
 // handleGetBlockHeaders handles block header requests
 func (h *Handler) handleGetBlockHeaders(p *Peer, msg p2p.Msg) error {
 	var query GetBlockHeadersPacket
-	if err := msg.Decode(&query); err != nil {
-		return fmt.Errorf("decode error: %v", err)
+	id, err := p.decodePacket(msg, &query)
+	if err != nil {
+		return err
 	}
 
+	// Skeleton requests ask for maxHeaderFetch headers at most, anything
+	// beyond that is only good for making us do pointless work
+	limit := serveCaps[GetBlockHeadersMsg]
+	if query.Amount > uint64(limit.items) {
+		query.Amount = uint64(limit.items)
+	}
 	headers := make(BlockHeadersPacket, 0, query.Amount)
+	if !h.throttle(p.id, serveCost(GetBlockHeadersMsg, int(query.Amount))) {
+		return p.sendPacket(BlockHeadersMsg, id, headers)
+	}
 
 	var origin uint64
 	if query.Origin.Hash != (common.Hash{}) {
 		block := h.backend.GetBlockByHash(query.Origin.Hash)
-		if block != nil {
-			origin = block.NumberU64()
+		if block == nil {
+			return p.sendPacket(BlockHeadersMsg, id, headers)
 		}
+		origin = block.NumberU64()
 	} else {
 		origin = query.Origin.Number
 	}
 
-	for i := uint64(0); i < query.Amount; i++ {
+	var bytes uint64
+	for i := uint64(0); i < query.Amount && bytes < limit.bytes; i++ {
 		var num uint64
 		if query.Reverse {
 			if origin < i*(query.Skip+1) {
@@ -704,21 +1120,26 @@ func (h *Handler) handleGetBlockHeaders(p *Peer, msg p2p.Msg) error {
 			break
 		}
 		headers = append(headers, block.Header())
+		bytes += block.Header().Size()
 	}
 
-	return p2p.Send(p.rw, BlockHeadersMsg, headers)
+	return p.sendPacket(BlockHeadersMsg, id, headers)
 }
 
 // handleBlockHeaders handles block header responses
 func (h *Handler) handleBlockHeaders(p *Peer, msg p2p.Msg) error {
 	var headers BlockHeadersPacket
-	if err := msg.Decode(&headers); err != nil {
-		return fmt.Errorf("decode error: %v", err)
+	id, err := p.decodePacket(msg, &headers)
+	if err != nil {
+		return err
 	}
 
 	log.Debug("Received block headers", "peer", p.id[:16], "count", len(headers))
+	if len(headers) > 0 {
+		h.scorePeer(p.id, EventUsefulResponse)
+	}
 	if h.downloader != nil {
-		h.downloader.DeliverHeaders(p, headers)
+		h.downloader.DeliverHeaders(p, id, headers)
 	}
 	return nil
 }
@@ -726,49 +1147,169 @@ func (h *Handler) handleBlockHeaders(p *Peer, msg p2p.Msg) error {
 // handleGetBlockBodies handles block body requests
 func (h *Handler) handleGetBlockBodies(p *Peer, msg p2p.Msg) error {
 	var hashes GetBlockBodiesPacket
-	if err := msg.Decode(&hashes); err != nil {
-		return fmt.Errorf("decode error: %v", err)
+	id, err := p.decodePacket(msg, &hashes)
+	if err != nil {
+		return err
 	}
 
-	bodies := make(BlockBodiesPacket, 0, len(hashes))
+	var (
+		limit  = serveCaps[GetBlockBodiesMsg]
+		bodies = make(BlockBodiesPacket, 0, len(hashes))
+		bytes  uint64
+	)
+	if !h.throttle(p.id, serveCost(GetBlockBodiesMsg, len(hashes))) {
+		hashes = nil
+	}
 	for _, hash := range hashes {
+		if bytes >= limit.bytes || len(bodies) >= limit.items {
+			break
+		}
 		block := h.backend.GetBlockByHash(hash)
 		if block != nil {
 			bodies = append(bodies, BlockBody{
 				Transactions: block.Transactions(),
 				Uncles:       block.Uncles(),
 			})
+			bytes += block.Size()
 		}
 	}
 
-	return p2p.Send(p.rw, BlockBodiesMsg, bodies)
+	return p.sendPacket(BlockBodiesMsg, id, bodies)
 }
 
 // handleBlockBodies handles block body responses
 func (h *Handler) handleBlockBodies(p *Peer, msg p2p.Msg) error {
 	var bodies BlockBodiesPacket
-	if err := msg.Decode(&bodies); err != nil {
-		return fmt.Errorf("decode error: %v", err)
+	id, err := p.decodePacket(msg, &bodies)
+	if err != nil {
+		return err
 	}
 
 	log.Debug("Received block bodies", "peer", p.id[:16], "count", len(bodies))
+	if len(bodies) > 0 {
+		h.scorePeer(p.id, EventUsefulResponse)
+	}
 	if h.downloader != nil {
-		h.downloader.DeliverBodies(p, bodies)
+		h.downloader.DeliverBodies(p, id, bodies)
 	}
 	return nil
 }
 
+// handleGetReceipts serves the receipts of blocks requested by hash
+func (h *Handler) handleGetReceipts(p *Peer, msg p2p.Msg) error {
+	var hashes GetReceiptsPacket
+	id, err := p.decodePacket(msg, &hashes)
+	if err != nil {
+		return err
+	}
+
+	var (
+		limit    = serveCaps[GetReceiptsMsg]
+		receipts = make(ReceiptsPacket, 0, len(hashes))
+		bytes    uint64
+	)
+	if !h.throttle(p.id, serveCost(GetReceiptsMsg, len(hashes))) {
+		hashes = nil
+	}
+	for _, hash := range hashes {
+		if bytes >= limit.bytes || len(receipts) >= limit.items {
+			break
+		}
+		// Replies are a prefix of the request, so stop at the first block
+		// whose receipts we can't vouch for
+		block := h.backend.GetBlockByHash(hash)
+		if block == nil {
+			break
+		}
+		results := h.backend.GetReceipts(hash)
+		if len(results) != len(block.Transactions()) {
+			break
+		}
+		for _, receipt := range results {
+			bytes += receipt.Size()
+		}
+		receipts = append(receipts, results)
+	}
+	return p.sendPacket(ReceiptsMsg, id, receipts)
+}
+
+// handleReceipts handles receipt responses
+func (h *Handler) handleReceipts(p *Peer, msg p2p.Msg) error {
+	var receipts ReceiptsPacket
+	id, err := p.decodePacket(msg, &receipts)
+	if err != nil {
+		return err
+	}
+
+	log.Debug("Received receipts", "peer", p.id[:16], "blocks", len(receipts))
+	if h.downloader != nil {
+		h.downloader.DeliverReceipts(p, id, receipts)
+	}
+	return nil
+}
+
+// handleGetNodeData serves state trie nodes and contract code by hash
+func (h *Handler) handleGetNodeData(p *Peer, msg p2p.Msg) error {
+	var hashes GetNodeDataPacket
+	id, err := p.decodePacket(msg, &hashes)
+	if err != nil {
+		return err
+	}
+
+	var (
+		db    = h.backend.ChainDb()
+		limit = serveCaps[GetNodeDataMsg]
+		data  = make(NodeDataPacket, 0, len(hashes))
+		bytes uint64
+	)
+	if !h.throttle(p.id, serveCost(GetNodeDataMsg, len(hashes))) {
+		hashes = nil
+	}
+	for i, hash := range hashes {
+		if db == nil || bytes >= limit.bytes || i >= limit.items {
+			break
+		}
+		entry := rawdb.ReadTrieNode(db, hash)
+		if entry == nil {
+			entry = rawdb.ReadCode(db, hash)
+		}
+		if len(entry) == 0 {
+			continue
+		}
+		data = append(data, entry)
+		bytes += uint64(len(entry))
+	}
+	return p.sendPacket(NodeDataMsg, id, data)
+}
+
 // handleNewBlock handles new block propagation
 func (h *Handler) handleNewBlock(p *Peer, msg p2p.Msg) error {
 	var packet NewBlockPacket
 	if err := msg.Decode(&packet); err != nil {
 		return fmt.Errorf("decode error: %v", err)
 	}
+	return h.processBlock(p, &packet)
+}
 
+// handleBlock handles an obs/2 reply to a block request. Replies are only
+// matched with their requests by block hash, so the request ID isn't needed.
+func (h *Handler) handleBlock(p *Peer, msg p2p.Msg) error {
+	var packet NewBlockPacket
+	if _, err := p.decodePacket(msg, &packet); err != nil {
+		return err
+	}
+	return h.processBlock(p, &packet)
+}
+
+// processBlock imports a block received from a peer, whether propagated or
+// requested, and relays it
+func (h *Handler) processBlock(p *Peer, packet *NewBlockPacket) error {
 	block := packet.Block
 	hash := block.Hash()
 
 	p.knownBlocks.Add(hash)
+	p.receivedBlocks.Add(hash)
+	h.blockFetcher.Deliver(hash)
 
 	// Update peer's head
 	p.lock.Lock()
@@ -779,13 +1320,6 @@ func (h *Handler) handleNewBlock(p *Peer, msg p2p.Msg) error {
 	}
 	p.lock.Unlock()
 
-	// Deliver to synchronizer if syncing
-	if h.synchronizer != nil && h.synchronizer.Syncing() {
-		h.synchronizer.DeliverBlock(block)
-		atomic.AddUint64(&h.blocksReceived, 1)
-		return nil
-	}
-
 	// Check if we already have this block
 	if h.backend.HasBlock(hash) {
 		log.Debug("Already have block", "number", block.NumberU64(), "hash", hash.Hex()[:16])
@@ -799,44 +1333,39 @@ func (h *Handler) handleNewBlock(p *Peer, msg p2p.Msg) error {
 		"txs", len(block.Transactions()),
 	)
 
-	// Check if we have the parent block
-	parentHash := block.ParentHash()
-	if !h.backend.HasBlock(parentHash) {
-		// Store in pending blocks (keyed by parent hash)
-		h.pendingBlocksMu.Lock()
-		h.pendingBlocks[parentHash] = block
-		pendingCount := len(h.pendingBlocks)
-		h.pendingBlocksMu.Unlock()
-
-		// We're missing parent block(s), need to sync
-		ourHead := h.backend.CurrentBlock()
-		ourNum := ourHead.Number.Uint64()
-		blockNum := block.NumberU64()
-
-		log.Info("Missing parent block, stored in pending",
-			"our_head", ourNum,
-			"received_block", blockNum,
-			"parent_hash", parentHash.Hex()[:16],
-			"pending_count", pendingCount,
-		)
+	// Pool the block until its ancestors arrive if the parent is unknown
+	if !h.backend.HasBlock(block.ParentHash()) {
+		return h.handleOrphan(p, block)
+	}
 
-		// Request missing blocks from peer (only if we're behind)
-		if blockNum > ourNum+1 {
-			go h.syncMissingBlocks(p, ourNum+1, blockNum-1)
+	// Relay the block to a few peers as soon as it looks valid, the rest
+	// only hear about it once it has been imported
+	if err := h.verifyBlock(block); err != nil {
+		log.Debug("Received invalid block", "peer", p.id[:16], "number", block.NumberU64(), "hash", hash.Hex()[:16], "err", err)
+		if !errors.Is(err, core.ErrInvalidBlock) {
+			return nil
 		}
-		return nil
+		h.orphans.discard(hash)
+		return h.scorePeer(p.id, EventInvalidBlock)
 	}
+	h.propagateBlock(block)
 
 	// Insert block and process any pending children
 	if err := h.insertBlockAndChildren(block); err != nil {
 		log.Warn("Failed to insert received block", "err", err)
-		return nil // Don't disconnect, just log
+		// Only a block that fails validation is the peer's fault, not one
+		// we can't import for local reasons such as missing parent state
+		if !errors.Is(err, core.ErrInvalidBlock) {
+			return nil
+		}
+		h.orphans.discard(hash)
+		return h.scorePeer(p.id, EventInvalidBlock)
 	}
 
 	atomic.AddUint64(&h.blocksReceived, 1)
+	h.scorePeer(p.id, EventUsefulResponse)
 
-	// Propagate to other peers
-	h.BroadcastBlock(block)
+	h.announceBlock(block)
 
 	return nil
 }
@@ -844,8 +1373,12 @@ func (h *Handler) handleNewBlock(p *Peer, msg p2p.Msg) error {
 // handleGetBlockByNumber handles block by number requests
 func (h *Handler) handleGetBlockByNumber(p *Peer, msg p2p.Msg) error {
 	var number uint64
-	if err := msg.Decode(&number); err != nil {
-		return fmt.Errorf("decode error: %v", err)
+	id, err := p.decodePacket(msg, &number)
+	if err != nil {
+		return err
+	}
+	if !h.throttle(p.id, 1) {
+		return nil
 	}
 
 	block := h.backend.GetBlockByNumber(number)
@@ -853,19 +1386,18 @@ func (h *Handler) handleGetBlockByNumber(p *Peer, msg p2p.Msg) error {
 		return nil
 	}
 
-	td := h.backend.GetTD(block.Hash())
-	if td == nil {
-		td = big.NewInt(0)
-	}
-
-	return p2p.Send(p.rw, NewBlockMsg, &NewBlockPacket{Block: block, TD: td})
+	return h.replyBlock(p, id, block)
 }
 
 // handleGetBlockByHash handles block by hash requests
 func (h *Handler) handleGetBlockByHash(p *Peer, msg p2p.Msg) error {
 	var hash common.Hash
-	if err := msg.Decode(&hash); err != nil {
-		return fmt.Errorf("decode error: %v", err)
+	id, err := p.decodePacket(msg, &hash)
+	if err != nil {
+		return err
+	}
+	if !h.throttle(p.id, 1) {
+		return nil
 	}
 
 	block := h.backend.GetBlockByHash(hash)
@@ -873,17 +1405,26 @@ func (h *Handler) handleGetBlockByHash(p *Peer, msg p2p.Msg) error {
 		return nil
 	}
 
+	return h.replyBlock(p, id, block)
+}
+
+// replyBlock answers a block request. obs/1 has no reply message of its own,
+// so the block is sent as if it was propagated.
+func (h *Handler) replyBlock(p *Peer, id uint64, block *obstypes.ObsidianBlock) error {
 	td := h.backend.GetTD(block.Hash())
 	if td == nil {
 		td = big.NewInt(0)
 	}
-
-	return p2p.Send(p.rw, NewBlockMsg, &NewBlockPacket{Block: block, TD: td})
+	packet := &NewBlockPacket{Block: block, TD: td}
+	if p.version < OBS2 {
+		return p2p.Send(p.rw, NewBlockMsg, packet)
+	}
+	return p.sendPacket(BlockMsg, id, packet)
 }
 
 // requestBlock requests a block from a peer
 func (h *Handler) requestBlock(p *Peer, hash common.Hash) {
-	if err := p2p.Send(p.rw, GetBlockByHashMsg, hash); err != nil {
+	if err := p.sendPacket(GetBlockByHashMsg, h.nextRequestID(), hash); err != nil {
 		log.Debug("Failed to request block", "peer", p.id[:16], "err", err)
 	}
 }
@@ -898,12 +1439,30 @@ func (h *Handler) broadcastLoop(p *Peer) {
 				return
 			}
 
+		case block := <-p.queuedBlockAnns:
+			if err := h.sendNewBlockHashes(p, block); err != nil {
+				log.Debug("Failed to announce block", "peer", p.id[:16], "err", err)
+				return
+			}
+
 		case txs := <-p.queuedTxs:
 			if err := h.sendTransactions(p, txs); err != nil {
 				log.Debug("Failed to send transactions", "peer", p.id[:16], "err", err)
 				return
 			}
 
+		case txs := <-p.queuedTxAnns:
+			if err := h.sendPooledTxHashes(p, txs); err != nil {
+				log.Debug("Failed to announce transactions", "peer", p.id[:16], "err", err)
+				return
+			}
+
+		case txs := <-p.queuedStemTxs:
+			if err := h.sendStemTxs(p, txs); err != nil {
+				log.Debug("Failed to stem transactions", "peer", p.id[:16], "err", err)
+				return
+			}
+
 		case <-p.term:
 			return
 		}
@@ -923,183 +1482,217 @@ func (h *Handler) sendNewBlock(p *Peer, block *obstypes.ObsidianBlock) error {
 	return p2p.Send(p.rw, NewBlockMsg, &NewBlockPacket{Block: block, TD: td})
 }
 
+// sendNewBlockHashes announces a block to a peer without sending it
+func (h *Handler) sendNewBlockHashes(p *Peer, block *obstypes.ObsidianBlock) error {
+	p.knownBlocks.Add(block.Hash())
+	return p2p.Send(p.rw, NewBlockHashesMsg, NewBlockHashesPacket{{Hash: block.Hash(), Number: block.NumberU64()}})
+}
+
 // sendTransactions sends transactions to a peer
 func (h *Handler) sendTransactions(p *Peer, txs []*obstypes.StealthTransaction) error {
 	for _, tx := range txs {
 		p.knownTxs.Add(tx.Hash())
 	}
 	atomic.AddUint64(&h.txsSent, uint64(len(txs)))
-	return p2p.Send(p.rw, TransactionsMsg, TransactionsPacket(txs))
+	packet, err := p.encodeTxs(txs)
+	if err != nil {
+		return err
+	}
+	return p2p.Send(p.rw, TransactionsMsg, packet)
 }
 
-// BroadcastBlock sends a block to all connected peers
+// sendPooledTxHashes announces transactions to a peer without sending bodies
+func (h *Handler) sendPooledTxHashes(p *Peer, txs []*obstypes.StealthTransaction) error {
+	ann := NewPooledTxHashesPacket{
+		Types:  make([]byte, 0, len(txs)),
+		Sizes:  make([]uint32, 0, len(txs)),
+		Hashes: make([]common.Hash, 0, len(txs)),
+	}
+	for _, tx := range txs {
+		p.knownTxs.Add(tx.Hash())
+		ann.Types = append(ann.Types, tx.Type())
+		ann.Sizes = append(ann.Sizes, uint32(tx.Size()))
+		ann.Hashes = append(ann.Hashes, tx.Hash())
+	}
+	return p2p.Send(p.rw, NewPooledTxHashesMsg, &ann)
+}
+
+// BroadcastBlock propagates a block we created or imported to connected
+// peers: the full block goes to the square root of the peers that don't know
+// it yet, the others get an announcement and can fetch it if they need it
 func (h *Handler) BroadcastBlock(block *obstypes.ObsidianBlock) {
-	hash := block.Hash()
-	totalPeers := h.PeerCount()
+	h.propagateBlock(block)
+	h.announceBlock(block)
+}
 
+// verifyBlock performs the checks a block has to pass before it is relayed:
+// a valid header and proof of work on top of a known parent, and a body that
+// matches the header. The state transition is only checked on import.
+func (h *Handler) verifyBlock(block *obstypes.ObsidianBlock) error {
+	if err := h.backend.VerifyHeader(block.Header()); err != nil {
+		return err
+	}
+	if obstypes.DeriveSha(obstypes.StealthTransactions(block.Transactions())) != block.TxHash() {
+		return fmt.Errorf("%w: transaction root mismatch", core.ErrInvalidBlock)
+	}
+	if obstypes.CalcUncleHash(block.Uncles()) != block.UncleHash() {
+		return fmt.Errorf("%w: uncle hash mismatch", core.ErrInvalidBlock)
+	}
+	return nil
+}
+
+// unknownPeers returns the peers that don't know a block yet
+func (h *Handler) unknownPeers(hash common.Hash) []*Peer {
 	h.peersMu.RLock()
+	defer h.peersMu.RUnlock()
+
 	peers := make([]*Peer, 0, len(h.peers))
 	for _, p := range h.peers {
 		if !p.knownBlocks.Has(hash) {
 			peers = append(peers, p)
 		}
 	}
-	h.peersMu.RUnlock()
-
-	if totalPeers == 0 {
-		log.Debug("No peers connected, skipping broadcast",
-			"number", block.NumberU64(),
-			"hash", hash.Hex()[:16],
-		)
-		return
-	}
+	return peers
+}
 
+// propagateBlock sends a block in full to the square root of the peers that
+// don't know it yet
+func (h *Handler) propagateBlock(block *obstypes.ObsidianBlock) {
+	hash := block.Hash()
+	peers := h.unknownPeers(hash)
 	if len(peers) == 0 {
-		log.Debug("All peers already know this block",
-			"number", block.NumberU64(),
-			"hash", hash.Hex()[:16],
-			"total_peers", totalPeers,
-		)
 		return
 	}
-
-	// Broadcast to all peers that don't know this block
-	// We use a small worker pool or immediate dispatch but ensure we don't block
-	var sent int
-	for _, p := range peers {
+	direct := peers[:int(math.Sqrt(float64(len(peers))))]
+	for _, p := range direct {
 		p.knownBlocks.Add(hash) // Mark as known before sending to prevent duplicates
 		select {
 		case p.queuedBlocks <- block:
-			sent++
 		default:
-			// Queue full, send in background to not block the broadcaster
-			go func(peer *Peer, b *obstypes.ObsidianBlock) {
-				if err := h.sendNewBlock(peer, b); err != nil {
-					log.Debug("Failed to broadcast block to peer",
-						"peer", peer.id[:16],
-						"block", b.NumberU64(),
-						"err", err,
-					)
-				}
-			}(p, block)
-			sent++
+			log.Debug("Dropping block propagation", "peer", p.id[:16], "number", block.NumberU64())
 		}
 	}
+	log.Debug("Propagated block",
+		"number", block.NumberU64(),
+		"hash", hash.Hex()[:16],
+		"peers", len(direct),
+		"total_peers", h.PeerCount(),
+	)
+}
 
-	log.Info("Block broadcast initiated",
+// announceBlock announces a block by hash to every peer that doesn't know it
+// yet
+func (h *Handler) announceBlock(block *obstypes.ObsidianBlock) {
+	hash := block.Hash()
+	peers := h.unknownPeers(hash)
+	for _, p := range peers {
+		p.knownBlocks.Add(hash)
+		select {
+		case p.queuedBlockAnns <- block:
+		default:
+			log.Debug("Dropping block announcement", "peer", p.id[:16], "number", block.NumberU64())
+		}
+	}
+	log.Debug("Announced block",
 		"number", block.NumberU64(),
 		"hash", hash.Hex()[:16],
-		"peers", sent,
-		"total_peers", totalPeers,
+		"peers", len(peers),
+		"total_peers", h.PeerCount(),
 	)
 }
 
-// BroadcastTxs sends transactions to all connected peers
+// BroadcastTxs propagates transactions to connected peers. Full bodies only
+// go to the square root of the peers that don't know a transaction yet; the
+// others get an announcement and can fetch it if they need it.
 func (h *Handler) BroadcastTxs(txs []*obstypes.StealthTransaction) {
 	if len(txs) == 0 {
 		return
 	}
 
 	h.peersMu.RLock()
-	defer h.peersMu.RUnlock()
-
+	peers := make([]*Peer, 0, len(h.peers))
 	for _, p := range h.peers {
-		// Filter out known transactions
-		unknown := make([]*obstypes.StealthTransaction, 0, len(txs))
-		for _, tx := range txs {
-			if !p.knownTxs.Has(tx.Hash()) {
-				unknown = append(unknown, tx)
+		peers = append(peers, p)
+	}
+	h.peersMu.RUnlock()
+
+	direct := make(map[*Peer][]*obstypes.StealthTransaction)
+	announce := make(map[*Peer][]*obstypes.StealthTransaction)
+	for _, tx := range txs {
+		hash := tx.Hash()
+
+		unknown := make([]*Peer, 0, len(peers))
+		for _, p := range peers {
+			if !p.knownTxs.Has(hash) {
+				unknown = append(unknown, p)
 			}
 		}
-
-		if len(unknown) > 0 {
-			select {
-			case p.queuedTxs <- unknown:
-			default:
-				log.Debug("Dropping tx broadcast", "peer", p.id[:16])
+		numDirect := int(math.Sqrt(float64(len(unknown))))
+		for i, p := range unknown {
+			if i < numDirect {
+				direct[p] = append(direct[p], tx)
+			} else {
+				announce[p] = append(announce[p], tx)
 			}
 		}
 	}
-}
-
-// checkSync checks if we need to sync with a peer
-func (h *Handler) checkSync(p *Peer) {
-	// Use the synchronizer if available
-	if h.synchronizer != nil {
-		// Synchronizer handles its own sync checks
-		return
-	}
 
-	// Fallback: basic sync logic
-	if !atomic.CompareAndSwapInt32(&h.syncing, 0, 1) {
-		return
-	}
-	defer atomic.StoreInt32(&h.syncing, 0)
-
-	head := h.backend.CurrentBlock()
-	ourTD := h.backend.GetTD(head.Hash())
-	if ourTD == nil {
-		ourTD = big.NewInt(0)
-	}
-
-	p.lock.RLock()
-	peerTD := p.td
-	peerNum := p.number
-	p.lock.RUnlock()
-
-	if peerTD == nil || peerTD.Cmp(ourTD) <= 0 {
-		return
+	for p, txs := range direct {
+		select {
+		case p.queuedTxs <- txs:
+		default:
+			log.Debug("Dropping tx broadcast", "peer", p.id[:16])
+		}
 	}
-
-	log.Info("Starting sync with peer",
-		"peer", p.id[:16],
-		"ourHead", head.Number.Uint64(),
-		"peerHead", peerNum,
-	)
-
-	// Request blocks we're missing
-	for num := head.Number.Uint64() + 1; num <= peerNum; num++ {
-		if err := p2p.Send(p.rw, GetBlockByNumberMsg, num); err != nil {
-			log.Error("Failed to request block", "number", num, "err", err)
-			break
+	for p, txs := range announce {
+		select {
+		case p.queuedTxAnns <- txs:
+		default:
+			log.Debug("Dropping tx announcement", "peer", p.id[:16])
 		}
-		time.Sleep(100 * time.Millisecond) // Rate limit
 	}
 }
 
-// syncMissingBlocks requests missing blocks from a peer to fill gaps in our chain
-func (h *Handler) syncMissingBlocks(p *Peer, fromNum, toNum uint64) {
-	// Use synchronizer if available
-	if h.synchronizer != nil {
-		log.Info("Triggering synchronizer for missing blocks",
-			"peer", p.id[:16],
-			"from", fromNum,
-			"to", toNum,
-		)
-		_ = h.synchronizer.Start()
-		return
+// handleOrphan pools a block whose parent is unknown and goes after the
+// missing ancestors: a short gap is closed by asking the peer for them by
+// hash, a long one by syncing. Only blocks with a valid seal are pooled, so
+// filling the pool takes proof of work.
+func (h *Handler) handleOrphan(p *Peer, block *obstypes.ObsidianBlock) error {
+	hash := block.Hash()
+	if err := h.backend.VerifySeal(block.Header()); err != nil {
+		log.Debug("Orphan block with invalid seal", "peer", p.id[:16], "number", block.NumberU64(), "hash", hash.Hex()[:16], "err", err)
+		if !errors.Is(err, core.ErrInvalidBlock) {
+			return nil
+		}
+		return h.scorePeer(p.id, EventInvalidBlock)
+	}
+	if err := h.orphans.add(block, p.id); err != nil {
+		log.Debug("Orphan block dropped", "peer", p.id[:16], "number", block.NumberU64(), "hash", hash.Hex()[:16], "err", err)
+		return nil
 	}
+	ancestor, depth := h.orphans.missingAncestor(hash)
+	ancestorNum := block.NumberU64() - uint64(depth) // Number of the missing block
+	ourNum := h.backend.CurrentBlock().Number.Uint64()
 
-	// Fallback: request blocks directly
-	log.Info("Requesting missing blocks",
-		"peer", p.id[:16],
-		"from", fromNum,
-		"to", toNum,
+	log.Debug("Pooled orphan block",
+		"number", block.NumberU64(),
+		"hash", hash.Hex()[:16],
+		"missing", ancestorNum,
+		"orphans", h.orphans.len(),
 	)
-
-	for num := fromNum; num <= toNum; num++ {
-		if err := p2p.Send(p.rw, GetBlockByNumberMsg, num); err != nil {
-			log.Error("Failed to request block", "number", num, "err", err)
-			return
-		}
-		// Wait a bit for response before requesting next
-		time.Sleep(50 * time.Millisecond)
+	if ancestorNum > ourNum+maxAncestorFetch {
+		go h.downloader.CheckAndSync()
+		return nil
 	}
+	if h.orphans.request(ancestor) {
+		h.requestBlock(p, ancestor)
+	}
+	return nil
 }
 
-// insertBlockAndChildren inserts a block and any pending child blocks
+// insertBlockAndChildren inserts a block and then any pooled orphans that
+// descend from it
 func (h *Handler) insertBlockAndChildren(block *obstypes.ObsidianBlock) error {
-	// Insert the block
 	if err := h.backend.InsertBlock(block); err != nil {
 		return err
 	}
@@ -1108,46 +1701,135 @@ func (h *Handler) insertBlockAndChildren(block *obstypes.ObsidianBlock) error {
 		"number", block.NumberU64(),
 		"hash", block.Hash().Hex()[:16],
 	)
+	h.importOrphans(block.Hash())
+	return nil
+}
 
-	// Check if any pending blocks are waiting for this block as parent
-	blockHash := block.Hash()
-	for {
-		h.pendingBlocksMu.Lock()
-		child, exists := h.pendingBlocks[blockHash]
-		if exists {
-			delete(h.pendingBlocks, blockHash)
-		}
-		h.pendingBlocksMu.Unlock()
-
-		if !exists {
-			break
-		}
-
-		// Insert the child block
-		if err := h.backend.InsertBlock(child); err != nil {
-			log.Warn("Failed to insert pending child block",
+// importOrphans inserts the pooled descendants of a block that just made it
+// into the chain
+func (h *Handler) importOrphans(parent common.Hash) {
+	queue := []common.Hash{parent}
+	for len(queue) > 0 {
+		parent, queue = queue[0], queue[1:]
+
+		for _, orphan := range h.orphans.take(parent) {
+			child := orphan.block
+			if err := h.backend.InsertBlock(child); err != nil && !errors.Is(err, core.ErrKnownBlock) {
+				log.Warn("Failed to insert orphan block",
+					"number", child.NumberU64(),
+					"hash", child.Hash().Hex()[:16],
+					"err", err,
+				)
+				// Nothing built on a bad block can be imported either
+				h.orphans.discard(child.Hash())
+				if errors.Is(err, core.ErrInvalidBlock) {
+					h.scorePeer(orphan.peer, EventInvalidBlock)
+				}
+				continue
+			}
+			log.Info("Orphan block inserted",
 				"number", child.NumberU64(),
 				"hash", child.Hash().Hex()[:16],
-				"err", err,
 			)
-			break
+			atomic.AddUint64(&h.blocksReceived, 1)
+			h.BroadcastBlock(child)
+
+			queue = append(queue, child.Hash())
 		}
+	}
+}
 
-		log.Info("Pending block inserted",
-			"number", child.NumberU64(),
-			"hash", child.Hash().Hex()[:16],
-		)
+// scorePeer applies an event to a peer's score. If the peer gets banned it is
+// disconnected and an error is returned for the message loop to bail out on.
+func (h *Handler) scorePeer(id string, ev PeerEvent) error {
+	score, banned := h.scorer.Record(id, ev)
+	if !banned {
+		if ev != EventUsefulResponse {
+			log.Debug("Peer penalised", "peer", id[:16], "event", ev, "score", score)
+		}
+		return nil
+	}
+	h.peersMu.RLock()
+	p, sp := h.peers[id], h.snapPeers[id]
+	h.peersMu.RUnlock()
+	if p != nil {
+		go p.Disconnect(p2p.DiscUselessPeer)
+	}
+	if sp != nil {
+		go sp.Disconnect(p2p.DiscUselessPeer)
+	}
+	return fmt.Errorf("%w: %v", errPeerBanned, ev)
+}
 
-		atomic.AddUint64(&h.blocksReceived, 1)
+// invalidTx reports whether a pool rejection proves that a transaction is
+// malformed, rather than just stale or unaffordable
+func invalidTx(err error) bool {
+	for _, target := range []error{
+		txpool.ErrInvalidSender,
+		txpool.ErrInvalidEphemeralKey,
+		txpool.ErrInvalidViewTag,
+		txpool.ErrNegativeValue,
+		txpool.ErrOversizedData,
+		obstypes.ErrInvalidStealthTx,
+		obstypes.ErrMissingEphemeralKey,
+		obstypes.ErrInvalidViewTag,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
 
-		// Broadcast the child block too
-		h.BroadcastBlock(child)
+// PeerInfo is the status of a connected peer
+type PeerInfo struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	RemoteAddr string   `json:"remoteAddress"`
+	Inbound    bool     `json:"inbound"`
+	Version    uint32   `json:"version"`
+	Head       string   `json:"head"`
+	Number     uint64   `json:"number"`
+	TD         *big.Int `json:"totalDifficulty"`
+	Score      int      `json:"score"`
+}
 
-		// Continue with the next child
-		blockHash = child.Hash()
-	}
+// PeersInfo returns the status of all connected peers
+func (h *Handler) PeersInfo() []*PeerInfo {
+	peers := h.Peers()
+	infos := make([]*PeerInfo, 0, len(peers))
+	for _, p := range peers {
+		p.lock.RLock()
+		info := &PeerInfo{
+			ID:         p.id,
+			Name:       p.Name(),
+			RemoteAddr: p.RemoteAddr().String(),
+			Inbound:    p.Inbound(),
+			Version:    p.version,
+			Head:       p.head.Hex(),
+			Number:     p.number,
+		}
+		if p.td != nil {
+			info.TD = new(big.Int).Set(p.td)
+		}
+		p.lock.RUnlock()
+		info.Score = h.scorer.Score(p.id)
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
 
-	return nil
+// PeerBans returns all active peer bans
+func (h *Handler) PeerBans() []PeerBan {
+	return h.scorer.Bans()
+}
+
+// UnbanPeer lifts the ban on a node, reporting whether it was banned
+func (h *Handler) UnbanPeer(id string) bool {
+	return h.scorer.Unban(id)
 }
 
 // PeerCount returns the number of connected peers
@@ -1169,18 +1851,29 @@ func (h *Handler) Peers() []*Peer {
 
 // Stats returns P2P statistics
 func (h *Handler) Stats() map[string]interface{} {
+	announced, fetching, inflight := h.txFetcher.Stats()
+	blocksAnnounced, blocksFetching := h.blockFetcher.Stats()
 	return map[string]interface{}{
-		"peers":          h.PeerCount(),
-		"blocksReceived": atomic.LoadUint64(&h.blocksReceived),
-		"blocksSent":     atomic.LoadUint64(&h.blocksSent),
-		"txsReceived":    atomic.LoadUint64(&h.txsReceived),
-		"txsSent":        atomic.LoadUint64(&h.txsSent),
+		"peers":           h.PeerCount(),
+		"blocksReceived":  atomic.LoadUint64(&h.blocksReceived),
+		"blocksSent":      atomic.LoadUint64(&h.blocksSent),
+		"blocksAnnounced": blocksAnnounced,
+		"blocksFetching":  blocksFetching,
+		"txsReceived":     atomic.LoadUint64(&h.txsReceived),
+		"txsSent":         atomic.LoadUint64(&h.txsSent),
+		"txsAnnounced":    announced,
+		"txsFetching":     fetching,
+		"txInflightBytes": inflight,
+		"servesThrottled": atomic.LoadUint64(&h.throttled),
 	}
 }
 
 // Stop stops the handler
 func (h *Handler) Stop() {
 	close(h.quitCh)
+	h.downloader.Stop()
+	h.blockFetcher.Stop()
+	h.txFetcher.Stop()
 
 	h.peersMu.Lock()
 	for _, p := range h.peers {
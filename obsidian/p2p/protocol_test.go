@@ -0,0 +1,201 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package p2p
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/obsidian-chain/obsidian/core/forkid"
+	obstypes "github.com/obsidian-chain/obsidian/core/types"
+)
+
+// Every version advertises enough message codes for its messages, and obs/1
+// keeps the length it always had
+func TestProtocolLengths(t *testing.T) {
+	if ProtocolLengths[OBS1] != 20 {
+		t.Fatalf("obs/1 length changed to %d", ProtocolLengths[OBS1])
+	}
+	h := NewHandler(1719, newTestBackend())
+	defer h.Stop()
+
+	for _, proto := range h.Protocols() {
+		if proto.Length != ProtocolLengths[proto.Version] {
+			t.Errorf("obs/%d: advertised length %d, want %d", proto.Version, proto.Length, ProtocolLengths[proto.Version])
+		}
+		for code := range msgHandlers[uint32(proto.Version)] {
+			if code >= proto.Length {
+				t.Errorf("obs/%d: message %#x beyond length %d", proto.Version, code, proto.Length)
+			}
+		}
+	}
+}
+
+func TestHandshakeForkIDMismatch(t *testing.T) {
+	backend := newTestBackend()
+	h := NewHandler(1719, backend)
+	defer h.Stop()
+
+	var id enode.ID
+	rand.Read(id[:])
+
+	app, net := p2p.MsgPipe()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- h.runPeer(ProtocolVersion, p2p.NewPeer(id, "test", nil), net)
+	}()
+
+	// Same network and genesis, but the peer has activated a fork we don't know
+	status := StatusPacket{
+		ProtocolVersion: ProtocolVersion,
+		NetworkID:       h.networkID,
+		TD:              big.NewInt(1),
+		HeadHash:        backend.genesis.Hash(),
+		GenesisHash:     backend.genesis.Hash(),
+		ForkID:          forkid.NewID([]uint64{1}, backend.genesis.Hash(), 10),
+	}
+	go p2p.Send(app, StatusMsg, &status)
+	go func() {
+		if msg, err := app.ReadMsg(); err == nil {
+			msg.Discard()
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, errForkIDRejected) {
+			t.Fatalf("unexpected handshake error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("peer on a different fork was not rejected")
+	}
+	if h.PeerCount() != 0 {
+		t.Fatal("rejected peer was registered")
+	}
+}
+
+// legacyStatusPacket is the status message of obs/1 nodes predating fork IDs
+type legacyStatusPacket struct {
+	ProtocolVersion uint32
+	NetworkID       uint64
+	TD              *big.Int
+	HeadHash        common.Hash
+	HeadNumber      uint64
+	GenesisHash     common.Hash
+}
+
+// An obs/1 node without fork IDs can still complete the handshake
+func TestHandshakeLegacyStatus(t *testing.T) {
+	backend := newTestBackend()
+	h := NewHandler(1719, backend)
+	defer h.Stop()
+
+	var id enode.ID
+	rand.Read(id[:])
+
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	go h.runPeer(OBS1, p2p.NewPeer(id, "test", nil), net)
+
+	status := legacyStatusPacket{
+		ProtocolVersion: OBS1,
+		NetworkID:       h.networkID,
+		TD:              big.NewInt(1),
+		HeadHash:        backend.genesis.Hash(),
+		GenesisHash:     backend.genesis.Hash(),
+	}
+	go p2p.Send(app, StatusMsg, &status)
+
+	msg, err := app.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ours legacyStatusPacket
+	if err := msg.Decode(&ours); err != nil {
+		t.Fatalf("old node can't decode our status: %v", err)
+	}
+	waitFor(t, func() bool { return h.PeerCount() > 0 })
+}
+
+func TestNodeFilter(t *testing.T) {
+	backend := newTestBackend()
+	h := NewHandler(1719, backend)
+	defer h.Stop()
+
+	filter := h.NodeFilter()
+
+	if !filter(newTestNode(t, h.Protocols()[0].Attributes...)) {
+		t.Error("node advertising our own fork ID was filtered")
+	}
+	if filter(newTestNode(t)) {
+		t.Error("node without an obs entry was accepted")
+	}
+	other := &enrEntry{ForkID: forkid.ID{Hash: [4]byte{0xde, 0xad, 0xbe, 0xef}}}
+	if filter(newTestNode(t, other)) {
+		t.Error("node on a different chain was accepted")
+	}
+}
+
+// headBackend is a test backend whose head can be moved
+type headBackend struct {
+	*testBackend
+	head atomic.Uint64
+}
+
+func (b *headBackend) CurrentBlock() *obstypes.ObsidianHeader {
+	return &obstypes.ObsidianHeader{Number: new(big.Int).SetUint64(b.head.Load())}
+}
+
+// The fork ID in the node record follows the head across a fork
+func TestENRUpdater(t *testing.T) {
+	backend := &headBackend{testBackend: newTestBackend()}
+	backend.config.StealthRegistryBlock = big.NewInt(10)
+	h := NewHandler(1719, backend)
+	defer h.Stop()
+
+	db, err := enode.OpenDB("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	key, _ := crypto.GenerateKey()
+	ln := enode.NewLocalNode(db, key)
+
+	heads := make(chan uint64)
+	h.StartENRUpdater(ln, heads)
+
+	advertised := func() forkid.ID {
+		var entry enrEntry
+		if err := ln.Node().Load(&entry); err != nil {
+			t.Fatal(err)
+		}
+		return entry.ForkID
+	}
+	before := h.forkID()
+	if id := advertised(); id != before {
+		t.Fatalf("initial fork ID mismatch: have %x, want %x", id, before)
+	}
+
+	backend.head.Store(10)
+	heads <- 10
+	after := h.forkID()
+	if after == before {
+		t.Fatal("crossing a fork did not change the fork ID")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for advertised() != after {
+		if time.Now().After(deadline) {
+			t.Fatalf("node record not updated: have %x, want %x", advertised(), after)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package p2p
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/obsidian-chain/obsidian/metrics"
+	"golang.org/x/time/rate"
+)
+
+// Serving limits. The cost of a request is the number of entries it asks
+// for, capped at what a single reply may carry.
+const (
+	// peerServeRate and peerServeBurst bound the entries served to a single
+	// peer, which is plenty for a peer syncing from us.
+	peerServeRate  = 2048
+	peerServeBurst = 4096
+
+	// globalServeRate and globalServeBurst bound the entries served to all
+	// peers together, so that serving never starves block import.
+	globalServeRate  = 8192
+	globalServeBurst = 16384
+
+	// maxServeDelay is how long a request may be held back waiting for the
+	// budget to refill. Requests that would wait longer get an empty reply.
+	maxServeDelay = 500 * time.Millisecond
+
+	// snapServeCost is the cost of a state sync request, whose replies are
+	// bounded by size rather than entry count.
+	snapServeCost = 128
+)
+
+// serveCap limits the reply to a single retrieval request
+type serveCap struct {
+	items int    // Maximum number of entries in a reply
+	bytes uint64 // Target maximum size of a reply
+}
+
+// serveCaps are the reply limits per request message
+var serveCaps = map[uint64]serveCap{
+	GetBlockHeadersMsg: {items: maxHeaderFetch, bytes: softResponseLimit},
+	GetBlockBodiesMsg:  {items: 128, bytes: softResponseLimit},
+	GetReceiptsMsg:     {items: 1024, bytes: softResponseLimit},
+	GetNodeDataMsg:     {items: 384, bytes: softResponseLimit},
+	GetPooledTxMsg:     {items: 256, bytes: softResponseLimit},
+
+	GetStealthFiltersMsg:       {items: maxStealthFilterFetch, bytes: softResponseLimit},
+	GetStealthFilterHeadersMsg: {items: maxStealthFilterHeaderFetch, bytes: softResponseLimit},
+}
+
+// serveLimiter meters the work done answering peer requests with a token
+// bucket per peer and one shared by all peers
+type serveLimiter struct {
+	peerRate  rate.Limit
+	peerBurst int
+	global    *rate.Limiter
+
+	mu    sync.Mutex
+	peers map[string]*rate.Limiter
+}
+
+// newServeLimiter creates a limiter granting every peer rate entries per
+// second with the given burst, and all peers together globalRate entries
+func newServeLimiter(peerRate, peerBurst, globalRate, globalBurst int) *serveLimiter {
+	return &serveLimiter{
+		peerRate:  rate.Limit(peerRate),
+		peerBurst: peerBurst,
+		global:    rate.NewLimiter(rate.Limit(globalRate), globalBurst),
+		peers:     make(map[string]*rate.Limiter),
+	}
+}
+
+// admit charges the cost of a request to the peer's and the global budget.
+// It returns how long the request has to wait for the budget to cover it, or
+// false if that would take longer than maxServeDelay, in which case nothing
+// is charged.
+func (l *serveLimiter) admit(peer string, cost int, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limiter := l.peers[peer]
+	if limiter == nil {
+		limiter = rate.NewLimiter(l.peerRate, l.peerBurst)
+		l.peers[peer] = limiter
+	}
+	if cost > l.peerBurst {
+		cost = l.peerBurst
+	}
+	if burst := l.global.Burst(); cost > burst {
+		cost = burst
+	}
+	own := limiter.ReserveN(now, cost)
+	all := l.global.ReserveN(now, cost)
+
+	delay := own.DelayFrom(now)
+	if d := all.DelayFrom(now); d > delay {
+		delay = d
+	}
+	if delay > maxServeDelay {
+		own.CancelAt(now)
+		all.CancelAt(now)
+		return 0, false
+	}
+	return delay, true
+}
+
+// prune forgets the peers whose budget has refilled completely, as a fresh
+// bucket would be no different
+func (l *serveLimiter) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for peer, limiter := range l.peers {
+		if limiter.TokensAt(now) >= float64(l.peerBurst) {
+			delete(l.peers, peer)
+		}
+	}
+}
+
+// serveCost returns the cost of a request for the given number of entries
+func serveCost(code uint64, items int) int {
+	if limit, ok := serveCaps[code]; ok && items > limit.items {
+		items = limit.items
+	}
+	if items < 1 {
+		items = 1
+	}
+	return items
+}
+
+// throttle holds back a request from a peer until the serving budget covers
+// its cost. It returns false if the request should be answered with an empty
+// reply instead.
+func (h *Handler) throttle(peer string, cost int) bool {
+	delay, ok := h.serving.admit(peer, cost, time.Now())
+	if ok && delay == 0 {
+		return true
+	}
+	atomic.AddUint64(&h.throttled, 1)
+	metrics.RecordThrottledServe()
+	if !ok {
+		log.Debug("Refused request over serving budget", "peer", peer[:16], "cost", cost)
+		return false
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-h.quitCh:
+		return false
+	}
+}
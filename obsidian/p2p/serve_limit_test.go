@@ -0,0 +1,97 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package p2p
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServeLimiterPeerBudget(t *testing.T) {
+	l := newServeLimiter(10, 10, 1000, 1000)
+	now := time.Now()
+
+	if delay, ok := l.admit("a", 10, now); !ok || delay != 0 {
+		t.Fatalf("burst not admitted: delay %v, ok %v", delay, ok)
+	}
+	// Small overdrafts wait for the budget to refill
+	if delay, ok := l.admit("a", 4, now); !ok || delay != 400*time.Millisecond {
+		t.Fatalf("overdraft mishandled: delay %v, ok %v", delay, ok)
+	}
+	// Large ones are refused without being charged
+	if _, ok := l.admit("a", 5, now); ok {
+		t.Fatal("request beyond the maximum delay admitted")
+	}
+	if delay, ok := l.admit("a", 1, now); !ok || delay != 500*time.Millisecond {
+		t.Fatalf("refused request was charged: delay %v, ok %v", delay, ok)
+	}
+	// Other peers have budgets of their own
+	if delay, ok := l.admit("b", 10, now); !ok || delay != 0 {
+		t.Fatalf("peer charged for another: delay %v, ok %v", delay, ok)
+	}
+}
+
+func TestServeLimiterGlobalBudget(t *testing.T) {
+	l := newServeLimiter(100, 100, 10, 20)
+	now := time.Now()
+
+	if _, ok := l.admit("a", 20, now); !ok {
+		t.Fatal("global burst not admitted")
+	}
+	if _, ok := l.admit("b", 10, now); ok {
+		t.Fatal("request beyond the global budget admitted")
+	}
+	// Nothing was charged to b's own budget
+	if _, ok := l.admit("b", 100, now.Add(2*time.Second)); !ok {
+		t.Fatal("refused request was charged to the peer")
+	}
+}
+
+func TestServeLimiterPrune(t *testing.T) {
+	l := newServeLimiter(10, 10, 1000, 1000)
+	now := time.Now()
+
+	l.admit("a", 10, now)
+	l.admit("b", 1, now)
+	l.prune(now.Add(500 * time.Millisecond))
+	if _, ok := l.peers["a"]; !ok || len(l.peers) != 1 {
+		t.Fatalf("unexpected peers after prune: %v", l.peers)
+	}
+	l.prune(now.Add(time.Second))
+	if len(l.peers) != 0 {
+		t.Fatalf("refilled peers kept: %v", l.peers)
+	}
+}
+
+func TestHandlerThrottlesRequests(t *testing.T) {
+	chain := makeTestChain(2 * maxHeaderFetch)
+	backend := newTestChainBackend(chain)
+	h := NewHandler(1719, backend)
+	defer h.Stop()
+
+	// Enough budget for a single full reply and no refill to speak of
+	h.serving = newServeLimiter(1, maxHeaderFetch, 1, maxHeaderFetch)
+	peer := newTestPeer(t, h, backend.testBackend)
+
+	request := func(id uint64) BlockHeadersPacket {
+		query := &GetBlockHeadersPacket{Origin: HashOrNumber{Number: 1}, Amount: 2 * maxHeaderFetch}
+		if err := peer.send(GetBlockHeadersMsg, id, query); err != nil {
+			t.Fatal(err)
+		}
+		var headers BlockHeadersPacket
+		if _, err := peer.decode(peer.expectMsg(t, BlockHeadersMsg), &headers); err != nil {
+			t.Fatal(err)
+		}
+		return headers
+	}
+	if headers := request(1); len(headers) != maxHeaderFetch {
+		t.Fatalf("served %d headers, want %d", len(headers), maxHeaderFetch)
+	}
+	if headers := request(2); len(headers) != 0 {
+		t.Fatalf("served %d headers over budget", len(headers))
+	}
+	if throttled := h.Stats()["servesThrottled"]; throttled != uint64(1) {
+		t.Fatalf("throttled requests: %v, want 1", throttled)
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package simnet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p"
+)
+
+// errLinkDown is returned when writing to a link that has been cut
+var errLinkDown = errors.New("link down")
+
+// linkQueueSize is the number of messages a link buffers in each direction
+// before writers block
+const linkQueueSize = 1024
+
+// Link is a simulated connection between two nodes. Messages are delivered
+// in order, each after the link's latency.
+type Link struct {
+	a, b *Node
+
+	mu      sync.Mutex
+	latency time.Duration
+	pipe    *p2p.MsgPipeRW // Nil while the link is down
+	closed  chan struct{}
+	sent    map[uint64]int // Messages sent either way, by code
+}
+
+// Latency returns the delay the link adds to every message
+func (l *Link) Latency() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.latency
+}
+
+// SetLatency changes the delay of messages sent from now on
+func (l *Link) SetLatency(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.latency = d
+}
+
+// Sent returns the number of messages with the given code the link has
+// carried in either direction, over all of its connections
+func (l *Link) Sent(code uint64) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sent[code]
+}
+
+// count records a message sent over the link
+func (l *Link) count(code uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.sent == nil {
+		l.sent = make(map[uint64]int)
+	}
+	l.sent[code]++
+}
+
+// Up reports whether the link is connected
+func (l *Link) Up() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.pipe != nil
+}
+
+// up connects the two nodes over a fresh pipe, running the obs protocol on
+// both ends. The nodes see each other as newly connected peers.
+func (l *Link) up(wg *sync.WaitGroup) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.pipe != nil {
+		return
+	}
+	ra, rb := p2p.MsgPipe()
+	l.pipe, l.closed = ra, make(chan struct{})
+
+	wg.Add(2)
+	go l.run(wg, l.a, l.b, ra, l.closed)
+	go l.run(wg, l.b, l.a, rb, l.closed)
+}
+
+// down disconnects the nodes. Messages still in flight are lost.
+func (l *Link) down() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.pipe != nil {
+		l.drop()
+	}
+}
+
+// drop closes the current pipe. It must be called with the lock held.
+func (l *Link) drop() {
+	close(l.closed)
+	l.pipe.Close()
+	l.pipe = nil
+}
+
+// run serves the remote node as a peer of the local one until the pipe is
+// closed, by either side
+func (l *Link) run(wg *sync.WaitGroup, local, remote *Node, pipe *p2p.MsgPipeRW, closed chan struct{}) {
+	defer wg.Done()
+
+	proto := local.Handler.Protocols()[0]
+	caps := []p2p.Cap{{Name: proto.Name, Version: proto.Version}}
+	peer := p2p.NewPeerPipe(remote.ID, remote.Name(), caps, pipe)
+
+	rw := &delayedRW{
+		pipe:   pipe,
+		link:   l,
+		closed: closed,
+		queue:  make(chan delayedMsg, linkQueueSize),
+	}
+	go rw.deliver()
+
+	proto.Run(peer, rw)
+	pipe.Close()
+}
+
+// delayedMsg is a message waiting out the link latency
+type delayedMsg struct {
+	msg p2p.Msg
+	at  time.Time
+}
+
+// delayedRW is one end of a link. Reads come straight from the pipe, writes
+// are queued and handed to the pipe once their delay has passed.
+type delayedRW struct {
+	pipe   *p2p.MsgPipeRW
+	link   *Link
+	closed chan struct{}
+	queue  chan delayedMsg
+}
+
+// ReadMsg implements p2p.MsgReader
+func (rw *delayedRW) ReadMsg() (p2p.Msg, error) {
+	return rw.pipe.ReadMsg()
+}
+
+// WriteMsg implements p2p.MsgWriter. The payload is buffered so that the
+// writer can move on before the message is delivered.
+func (rw *delayedRW) WriteMsg(msg p2p.Msg) error {
+	data, err := io.ReadAll(msg.Payload)
+	if err != nil {
+		return err
+	}
+	msg.Payload = bytes.NewReader(data)
+	msg.Size = uint32(len(data))
+
+	select {
+	case rw.queue <- delayedMsg{msg: msg, at: time.Now().Add(rw.link.Latency())}:
+		rw.link.count(msg.Code)
+		return nil
+	case <-rw.closed:
+		return errLinkDown
+	}
+}
+
+// deliver writes queued messages to the pipe when they are due
+func (rw *delayedRW) deliver() {
+	for {
+		select {
+		case m := <-rw.queue:
+			if wait := time.Until(m.at); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-rw.closed:
+					timer.Stop()
+					return
+				}
+			}
+			if err := rw.pipe.WriteMsg(m.msg); err != nil {
+				return
+			}
+		case <-rw.closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,353 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+// Package simnet runs networks of full Obsidian nodes inside a single
+// process, for testing propagation, sync and reorgs under latency and
+// partitions.
+package simnet
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/eth/ethconfig"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+
+	obstypes "github.com/obsidian-chain/obsidian/core/types"
+	"github.com/obsidian-chain/obsidian/eth/backend"
+	obsp2p "github.com/obsidian-chain/obsidian/p2p"
+)
+
+const (
+	// pollInterval is how often the wait helpers check their condition
+	pollInterval = 10 * time.Millisecond
+
+	// blockInterval spaces out the blocks of Node.Mine. Mined back to back,
+	// they would overflow the small propagation queues of the peers, which
+	// are sized for blocks that take seconds to find.
+	blockInterval = 10 * time.Millisecond
+)
+
+// Config describes a simulated network
+type Config struct {
+	Nodes int                                       // Number of nodes
+	Alloc map[common.Address]backend.GenesisAccount // Genesis allocation shared by all nodes
+
+	StealthRegistryBlock *big.Int // Activation of the stealth meta-address registry, nil if never
+}
+
+// Node is a full node of a simulated network: a backend with an in-memory
+// chain and a fake proof of work engine, and the obs protocol handler
+type Node struct {
+	Index    int
+	ID       enode.ID
+	Coinbase common.Address
+	Backend  *backend.Backend
+	Handler  *obsp2p.Handler
+}
+
+// Name returns the name the node is known by to its peers
+func (n *Node) Name() string {
+	return fmt.Sprintf("simnode-%d", n.Index)
+}
+
+// Head returns the header of the node's head block
+func (n *Node) Head() *obstypes.ObsidianHeader {
+	return n.Backend.CurrentBlock()
+}
+
+// Mine produces count blocks on top of the node's head, including whatever
+// transactions its pool holds, and propagates them
+func (n *Node) Mine(count int) ([]*obstypes.ObsidianBlock, error) {
+	blocks := make([]*obstypes.ObsidianBlock, 0, count)
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(blockInterval)
+		}
+		block, err := n.Backend.GetMiner().MineBlock()
+		if err != nil {
+			return blocks, fmt.Errorf("node %d: %w", n.Index, err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// Network is a set of simulated nodes and the links between them
+type Network struct {
+	Nodes []*Node
+
+	mu    sync.Mutex
+	links map[[2]int]*Link
+	cut   map[[2]int]*Link // Links taken down by Partition
+	wg    sync.WaitGroup   // Peer connections
+}
+
+// New starts the nodes of a network. They aren't connected to each other yet.
+func New(config Config) (*Network, error) {
+	net := &Network{
+		links: make(map[[2]int]*Link),
+		cut:   make(map[[2]int]*Link),
+	}
+	for i := 0; i < config.Nodes; i++ {
+		node, err := newNode(i, config)
+		if err != nil {
+			net.Close()
+			return nil, err
+		}
+		net.Nodes = append(net.Nodes, node)
+	}
+	return net, nil
+}
+
+// newNode creates and starts a node with an in-memory chain
+func newNode(index int, config Config) (*Node, error) {
+	cfg := backend.DefaultConfig()
+	cfg.InMemory = true
+	cfg.FakePoW = true
+	cfg.SyncMode = ethconfig.FullSync
+	cfg.StealthRegistryBlock = config.StealthRegistryBlock
+	for addr, account := range config.Alloc {
+		cfg.Genesis.Alloc[addr] = account
+	}
+	b, err := backend.New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("node %d: %w", index, err)
+	}
+	node := &Node{
+		Index:    index,
+		Coinbase: common.BigToAddress(big.NewInt(int64(index + 1))),
+		Backend:  b,
+		Handler:  obsp2p.NewHandler(cfg.ChainID.Uint64(), b),
+	}
+	rand.Read(node.ID[:])
+
+	// Distinct coinbases keep blocks mined by different nodes on the same
+	// parent apart
+	b.SetCoinbase(node.Coinbase)
+	b.SetP2PHandler(node.Handler)
+	if err := node.Handler.StartSync(); err != nil {
+		node.stop()
+		return nil, err
+	}
+	return node, nil
+}
+
+// stop shuts down the node's protocol handler and backend
+func (n *Node) stop() {
+	n.Handler.Stop()
+	n.Backend.Stop()
+}
+
+// linkKey returns the map key of the link between two nodes
+func linkKey(i, j int) [2]int {
+	if i > j {
+		i, j = j, i
+	}
+	return [2]int{i, j}
+}
+
+// Connect links two nodes, or brings their link back up, and returns it
+func (net *Network) Connect(i, j int, latency time.Duration) *Link {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+
+	key := linkKey(i, j)
+	link := net.links[key]
+	if link == nil {
+		link = &Link{a: net.Nodes[key[0]], b: net.Nodes[key[1]], latency: latency}
+		net.links[key] = link
+	}
+	delete(net.cut, key)
+	link.up(&net.wg)
+	return link
+}
+
+// ConnectAll links every pair of nodes
+func (net *Network) ConnectAll(latency time.Duration) {
+	for i := range net.Nodes {
+		for j := i + 1; j < len(net.Nodes); j++ {
+			net.Connect(i, j, latency)
+		}
+	}
+}
+
+// Disconnect takes down the link between two nodes, if there is one
+func (net *Network) Disconnect(i, j int) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+
+	if link := net.links[linkKey(i, j)]; link != nil {
+		link.down()
+	}
+}
+
+// Link returns the link between two nodes, or nil if they were never connected
+func (net *Network) Link(i, j int) *Link {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	return net.links[linkKey(i, j)]
+}
+
+// Partition splits the network into the given groups of nodes by taking down
+// every link between nodes of different groups. Nodes not listed form a group
+// of their own.
+func (net *Network) Partition(groups ...[]int) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+
+	group := make(map[int]int)
+	for g, nodes := range groups {
+		for _, i := range nodes {
+			group[i] = g + 1
+		}
+	}
+	for key, link := range net.links {
+		if group[key[0]] != group[key[1]] && link.Up() {
+			link.down()
+			net.cut[key] = link
+		}
+	}
+}
+
+// Heal brings back up the links taken down by Partition
+func (net *Network) Heal() {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+
+	for key, link := range net.cut {
+		link.up(&net.wg)
+		delete(net.cut, key)
+	}
+}
+
+// Sent returns the number of messages with the given code sent over all
+// links of the network
+func (net *Network) Sent(code uint64) int {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+
+	var sent int
+	for _, link := range net.links {
+		sent += link.Sent(code)
+	}
+	return sent
+}
+
+// WaitFor polls cond until it holds, failing after the timeout
+func WaitFor(timeout time.Duration, cond func() bool) error {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("condition not met within %v", timeout)
+		}
+		time.Sleep(pollInterval)
+	}
+	return nil
+}
+
+// WaitPeers waits until every node is connected to all the nodes its links
+// lead to
+func (net *Network) WaitPeers(timeout time.Duration) error {
+	want := make([]int, len(net.Nodes))
+	net.mu.Lock()
+	for key, link := range net.links {
+		if link.Up() {
+			want[key[0]]++
+			want[key[1]]++
+		}
+	}
+	net.mu.Unlock()
+
+	err := WaitFor(timeout, func() bool {
+		for i, node := range net.Nodes {
+			if node.Handler.PeerCount() != want[i] {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		var counts []string
+		for i, node := range net.Nodes {
+			counts = append(counts, fmt.Sprintf("%d: %d/%d", i, node.Handler.PeerCount(), want[i]))
+		}
+		return fmt.Errorf("peers not connected (%s): %w", strings.Join(counts, ", "), err)
+	}
+	return nil
+}
+
+// WaitConverged waits until the given nodes, or all nodes if none are given,
+// agree on the head block
+func (net *Network) WaitConverged(timeout time.Duration, nodes ...int) error {
+	if len(nodes) == 0 {
+		for i := range net.Nodes {
+			nodes = append(nodes, i)
+		}
+	}
+	err := WaitFor(timeout, func() bool {
+		head := net.Nodes[nodes[0]].Head().Hash()
+		for _, i := range nodes[1:] {
+			if net.Nodes[i].Head().Hash() != head {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		var heads []string
+		for _, i := range nodes {
+			head := net.Nodes[i].Head()
+			heads = append(heads, fmt.Sprintf("%d: #%d %x", i, head.Number, head.Hash().Bytes()[:4]))
+		}
+		return fmt.Errorf("heads diverge (%s): %w", strings.Join(heads, ", "), err)
+	}
+	return nil
+}
+
+// WaitForTx waits until every node knows a transaction, either pooled or
+// included in its chain
+func (net *Network) WaitForTx(hash common.Hash, timeout time.Duration) error {
+	return WaitFor(timeout, func() bool {
+		for _, node := range net.Nodes {
+			if _, _, _, _, err := node.Backend.GetTransaction(context.Background(), hash); err != nil {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Close disconnects all nodes and shuts them down
+func (net *Network) Close() {
+	net.mu.Lock()
+	for _, link := range net.links {
+		link.down()
+	}
+	net.mu.Unlock()
+
+	for _, node := range net.Nodes {
+		node.Handler.StopSync()
+	}
+	net.wg.Wait()
+
+	// Let syncs in progress notice they were cancelled before the databases
+	// go away
+	WaitFor(time.Second, func() bool {
+		for _, node := range net.Nodes {
+			if _, _, _, syncing := node.Handler.SyncProgress(); syncing {
+				return false
+			}
+		}
+		return true
+	})
+	for _, node := range net.Nodes {
+		node.stop()
+	}
+}
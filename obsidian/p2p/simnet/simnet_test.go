@@ -0,0 +1,604 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package simnet
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+
+	"github.com/obsidian-chain/obsidian/core/rawdb"
+	obstypes "github.com/obsidian-chain/obsidian/core/types"
+	"github.com/obsidian-chain/obsidian/eth/backend"
+	obsp2p "github.com/obsidian-chain/obsidian/p2p"
+	"github.com/obsidian-chain/obsidian/params"
+	"github.com/obsidian-chain/obsidian/relay"
+	obsrpc "github.com/obsidian-chain/obsidian/rpc"
+	"github.com/obsidian-chain/obsidian/stealth"
+	"github.com/obsidian-chain/obsidian/stealth/filter"
+	"github.com/obsidian-chain/obsidian/stealth/registry"
+)
+
+const convergeTimeout = 10 * time.Second
+
+// newTestNetwork starts a network that is shut down with the test
+func newTestNetwork(t *testing.T, config Config) *Network {
+	t.Helper()
+
+	net, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(net.Close)
+	return net
+}
+
+// mine produces blocks on a node, failing the test on error
+func mine(t *testing.T, node *Node, count int) []*obstypes.ObsidianBlock {
+	t.Helper()
+
+	blocks, err := node.Mine(count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blocks
+}
+
+// fundedNetwork starts a network whose genesis funds a fresh key
+func fundedNetwork(t *testing.T, nodes int) (*Network, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, _ := crypto.GenerateKey()
+	funds := new(big.Int).Mul(big.NewInt(1000), big.NewInt(1e18))
+	net := newTestNetwork(t, Config{
+		Nodes: nodes,
+		Alloc: map[common.Address]backend.GenesisAccount{crypto.PubkeyToAddress(key.PublicKey): {Balance: funds}},
+
+		StealthRegistryBlock: big.NewInt(0),
+	})
+	return net, key
+}
+
+// sendTx submits a stealth payment of one coin to recipient through a node
+func sendTx(t *testing.T, node *Node, key *ecdsa.PrivateKey, nonce uint64, recipient common.Address) *obstypes.StealthTransaction {
+	t.Helper()
+
+	ephemeral, _ := crypto.GenerateKey()
+	tx := obstypes.NewStealthTransaction(nonce, recipient, big.NewInt(1e18), 21000, big.NewInt(1e9), nil, crypto.CompressPubkey(&ephemeral.PublicKey), 0x42)
+	tx, err := obstypes.SignStealthTx(tx, obstypes.NewStealthEIP155Signer(node.Backend.ChainID()), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := node.Backend.SendTransaction(context.Background(), tx); err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+// balance returns the balance of an account at a node's head
+func balance(t *testing.T, node *Node, addr common.Address) *big.Int {
+	t.Helper()
+
+	bal, err := node.Backend.GetBalance(context.Background(), addr, rpc.LatestBlockNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bal
+}
+
+func TestConvergenceOverLatentLinks(t *testing.T) {
+	net := newTestNetwork(t, Config{Nodes: 5})
+
+	// A line, so blocks have to be relayed hop by hop
+	for i := 0; i < len(net.Nodes)-1; i++ {
+		net.Connect(i, i+1, 20*time.Millisecond)
+	}
+	if err := net.WaitPeers(convergeTimeout); err != nil {
+		t.Fatal(err)
+	}
+	blocks := mine(t, net.Nodes[0], 10)
+	if err := net.WaitConverged(convergeTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if head := net.Nodes[4].Head(); head.Hash() != blocks[9].Hash() {
+		t.Fatalf("far end at #%d, want #%d", head.Number, blocks[9].NumberU64())
+	}
+
+	// A node joining late catches up by syncing
+	net.Disconnect(3, 4)
+	mine(t, net.Nodes[2], 5)
+	if err := net.WaitConverged(convergeTimeout, 0, 1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	if number := net.Nodes[4].Head().Number.Uint64(); number != 10 {
+		t.Fatalf("disconnected node moved to #%d", number)
+	}
+	net.Connect(3, 4, 0)
+	if err := net.WaitConverged(convergeTimeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReorgAfterPartition(t *testing.T) {
+	net, key := fundedNetwork(t, 4)
+	net.ConnectAll(5 * time.Millisecond)
+	if err := net.WaitPeers(convergeTimeout); err != nil {
+		t.Fatal(err)
+	}
+	shared := mine(t, net.Nodes[0], 2)
+	if err := net.WaitConverged(convergeTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both halves extend the chain, the second one further
+	net.Partition([]int{0, 1}, []int{2, 3})
+	orphaned := sendTx(t, net.Nodes[0], key, 0, net.Nodes[1].Coinbase)
+	if blocks := mine(t, net.Nodes[0], 3); len(blocks[0].Transactions()) != 1 {
+		t.Fatalf("side chain block has %d transactions, want 1", len(blocks[0].Transactions()))
+	}
+	winners := mine(t, net.Nodes[2], 6)
+	if err := net.WaitConverged(convergeTimeout, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := net.WaitConverged(convergeTimeout, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	if net.Nodes[0].Head().Hash() == net.Nodes[2].Head().Hash() {
+		t.Fatal("partitioned halves share a head")
+	}
+
+	// Once healed, the first half reorgs onto the heavier chain
+	net.Heal()
+	if err := net.WaitConverged(convergeTimeout); err != nil {
+		t.Fatal(err)
+	}
+	head := winners[len(winners)-1]
+	for _, node := range net.Nodes {
+		if node.Head().Hash() != head.Hash() {
+			t.Fatalf("node %d on #%d, want #%d", node.Index, node.Head().Number, head.NumberU64())
+		}
+		// The canonical index and the state must follow the reorg
+		for _, block := range append(shared, winners...) {
+			if have := node.Backend.GetBlockByNumber(block.NumberU64()); have == nil || have.Hash() != block.Hash() {
+				t.Fatalf("node %d: wrong canonical block #%d", node.Index, block.NumberU64())
+			}
+		}
+		if entry := rawdb.ReadTxLookupEntry(node.Backend.ChainDb(), orphaned.Hash()); entry != nil {
+			t.Fatalf("node %d: transaction still looked up in reorged out block #%d", node.Index, entry.BlockIndex)
+		}
+		reward := params.CalculateBlockReward(1)
+		if have, want := balance(t, node, net.Nodes[0].Coinbase), new(big.Int).Mul(reward, big.NewInt(2)); have.Cmp(want) != 0 {
+			t.Fatalf("node %d: reorged out rewards kept: balance %v, want %v", node.Index, have, want)
+		}
+		if have, want := balance(t, node, net.Nodes[2].Coinbase), new(big.Int).Mul(reward, big.NewInt(6)); have.Cmp(want) != 0 {
+			t.Fatalf("node %d: canonical rewards missing: balance %v, want %v", node.Index, have, want)
+		}
+	}
+}
+
+func TestTransactionPropagation(t *testing.T) {
+	net, key := fundedNetwork(t, 4)
+	net.ConnectAll(10 * time.Millisecond)
+	if err := net.WaitPeers(convergeTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	recipient := common.Address{0xaa}
+	tx := sendTx(t, net.Nodes[0], key, 0, recipient)
+	if err := net.WaitForTx(tx.Hash(), convergeTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	// Any node can include it, and all of them apply it
+	block := mine(t, net.Nodes[3], 1)[0]
+	if len(block.Transactions()) != 1 || block.Transactions()[0].Hash() != tx.Hash() {
+		t.Fatalf("mined block has %d transactions, want the propagated one", len(block.Transactions()))
+	}
+	if err := net.WaitConverged(convergeTimeout); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range net.Nodes {
+		if have := balance(t, node, recipient); have.Cmp(tx.Value()) != 0 {
+			t.Fatalf("node %d: recipient balance %v, want %v", node.Index, have, tx.Value())
+		}
+		// The payment was announced the ERC-5564 way too
+		receipts := node.Backend.GetReceipts(block.Hash())
+		if len(receipts) != 1 || len(receipts[0].Logs) != 1 {
+			t.Fatalf("node %d: no announcement log", node.Index)
+		}
+		a, err := stealth.ParseAnnouncementLog(receipts[0].Logs[0])
+		if err != nil || a.Recipient != recipient || a.ViewTag != tx.ViewTag() || a.Value.Cmp(tx.Value()) != 0 {
+			t.Fatalf("node %d: announced %+v, err %v", node.Index, a, err)
+		}
+	}
+}
+
+// dandelionNetwork starts a fully connected network of nodes relaying
+// transactions over Dandelion++ stems
+func dandelionNetwork(t *testing.T, nodes int, config obsp2p.DandelionConfig) (*Network, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	net, key := fundedNetwork(t, nodes)
+	for _, node := range net.Nodes {
+		if err := node.Handler.EnableDandelion(config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	net.ConnectAll(5 * time.Millisecond)
+	if err := net.WaitPeers(convergeTimeout); err != nil {
+		t.Fatal(err)
+	}
+	return net, key
+}
+
+// poolCount returns how many nodes have a transaction pooled
+func poolCount(net *Network, hash common.Hash) int {
+	var count int
+	for _, node := range net.Nodes {
+		if node.Backend.GetPoolTransaction(hash) != nil {
+			count++
+		}
+	}
+	return count
+}
+
+// fluffed returns the number of messages that broadcast transactions
+func fluffed(net *Network) int {
+	return net.Sent(obsp2p.TransactionsMsg) + net.Sent(obsp2p.NewPooledTxHashesMsg)
+}
+
+func TestDandelionStem(t *testing.T) {
+	net, key := dandelionNetwork(t, 5, obsp2p.DandelionConfig{
+		Epoch:            time.Minute,
+		FluffProbability: 0,
+		Embargo:          time.Minute,
+	})
+	tx := sendTx(t, net.Nodes[0], key, 0, common.Address{0xaa})
+
+	// Nobody fluffs, so the transaction travels the stem until it runs into
+	// a node that has seen it, without ever being broadcast
+	if err := WaitFor(convergeTimeout, func() bool { return poolCount(net, tx.Hash()) >= 2 }); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := fluffed(net); n != 0 {
+		t.Fatalf("stem transaction broadcast in %d messages", n)
+	}
+	if have, stems := poolCount(net, tx.Hash()), net.Sent(obsp2p.StemTxMsg); stems < have-1 {
+		t.Fatalf("%d nodes reached by %d stem messages", have, stems)
+	}
+}
+
+func TestDandelionFluff(t *testing.T) {
+	net, key := dandelionNetwork(t, 5, obsp2p.DandelionConfig{
+		Epoch:            time.Minute,
+		FluffProbability: 1,
+		Embargo:          time.Minute,
+	})
+	tx := sendTx(t, net.Nodes[0], key, 0, common.Address{0xaa})
+
+	// The sender stems its own transaction, the first relay fluffs it
+	if err := net.WaitForTx(tx.Hash(), convergeTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if stems := net.Sent(obsp2p.StemTxMsg); stems != 1 {
+		t.Fatalf("%d stem messages, want 1", stems)
+	}
+	if fluffed(net) == 0 {
+		t.Fatal("transaction spread without being broadcast")
+	}
+}
+
+func TestDandelionEmbargo(t *testing.T) {
+	net, key := fundedNetwork(t, 3)
+	config := obsp2p.DandelionConfig{
+		Epoch:            time.Minute,
+		FluffProbability: 0,
+		Embargo:          200 * time.Millisecond,
+	}
+	for _, node := range net.Nodes {
+		if err := node.Handler.EnableDandelion(config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	net.Connect(0, 1, 100*time.Millisecond)
+	net.Connect(1, 2, 5*time.Millisecond)
+	if err := net.WaitPeers(convergeTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	// Break the stem while the transaction is on its first hop
+	start := time.Now()
+	tx := sendTx(t, net.Nodes[0], key, 0, common.Address{0xaa})
+	net.Disconnect(0, 1)
+	if n := poolCount(net, tx.Hash()); n != 1 {
+		t.Fatalf("transaction reached %d nodes over a broken stem", n)
+	}
+	net.Connect(0, 1, 5*time.Millisecond)
+
+	// The sender's embargo runs out and it broadcasts the transaction itself
+	if err := net.WaitForTx(tx.Hash(), convergeTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < config.Embargo {
+		t.Fatalf("transaction fluffed after %v, before the embargo", elapsed)
+	}
+	if fluffed(net) == 0 {
+		t.Fatal("transaction spread without being broadcast")
+	}
+	block := mine(t, net.Nodes[2], 1)[0]
+	if len(block.Transactions()) != 1 {
+		t.Fatalf("mined block has %d transactions, want 1", len(block.Transactions()))
+	}
+}
+
+func TestStealthFilters(t *testing.T) {
+	net, key := fundedNetwork(t, 2)
+	net.Connect(0, 1, 5*time.Millisecond)
+	if err := net.WaitPeers(convergeTimeout); err != nil {
+		t.Fatal(err)
+	}
+	mine(t, net.Nodes[0], 2)
+	tx := sendTx(t, net.Nodes[0], key, 0, common.Address{0xaa})
+	if err := net.WaitForTx(tx.Hash(), convergeTimeout); err != nil {
+		t.Fatal(err)
+	}
+	blocks := mine(t, net.Nodes[0], 2)
+	if err := net.WaitConverged(convergeTimeout); err != nil {
+		t.Fatal(err)
+	}
+	paid, head := blocks[0], blocks[1]
+
+	// Filters and headers fetched from a peer agree with the ones built locally
+	ctx, cancel := context.WithTimeout(context.Background(), convergeTimeout)
+	defer cancel()
+
+	source := net.Nodes[0].ID.String()
+	headers, err := net.Nodes[1].Handler.RequestStealthFilterHeaders(ctx, source, 0, head.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	filters, err := net.Nodes[1].Handler.RequestStealthFilters(ctx, source, 0, head.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := net.Nodes[1].Backend.StealthFilterRange(0, head.Hash(), 100)
+	if local == nil {
+		t.Fatal("no local stealth filters")
+	}
+	for i, header := range local.Headers() {
+		if header != headers[i+1] {
+			t.Fatalf("filter header of block %d differs between nodes", i)
+		}
+	}
+
+	// Only the block carrying the payment matches its view tag and recipient
+	for i, raw := range filters.Filters {
+		f, err := filter.Decode(filters.Blocks[i], raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := filters.Blocks[i] == paid.Hash()
+		if f.MatchViewTags([]byte{0x42}) != want || f.MatchAddresses([]common.Address{{0xaa}}) != want {
+			t.Errorf("filter of block %d: match %v, want %v", i, !want, want)
+		}
+	}
+
+	// The announcement index serves the payment too
+	var found []common.Hash
+	net.Nodes[1].Backend.StealthAnnouncements(ctx, 0, head.NumberU64(), []byte{0x42}, func(number uint64, anns []stealth.Announcement) bool {
+		for _, a := range anns {
+			found = append(found, a.TxHash)
+		}
+		return true
+	})
+	if len(found) != 1 || found[0] != tx.Hash() {
+		t.Fatalf("announcements %v, want %x", found, tx.Hash())
+	}
+}
+
+func TestStealthRegistry(t *testing.T) {
+	net, key := fundedNetwork(t, 2)
+	net.Connect(0, 1, 5*time.Millisecond)
+	if err := net.WaitPeers(convergeTimeout); err != nil {
+		t.Fatal(err)
+	}
+	keys, _ := stealth.GenerateStealthKeyPair()
+	meta := keys.MetaAddress()
+	input, err := registry.ABI.Pack("registerKeys", big.NewInt(registry.SchemeSecp256k1), meta.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	data := hexutil.Bytes(input)
+	gas, err := net.Nodes[0].Backend.EstimateGas(ctx, obstypes.CallArgs{To: &registry.Address, Data: &data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ephemeral, _ := crypto.GenerateKey()
+	tx := obstypes.NewStealthTransaction(0, registry.Address, big.NewInt(0), gas, big.NewInt(1e9), input, crypto.CompressPubkey(&ephemeral.PublicKey), 0)
+	if tx, err = obstypes.SignStealthTx(tx, obstypes.NewStealthEIP155Signer(net.Nodes[0].Backend.ChainID()), key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.Nodes[0].Backend.SendTransaction(ctx, tx); err != nil {
+		t.Fatal(err)
+	}
+	mine(t, net.Nodes[0], 1)
+	if err := net.WaitConverged(convergeTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both nodes executed the registration, and it can be looked up by account
+	api := obsrpc.NewPublicObsidianAPI(net.Nodes[1].Backend)
+	found, err := api.GetMetaAddress(ctx, crypto.PubkeyToAddress(key.PublicKey), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found == nil || *found != meta.String() {
+		t.Fatalf("looked up meta-address %v, want %s", found, meta.String())
+	}
+	if found, err := api.GetMetaAddress(ctx, common.Address{0xaa}, nil); err != nil || found != nil {
+		t.Fatalf("found meta-address %v for an unregistered account, err %v", found, err)
+	}
+}
+
+// Before the registry fork, calls to its address are plain transfers
+func TestStealthRegistryFork(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	funds := new(big.Int).Mul(big.NewInt(1000), big.NewInt(1e18))
+	net := newTestNetwork(t, Config{
+		Nodes: 1,
+		Alloc: map[common.Address]backend.GenesisAccount{crypto.PubkeyToAddress(key.PublicKey): {Balance: funds}},
+
+		StealthRegistryBlock: big.NewInt(2),
+	})
+	node := net.Nodes[0]
+	keys, _ := stealth.GenerateStealthKeyPair()
+	input, err := registry.ABI.Pack("registerKeys", big.NewInt(registry.SchemeSecp256k1), keys.MetaAddress().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	api := obsrpc.NewPublicObsidianAPI(node.Backend)
+	register := func(nonce uint64) *obstypes.ObsidianBlock {
+		data := hexutil.Bytes(input)
+		gas, err := node.Backend.EstimateGas(ctx, obstypes.CallArgs{To: &registry.Address, Data: &data})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ephemeral, _ := crypto.GenerateKey()
+		tx := obstypes.NewStealthTransaction(nonce, registry.Address, big.NewInt(0), gas, big.NewInt(1e9), input, crypto.CompressPubkey(&ephemeral.PublicKey), 0)
+		if tx, err = obstypes.SignStealthTx(tx, obstypes.NewStealthEIP155Signer(node.Backend.ChainID()), key); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := node.Backend.SendTransaction(ctx, tx); err != nil {
+			t.Fatal(err)
+		}
+		return mine(t, node, 1)[0]
+	}
+	block := register(0)
+	for _, log := range node.Backend.GetReceipts(block.Hash())[0].Logs {
+		if log.Address == registry.Address {
+			t.Fatal("registry ran before its fork")
+		}
+	}
+	if found, err := api.GetMetaAddress(ctx, crypto.PubkeyToAddress(key.PublicKey), nil); err != nil || found != nil {
+		t.Fatalf("registered before the fork: %v, err %v", found, err)
+	}
+	register(1)
+	if found, err := api.GetMetaAddress(ctx, crypto.PubkeyToAddress(key.PublicKey), nil); err != nil || found == nil {
+		t.Fatalf("not registered after the fork: %v, err %v", found, err)
+	}
+}
+
+func TestStealthTokenPayment(t *testing.T) {
+	net, key := fundedNetwork(t, 1)
+	node := net.Nodes[0]
+	keys, _ := stealth.GenerateStealthKeyPair()
+	addr, err := stealth.GenerateStealthAddress(keys.MetaAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	asset := stealth.Asset{Standard: stealth.ERC20Standard, Token: common.Address{0x20}}
+	to, input, err := stealth.TransferData(asset, crypto.PubkeyToAddress(key.PublicKey), addr.Address, big.NewInt(250))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := obstypes.NewStealthTransaction(0, to, big.NewInt(0), 100000, big.NewInt(1e9), input, addr.EphemeralPubKey, addr.ViewTag)
+	if tx, err = obstypes.SignStealthTx(tx, obstypes.NewStealthEIP155Signer(node.Backend.ChainID()), key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := node.Backend.SendTransaction(context.Background(), tx); err != nil {
+		t.Fatal(err)
+	}
+	block := mine(t, node, 1)[0]
+
+	// The payment is announced for the stealth address, not the token
+	receipts := node.Backend.GetReceipts(block.Hash())
+	if len(receipts) != 1 || len(receipts[0].Logs) != 1 {
+		t.Fatal("no announcement log")
+	}
+	if a, err := stealth.ParseAnnouncementLog(receipts[0].Logs[0]); err != nil || a.Recipient != addr.Address || a.Asset != asset {
+		t.Fatalf("announced %+v, err %v", a, err)
+	}
+	scanner := stealth.NewScanner(keys.ViewPrivateKey, keys.SpendPrivateKey)
+	if _, err := scanner.Sync(context.Background(), node.Backend, 0, block.NumberU64()); err != nil {
+		t.Fatal(err)
+	}
+	// The token call isn't executed, so the payment is only a claim
+	if balance := scanner.UnverifiedBalances()[asset]; balance == nil || balance.Int64() != 250 {
+		t.Fatalf("token balance %v, want 250", balance)
+	}
+	if balance := scanner.Balances()[asset]; balance != nil {
+		t.Fatalf("unverified token counted as a balance: %v", balance)
+	}
+}
+
+// relayBackend lets a relayer submit transactions straight to a node
+type relayBackend struct{ *backend.Backend }
+
+func (b relayBackend) NonceAt(ctx context.Context, addr common.Address) (uint64, error) {
+	return b.GetNonce(ctx, addr, rpc.LatestBlockNumber)
+}
+
+func (b relayBackend) BalanceAt(ctx context.Context, addr common.Address) (*big.Int, error) {
+	return b.GetBalance(ctx, addr, rpc.LatestBlockNumber)
+}
+
+func TestSponsoredWithdrawal(t *testing.T) {
+	net, key := fundedNetwork(t, 1)
+	node := net.Nodes[0]
+	keys, _ := stealth.GenerateStealthKeyPair()
+	addr, err := stealth.GenerateStealthAddress(keys.MetaAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment := obstypes.NewStealthTransaction(0, addr.Address, big.NewInt(1e18), 21000, big.NewInt(1e9), nil, addr.EphemeralPubKey, addr.ViewTag)
+	signer := obstypes.NewStealthEIP155Signer(node.Backend.ChainID())
+	if payment, err = obstypes.SignStealthTx(payment, signer, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := node.Backend.SendTransaction(context.Background(), payment); err != nil {
+		t.Fatal(err)
+	}
+	mine(t, node, 1)
+
+	// The stealth address spends its whole balance, the relayer pays the gas
+	spendKey, _, err := stealth.DeriveStealthAddressPrivateKey(keys.ViewPrivateKey, keys.SpendPrivateKey, addr.EphemeralPubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ephemeral, _ := crypto.GenerateKey()
+	withdrawal := obstypes.NewSponsoredTransaction(0, common.Address{0xbb}, big.NewInt(1e18), nil, crypto.CompressPubkey(&ephemeral.PublicKey), 0)
+	if withdrawal, err = obstypes.SignStealthTx(withdrawal, signer, spendKey); err != nil {
+		t.Fatal(err)
+	}
+	relayer := relay.New(relayBackend{node.Backend}, key, node.Backend.ChainID(), relay.DefaultConfig)
+	before := balance(t, node, relayer.Address())
+	hash, err := relayer.Sponsor(context.Background(), withdrawal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := mine(t, node, 1)[0]
+	if len(block.Transactions()) != 1 || block.Transactions()[0].Hash() != hash {
+		t.Fatal("sponsored transaction not mined")
+	}
+	if have := balance(t, node, addr.Address); have.Sign() != 0 {
+		t.Fatalf("stealth address left with %v", have)
+	}
+	if have := balance(t, node, common.Address{0xbb}); have.Cmp(big.NewInt(1e18)) != 0 {
+		t.Fatalf("withdrawn %v, want 1e18", have)
+	}
+	fees := new(big.Int).Sub(before, balance(t, node, relayer.Address()))
+	if fees.Sign() <= 0 {
+		t.Fatalf("relayer paid %v in fees", fees)
+	}
+}
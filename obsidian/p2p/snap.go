@@ -0,0 +1,473 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/ethereum/go-ethereum/trie/trienode"
+	"github.com/obsidian-chain/obsidian/core/rawdb"
+	"github.com/obsidian-chain/obsidian/core/state"
+)
+
+const (
+	// SnapProtocolName is the name of the state sync protocol, which runs
+	// alongside obs on the same connections
+	SnapProtocolName = "obssnap"
+	// SnapProtocolVersion is the version of the state sync protocol
+	SnapProtocolVersion = 1
+	// SnapProtocolLength is the number of message types
+	SnapProtocolLength = 8
+
+	// maxSnapMessageSize is the largest state sync message accepted
+	maxSnapMessageSize = 10 * 1024 * 1024
+
+	// Caps on the items looked up for a single request, to bound the work
+	// regardless of how large the items turn out to be
+	maxStorageLookups  = 1024
+	maxCodeLookups     = 1024
+	maxTrieNodeLookups = 1024
+)
+
+// State sync message codes
+const (
+	GetAccountRangeMsg  = 0x00
+	AccountRangeMsg     = 0x01
+	GetStorageRangesMsg = 0x02
+	StorageRangesMsg    = 0x03
+	GetByteCodesMsg     = 0x04
+	ByteCodesMsg        = 0x05
+	GetTrieNodesMsg     = 0x06
+	TrieNodesMsg        = 0x07
+)
+
+// GetAccountRangePacket requests the accounts of a state trie from Origin
+// onwards, along with the proofs needed to verify them against Root. Limit
+// is a hint at where the requester stops caring.
+type GetAccountRangePacket struct {
+	ID     uint64
+	Root   common.Hash
+	Origin common.Hash
+	Limit  common.Hash
+	Bytes  uint64
+}
+
+// AccountRangePacket is the reply to GetAccountRangePacket. An empty reply
+// without proofs means the state isn't available.
+type AccountRangePacket struct {
+	ID       uint64
+	Accounts []*AccountData
+	Proof    [][]byte
+}
+
+// AccountData is an account leaf of the state trie
+type AccountData struct {
+	Hash common.Hash  // Hash of the account address
+	Body rlp.RawValue // Encoded state.Account
+}
+
+// GetStorageRangesPacket requests the storage slots of several accounts of a
+// state trie. Origin applies to the first account and Limit to the last one,
+// so large storage tries can be retrieved in chunks.
+type GetStorageRangesPacket struct {
+	ID       uint64
+	Root     common.Hash
+	Accounts []common.Hash
+	Origin   []byte
+	Limit    []byte
+	Bytes    uint64
+}
+
+// StorageRangesPacket is the reply to GetStorageRangesPacket. The slots of
+// every account but the last are complete; the last one's may be cut short,
+// in which case the proofs for its range are attached.
+type StorageRangesPacket struct {
+	ID    uint64
+	Slots [][]*StorageData
+	Proof [][]byte
+}
+
+// StorageData is a storage leaf of a storage trie
+type StorageData struct {
+	Hash common.Hash // Hash of the storage key
+	Body []byte      // Trie encoding of the value
+}
+
+// GetByteCodesPacket requests contract code by hash
+type GetByteCodesPacket struct {
+	ID     uint64
+	Hashes []common.Hash
+	Bytes  uint64
+}
+
+// ByteCodesPacket is the reply to GetByteCodesPacket, in request order with
+// unknown codes left out
+type ByteCodesPacket struct {
+	ID    uint64
+	Codes [][]byte
+}
+
+// GetTrieNodesPacket requests state trie nodes by hash, as used to heal the
+// state after the ranges were retrieved
+type GetTrieNodesPacket struct {
+	ID     uint64
+	Hashes []common.Hash
+	Bytes  uint64
+}
+
+// TrieNodesPacket is the reply to GetTrieNodesPacket, in request order and
+// cut short at the first unknown node
+type TrieNodesPacket struct {
+	ID    uint64
+	Nodes [][]byte
+}
+
+// snapPeer is a peer on the state sync protocol
+type snapPeer struct {
+	*p2p.Peer
+	rw p2p.MsgReadWriter
+	id string
+}
+
+// SnapProtocol returns the state sync protocol descriptor
+func (h *Handler) SnapProtocol() p2p.Protocol {
+	return p2p.Protocol{
+		Name:    SnapProtocolName,
+		Version: SnapProtocolVersion,
+		Length:  SnapProtocolLength,
+		Run:     h.runSnapPeer,
+	}
+}
+
+// runSnapPeer handles a state sync protocol connection
+func (h *Handler) runSnapPeer(p *p2p.Peer, rw p2p.MsgReadWriter) error {
+	peer := &snapPeer{Peer: p, rw: rw, id: p.ID().String()}
+
+	if ban, banned := h.scorer.Banned(peer.id); banned {
+		return fmt.Errorf("%w until %v: %s", errPeerBanned, ban.Until.Format(time.RFC3339), ban.Reason)
+	}
+	h.peersMu.Lock()
+	if _, exists := h.snapPeers[peer.id]; exists {
+		h.peersMu.Unlock()
+		return errors.New("snap peer already registered")
+	}
+	h.snapPeers[peer.id] = peer
+	h.peersMu.Unlock()
+
+	defer func() {
+		h.peersMu.Lock()
+		delete(h.snapPeers, peer.id)
+		h.peersMu.Unlock()
+		h.stateSync.dropPeer(peer.id)
+	}()
+	log.Debug("Snap peer registered", "peer", peer.id[:16])
+
+	for {
+		if err := h.handleSnapMsg(peer); err != nil {
+			return err
+		}
+	}
+}
+
+// snapPeerList returns the connected state sync peers
+func (h *Handler) snapPeerList() []*snapPeer {
+	h.peersMu.RLock()
+	defer h.peersMu.RUnlock()
+
+	peers := make([]*snapPeer, 0, len(h.snapPeers))
+	for _, p := range h.snapPeers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// handleSnapMsg reads and handles a single state sync message
+func (h *Handler) handleSnapMsg(p *snapPeer) error {
+	msg, err := p.rw.ReadMsg()
+	if err != nil {
+		return err
+	}
+	defer msg.Discard()
+
+	if msg.Size > maxSnapMessageSize {
+		h.scorePeer(p.id, EventOversizedMessage)
+		return fmt.Errorf("message too large: %d", msg.Size)
+	}
+	switch msg.Code {
+	case GetAccountRangeMsg:
+		var req GetAccountRangePacket
+		if err := msg.Decode(&req); err != nil {
+			return fmt.Errorf("decode error: %v", err)
+		}
+		var accounts []*AccountData
+		var proof [][]byte
+		if h.throttle(p.id, snapServeCost) {
+			accounts, proof = h.serviceAccountRange(&req)
+		}
+		return p2p.Send(p.rw, AccountRangeMsg, &AccountRangePacket{ID: req.ID, Accounts: accounts, Proof: proof})
+
+	case GetStorageRangesMsg:
+		var req GetStorageRangesPacket
+		if err := msg.Decode(&req); err != nil {
+			return fmt.Errorf("decode error: %v", err)
+		}
+		var slots [][]*StorageData
+		var proof [][]byte
+		if h.throttle(p.id, snapServeCost) {
+			slots, proof = h.serviceStorageRanges(&req)
+		}
+		return p2p.Send(p.rw, StorageRangesMsg, &StorageRangesPacket{ID: req.ID, Slots: slots, Proof: proof})
+
+	case GetByteCodesMsg:
+		var req GetByteCodesPacket
+		if err := msg.Decode(&req); err != nil {
+			return fmt.Errorf("decode error: %v", err)
+		}
+		var codes [][]byte
+		if h.throttle(p.id, snapServeCost) {
+			codes = h.serviceByteCodes(&req)
+		}
+		return p2p.Send(p.rw, ByteCodesMsg, &ByteCodesPacket{ID: req.ID, Codes: codes})
+
+	case GetTrieNodesMsg:
+		var req GetTrieNodesPacket
+		if err := msg.Decode(&req); err != nil {
+			return fmt.Errorf("decode error: %v", err)
+		}
+		var nodes [][]byte
+		if h.throttle(p.id, snapServeCost) {
+			nodes = h.serviceTrieNodes(&req)
+		}
+		return p2p.Send(p.rw, TrieNodesMsg, &TrieNodesPacket{ID: req.ID, Nodes: nodes})
+
+	case AccountRangeMsg:
+		res := new(AccountRangePacket)
+		if err := msg.Decode(res); err != nil {
+			return fmt.Errorf("decode error: %v", err)
+		}
+		h.stateSync.deliver(p.id, res.ID, res)
+
+	case StorageRangesMsg:
+		res := new(StorageRangesPacket)
+		if err := msg.Decode(res); err != nil {
+			return fmt.Errorf("decode error: %v", err)
+		}
+		h.stateSync.deliver(p.id, res.ID, res)
+
+	case ByteCodesMsg:
+		res := new(ByteCodesPacket)
+		if err := msg.Decode(res); err != nil {
+			return fmt.Errorf("decode error: %v", err)
+		}
+		h.stateSync.deliver(p.id, res.ID, res)
+
+	case TrieNodesMsg:
+		res := new(TrieNodesPacket)
+		if err := msg.Decode(res); err != nil {
+			return fmt.Errorf("decode error: %v", err)
+		}
+		h.stateSync.deliver(p.id, res.ID, res)
+
+	default:
+		log.Debug("Unknown snap message", "code", msg.Code)
+		return h.scorePeer(p.id, EventUnknownMessage)
+	}
+	return nil
+}
+
+// responseLimit caps the reply size a requester asked for
+func responseLimit(bytes uint64) uint64 {
+	if bytes > softResponseLimit {
+		return softResponseLimit
+	}
+	return bytes
+}
+
+// serviceAccountRange collects the accounts of a state trie from the
+// requested origin, with proofs for both ends of the range
+func (h *Handler) serviceAccountRange(req *GetAccountRangePacket) ([]*AccountData, [][]byte) {
+	db := h.backend.ChainDb()
+	if db == nil {
+		return nil, nil
+	}
+	tr, err := trie.New(trie.StateTrieID(req.Root), state.NewNodeDatabase(db))
+	if err != nil {
+		return nil, nil
+	}
+	var (
+		accounts []*AccountData
+		size     uint64
+		limit    = responseLimit(req.Bytes)
+		it       = trie.NewIterator(tr.MustNodeIterator(req.Origin[:]))
+	)
+	for it.Next() {
+		hash := common.BytesToHash(it.Key)
+		accounts = append(accounts, &AccountData{Hash: hash, Body: common.CopyBytes(it.Value)})
+		size += uint64(common.HashLength + len(it.Value))
+
+		if bytes.Compare(hash[:], req.Limit[:]) >= 0 || size >= limit {
+			break
+		}
+	}
+	if it.Err != nil {
+		return nil, nil
+	}
+	proof := trienode.NewProofSet()
+	if err := tr.Prove(req.Origin[:], proof); err != nil {
+		return nil, nil
+	}
+	if len(accounts) > 0 {
+		if err := tr.Prove(accounts[len(accounts)-1].Hash[:], proof); err != nil {
+			return nil, nil
+		}
+	}
+	return accounts, proof.List()
+}
+
+// serviceStorageRanges collects the storage slots of the requested accounts,
+// stopping after the first account whose slots don't fit in the reply
+func (h *Handler) serviceStorageRanges(req *GetStorageRangesPacket) ([][]*StorageData, [][]byte) {
+	db := h.backend.ChainDb()
+	if db == nil {
+		return nil, nil
+	}
+	accTrie, err := trie.New(trie.StateTrieID(req.Root), state.NewNodeDatabase(db))
+	if err != nil {
+		return nil, nil
+	}
+	var (
+		slots [][]*StorageData
+		proof [][]byte
+		size  uint64
+		limit = responseLimit(req.Bytes)
+	)
+	for i, account := range req.Accounts {
+		if i >= maxStorageLookups || size >= limit {
+			break
+		}
+		blob, err := accTrie.Get(account[:])
+		if err != nil || blob == nil {
+			return nil, nil
+		}
+		var acc state.Account
+		if err := rlp.DecodeBytes(blob, &acc); err != nil {
+			return nil, nil
+		}
+		var origin, last common.Hash
+		if i == 0 {
+			origin = common.BytesToHash(req.Origin)
+		}
+		last = common.MaxHash
+		if i == len(req.Accounts)-1 && len(req.Limit) > 0 {
+			last = common.BytesToHash(req.Limit)
+		}
+		stTrie, err := trie.New(trie.StorageTrieID(req.Root, account, acc.Root), state.NewNodeDatabase(db))
+		if err != nil {
+			return nil, nil
+		}
+		var (
+			storage []*StorageData
+			cut     bool
+			it      = trie.NewIterator(stTrie.MustNodeIterator(origin[:]))
+		)
+		for it.Next() {
+			if size >= limit {
+				cut = true
+				break
+			}
+			hash := common.BytesToHash(it.Key)
+			storage = append(storage, &StorageData{Hash: hash, Body: common.CopyBytes(it.Value)})
+			size += uint64(common.HashLength + len(it.Value))
+
+			if bytes.Compare(hash[:], last[:]) >= 0 {
+				cut = last != common.MaxHash
+				break
+			}
+		}
+		if it.Err != nil {
+			return nil, nil
+		}
+		if cut && len(storage) == 0 {
+			break // Nothing of this account fits, leave it for the next request
+		}
+		slots = append(slots, storage)
+
+		// A partial range needs proofs, a complete trie speaks for itself
+		if origin != (common.Hash{}) || cut {
+			set := trienode.NewProofSet()
+			if err := stTrie.Prove(origin[:], set); err != nil {
+				return nil, nil
+			}
+			if len(storage) > 0 {
+				if err := stTrie.Prove(storage[len(storage)-1].Hash[:], set); err != nil {
+					return nil, nil
+				}
+			}
+			proof = set.List()
+			break
+		}
+	}
+	return slots, proof
+}
+
+// serviceByteCodes looks up the requested contract codes
+func (h *Handler) serviceByteCodes(req *GetByteCodesPacket) [][]byte {
+	db := h.backend.ChainDb()
+	if db == nil {
+		return nil
+	}
+	var (
+		codes [][]byte
+		size  uint64
+		limit = responseLimit(req.Bytes)
+	)
+	for i, hash := range req.Hashes {
+		if i >= maxCodeLookups || size >= limit {
+			break
+		}
+		if hash == crypto.Keccak256Hash(nil) {
+			codes = append(codes, []byte{})
+			continue
+		}
+		if code := rawdb.ReadCode(db, hash); len(code) > 0 {
+			codes = append(codes, code)
+			size += uint64(len(code))
+		}
+	}
+	return codes
+}
+
+// serviceTrieNodes looks up the requested trie nodes
+func (h *Handler) serviceTrieNodes(req *GetTrieNodesPacket) [][]byte {
+	db := h.backend.ChainDb()
+	if db == nil {
+		return nil
+	}
+	var (
+		nodes [][]byte
+		size  uint64
+		limit = responseLimit(req.Bytes)
+	)
+	for i, hash := range req.Hashes {
+		if i >= maxTrieNodeLookups || size >= limit {
+			break
+		}
+		blob := rawdb.ReadTrieNode(db, hash)
+		if blob == nil {
+			break
+		}
+		nodes = append(nodes, blob)
+		size += uint64(len(blob))
+	}
+	return nodes
+}
@@ -0,0 +1,755 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/ethereum/go-ethereum/trie/trienode"
+	"github.com/obsidian-chain/obsidian/core/rawdb"
+	"github.com/obsidian-chain/obsidian/core/state"
+)
+
+// State sync configuration
+const (
+	snapPivotDistance  = 64         // Blocks below the sync target whose state is downloaded
+	accountConcurrency = 16         // Chunks the account hash space is split into
+	storageBatchSize   = 128        // Accounts whose storage is requested at once
+	codeBatchSize      = 64         // Contract codes requested at once
+	trieNodeBatchSize  = 256        // Trie nodes requested at once while healing
+	snapRequestBytes   = 512 * 1024 // Soft size limit asked of state sync replies
+	snapLogInterval    = 8 * time.Second
+)
+
+var (
+	errStateUnavailable = errors.New("no peer can serve the state")
+	errStateMismatch    = errors.New("synced state does not match the pivot root")
+)
+
+var emptyCodeHash = crypto.Keccak256Hash(nil)
+
+// stateSyncer downloads the state of a pivot block from the snap peers. The
+// account hash space is split into chunks that are retrieved concurrently as
+// ranges proven against the pivot root, with the storage of each account and
+// its contract code following along. The flat state is written as ranges are
+// verified, the state tries are then rebuilt from it, and anything that
+// doesn't add up to the pivot root - as happens if a sync was interrupted and
+// resumed on a newer pivot - is healed by fetching the differing trie nodes.
+type stateSyncer struct {
+	handler *Handler
+	db      *rawdb.Database
+
+	root      common.Hash
+	accounts  []*accountTask
+	storage   []*storageTask
+	codes     map[common.Hash]struct{}
+	stateless map[string]struct{} // Peers that failed to serve the current root
+
+	pending map[uint64]*snapRequest
+	nextID  uint64
+
+	responseCh chan snapResponse
+	dropCh     chan string
+
+	// Healing
+	sched      *trie.Sync
+	nodeQueue  map[common.Hash][]string // Missing trie node hash -> paths
+	healCodes  map[common.Hash]struct{}
+	healBuffer *memorydb.Database
+
+	// Statistics
+	accountsSynced, slotsSynced, codesSynced, nodesHealed uint64
+
+	log log.Logger
+}
+
+// accountTask is a chunk of the account hash space still to be retrieved
+type accountTask struct {
+	next     common.Hash
+	last     common.Hash
+	done     bool
+	inflight bool
+}
+
+// storageTask is an account whose storage is still to be retrieved, from next
+// onwards for accounts too large for a single reply
+type storageTask struct {
+	account common.Hash
+	root    common.Hash
+	next    common.Hash
+}
+
+// snapRequest is a state sync request in flight with one peer
+type snapRequest struct {
+	id       uint64
+	peer     string
+	sent     time.Time
+	deadline time.Time
+
+	account *accountTask   // Account range retrieval
+	origin  common.Hash    // Start of the account range
+	storage []*storageTask // Storage range retrieval
+	codes   []common.Hash  // Code retrieval
+	nodes   []common.Hash  // Trie node retrieval
+	heal    bool           // Codes requested by the healer rather than the ranges
+}
+
+// snapResponse is a state sync reply delivered by a peer
+type snapResponse struct {
+	peer   string
+	id     uint64
+	packet interface{}
+}
+
+func newStateSyncer(handler *Handler, db *rawdb.Database) *stateSyncer {
+	return &stateSyncer{
+		handler:    handler,
+		db:         db,
+		pending:    make(map[uint64]*snapRequest),
+		responseCh: make(chan snapResponse, 64),
+		dropCh:     make(chan string, 16),
+		log:        log.New("module", "statesync"),
+	}
+}
+
+// deliver hands a reply to the running sync. Replies nobody is waiting for
+// are dropped.
+func (s *stateSyncer) deliver(peer string, id uint64, packet interface{}) {
+	select {
+	case s.responseCh <- snapResponse{peer: peer, id: id, packet: packet}:
+	default:
+		s.log.Debug("State sync response channel full, dropping", "peer", peer[:16])
+	}
+}
+
+// dropPeer notifies the running sync that a peer went away
+func (s *stateSyncer) dropPeer(peer string) {
+	select {
+	case s.dropCh <- peer:
+	default:
+	}
+}
+
+// reset prepares the syncer for a new pivot root. Account chunks completed
+// for an earlier root are kept, the healing will make up the difference.
+func (s *stateSyncer) reset(root common.Hash) {
+	if s.accounts == nil {
+		step := new(big.Int).Div(new(big.Int).Lsh(common.Big1, 256), big.NewInt(accountConcurrency))
+		next := new(big.Int)
+		for i := 0; i < accountConcurrency; i++ {
+			last := new(big.Int).Sub(new(big.Int).Add(next, step), common.Big1)
+			if i == accountConcurrency-1 {
+				last = new(big.Int).Sub(new(big.Int).Lsh(common.Big1, 256), common.Big1)
+			}
+			s.accounts = append(s.accounts, &accountTask{
+				next: common.BigToHash(next),
+				last: common.BigToHash(last),
+			})
+			next = new(big.Int).Add(last, common.Big1)
+		}
+	}
+	for _, task := range s.accounts {
+		task.inflight = false
+	}
+	s.root = root
+	s.storage = nil
+	s.codes = make(map[common.Hash]struct{})
+	s.stateless = make(map[string]struct{})
+	s.pending = make(map[uint64]*snapRequest)
+	s.sched = nil
+}
+
+// Sync retrieves the state with the given root
+func (s *stateSyncer) Sync(root common.Hash, cancel chan struct{}) error {
+	if state.HasState(s.db, root) {
+		// The tries are there already, only the flat state may lag behind
+		_, err := state.RepairFlatState(s.db, root)
+		return err
+	}
+	if root != s.root || s.accounts == nil {
+		s.reset(root)
+	}
+	// Requests left over from an aborted run are sent again
+	for id, req := range s.pending {
+		delete(s.pending, id)
+		s.revert(req)
+	}
+	s.stateless = make(map[string]struct{})
+	s.sched = nil
+
+	s.log.Info("Starting state sync", "root", root)
+	start := time.Now()
+
+	// Download the flat state and rebuild the tries from it
+	if err := s.loop(cancel, s.rangesDone); err != nil {
+		return err
+	}
+	generated, err := state.GenerateTries(s.db)
+	if err != nil {
+		return err
+	}
+	s.log.Info("Generated state tries", "root", generated, "accounts", s.accountsSynced, "slots", s.slotsSynced, "codes", s.codesSynced)
+
+	if generated != root {
+		// Something doesn't add up, fetch whatever nodes of the pivot state
+		// we don't have and bring the flat state in line with them
+		s.log.Info("Healing state", "want", root, "have", generated)
+		s.sched = state.NewStateSync(root, state.NewSyncDatabase(s.db))
+		s.nodeQueue = make(map[common.Hash][]string)
+		s.healCodes = make(map[common.Hash]struct{})
+		s.healBuffer = memorydb.New()
+		s.scheduleHeal()
+
+		if err := s.loop(cancel, func() bool { return s.sched.Pending() == 0 }); err != nil {
+			return err
+		}
+		if err := s.commitHeal(true); err != nil {
+			return err
+		}
+		repaired, err := state.RepairFlatState(s.db, root)
+		if err != nil {
+			return err
+		}
+		if generated, err = state.GenerateTries(s.db); err != nil {
+			return err
+		}
+		if generated != root {
+			return fmt.Errorf("%w: have %x, want %x", errStateMismatch, generated, root)
+		}
+		s.log.Info("Healed state", "nodes", s.nodesHealed, "repaired", repaired)
+	}
+	s.log.Info("State sync completed", "root", root, "elapsed", time.Since(start))
+	return nil
+}
+
+// rangesDone reports whether all account chunks, storage and code have been
+// retrieved
+func (s *stateSyncer) rangesDone() bool {
+	for _, task := range s.accounts {
+		if !task.done {
+			return false
+		}
+	}
+	return len(s.storage) == 0 && len(s.codes) == 0 && len(s.pending) == 0
+}
+
+// loop hands out requests to idle peers and processes their replies until
+// done reports true
+func (s *stateSyncer) loop(cancel chan struct{}, done func() bool) error {
+	ticker := time.NewTicker(timeoutCheckTick)
+	defer ticker.Stop()
+
+	report := time.NewTicker(snapLogInterval)
+	defer report.Stop()
+
+	for !done() {
+		s.assignTasks()
+		if len(s.pending) == 0 {
+			return errStateUnavailable
+		}
+		select {
+		case res := <-s.responseCh:
+			req := s.pending[res.id]
+			if req == nil || req.peer != res.peer {
+				continue // Stale or unsolicited
+			}
+			delete(s.pending, res.id)
+			if err := s.process(req, res.packet); err != nil {
+				return err
+			}
+
+		case peer := <-s.dropCh:
+			for id, req := range s.pending {
+				if req.peer == peer {
+					delete(s.pending, id)
+					s.revert(req)
+				}
+			}
+
+		case <-ticker.C:
+			now := time.Now()
+			for id, req := range s.pending {
+				if now.Before(req.deadline) {
+					continue
+				}
+				delete(s.pending, id)
+				s.revert(req)
+				s.log.Debug("State request timed out", "peer", req.peer[:16])
+				s.handler.scorePeer(req.peer, EventTimeout)
+			}
+
+		case <-report.C:
+			s.log.Info("State sync in progress", "accounts", s.accountsSynced, "slots", s.slotsSynced, "codes", s.codesSynced, "healed", s.nodesHealed)
+
+		case <-cancel:
+			return ErrCancelled
+		}
+	}
+	return nil
+}
+
+// assignTasks sends a request to every idle peer that has work to do
+func (s *stateSyncer) assignTasks() {
+	busy := make(map[string]struct{})
+	for _, req := range s.pending {
+		busy[req.peer] = struct{}{}
+	}
+	for _, p := range s.handler.snapPeerList() {
+		if _, ok := busy[p.id]; ok {
+			continue
+		}
+		if _, ok := s.stateless[p.id]; ok {
+			continue
+		}
+		req, packet, code := s.nextRequest()
+		if req == nil {
+			return
+		}
+		req.id, req.peer = s.nextID, p.id
+		s.nextID++
+		req.sent = time.Now()
+		req.deadline = req.sent.Add(requestTimeout)
+		s.setID(packet, req.id)
+
+		if err := p2p.Send(p.rw, code, packet); err != nil {
+			s.revert(req)
+			continue
+		}
+		s.pending[req.id] = req
+	}
+}
+
+// nextRequest builds the most useful request to send next, preferring to
+// work off the storage and code found so far before looking for more
+func (s *stateSyncer) nextRequest() (*snapRequest, interface{}, uint64) {
+	if s.sched != nil {
+		if len(s.healCodes) > 0 {
+			req := &snapRequest{heal: true}
+			for hash := range s.healCodes {
+				req.codes = append(req.codes, hash)
+				delete(s.healCodes, hash)
+				if len(req.codes) >= codeBatchSize {
+					break
+				}
+			}
+			return req, &GetByteCodesPacket{Hashes: req.codes, Bytes: snapRequestBytes}, GetByteCodesMsg
+		}
+		if len(s.nodeQueue) > 0 {
+			req := new(snapRequest)
+			for hash := range s.nodeQueue {
+				req.nodes = append(req.nodes, hash)
+				if len(req.nodes) >= trieNodeBatchSize {
+					break
+				}
+			}
+			return req, &GetTrieNodesPacket{Hashes: req.nodes, Bytes: snapRequestBytes}, GetTrieNodesMsg
+		}
+		return nil, nil, 0
+	}
+	if len(s.codes) > 0 {
+		req := new(snapRequest)
+		for hash := range s.codes {
+			req.codes = append(req.codes, hash)
+			delete(s.codes, hash)
+			if len(req.codes) >= codeBatchSize {
+				break
+			}
+		}
+		return req, &GetByteCodesPacket{Hashes: req.codes, Bytes: snapRequestBytes}, GetByteCodesMsg
+	}
+	if len(s.storage) > 0 {
+		// Large storage continues alone, everything else is batched
+		n := 1
+		if s.storage[0].next == (common.Hash{}) {
+			for n < len(s.storage) && n < storageBatchSize && s.storage[n].next == (common.Hash{}) {
+				n++
+			}
+		}
+		req := &snapRequest{storage: s.storage[:n:n]}
+		s.storage = s.storage[n:]
+
+		packet := &GetStorageRangesPacket{Root: s.root, Bytes: snapRequestBytes}
+		for _, task := range req.storage {
+			packet.Accounts = append(packet.Accounts, task.account)
+		}
+		if next := req.storage[0].next; next != (common.Hash{}) {
+			packet.Origin = next[:]
+		}
+		return req, packet, GetStorageRangesMsg
+	}
+	for _, task := range s.accounts {
+		if task.done || task.inflight {
+			continue
+		}
+		task.inflight = true
+		req := &snapRequest{account: task, origin: task.next}
+		return req, &GetAccountRangePacket{Root: s.root, Origin: task.next, Limit: task.last, Bytes: snapRequestBytes}, GetAccountRangeMsg
+	}
+	return nil, nil, 0
+}
+
+// setID stamps a request packet with its request ID
+func (s *stateSyncer) setID(packet interface{}, id uint64) {
+	switch packet := packet.(type) {
+	case *GetAccountRangePacket:
+		packet.ID = id
+	case *GetStorageRangesPacket:
+		packet.ID = id
+	case *GetByteCodesPacket:
+		packet.ID = id
+	case *GetTrieNodesPacket:
+		packet.ID = id
+	}
+}
+
+// revert makes the tasks of a failed request available again
+func (s *stateSyncer) revert(req *snapRequest) {
+	switch {
+	case req.account != nil:
+		req.account.inflight = false
+	case len(req.storage) > 0:
+		s.storage = append(req.storage, s.storage...)
+	case len(req.codes) > 0:
+		for _, hash := range req.codes {
+			if req.heal {
+				s.healCodes[hash] = struct{}{}
+			} else {
+				s.codes[hash] = struct{}{}
+			}
+		}
+	}
+	// Trie nodes stay queued until they are delivered
+}
+
+// fail reverts a request that the peer couldn't or wouldn't serve. A peer
+// that sent something provably wrong is penalised, one that just doesn't
+// have the state isn't asked again during this sync.
+func (s *stateSyncer) fail(req *snapRequest, invalid error) {
+	s.revert(req)
+	if invalid != nil {
+		s.log.Debug("Invalid state sync response", "peer", req.peer[:16], "err", invalid)
+		s.handler.scorePeer(req.peer, EventInvalidResponse)
+	}
+	s.stateless[req.peer] = struct{}{}
+}
+
+// process handles the reply to a request
+func (s *stateSyncer) process(req *snapRequest, packet interface{}) error {
+	switch res := packet.(type) {
+	case *AccountRangePacket:
+		if req.account == nil {
+			s.fail(req, errors.New("unexpected account range"))
+			return nil
+		}
+		return s.processAccounts(req, res)
+	case *StorageRangesPacket:
+		if len(req.storage) == 0 {
+			s.fail(req, errors.New("unexpected storage ranges"))
+			return nil
+		}
+		return s.processStorage(req, res)
+	case *ByteCodesPacket:
+		if len(req.codes) == 0 {
+			s.fail(req, errors.New("unexpected byte codes"))
+			return nil
+		}
+		return s.processCodes(req, res)
+	case *TrieNodesPacket:
+		if len(req.nodes) == 0 {
+			s.fail(req, errors.New("unexpected trie nodes"))
+			return nil
+		}
+		return s.processNodes(req, res)
+	}
+	return nil
+}
+
+// processAccounts verifies and stores an account range
+func (s *stateSyncer) processAccounts(req *snapRequest, res *AccountRangePacket) error {
+	task := req.account
+	task.inflight = false
+
+	if len(res.Accounts) == 0 && len(res.Proof) == 0 {
+		s.fail(req, nil)
+		return nil
+	}
+	keys := make([][]byte, len(res.Accounts))
+	values := make([][]byte, len(res.Accounts))
+	for i, account := range res.Accounts {
+		keys[i], values[i] = account.Hash[:], account.Body
+	}
+	more, err := trie.VerifyRangeProof(s.root, req.origin[:], keys, values, proofSet(res.Proof))
+	if err != nil {
+		s.fail(req, err)
+		return nil
+	}
+	// Accounts past the chunk belong to another task
+	for len(res.Accounts) > 0 && bytes.Compare(res.Accounts[len(res.Accounts)-1].Hash[:], task.last[:]) > 0 {
+		res.Accounts = res.Accounts[:len(res.Accounts)-1]
+		more = false
+	}
+	end := task.last
+	if more && len(res.Accounts) > 0 {
+		end = res.Accounts[len(res.Accounts)-1].Hash
+	}
+	// Store the accounts and drop any stale ones the range proves absent
+	batch := s.db.NewBatch()
+	returned := make(map[common.Hash]struct{}, len(res.Accounts))
+	for _, account := range res.Accounts {
+		var acc state.Account
+		if err := rlp.DecodeBytes(account.Body, &acc); err != nil {
+			s.fail(req, err)
+			return nil
+		}
+		returned[account.Hash] = struct{}{}
+		rawdb.WriteAccountData(batch, account.Hash, account.Body)
+
+		if acc.Root != types.EmptyRootHash {
+			s.storage = append(s.storage, &storageTask{account: account.Hash, root: acc.Root})
+		} else {
+			state.DeleteFlatStorage(s.db, account.Hash)
+		}
+		if codeHash := common.BytesToHash(acc.CodeHash); len(acc.CodeHash) > 0 && codeHash != emptyCodeHash {
+			if len(rawdb.ReadCode(s.db, codeHash)) == 0 {
+				s.codes[codeHash] = struct{}{}
+			}
+		}
+	}
+	var stale []common.Hash
+	rawdb.IterateAccountData(s.db, req.origin, func(hash common.Hash, _ []byte) bool {
+		if bytes.Compare(hash[:], end[:]) > 0 {
+			return false
+		}
+		if _, ok := returned[hash]; !ok {
+			stale = append(stale, hash)
+		}
+		return true
+	})
+	for _, hash := range stale {
+		rawdb.DeleteAccountData(batch, hash)
+		state.DeleteFlatStorage(s.db, hash)
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	s.accountsSynced += uint64(len(res.Accounts))
+	s.handler.scorePeer(req.peer, EventUsefulResponse)
+
+	if !more || end == task.last {
+		task.done = true
+	} else {
+		task.next = incHash(end)
+	}
+	return nil
+}
+
+// processStorage verifies and stores the storage ranges of some accounts
+func (s *stateSyncer) processStorage(req *snapRequest, res *StorageRangesPacket) error {
+	if len(res.Slots) == 0 || len(res.Slots) > len(req.storage) {
+		if len(res.Slots) == 0 && len(res.Proof) == 0 {
+			s.fail(req, nil)
+		} else {
+			s.fail(req, errors.New("mismatching storage range count"))
+		}
+		return nil
+	}
+	batch := s.db.NewBatch()
+	for i, slots := range res.Slots {
+		task := req.storage[i]
+
+		keys := make([][]byte, len(slots))
+		values := make([][]byte, len(slots))
+		for j, slot := range slots {
+			keys[j], values[j] = slot.Hash[:], slot.Body
+		}
+		var (
+			more bool
+			err  error
+		)
+		if i == len(res.Slots)-1 && len(res.Proof) > 0 {
+			more, err = trie.VerifyRangeProof(task.root, task.next[:], keys, values, proofSet(res.Proof))
+		} else {
+			more, err = trie.VerifyRangeProof(task.root, nil, keys, values, nil)
+		}
+		if err != nil {
+			s.fail(&snapRequest{peer: req.peer, storage: req.storage[i:]}, err)
+			return batch.Write()
+		}
+		end := common.MaxHash
+		if more {
+			end = slots[len(slots)-1].Hash
+		}
+		returned := make(map[common.Hash]struct{}, len(slots))
+		for _, slot := range slots {
+			value, err := state.DecodeStorage(slot.Body)
+			if err != nil {
+				s.fail(&snapRequest{peer: req.peer, storage: req.storage[i:]}, err)
+				return batch.Write()
+			}
+			returned[slot.Hash] = struct{}{}
+			rawdb.WriteStorageData(batch, task.account, slot.Hash, value[:])
+		}
+		var stale []common.Hash
+		rawdb.IterateStorageData(s.db, task.account, task.next, func(hash common.Hash, _ []byte) bool {
+			if bytes.Compare(hash[:], end[:]) > 0 {
+				return false
+			}
+			if _, ok := returned[hash]; !ok {
+				stale = append(stale, hash)
+			}
+			return true
+		})
+		for _, hash := range stale {
+			rawdb.DeleteStorageData(batch, task.account, hash)
+		}
+		s.slotsSynced += uint64(len(slots))
+
+		if more {
+			task.next = incHash(end)
+			s.storage = append([]*storageTask{task}, s.storage...)
+		}
+	}
+	// Accounts the reply didn't get to are retried
+	s.storage = append(req.storage[len(res.Slots):], s.storage...)
+	s.handler.scorePeer(req.peer, EventUsefulResponse)
+	return batch.Write()
+}
+
+// processCodes verifies and stores contract codes
+func (s *stateSyncer) processCodes(req *snapRequest, res *ByteCodesPacket) error {
+	if len(res.Codes) == 0 {
+		s.fail(req, nil)
+		return nil
+	}
+	wanted := make(map[common.Hash]struct{}, len(req.codes))
+	for _, hash := range req.codes {
+		wanted[hash] = struct{}{}
+	}
+	batch := s.db.NewBatch()
+	for _, code := range res.Codes {
+		hash := crypto.Keccak256Hash(code)
+		if _, ok := wanted[hash]; !ok {
+			s.fail(req, fmt.Errorf("unrequested code %x", hash))
+			return nil
+		}
+		delete(wanted, hash)
+		if req.heal {
+			if err := s.sched.ProcessCode(trie.CodeSyncResult{Hash: hash, Data: code}); err != nil {
+				s.log.Debug("Failed to process healed code", "hash", hash, "err", err)
+			}
+		} else {
+			rawdb.WriteCode(batch, hash, code)
+		}
+		s.codesSynced++
+	}
+	for hash := range wanted {
+		if req.heal {
+			s.healCodes[hash] = struct{}{}
+		} else {
+			s.codes[hash] = struct{}{}
+		}
+	}
+	s.handler.scorePeer(req.peer, EventUsefulResponse)
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	if req.heal {
+		s.scheduleHeal()
+		return s.commitHeal(false)
+	}
+	return nil
+}
+
+// processNodes feeds healed trie nodes to the scheduler
+func (s *stateSyncer) processNodes(req *snapRequest, res *TrieNodesPacket) error {
+	if len(res.Nodes) == 0 {
+		s.fail(req, nil)
+		return nil
+	}
+	if len(res.Nodes) > len(req.nodes) {
+		s.fail(req, errors.New("unrequested trie nodes"))
+		return nil
+	}
+	for i, blob := range res.Nodes {
+		hash := req.nodes[i]
+		if crypto.Keccak256Hash(blob) != hash {
+			s.fail(req, fmt.Errorf("trie node %x mismatch", hash))
+			return nil
+		}
+		paths, ok := s.nodeQueue[hash]
+		if !ok {
+			continue // Delivered by someone else meanwhile
+		}
+		delete(s.nodeQueue, hash)
+		for _, path := range paths {
+			if err := s.sched.ProcessNode(trie.NodeSyncResult{Path: path, Data: blob}); err != nil {
+				return fmt.Errorf("failed to process trie node %x: %w", hash, err)
+			}
+		}
+		s.nodesHealed++
+	}
+	s.handler.scorePeer(req.peer, EventUsefulResponse)
+	s.scheduleHeal()
+	return s.commitHeal(false)
+}
+
+// scheduleHeal queues the trie nodes and codes the healer is missing
+func (s *stateSyncer) scheduleHeal() {
+	paths, hashes, codes := s.sched.Missing(0)
+	for i, hash := range hashes {
+		s.nodeQueue[hash] = append(s.nodeQueue[hash], paths[i])
+	}
+	for _, hash := range codes {
+		s.healCodes[hash] = struct{}{}
+	}
+}
+
+// commitHeal flushes the healed nodes to disk once enough have piled up
+func (s *stateSyncer) commitHeal(force bool) error {
+	if !force && s.sched.MemSize() < ethdb.IdealBatchSize {
+		return nil
+	}
+	batch := s.healBuffer.NewBatch()
+	if err := s.sched.Commit(batch); err != nil {
+		return err
+	}
+	return batch.Replay(state.NewSyncDatabase(s.db))
+}
+
+// proofSet converts the proof nodes of a reply into a lookup set. A reply
+// without proof yields nil, which asks for the range to be the whole trie.
+func proofSet(proof [][]byte) ethdb.KeyValueReader {
+	if len(proof) == 0 {
+		return nil
+	}
+	list := make(trienode.ProofList, len(proof))
+	for i, node := range proof {
+		list[i] = node
+	}
+	return list.Set()
+}
+
+// incHash returns the hash following h
+func incHash(h common.Hash) common.Hash {
+	for i := len(h) - 1; i >= 0; i-- {
+		h[i]++
+		if h[i] != 0 {
+			break
+		}
+	}
+	return h
+}
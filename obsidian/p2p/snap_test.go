@@ -0,0 +1,398 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package p2p
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/eth/ethconfig"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/obsidian-chain/obsidian/core"
+	"github.com/obsidian-chain/obsidian/core/rawdb"
+	"github.com/obsidian-chain/obsidian/core/state"
+	obstypes "github.com/obsidian-chain/obsidian/core/types"
+)
+
+// testSnapBackend is a chain backend on a real database that can store
+// blocks without their state and move its head onto a synced pivot
+type testSnapBackend struct {
+	*testChainBackend
+	headless []*obstypes.ObsidianBlock
+	receipts map[common.Hash]obstypes.Receipts
+}
+
+func newTestSnapBackend(t *testing.T, blocks []*obstypes.ObsidianBlock) *testSnapBackend {
+	t.Helper()
+
+	db, err := rawdb.NewDatabase(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	b := &testSnapBackend{
+		testChainBackend: newTestChainBackend(blocks),
+		receipts:         make(map[common.Hash]obstypes.Receipts),
+	}
+	b.db = db
+	return b
+}
+
+func (b *testSnapBackend) InsertBlockWithoutState(block *obstypes.ObsidianBlock) error {
+	b.chainMu.Lock()
+	defer b.chainMu.Unlock()
+
+	tail := b.blocks[len(b.blocks)-1]
+	if n := len(b.headless); n > 0 {
+		tail = b.headless[n-1]
+	}
+	if block.ParentHash() != tail.Hash() {
+		return fmt.Errorf("block %d does not extend %d", block.NumberU64(), tail.NumberU64())
+	}
+	b.headless = append(b.headless, block)
+	return nil
+}
+
+func (b *testSnapBackend) GetReceipts(hash common.Hash) obstypes.Receipts {
+	b.chainMu.RLock()
+	defer b.chainMu.RUnlock()
+	return b.receipts[hash]
+}
+
+func (b *testSnapBackend) InsertReceipts(hash common.Hash, receipts obstypes.Receipts) error {
+	b.chainMu.Lock()
+	defer b.chainMu.Unlock()
+
+	for _, block := range b.headless {
+		if block.Hash() != hash {
+			continue
+		}
+		if root := obstypes.DeriveSha(receipts); root != block.ReceiptHash() {
+			return fmt.Errorf("%w: %x", core.ErrReceiptRootMismatch, root)
+		}
+		b.receipts[hash] = receipts
+		return nil
+	}
+	return errors.New("unknown block")
+}
+
+func (b *testSnapBackend) SnapSyncCommitHead(hash common.Hash) error {
+	b.chainMu.Lock()
+	defer b.chainMu.Unlock()
+
+	for i, block := range b.headless {
+		if block.Hash() != hash {
+			continue
+		}
+		if !state.HasState(b.db, block.Root()) {
+			return errors.New("pivot state missing")
+		}
+		for _, block := range b.headless[:i+1] {
+			b.blocks = append(b.blocks, block)
+			b.hashes[block.Hash()] = block.NumberU64()
+		}
+		b.headless = b.headless[i+1:]
+		return nil
+	}
+	return errors.New("unknown pivot")
+}
+
+// makeTestState fills db with accounts, storage and code, one of the accounts
+// holding more storage than fits in a single reply
+func makeTestState(t *testing.T, db *rawdb.Database, accounts int) common.Hash {
+	t.Helper()
+
+	s := state.NewMemoryStateDB()
+	for i := 0; i < accounts; i++ {
+		addr := common.BigToAddress(big.NewInt(int64(i + 1)))
+		s.SetBalance(addr, big.NewInt(int64(i+1)))
+		if i%5 == 0 {
+			s.SetState(addr, common.Hash{byte(i)}, common.Hash{byte(i + 1)})
+		}
+		if i%7 == 0 {
+			s.SetCode(addr, []byte{0x60, byte(i % 3)})
+		}
+	}
+	large := common.Address{0xbb}
+	s.SetBalance(large, big.NewInt(1))
+	for i := 0; i < 20000; i++ {
+		s.SetState(large, common.BigToHash(big.NewInt(int64(i))), crypto.Keccak256Hash(large[:], []byte{byte(i)}))
+	}
+	root, err := s.Commit(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CommitToDB(db, root); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// connectSnap runs the state sync protocol between two handlers over a
+// message pipe
+func connectSnap(t *testing.T, a, b *Handler) {
+	t.Helper()
+
+	var ida, idb enode.ID
+	rand.Read(ida[:])
+	rand.Read(idb[:])
+
+	ra, rb := p2p.MsgPipe()
+	t.Cleanup(func() { ra.Close() })
+
+	go a.runSnapPeer(p2p.NewPeer(idb, "b", nil), ra)
+	go b.runSnapPeer(p2p.NewPeer(ida, "a", nil), rb)
+	waitFor(t, func() bool { return len(a.snapPeerList()) > 0 && len(b.snapPeerList()) > 0 })
+}
+
+// syncState runs a state sync from the sources into sink
+func syncState(t *testing.T, sink *Handler, root common.Hash) {
+	t.Helper()
+
+	done := make(chan error, 1)
+	cancel := make(chan struct{})
+	go func() { done <- sink.stateSync.Sync(root, cancel) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("state sync failed: %v", err)
+		}
+	case <-time.After(30 * time.Second):
+		close(cancel)
+		t.Fatal("state sync timed out")
+	}
+}
+
+func TestStateSync(t *testing.T) {
+	source := newTestSnapBackend(t, nil)
+	root := makeTestState(t, source.db, 500)
+	sh := NewHandler(1719, source)
+	defer sh.Stop()
+
+	sink := newTestSnapBackend(t, nil)
+	h := NewHandler(1719, sink)
+	defer h.Stop()
+
+	for i := 0; i < 2; i++ {
+		connectSnap(t, h, sh)
+	}
+	syncState(t, h, root)
+
+	if generated, err := state.GenerateTries(sink.db); err != nil || generated != root {
+		t.Fatalf("synced state root mismatch: have %x, want %x (err %v)", generated, root, err)
+	}
+	s, err := state.New(root, sink.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := common.BigToAddress(big.NewInt(8))
+	if balance := s.GetBalance(addr); balance.Int64() != 8 {
+		t.Fatalf("balance mismatch: have %v, want 8", balance)
+	}
+	if code := s.GetCode(addr); len(code) != 2 {
+		t.Fatalf("code missing: %x", code)
+	}
+}
+
+func TestStateSyncHeal(t *testing.T) {
+	source := newTestSnapBackend(t, nil)
+	makeTestState(t, source.db, 200)
+
+	// The sink holds an older version of the source state, as if a sync to an
+	// earlier pivot had finished right before the pivot moved
+	sink := newTestSnapBackend(t, nil)
+	old := makeTestState(t, sink.db, 200)
+
+	s, err := state.New(old, source.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetBalance(common.BigToAddress(big.NewInt(3)), big.NewInt(1000))
+	s.SetState(common.BigToAddress(big.NewInt(11)), common.Hash{1}, common.Hash{2})
+	s.SetState(common.Address{0xbb}, common.Hash{}, common.Hash{})
+	s.SetCode(common.Address{0xcc}, []byte{0x60, 0x60})
+	s.Suicide(common.BigToAddress(big.NewInt(6)))
+	root, err := s.Commit(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CommitToDB(source.db, root); err != nil {
+		t.Fatal(err)
+	}
+
+	sh := NewHandler(1719, source)
+	defer sh.Stop()
+	h := NewHandler(1719, sink)
+	defer h.Stop()
+	connectSnap(t, h, sh)
+
+	// Pretend every range was fetched for the old root already
+	h.stateSync.reset(old)
+	for _, task := range h.stateSync.accounts {
+		task.done = true
+	}
+	syncState(t, h, root)
+
+	if h.stateSync.nodesHealed == 0 {
+		t.Fatal("state was not healed")
+	}
+	if generated, err := state.GenerateTries(sink.db); err != nil || generated != root {
+		t.Fatalf("healed state root mismatch: have %x, want %x (err %v)", generated, root, err)
+	}
+	synced, err := state.New(root, sink.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance := synced.GetBalance(common.BigToAddress(big.NewInt(3))); balance.Int64() != 1000 {
+		t.Fatalf("balance not healed: %v", balance)
+	}
+	if code := synced.GetCode(common.Address{0xcc}); len(code) != 2 {
+		t.Fatalf("code not healed: %x", code)
+	}
+}
+
+// makeReceiptChain generates a chain on top of genesis in which every block
+// carries the given state root, and those with transactions a log. Next to
+// the receipts it returns forged ones that don't match the receipt roots.
+func makeReceiptChain(genesis *obstypes.ObsidianBlock, root common.Hash, length int) ([]*obstypes.ObsidianBlock, map[common.Hash]obstypes.Receipts, map[common.Hash]obstypes.Receipts) {
+	var (
+		chain    = makeTestChain(length)
+		receipts = make(map[common.Hash]obstypes.Receipts)
+		forged   = make(map[common.Hash]obstypes.Receipts)
+		parent   = genesis
+	)
+	for i, block := range chain {
+		header := block.Header()
+		header.ParentHash = parent.Hash()
+		header.Root = root
+
+		var real, fake obstypes.Receipts
+		for _, tx := range block.Transactions() {
+			receipt := &obstypes.Receipt{
+				Type:              tx.Type(),
+				Status:            obstypes.ReceiptStatusSuccessful,
+				CumulativeGasUsed: 21000,
+				Logs:              []*obstypes.Log{{Address: common.Address{0x01}, Data: []byte{byte(i)}}},
+			}
+			receipt.Bloom = obstypes.CreateBloom(obstypes.Receipts{receipt})
+			real = append(real, receipt)
+
+			lie := *receipt
+			lie.CumulativeGasUsed++
+			fake = append(fake, &lie)
+		}
+		if len(real) > 0 {
+			header.ReceiptHash = obstypes.DeriveSha(real)
+		}
+		chain[i] = obstypes.NewBlockWithHeader(header).WithBody(block.Transactions(), block.Uncles())
+		parent = chain[i]
+
+		receipts[chain[i].Hash()] = real
+		forged[chain[i].Hash()] = fake
+	}
+	return chain, receipts, forged
+}
+
+func TestSnapSyncChain(t *testing.T) {
+	const length = 300
+
+	source := newTestSnapBackend(t, nil)
+	root := makeTestState(t, source.db, 100)
+
+	// A peer serving forged receipts for the same chain
+	liar := newTestSnapBackend(t, nil)
+
+	chain, receipts, forged := makeReceiptChain(source.genesis, root, length)
+	source.receipts, liar.receipts = receipts, forged
+	for _, backend := range []*testSnapBackend{source, liar} {
+		for _, block := range chain {
+			backend.blocks = append(backend.blocks, block)
+			backend.hashes[block.Hash()] = block.NumberU64()
+		}
+	}
+
+	sink := newTestSnapBackend(t, nil)
+	sink.held = true
+	sink.mode = ethconfig.SnapSync
+	h := NewHandler(1719, sink)
+	defer h.Stop()
+
+	sh := NewHandler(1719, source)
+	defer sh.Stop()
+	lh := NewHandler(1719, liar)
+	defer lh.Stop()
+
+	connectHandlers(t, h, sh)
+	connectHandlers(t, h, lh)
+	connectSnap(t, h, sh)
+	startSync(t, h, sink.testChainBackend, 2)
+	waitForHead(t, sink.testChainBackend, length, 30*time.Second)
+
+	if head := sink.CurrentBlock(); head.Hash() != chain[length-1].Hash() {
+		t.Fatalf("synced to the wrong head: %x", head.Hash())
+	}
+	if !state.HasState(sink.db, root) {
+		t.Fatal("pivot state not synced")
+	}
+	pivot := length - snapPivotDistance
+	for _, block := range chain[:pivot] {
+		if block.ReceiptHash() == obstypes.EmptyReceiptsHash {
+			continue
+		}
+		receipts := sink.GetReceipts(block.Hash())
+		if len(receipts) == 0 || receipts[0].CumulativeGasUsed != 21000 {
+			t.Fatalf("block %d: receipts missing or forged", block.NumberU64())
+		}
+	}
+}
+
+// Whether the liar gets any receipt requests during a sync depends on peer
+// speed, so forged receipts are checked with the liar as the only peer
+func TestFetchForgedReceipts(t *testing.T) {
+	liar := newTestSnapBackend(t, nil)
+	chain, _, forged := makeReceiptChain(liar.genesis, common.Hash{}, 8)
+	liar.receipts = forged
+	for _, block := range chain {
+		liar.blocks = append(liar.blocks, block)
+		liar.hashes[block.Hash()] = block.NumberU64()
+	}
+	sink := newTestSnapBackend(t, nil)
+	sink.held = true
+	sink.headless = chain
+	h := NewHandler(1719, sink)
+	defer h.Stop()
+	lh := NewHandler(1719, liar)
+	defer lh.Stop()
+
+	_, liarID := connectHandlers(t, h, lh)
+	waitFor(t, func() bool { return h.PeerCount() == 1 })
+
+	headers := make([]*obstypes.ObsidianHeader, len(chain))
+	for i, block := range chain {
+		headers[i] = block.Header()
+	}
+	if err := h.downloader.fetchReceipts(headers); !errors.Is(err, errStalledPeers) {
+		t.Fatalf("have %v, want %v", err, errStalledPeers)
+	}
+	for _, block := range chain {
+		if len(sink.GetReceipts(block.Hash())) != 0 {
+			t.Fatalf("block %d: forged receipts stored", block.NumberU64())
+		}
+	}
+	// Repeated offences get the peer banned, which resets its score
+	if _, banned := h.scorer.Banned(liarID); !banned {
+		if score := h.scorer.Score(liarID); score >= 0 {
+			t.Fatalf("peer serving forged receipts not penalised: score %d", score)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/obsidian-chain/obsidian/stealth/filter"
+)
+
+// Limits of stealth filter requests, the ones of BIP-157
+const (
+	maxStealthFilterFetch       = 1000 // Filters per StealthFiltersMsg
+	maxStealthFilterHeaderFetch = 2000 // Filter hashes per StealthFilterHeadersMsg
+)
+
+var (
+	// errFiltersUnsupported is returned when requesting stealth filters from
+	// a peer older than obs/3
+	errFiltersUnsupported = errors.New("peer does not serve stealth filters")
+
+	// errFiltersUnavailable is returned when a peer sends an empty reply to a
+	// stealth filter request
+	errFiltersUnavailable = errors.New("stealth filters unavailable")
+)
+
+// GetStealthFiltersPacket requests the stealth filters of the blocks from
+// number Start up to the block Stop, on the chain ending at Stop
+type GetStealthFiltersPacket struct {
+	Start uint64
+	Stop  common.Hash
+}
+
+// StealthFiltersPacket is the response with the requested stealth filters,
+// empty if the peer can't serve all of them
+type StealthFiltersPacket struct {
+	Blocks  []common.Hash
+	Filters [][]byte
+}
+
+// GetStealthFilterHeadersPacket requests the stealth filter hashes of the
+// blocks from number Start up to the block Stop, on the chain ending at Stop
+type GetStealthFilterHeadersPacket struct {
+	Start uint64
+	Stop  common.Hash
+}
+
+// StealthFilterHeadersPacket is the response with the requested filter
+// hashes and the filter header of the block before them, from which the
+// requester derives the filter headers. It's empty if the peer can't serve
+// all of them.
+type StealthFilterHeadersPacket struct {
+	Prev         common.Hash
+	FilterHashes []common.Hash
+}
+
+// filterRequests tracks the stealth filter requests waiting for a reply
+type filterRequests struct {
+	mu      sync.Mutex
+	pending map[uint64]*filterRequest
+}
+
+// filterRequest is a stealth filter request waiting for a reply
+type filterRequest struct {
+	peer  string
+	code  uint64 // Expected reply message
+	reply chan interface{}
+}
+
+func newFilterRequests() *filterRequests {
+	return &filterRequests{pending: make(map[uint64]*filterRequest)}
+}
+
+// handleGetStealthFilters serves the stealth filters of a range of blocks
+func (h *Handler) handleGetStealthFilters(p *Peer, msg p2p.Msg) error {
+	var req GetStealthFiltersPacket
+	id, err := p.decodePacket(msg, &req)
+	if err != nil {
+		return err
+	}
+	// The size of the range is only known once its stop block is found, so
+	// the reply is metered rather than the request
+	var res StealthFiltersPacket
+	r := h.backend.StealthFilterRange(req.Start, req.Stop, maxStealthFilterFetch)
+	if r != nil {
+		res.Blocks, res.Filters = r.Blocks, r.Filters
+	}
+	if !h.throttle(p.id, serveCost(GetStealthFiltersMsg, len(res.Blocks))) {
+		res = StealthFiltersPacket{}
+	}
+	return p.sendPacket(StealthFiltersMsg, id, &res)
+}
+
+// handleGetStealthFilterHeaders serves the stealth filter hashes of a range
+// of blocks
+func (h *Handler) handleGetStealthFilterHeaders(p *Peer, msg p2p.Msg) error {
+	var req GetStealthFilterHeadersPacket
+	id, err := p.decodePacket(msg, &req)
+	if err != nil {
+		return err
+	}
+	var res StealthFilterHeadersPacket
+	r := h.backend.StealthFilterRange(req.Start, req.Stop, maxStealthFilterHeaderFetch)
+	if r != nil {
+		res.Prev, res.FilterHashes = r.Prev, r.FilterHashes()
+	}
+	if !h.throttle(p.id, serveCost(GetStealthFilterHeadersMsg, len(res.FilterHashes))) {
+		res = StealthFilterHeadersPacket{}
+	}
+	return p.sendPacket(StealthFilterHeadersMsg, id, &res)
+}
+
+// handleStealthFilters handles stealth filter responses
+func (h *Handler) handleStealthFilters(p *Peer, msg p2p.Msg) error {
+	res := new(StealthFiltersPacket)
+	id, err := p.decodePacket(msg, res)
+	if err != nil {
+		return err
+	}
+	h.filterReqs.deliver(p.id, id, StealthFiltersMsg, res)
+	return nil
+}
+
+// handleStealthFilterHeaders handles stealth filter header responses
+func (h *Handler) handleStealthFilterHeaders(p *Peer, msg p2p.Msg) error {
+	res := new(StealthFilterHeadersPacket)
+	id, err := p.decodePacket(msg, res)
+	if err != nil {
+		return err
+	}
+	h.filterReqs.deliver(p.id, id, StealthFilterHeadersMsg, res)
+	return nil
+}
+
+// deliver hands a reply to the request waiting for it. Replies nobody is
+// waiting for are dropped.
+func (r *filterRequests) deliver(peer string, id uint64, code uint64, res interface{}) {
+	r.mu.Lock()
+	req := r.pending[id]
+	if req != nil && req.peer == peer && req.code == code {
+		delete(r.pending, id)
+	} else {
+		req = nil
+	}
+	r.mu.Unlock()
+
+	if req == nil {
+		log.Debug("Unrequested stealth filter reply", "peer", peer[:16], "id", id)
+		return
+	}
+	req.reply <- res
+}
+
+// RequestStealthFilters fetches the stealth filters of the blocks from number
+// start up to the block stop from a peer. The filters should be checked
+// against filter headers obtained from several peers.
+func (h *Handler) RequestStealthFilters(ctx context.Context, peer string, start uint64, stop common.Hash) (*filter.Range, error) {
+	reply, err := h.requestFilters(ctx, peer, GetStealthFiltersMsg, StealthFiltersMsg, &GetStealthFiltersPacket{Start: start, Stop: stop})
+	if err != nil {
+		return nil, err
+	}
+	res := reply.(*StealthFiltersPacket)
+	if len(res.Blocks) == 0 {
+		return nil, errFiltersUnavailable
+	}
+	if len(res.Blocks) != len(res.Filters) || res.Blocks[len(res.Blocks)-1] != stop {
+		h.scorePeer(peer, EventInvalidResponse)
+		return nil, fmt.Errorf("invalid stealth filters from peer %s", peer)
+	}
+	return &filter.Range{Blocks: res.Blocks, Filters: res.Filters}, nil
+}
+
+// RequestStealthFilterHeaders fetches the stealth filter headers of the
+// blocks from number start up to the block stop from a peer. It returns the
+// filter header of the block before start followed by those of the range.
+func (h *Handler) RequestStealthFilterHeaders(ctx context.Context, peer string, start uint64, stop common.Hash) ([]common.Hash, error) {
+	reply, err := h.requestFilters(ctx, peer, GetStealthFilterHeadersMsg, StealthFilterHeadersMsg, &GetStealthFilterHeadersPacket{Start: start, Stop: stop})
+	if err != nil {
+		return nil, err
+	}
+	res := reply.(*StealthFilterHeadersPacket)
+	if len(res.FilterHashes) == 0 {
+		return nil, errFiltersUnavailable
+	}
+	return append([]common.Hash{res.Prev}, filter.Headers(res.Prev, res.FilterHashes)...), nil
+}
+
+// requestFilters sends a stealth filter request to a peer and waits for the
+// reply
+func (h *Handler) requestFilters(ctx context.Context, peer string, code, replyCode uint64, packet interface{}) (interface{}, error) {
+	h.peersMu.RLock()
+	p, ok := h.peers[peer]
+	h.peersMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("peer %s not registered", peer)
+	}
+	if p.version < OBS3 {
+		return nil, errFiltersUnsupported
+	}
+	var (
+		id  = h.nextRequestID()
+		req = &filterRequest{peer: peer, code: replyCode, reply: make(chan interface{}, 1)}
+	)
+	h.filterReqs.mu.Lock()
+	h.filterReqs.pending[id] = req
+	h.filterReqs.mu.Unlock()
+
+	defer func() {
+		h.filterReqs.mu.Lock()
+		delete(h.filterReqs.pending, id)
+		h.filterReqs.mu.Unlock()
+	}()
+	if err := p.sendPacket(code, id, packet); err != nil {
+		return nil, err
+	}
+	select {
+	case reply := <-req.reply:
+		return reply, nil
+	case <-p.term:
+		return nil, fmt.Errorf("peer %s disconnected", peer)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/obsidian-chain/obsidian/stealth/filter"
+)
+
+// StealthFilterRange serves a filter per block holding the block number as
+// a view tag
+func (b *testChainBackend) StealthFilterRange(start uint64, stop common.Hash, max uint64) *filter.Range {
+	b.chainMu.RLock()
+	defer b.chainMu.RUnlock()
+
+	number, ok := b.hashes[stop]
+	if !ok || start > number || number-start >= max {
+		return nil
+	}
+	r := new(filter.Range)
+	for n := uint64(0); n <= number; n++ {
+		hash := b.blocks[n].Hash()
+		raw := filter.New(hash, [][]byte{filter.ViewTagItem(byte(n))}).Bytes()
+		if n < start {
+			r.Prev = filter.Header(filter.Hash(raw), r.Prev)
+			continue
+		}
+		r.Blocks = append(r.Blocks, hash)
+		r.Filters = append(r.Filters, raw)
+	}
+	return r
+}
+
+func TestStealthFilterRetrieval(t *testing.T) {
+	chain := makeTestChain(20)
+
+	h := NewHandler(1719, newTestChainBackend(nil))
+	defer h.Stop()
+	source := NewHandler(1719, newTestChainBackend(chain))
+	defer source.Stop()
+
+	_, sourceID := connectHandlers(t, h, source)
+	waitFor(t, func() bool { return h.PeerCount() == 1 && source.PeerCount() == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stop := chain[14].Hash()
+	headers, err := h.RequestStealthFilterHeaders(ctx, sourceID, 5, stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 12 {
+		t.Fatalf("got %d filter headers, want 12", len(headers))
+	}
+	filters, err := h.RequestStealthFilters(ctx, sourceID, 5, stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The filters check out against the headers, and match their blocks only
+	filters.Prev = headers[0]
+	for i, header := range filters.Headers() {
+		if header != headers[i+1] {
+			t.Fatalf("filter of block %d does not match its header", i+5)
+		}
+		f, err := filter.Decode(filters.Blocks[i], filters.Filters[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !f.MatchViewTags([]byte{byte(i + 5)}) || f.MatchViewTags([]byte{byte(i + 6)}) {
+			t.Errorf("unexpected filter for block %d", i+5)
+		}
+	}
+
+	if _, err := h.RequestStealthFilters(ctx, sourceID, 5, common.Hash{1}); err != errFiltersUnavailable {
+		t.Errorf("filters of an unknown chain served, err %v", err)
+	}
+	if _, err := h.RequestStealthFilterHeaders(ctx, sourceID, 0, chain[19].Hash()); err != nil {
+		t.Errorf("failed to fetch filter headers from genesis: %v", err)
+	}
+}
+
+func TestStealthFiltersNeedObs3(t *testing.T) {
+	chain := makeTestChain(5)
+
+	h := NewHandler(1719, newTestChainBackend(nil))
+	defer h.Stop()
+	source := NewHandler(1719, newTestChainBackend(chain))
+	defer source.Stop()
+
+	_, sourceID := connectHandlersVersion(t, h, source, OBS2)
+	waitFor(t, func() bool { return h.PeerCount() == 1 && source.PeerCount() == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := h.RequestStealthFilters(ctx, sourceID, 0, chain[4].Hash()); err != errFiltersUnsupported {
+		t.Fatalf("have %v, want %v", err, errFiltersUnsupported)
+	}
+}
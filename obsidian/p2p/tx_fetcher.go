@@ -0,0 +1,396 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	obstypes "github.com/obsidian-chain/obsidian/core/types"
+)
+
+// Transaction fetcher configuration
+const (
+	// maxTxAnnounces is the maximum number of unique transactions a peer may
+	// have announced but not yet delivered.
+	maxTxAnnounces = 4096
+
+	// maxTxRetrievals is the maximum number of transactions requested from a
+	// peer in a single GetPooledTxMsg.
+	maxTxRetrievals = 256
+
+	// maxTxRetrievalSize is the soft cap on the announced size of the
+	// transactions requested from a peer in a single GetPooledTxMsg.
+	maxTxRetrievalSize = 128 * 1024
+
+	// maxTxInflightBytes caps the announced size of all transactions being
+	// retrieved across all peers at any one time.
+	maxTxInflightBytes = 4 * 1024 * 1024
+
+	// txFetchTimeout is how long a peer gets to answer a retrieval before the
+	// request is abandoned and the hashes are scheduled with other peers.
+	txFetchTimeout = 5 * time.Second
+
+	// txTimeoutCheckInterval is how often outstanding requests are checked for
+	// expiry.
+	txTimeoutCheckInterval = 500 * time.Millisecond
+)
+
+var (
+	ErrAnnounceMismatch = errors.New("announcement field lengths differ")
+	ErrAnnounceMeta     = errors.New("delivered transaction does not match announcement")
+)
+
+// txAnnounce is the metadata a peer attached to a transaction announcement
+type txAnnounce struct {
+	kind byte
+	size uint32
+}
+
+// txRequest is an outstanding GetPooledTxMsg sent to a peer
+type txRequest struct {
+	id     uint64
+	hashes []common.Hash
+	bytes  uint64
+	time   time.Time
+}
+
+// TxFetcher retrieves transactions that peers announced by hash. It keeps
+// track of who announced what, requests every hash from at most one peer at
+// a time and moves on to another announcer when a peer is too slow.
+type TxFetcher struct {
+	hasTx    func(hash common.Hash) bool
+	addTxs   func(peer string, txs []*obstypes.StealthTransaction) []error
+	fetchTxs func(peer string, id uint64, hashes []common.Hash) error
+
+	// scorePeer, if set, is told about announcement and retrieval behaviour
+	scorePeer func(peer string, ev PeerEvent) error
+
+	mu        sync.Mutex
+	announces map[string]map[common.Hash]txAnnounce // peer -> announced but not delivered
+	announced map[common.Hash]map[string]struct{}   // hash -> peers that announced it
+	fetching  map[common.Hash]string                // hash -> peer it is requested from
+	requests  map[string]*txRequest                 // peer -> outstanding request
+	inflight  uint64                                // announced bytes of all outstanding requests
+	reqID     uint64                                // ID of the last request
+
+	timeout time.Duration
+	quitCh  chan struct{}
+	log     log.Logger
+}
+
+// NewTxFetcher creates a transaction fetcher. hasTx reports whether the pool
+// already knows a transaction, addTxs hands retrieved transactions to the pool
+// and fetchTxs sends a retrieval request with the given ID to a peer.
+func NewTxFetcher(
+	hasTx func(hash common.Hash) bool,
+	addTxs func(peer string, txs []*obstypes.StealthTransaction) []error,
+	fetchTxs func(peer string, id uint64, hashes []common.Hash) error,
+) *TxFetcher {
+	return &TxFetcher{
+		hasTx:     hasTx,
+		addTxs:    addTxs,
+		fetchTxs:  fetchTxs,
+		announces: make(map[string]map[common.Hash]txAnnounce),
+		announced: make(map[common.Hash]map[string]struct{}),
+		fetching:  make(map[common.Hash]string),
+		requests:  make(map[string]*txRequest),
+		timeout:   txFetchTimeout,
+		quitCh:    make(chan struct{}),
+		log:       log.New("module", "txfetcher"),
+	}
+}
+
+// Start begins the request expiry loop
+func (f *TxFetcher) Start() {
+	go f.loop()
+}
+
+// Stop terminates the request expiry loop
+func (f *TxFetcher) Stop() {
+	close(f.quitCh)
+}
+
+// loop periodically expires requests that peers failed to answer in time
+func (f *TxFetcher) loop() {
+	ticker := time.NewTicker(txTimeoutCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			f.expire(time.Now())
+		case <-f.quitCh:
+			return
+		}
+	}
+}
+
+// Notify records a batch of transaction announcements from a peer and
+// schedules retrieval of the ones we don't have yet.
+func (f *TxFetcher) Notify(peer string, types []byte, sizes []uint32, hashes []common.Hash) error {
+	if len(types) != len(hashes) || len(sizes) != len(hashes) {
+		return fmt.Errorf("%w: %d types, %d sizes, %d hashes", ErrAnnounceMismatch, len(types), len(sizes), len(hashes))
+	}
+
+	f.mu.Lock()
+	announces := f.announces[peer]
+	if announces == nil {
+		announces = make(map[common.Hash]txAnnounce)
+		f.announces[peer] = announces
+	}
+	var dropped, duplicates int
+	for i, hash := range hashes {
+		if types[i] != obstypes.StealthTxType && types[i] != obstypes.SponsoredTxType {
+			dropped++
+			continue
+		}
+		if _, ok := announces[hash]; ok {
+			duplicates++
+			continue
+		}
+		if f.hasTx(hash) {
+			continue
+		}
+		if len(announces) >= maxTxAnnounces {
+			dropped++
+			continue
+		}
+		announces[hash] = txAnnounce{kind: types[i], size: sizes[i]}
+		if f.announced[hash] == nil {
+			f.announced[hash] = make(map[string]struct{})
+		}
+		f.announced[hash][peer] = struct{}{}
+	}
+	reqs := f.schedule()
+	f.mu.Unlock()
+
+	if dropped > 0 {
+		f.log.Debug("Dropped transaction announcements", "peer", peer, "count", dropped)
+	}
+	if duplicates > 0 {
+		f.score(peer, EventDuplicateAnnounce)
+	}
+	f.send(reqs)
+	return nil
+}
+
+// Enqueue hands transactions received from a peer to the pool. Transactions
+// delivered in reply to one of our requests (direct) must match the type and
+// size the peer announced; broadcasts simply clear any pending announcements.
+// A direct delivery only settles the outstanding request if its ID matches,
+// or if it has none because the peer speaks obs/1.
+func (f *TxFetcher) Enqueue(peer string, id uint64, txs []*obstypes.StealthTransaction, direct bool) error {
+	f.mu.Lock()
+	if direct {
+		announces := f.announces[peer]
+		for _, tx := range txs {
+			ann, ok := announces[tx.Hash()]
+			if !ok {
+				continue
+			}
+			if ann.kind != tx.Type() || uint64(ann.size) != tx.Size() {
+				f.mu.Unlock()
+				return fmt.Errorf("%w: %s", ErrAnnounceMeta, tx.Hash().Hex())
+			}
+		}
+	}
+	for _, tx := range txs {
+		f.forget(tx.Hash())
+	}
+	var reqs map[string]*txRequest
+	if req := f.requests[peer]; direct && req != nil && (id == 0 || id == req.id) {
+		// Whatever the peer didn't send back it doesn't have anymore, so
+		// stop expecting it from this peer and let other announcers serve it.
+		for _, hash := range req.hashes {
+			if f.fetching[hash] == peer {
+				delete(f.fetching, hash)
+				f.unannounce(peer, hash)
+			}
+		}
+		f.inflight -= req.bytes
+		delete(f.requests, peer)
+		reqs = f.schedule()
+	}
+	f.mu.Unlock()
+
+	if direct && len(txs) > 0 {
+		f.score(peer, EventUsefulResponse)
+	}
+	f.addTxs(peer, txs)
+	f.send(reqs)
+	return nil
+}
+
+// Drop removes all state held about a disconnected peer and reschedules
+// anything that was being retrieved from it.
+func (f *TxFetcher) Drop(peer string) {
+	f.mu.Lock()
+	if req := f.requests[peer]; req != nil {
+		for _, hash := range req.hashes {
+			if f.fetching[hash] == peer {
+				delete(f.fetching, hash)
+			}
+		}
+		f.inflight -= req.bytes
+		delete(f.requests, peer)
+	}
+	for hash := range f.announces[peer] {
+		f.unannounce(peer, hash)
+	}
+	delete(f.announces, peer)
+	reqs := f.schedule()
+	f.mu.Unlock()
+
+	f.send(reqs)
+}
+
+// expire abandons requests older than the fetch timeout. The slow peer is not
+// asked for the same hashes again; other announcers are tried instead.
+func (f *TxFetcher) expire(now time.Time) {
+	f.mu.Lock()
+	var expired []string
+	for peer, req := range f.requests {
+		if now.Sub(req.time) < f.timeout {
+			continue
+		}
+		for _, hash := range req.hashes {
+			if f.fetching[hash] == peer {
+				delete(f.fetching, hash)
+				f.unannounce(peer, hash)
+			}
+		}
+		f.inflight -= req.bytes
+		delete(f.requests, peer)
+		expired = append(expired, peer)
+		f.log.Debug("Transaction request timed out", "peer", peer, "hashes", len(req.hashes))
+	}
+	var reqs map[string]*txRequest
+	if len(expired) > 0 {
+		reqs = f.schedule()
+	}
+	f.mu.Unlock()
+
+	for _, peer := range expired {
+		f.score(peer, EventTimeout)
+	}
+	f.send(reqs)
+}
+
+// schedule assigns announced hashes that nobody is retrieving to idle peers,
+// respecting the per-request and global in-flight limits. It must be called
+// with the lock held; the returned requests are sent by the caller after
+// releasing it.
+func (f *TxFetcher) schedule() map[string]*txRequest {
+	peers := make([]string, 0, len(f.announces))
+	for peer := range f.announces {
+		if _, busy := f.requests[peer]; !busy {
+			peers = append(peers, peer)
+		}
+	}
+	sort.Strings(peers)
+
+	reqs := make(map[string]*txRequest)
+	now := time.Now()
+	for _, peer := range peers {
+		if f.inflight >= maxTxInflightBytes {
+			break
+		}
+		hashes := make([]common.Hash, 0, len(f.announces[peer]))
+		for hash := range f.announces[peer] {
+			if _, ok := f.fetching[hash]; !ok {
+				hashes = append(hashes, hash)
+			}
+		}
+		sort.Slice(hashes, func(i, j int) bool {
+			return hashes[i].Cmp(hashes[j]) < 0
+		})
+
+		var (
+			batch []common.Hash
+			bytes uint64
+		)
+		for _, hash := range hashes {
+			size := uint64(f.announces[peer][hash].size)
+			if len(batch) > 0 && bytes+size > maxTxRetrievalSize {
+				break
+			}
+			// An oversized announcement may only go out when nothing else is
+			// in flight, otherwise it would never be fetched at all
+			if f.inflight+bytes+size > maxTxInflightBytes && (len(batch) > 0 || f.inflight > 0) {
+				break
+			}
+			batch = append(batch, hash)
+			bytes += size
+			f.fetching[hash] = peer
+			if len(batch) >= maxTxRetrievals {
+				break
+			}
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		f.reqID++
+		f.requests[peer] = &txRequest{id: f.reqID, hashes: batch, bytes: bytes, time: now}
+		f.inflight += bytes
+		reqs[peer] = f.requests[peer]
+	}
+	return reqs
+}
+
+// send dispatches scheduled requests without blocking the caller on slow
+// peers. If a request can't be sent the peer is dropped so its hashes can be
+// tried elsewhere.
+func (f *TxFetcher) send(reqs map[string]*txRequest) {
+	for peer, req := range reqs {
+		go func(peer string, req *txRequest) {
+			if err := f.fetchTxs(peer, req.id, req.hashes); err != nil {
+				f.log.Debug("Failed to request transactions", "peer", peer, "err", err)
+				f.Drop(peer)
+			}
+		}(peer, req)
+	}
+}
+
+// score reports a peer event to the scorer, if there is one
+func (f *TxFetcher) score(peer string, ev PeerEvent) {
+	if f.scorePeer != nil {
+		f.scorePeer(peer, ev)
+	}
+}
+
+// forget removes every trace of a transaction that has been delivered. It
+// must be called with the lock held.
+func (f *TxFetcher) forget(hash common.Hash) {
+	for peer := range f.announced[hash] {
+		delete(f.announces[peer], hash)
+	}
+	delete(f.announced, hash)
+	delete(f.fetching, hash)
+}
+
+// unannounce removes a single peer's announcement of a hash. It must be
+// called with the lock held.
+func (f *TxFetcher) unannounce(peer string, hash common.Hash) {
+	delete(f.announces[peer], hash)
+	if peers := f.announced[hash]; peers != nil {
+		delete(peers, peer)
+		if len(peers) == 0 {
+			delete(f.announced, hash)
+		}
+	}
+}
+
+// Stats returns the number of announced hashes, the number being retrieved
+// and the announced size of all outstanding requests
+func (f *TxFetcher) Stats() (announced, fetching int, inflightBytes uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.announced), len(f.fetching), f.inflight
+}
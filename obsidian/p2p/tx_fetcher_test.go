@@ -0,0 +1,461 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package p2p
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/eth/ethconfig"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/obsidian-chain/obsidian/core"
+	"github.com/obsidian-chain/obsidian/core/forkid"
+	"github.com/obsidian-chain/obsidian/core/rawdb"
+	obstypes "github.com/obsidian-chain/obsidian/core/types"
+	"github.com/obsidian-chain/obsidian/stealth/filter"
+)
+
+// testBackend is a minimal in-memory chain and pool for protocol tests
+type testBackend struct {
+	genesis *obstypes.ObsidianBlock
+	config  *core.ChainConfig
+	db      *rawdb.Database
+	mode    ethconfig.SyncMode
+
+	mu   sync.Mutex
+	pool map[common.Hash]*obstypes.StealthTransaction
+}
+
+func newTestBackend() *testBackend {
+	header := &obstypes.ObsidianHeader{
+		Number:     big.NewInt(0),
+		Difficulty: big.NewInt(1),
+	}
+	return &testBackend{
+		genesis: obstypes.NewBlockWithHeader(header),
+		config:  core.DefaultChainConfig(),
+		pool:    make(map[common.Hash]*obstypes.StealthTransaction),
+	}
+}
+
+func (b *testBackend) CurrentBlock() *obstypes.ObsidianHeader { return b.genesis.Header() }
+func (b *testBackend) GetBlockByHash(hash common.Hash) *obstypes.ObsidianBlock {
+	if hash == b.genesis.Hash() {
+		return b.genesis
+	}
+	return nil
+}
+func (b *testBackend) GetBlockByNumber(number uint64) *obstypes.ObsidianBlock {
+	if number == 0 {
+		return b.genesis
+	}
+	return nil
+}
+func (b *testBackend) GetTD(hash common.Hash) *big.Int             { return big.NewInt(1) }
+func (b *testBackend) GenesisHash() common.Hash                    { return b.genesis.Hash() }
+func (b *testBackend) ChainID() *big.Int                           { return big.NewInt(1719) }
+func (b *testBackend) ChainConfig() *core.ChainConfig              { return b.config }
+func (b *testBackend) ChainDb() *rawdb.Database                    { return b.db }
+func (b *testBackend) VerifyHeader(*obstypes.ObsidianHeader) error { return nil }
+func (b *testBackend) InsertBlock(*obstypes.ObsidianBlock) error   { return errors.New("not supported") }
+func (b *testBackend) HasBlock(hash common.Hash) bool              { return hash == b.genesis.Hash() }
+func (b *testBackend) SyncMode() ethconfig.SyncMode                { return b.mode }
+func (b *testBackend) InsertBlockWithoutState(*obstypes.ObsidianBlock) error {
+	return errors.New("not supported")
+}
+func (b *testBackend) SnapSyncCommitHead(common.Hash) error      { return errors.New("not supported") }
+func (b *testBackend) GetReceipts(common.Hash) obstypes.Receipts { return nil }
+func (b *testBackend) InsertReceipts(common.Hash, obstypes.Receipts) error {
+	return errors.New("not supported")
+}
+
+// VerifySeal treats a zero difficulty as a bad seal
+func (b *testBackend) VerifySeal(header *obstypes.ObsidianHeader) error {
+	if header.Difficulty == nil || header.Difficulty.Sign() == 0 {
+		return fmt.Errorf("%w: %w", core.ErrInvalidBlock, core.ErrInvalidPoW)
+	}
+	return nil
+}
+
+func (b *testBackend) AddRemoteTxs(txs []*obstypes.StealthTransaction) []error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	errs := make([]error, len(txs))
+	for _, tx := range txs {
+		b.pool[tx.Hash()] = tx
+	}
+	return errs
+}
+
+func (b *testBackend) PendingTxs() []*obstypes.StealthTransaction {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	txs := make([]*obstypes.StealthTransaction, 0, len(b.pool))
+	for _, tx := range b.pool {
+		txs = append(txs, tx)
+	}
+	return txs
+}
+
+func (b *testBackend) GetPoolTransaction(hash common.Hash) *obstypes.StealthTransaction {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.pool[hash]
+}
+
+func (b *testBackend) StealthFilterRange(uint64, common.Hash, uint64) *filter.Range { return nil }
+
+// testPeer is the remote end of a protocol connection driven by a test
+type testPeer struct {
+	id      enode.ID
+	version uint
+	rw      *p2p.MsgPipeRW
+	errc    chan error
+}
+
+// newTestPeer connects a simulated peer to the handler and completes the
+// status handshake
+func newTestPeer(t *testing.T, h *Handler, backend *testBackend) *testPeer {
+	return newTestPeerVersion(t, h, backend, ProtocolVersion)
+}
+
+// newTestPeerVersion connects a simulated peer speaking the given protocol
+// version
+func newTestPeerVersion(t *testing.T, h *Handler, backend *testBackend, version uint) *testPeer {
+	t.Helper()
+
+	var id enode.ID
+	rand.Read(id[:])
+
+	app, net := p2p.MsgPipe()
+	peer := &testPeer{id: id, version: version, rw: app, errc: make(chan error, 1)}
+	go func() {
+		peer.errc <- h.runPeer(version, p2p.NewPeer(id, "test", nil), net)
+	}()
+
+	status := StatusPacket{
+		ProtocolVersion: uint32(version),
+		NetworkID:       h.networkID,
+		TD:              big.NewInt(1),
+		HeadHash:        backend.genesis.Hash(),
+		GenesisHash:     backend.genesis.Hash(),
+		ForkID:          forkid.NewID(forkid.GatherForks(backend.config), backend.genesis.Hash(), 0),
+	}
+	if err := p2p.Send(app, StatusMsg, &status); err != nil {
+		t.Fatalf("failed to send status: %v", err)
+	}
+	msg := peer.expectMsg(t, StatusMsg)
+	msg.Discard()
+
+	waitFor(t, func() bool { return h.PeerCount() > 0 })
+	return peer
+}
+
+// expectMsg reads the next message from the handler and checks its code
+func (p *testPeer) expectMsg(t *testing.T, code uint64) p2p.Msg {
+	t.Helper()
+
+	type result struct {
+		msg p2p.Msg
+		err error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		msg, err := p.rw.ReadMsg()
+		resc <- result{msg, err}
+	}()
+
+	select {
+	case res := <-resc:
+		if res.err != nil {
+			t.Fatalf("failed to read message: %v", res.err)
+		}
+		if res.msg.Code != code {
+			t.Fatalf("message code mismatch: have %d, want %d", res.msg.Code, code)
+		}
+		return res.msg
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for message %d", code)
+	}
+	return p2p.Msg{}
+}
+
+// send sends a request or response, wrapped in an envelope on obs/2
+func (p *testPeer) send(code uint64, id uint64, data interface{}) error {
+	if p.version < OBS2 {
+		return p2p.Send(p.rw, code, data)
+	}
+	return p2p.Send(p.rw, code, &requestEnvelope{ID: id, Packet: data})
+}
+
+// decode decodes a request or response and returns its request ID
+func (p *testPeer) decode(msg p2p.Msg, v interface{}) (uint64, error) {
+	if p.version < OBS2 {
+		return 0, msg.Decode(v)
+	}
+	var env rawEnvelope
+	if err := msg.Decode(&env); err != nil {
+		return 0, err
+	}
+	return env.ID, rlp.DecodeBytes(env.Packet, v)
+}
+
+// waitFor polls a condition until it holds or the test times out
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newTestTx(nonce uint64) *obstypes.StealthTransaction {
+	return obstypes.NewStealthTransaction(nonce, common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(1), nil, nil, 0)
+}
+
+// newRecordingFetcher creates a fetcher whose retrieval requests are
+// delivered on the returned channel instead of the network
+func newRecordingFetcher(known map[common.Hash]bool) (*TxFetcher, chan fetchCall) {
+	calls := make(chan fetchCall, 64)
+	f := NewTxFetcher(
+		func(hash common.Hash) bool { return known[hash] },
+		func(peer string, txs []*obstypes.StealthTransaction) []error { return make([]error, len(txs)) },
+		func(peer string, id uint64, hashes []common.Hash) error {
+			calls <- fetchCall{peer: peer, id: id, hashes: hashes}
+			return nil
+		},
+	)
+	return f, calls
+}
+
+type fetchCall struct {
+	peer   string
+	id     uint64
+	hashes []common.Hash
+}
+
+func expectFetch(t *testing.T, calls chan fetchCall) fetchCall {
+	t.Helper()
+	select {
+	case call := <-calls:
+		return call
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for retrieval request")
+	}
+	return fetchCall{}
+}
+
+func expectNoFetch(t *testing.T, calls chan fetchCall) {
+	t.Helper()
+	select {
+	case call := <-calls:
+		t.Fatalf("unexpected retrieval request to %s for %d hashes", call.peer, len(call.hashes))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestTxFetcherNoDuplicateRequests(t *testing.T) {
+	known := map[common.Hash]bool{{0xff}: true}
+	f, calls := newRecordingFetcher(known)
+
+	types := []byte{obstypes.StealthTxType, obstypes.StealthTxType, obstypes.StealthTxType}
+	sizes := []uint32{100, 100, 100}
+	hashes := []common.Hash{{0x01}, {0x02}, {0xff}}
+
+	if err := f.Notify("a", types, sizes, hashes); err != nil {
+		t.Fatalf("notify failed: %v", err)
+	}
+	call := expectFetch(t, calls)
+	if call.peer != "a" || len(call.hashes) != 2 {
+		t.Fatalf("unexpected request: peer %s, %d hashes", call.peer, len(call.hashes))
+	}
+
+	// A second announcer of the same hashes must not trigger another request
+	if err := f.Notify("b", types, sizes, hashes); err != nil {
+		t.Fatalf("notify failed: %v", err)
+	}
+	expectNoFetch(t, calls)
+
+	// Once the first peer goes away the second one is asked instead
+	f.Drop("a")
+	call = expectFetch(t, calls)
+	if call.peer != "b" || len(call.hashes) != 2 {
+		t.Fatalf("unexpected request: peer %s, %d hashes", call.peer, len(call.hashes))
+	}
+}
+
+func TestTxFetcherTimeout(t *testing.T) {
+	f, calls := newRecordingFetcher(nil)
+
+	types := []byte{obstypes.StealthTxType}
+	sizes := []uint32{100}
+	hashes := []common.Hash{{0x01}}
+
+	f.Notify("a", types, sizes, hashes)
+	if call := expectFetch(t, calls); call.peer != "a" {
+		t.Fatalf("request sent to %s, want a", call.peer)
+	}
+	f.Notify("b", types, sizes, hashes)
+	expectNoFetch(t, calls)
+
+	// Nothing happens before the timeout
+	f.expire(time.Now())
+	expectNoFetch(t, calls)
+
+	f.expire(time.Now().Add(txFetchTimeout))
+	if call := expectFetch(t, calls); call.peer != "b" {
+		t.Fatalf("request sent to %s, want b", call.peer)
+	}
+
+	// The slow peer isn't asked again even if the alternative times out too
+	f.expire(time.Now().Add(2 * txFetchTimeout))
+	expectNoFetch(t, calls)
+	if announced, fetching, inflight := f.Stats(); announced != 0 || fetching != 0 || inflight != 0 {
+		t.Fatalf("stale state: %d announced, %d fetching, %d bytes", announced, fetching, inflight)
+	}
+}
+
+func TestTxFetcherInflightLimit(t *testing.T) {
+	f, calls := newRecordingFetcher(nil)
+
+	const size = 1024 * 1024
+	peers := 2 * maxTxInflightBytes / size
+	for i := 0; i < peers; i++ {
+		hash := common.Hash{byte(i + 1)}
+		f.Notify(string(rune('a'+i)), []byte{obstypes.StealthTxType}, []uint32{size}, []common.Hash{hash})
+	}
+
+	for i := 0; i < maxTxInflightBytes/size; i++ {
+		expectFetch(t, calls)
+	}
+	expectNoFetch(t, calls)
+
+	if _, _, inflight := f.Stats(); inflight > maxTxInflightBytes {
+		t.Fatalf("in-flight bytes %d exceed limit %d", inflight, maxTxInflightBytes)
+	}
+}
+
+func TestTxFetcherAnnounceMismatch(t *testing.T) {
+	f, _ := newRecordingFetcher(nil)
+
+	err := f.Notify("a", []byte{obstypes.StealthTxType}, nil, []common.Hash{{0x01}})
+	if !errors.Is(err, ErrAnnounceMismatch) {
+		t.Fatalf("expected announce mismatch, got %v", err)
+	}
+}
+
+func TestHandlerPooledTxRetrieval(t *testing.T) {
+	backend := newTestBackend()
+	h := NewHandler(1719, backend)
+	defer h.Stop()
+
+	peer := newTestPeer(t, h, backend)
+
+	txs := []*obstypes.StealthTransaction{newTestTx(0), newTestTx(1)}
+	ann := NewPooledTxHashesPacket{}
+	for _, tx := range txs {
+		ann.Types = append(ann.Types, tx.Type())
+		ann.Sizes = append(ann.Sizes, uint32(tx.Size()))
+		ann.Hashes = append(ann.Hashes, tx.Hash())
+	}
+	if err := p2p.Send(peer.rw, NewPooledTxHashesMsg, &ann); err != nil {
+		t.Fatalf("failed to announce: %v", err)
+	}
+
+	var req GetPooledTxPacket
+	id, err := peer.decode(peer.expectMsg(t, GetPooledTxMsg), &req)
+	if err != nil {
+		t.Fatalf("failed to decode request: %v", err)
+	}
+	if len(req) != len(txs) {
+		t.Fatalf("requested %d transactions, want %d", len(req), len(txs))
+	}
+	envs := make(TxEnvelopes, len(txs))
+	for i, tx := range txs {
+		envs[i], _ = tx.MarshalBinary()
+	}
+	if err := peer.send(PooledTransactionsMsg, id, envs); err != nil {
+		t.Fatalf("failed to deliver: %v", err)
+	}
+
+	waitFor(t, func() bool {
+		return backend.GetPoolTransaction(txs[0].Hash()) != nil && backend.GetPoolTransaction(txs[1].Hash()) != nil
+	})
+}
+
+func TestHandlerServesPooledTxs(t *testing.T) {
+	backend := newTestBackend()
+	h := NewHandler(1719, backend)
+	defer h.Stop()
+
+	tx := newTestTx(0)
+	backend.AddRemoteTxs([]*obstypes.StealthTransaction{tx})
+
+	peer := newTestPeer(t, h, backend)
+	query := GetPooledTxPacket{tx.Hash(), {0xde, 0xad}}
+	if err := peer.send(GetPooledTxMsg, 7, query); err != nil {
+		t.Fatalf("failed to request: %v", err)
+	}
+
+	var resp TxEnvelopes
+	id, err := peer.decode(peer.expectMsg(t, PooledTransactionsMsg), &resp)
+	if err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if id != 7 {
+		t.Fatalf("response to request %d, want 7", id)
+	}
+	if len(resp) != 1 {
+		t.Fatalf("unexpected response: %d transactions", len(resp))
+	}
+	var have obstypes.StealthTransaction
+	if err := have.UnmarshalBinary(resp[0]); err != nil || have.Hash() != tx.Hash() {
+		t.Fatalf("unexpected transaction %x: %v", have.Hash(), err)
+	}
+}
+
+func TestHandlerDropsMismatchedDelivery(t *testing.T) {
+	backend := newTestBackend()
+	h := NewHandler(1719, backend)
+	defer h.Stop()
+
+	peer := newTestPeer(t, h, backend)
+
+	tx := newTestTx(0)
+	ann := NewPooledTxHashesPacket{
+		Types:  []byte{tx.Type()},
+		Sizes:  []uint32{uint32(tx.Size()) + 100},
+		Hashes: []common.Hash{tx.Hash()},
+	}
+	p2p.Send(peer.rw, NewPooledTxHashesMsg, &ann)
+	id, _ := peer.decode(peer.expectMsg(t, GetPooledTxMsg), new(GetPooledTxPacket))
+	env, _ := tx.MarshalBinary()
+	peer.send(PooledTransactionsMsg, id, TxEnvelopes{env})
+
+	select {
+	case err := <-peer.errc:
+		if !errors.Is(err, ErrAnnounceMeta) {
+			t.Fatalf("unexpected disconnect reason: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("peer with mismatched announcement was not dropped")
+	}
+	if backend.GetPoolTransaction(tx.Hash()) != nil {
+		t.Fatal("mismatched transaction was added to the pool")
+	}
+}
@@ -53,6 +53,10 @@ const (
 	// StealthTxType is the transaction type for stealth address transactions
 	StealthTxType = 0x10
 
+	// SponsoredTxType is the transaction type for stealth transactions whose
+	// fees are paid by a sponsor
+	SponsoredTxType = 0x11
+
 	// StealthRegistryAddress is the precompile address for stealth address registry
 	StealthRegistryAddress = 0x0B
 )
@@ -0,0 +1,199 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+// Package relay implements a reference relayer for sponsored stealth
+// transactions.
+//
+// The owner of a stealth address signs a sponsored transaction spending from
+// it without any fees, and hands it to a relayer. The relayer checks that the
+// transaction can go through, sets and signs the fees, pays them from its own
+// account and submits the transaction. Nothing on chain ties the stealth
+// address to any other account of its owner.
+package relay
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	ethrpc "github.com/ethereum/go-ethereum/rpc"
+	obstypes "github.com/obsidian-chain/obsidian/core/types"
+)
+
+var (
+	// ErrNotSponsored is returned for transactions that don't ask for a
+	// sponsor
+	ErrNotSponsored = errors.New("transaction is not sponsored")
+	// ErrInvalidSender is returned when the sender of a transaction can't be
+	// recovered from its signature
+	ErrInvalidSender = errors.New("invalid sender signature")
+	// ErrNonce is returned for transactions that aren't next in line for
+	// their sender, which the relayer won't lock up funds for
+	ErrNonce = errors.New("transaction nonce is not the next one")
+	// ErrInsufficientFunds is returned when the sender can't pay the value
+	ErrInsufficientFunds = errors.New("insufficient funds for value")
+	// ErrGasTooHigh is returned for transactions needing more gas than the
+	// relayer sponsors
+	ErrGasTooHigh = errors.New("transaction needs more gas than sponsored")
+)
+
+// Config is the sponsoring policy of a relayer
+type Config struct {
+	MaxGas   uint64   // Largest gas limit sponsored
+	GasPrice *big.Int // Gas price sponsored transactions pay
+}
+
+// DefaultConfig sponsors anything up to a token transfer at 1 Gwei
+var DefaultConfig = Config{
+	MaxGas:   100000,
+	GasPrice: big.NewInt(1e9),
+}
+
+// Backend is the node a relayer checks transactions against and submits
+// them to
+type Backend interface {
+	NonceAt(ctx context.Context, addr common.Address) (uint64, error)
+	BalanceAt(ctx context.Context, addr common.Address) (*big.Int, error)
+	EstimateGas(ctx context.Context, args obstypes.CallArgs) (uint64, error)
+	SendTransaction(ctx context.Context, tx *obstypes.StealthTransaction) (common.Hash, error)
+}
+
+// Relayer pays the fees of sponsored transactions from its own account
+type Relayer struct {
+	backend Backend
+	key     *ecdsa.PrivateKey
+	signer  obstypes.StealthSigner
+	config  Config
+}
+
+// New creates a relayer sponsoring transactions with the given key
+func New(backend Backend, key *ecdsa.PrivateKey, chainID *big.Int, config Config) *Relayer {
+	if config.MaxGas == 0 {
+		config.MaxGas = DefaultConfig.MaxGas
+	}
+	if config.GasPrice == nil {
+		config.GasPrice = DefaultConfig.GasPrice
+	}
+	return &Relayer{
+		backend: backend,
+		key:     key,
+		signer:  obstypes.NewStealthEIP155Signer(chainID),
+		config:  config,
+	}
+}
+
+// Address returns the account the relayer pays fees from
+func (r *Relayer) Address() common.Address {
+	return crypto.PubkeyToAddress(r.key.PublicKey)
+}
+
+// Sponsor checks a sponsored transaction signed by its sender, signs its fees
+// and submits it
+func (r *Relayer) Sponsor(ctx context.Context, tx *obstypes.StealthTransaction) (common.Hash, error) {
+	if !tx.Sponsored() {
+		return common.Hash{}, ErrNotSponsored
+	}
+	from, err := r.signer.Sender(tx)
+	if err != nil {
+		return common.Hash{}, ErrInvalidSender
+	}
+	// Only sponsor transactions that can execute right away, anything else
+	// would keep the fees committed in the pool
+	nonce, err := r.backend.NonceAt(ctx, from)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if tx.Nonce() != nonce {
+		return common.Hash{}, ErrNonce
+	}
+	balance, err := r.backend.BalanceAt(ctx, from)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if balance.Cmp(tx.Value()) < 0 {
+		return common.Hash{}, ErrInsufficientFunds
+	}
+	data := hexutil.Bytes(tx.Data())
+	gas, err := r.backend.EstimateGas(ctx, obstypes.CallArgs{From: &from, To: tx.To(), Value: (*hexutil.Big)(tx.Value()), Data: &data})
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if gas > r.config.MaxGas {
+		return common.Hash{}, ErrGasTooHigh
+	}
+	signed, err := obstypes.SignSponsorTx(tx.WithSponsorFees(gas, r.config.GasPrice), r.signer, r.key)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if err := signed.ValidateBasic(); err != nil {
+		return common.Hash{}, err
+	}
+	return r.backend.SendTransaction(ctx, signed)
+}
+
+// API is the RPC interface of a relayer, served in the relay namespace
+type API struct {
+	relayer *Relayer
+}
+
+// NewAPI creates the RPC interface of a relayer
+func NewAPI(relayer *Relayer) *API {
+	return &API{relayer: relayer}
+}
+
+// SendTransaction sponsors an RLP encoded sponsored transaction
+func (api *API) SendTransaction(ctx context.Context, encodedTx hexutil.Bytes) (common.Hash, error) {
+	tx := new(obstypes.StealthTransaction)
+	if err := rlp.DecodeBytes(encodedTx, tx); err != nil {
+		return common.Hash{}, err
+	}
+	return api.relayer.Sponsor(ctx, tx)
+}
+
+// Sponsor returns the account the relayer pays fees from
+func (api *API) Sponsor() common.Address {
+	return api.relayer.Address()
+}
+
+// rpcBackend is a Backend reached over RPC
+type rpcBackend struct {
+	client *ethrpc.Client
+}
+
+// NewRPCBackend returns a Backend talking to a node over RPC
+func NewRPCBackend(client *ethrpc.Client) Backend {
+	return &rpcBackend{client: client}
+}
+
+func (b *rpcBackend) NonceAt(ctx context.Context, addr common.Address) (uint64, error) {
+	var nonce hexutil.Uint64
+	err := b.client.CallContext(ctx, &nonce, "eth_getTransactionCount", addr, "latest")
+	return uint64(nonce), err
+}
+
+func (b *rpcBackend) BalanceAt(ctx context.Context, addr common.Address) (*big.Int, error) {
+	var balance hexutil.Big
+	err := b.client.CallContext(ctx, &balance, "eth_getBalance", addr, "latest")
+	return (*big.Int)(&balance), err
+}
+
+func (b *rpcBackend) EstimateGas(ctx context.Context, args obstypes.CallArgs) (uint64, error) {
+	var gas hexutil.Uint64
+	err := b.client.CallContext(ctx, &gas, "eth_estimateGas", args)
+	return uint64(gas), err
+}
+
+func (b *rpcBackend) SendTransaction(ctx context.Context, tx *obstypes.StealthTransaction) (common.Hash, error) {
+	data, err := rlp.EncodeToBytes(tx)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	var hash common.Hash
+	err = b.client.CallContext(ctx, &hash, "eth_sendRawTransaction", hexutil.Encode(data))
+	return hash, err
+}
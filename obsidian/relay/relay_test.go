@@ -0,0 +1,94 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package relay
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	obstypes "github.com/obsidian-chain/obsidian/core/types"
+)
+
+var testChainID = big.NewInt(1719)
+
+// testBackend is a node holding a single account
+type testBackend struct {
+	nonce   uint64
+	balance *big.Int
+	gas     uint64
+	sent    []*obstypes.StealthTransaction
+}
+
+func (b *testBackend) NonceAt(context.Context, common.Address) (uint64, error) { return b.nonce, nil }
+func (b *testBackend) BalanceAt(context.Context, common.Address) (*big.Int, error) {
+	return b.balance, nil
+}
+func (b *testBackend) EstimateGas(context.Context, obstypes.CallArgs) (uint64, error) {
+	return b.gas, nil
+}
+func (b *testBackend) SendTransaction(_ context.Context, tx *obstypes.StealthTransaction) (common.Hash, error) {
+	b.sent = append(b.sent, tx)
+	return tx.Hash(), nil
+}
+
+func TestSponsor(t *testing.T) {
+	sender, _ := crypto.GenerateKey()
+	sponsor, _ := crypto.GenerateKey()
+	ephemeral, _ := crypto.GenerateKey()
+	signer := obstypes.NewStealthEIP155Signer(testChainID)
+
+	backend := &testBackend{nonce: 3, balance: big.NewInt(100), gas: 21000}
+	relayer := New(backend, sponsor, testChainID, Config{})
+
+	sign := func(nonce uint64, value int64) *obstypes.StealthTransaction {
+		tx := obstypes.NewSponsoredTransaction(nonce, common.Address{0x01}, big.NewInt(value), nil, crypto.CompressPubkey(&ephemeral.PublicKey), 0)
+		tx, err := obstypes.SignStealthTx(tx, signer, sender)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+	if _, err := relayer.Sponsor(context.Background(), sign(2, 1)); !errors.Is(err, ErrNonce) {
+		t.Fatalf("stale nonce: have %v, want %v", err, ErrNonce)
+	}
+	if _, err := relayer.Sponsor(context.Background(), sign(3, 101)); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("overspend: have %v, want %v", err, ErrInsufficientFunds)
+	}
+	backend.gas = DefaultConfig.MaxGas + 1
+	if _, err := relayer.Sponsor(context.Background(), sign(3, 1)); !errors.Is(err, ErrGasTooHigh) {
+		t.Fatalf("expensive: have %v, want %v", err, ErrGasTooHigh)
+	}
+	backend.gas = 21000
+	if len(backend.sent) != 0 {
+		t.Fatalf("%d refused transactions sent", len(backend.sent))
+	}
+
+	tx := sign(3, 1)
+	if _, err := relayer.Sponsor(context.Background(), tx); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.sent) != 1 {
+		t.Fatalf("%d transactions sent, want 1", len(backend.sent))
+	}
+	sent := backend.sent[0]
+	if sent.Gas() != 21000 || sent.GasPrice().Cmp(DefaultConfig.GasPrice) != 0 {
+		t.Fatalf("sponsored gas %d at %v", sent.Gas(), sent.GasPrice())
+	}
+	if from, err := signer.Sender(sent); err != nil || from != crypto.PubkeyToAddress(sender.PublicKey) {
+		t.Fatalf("sender %v, err %v", from, err)
+	}
+	if payer, err := signer.Sponsor(sent); err != nil || payer != relayer.Address() {
+		t.Fatalf("sponsor %v, err %v", payer, err)
+	}
+
+	// Plain stealth transactions pay their own fees
+	plain := obstypes.NewStealthTransaction(3, common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(1e9), nil, crypto.CompressPubkey(&ephemeral.PublicKey), 0)
+	if _, err := relayer.Sponsor(context.Background(), plain); !errors.Is(err, ErrNotSponsored) {
+		t.Fatalf("plain: have %v, want %v", err, ErrNotSponsored)
+	}
+}
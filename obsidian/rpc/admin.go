@@ -14,13 +14,18 @@ import (
 
 	"github.com/obsidian-chain/obsidian/health"
 	"github.com/obsidian-chain/obsidian/metrics"
+	obsp2p "github.com/obsidian-chain/obsidian/p2p"
+	"github.com/obsidian-chain/obsidian/shutdown"
 )
 
 // AdminBackend interface provides backend methods for admin RPC
 type AdminBackend interface {
 	GetHealthMonitor() *health.Monitor
 	GetMetrics() *metrics.MetricsRegistry
-	GetShutdownManager() interface{}
+	GetShutdownManager() *shutdown.Manager
+	PeersInfo() []*obsp2p.PeerInfo
+	PeerBans() []obsp2p.PeerBan
+	UnbanPeer(id string) bool
 }
 
 // Admin provides admin RPC methods
@@ -87,6 +92,10 @@ type MetricsSnapshot struct {
 	RPCRequestsTotal     int64  `json:"rpcRequestsTotal"`
 	MessagesSent         int64  `json:"messagesSent"`
 	MessagesReceived     int64  `json:"messagesReceived"`
+	PeerPenalties        int64  `json:"peerPenalties"`
+	PeerBans             int64  `json:"peerBans"`
+	PeersBanned          int64  `json:"peersBanned"`
+	ThrottledServes      int64  `json:"throttledServes"`
 	TxPoolSize           int64  `json:"txPoolSize"`
 	AvgBlockTime         string `json:"avgBlockTime"`
 	Timestamp            int64  `json:"timestamp"`
@@ -107,12 +116,31 @@ func (a *Admin) Metrics(ctx context.Context) (*MetricsSnapshot, error) {
 		RPCRequestsTotal:     m.RPCRequestsTotal,
 		MessagesSent:         m.MessagesSent,
 		MessagesReceived:     m.MessagesReceived,
+		PeerPenalties:        m.PeerPenalties,
+		PeerBans:             m.PeerBans,
+		PeersBanned:          m.PeersBanned,
+		ThrottledServes:      m.ThrottledServes,
 		TxPoolSize:           m.TxPoolSize,
 		AvgBlockTime:         m.BlockProcessTime.String(),
 		Timestamp:            time.Now().Unix(),
 	}, nil
 }
 
+// Peers returns the connected peers along with their misbehaviour scores
+func (a *Admin) Peers(ctx context.Context) ([]*obsp2p.PeerInfo, error) {
+	return a.backend.PeersInfo(), nil
+}
+
+// PeerBans returns the nodes that are currently banned
+func (a *Admin) PeerBans(ctx context.Context) ([]obsp2p.PeerBan, error) {
+	return a.backend.PeerBans(), nil
+}
+
+// UnbanPeer lifts the ban on a node, reporting whether it was banned
+func (a *Admin) UnbanPeer(ctx context.Context, id string) (bool, error) {
+	return a.backend.UnbanPeer(id), nil
+}
+
 // NodeInfo represents node information
 type NodeInfo struct {
 	Name       string `json:"name"`
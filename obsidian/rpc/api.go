@@ -18,6 +18,8 @@ import (
 	obstypes "github.com/obsidian-chain/obsidian/core/types"
 	"github.com/obsidian-chain/obsidian/params"
 	"github.com/obsidian-chain/obsidian/stealth"
+	"github.com/obsidian-chain/obsidian/stealth/filter"
+	"github.com/obsidian-chain/obsidian/stealth/registry"
 )
 
 // Common errors
@@ -73,6 +75,10 @@ type Backend interface {
 
 	// Log methods
 	GetLogs(ctx context.Context, filter obstypes.FilterQuery) ([]*obstypes.Log, error)
+
+	// Stealth methods
+	StealthAnnouncements(ctx context.Context, from, to uint64, viewTags []byte, fn func(number uint64, announcements []stealth.Announcement) bool) error
+	StealthFilterRange(start uint64, stop common.Hash, max uint64) *filter.Range
 }
 
 // CallArgs is an alias for the shared CallArgs type
@@ -145,6 +151,18 @@ func (api *PublicEthereumAPI) GetTransactionByHash(ctx context.Context, hash com
 	return RPCMarshalTransaction(tx, blockHash, blockNumber, index), nil
 }
 
+// GetRawTransactionByHash returns the RLP encoding of a transaction
+func (api *PublicEthereumAPI) GetRawTransactionByHash(ctx context.Context, hash common.Hash) (hexutil.Bytes, error) {
+	tx, _, _, _, err := api.b.GetTransaction(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	if tx == nil {
+		return nil, nil
+	}
+	return rlp.EncodeToBytes(tx)
+}
+
 // GetTransactionReceipt returns the transaction receipt
 func (api *PublicEthereumAPI) GetTransactionReceipt(ctx context.Context, hash common.Hash) (map[string]interface{}, error) {
 	return api.b.GetTransactionReceipt(ctx, hash)
@@ -532,7 +550,165 @@ func (api *PublicObsidianAPI) GetProtocolInfo() map[string]interface{} {
 	}
 }
 
+const (
+	// maxAnnouncements is the number of stealth announcements after which a
+	// page is closed. Pages end on block boundaries, so they may run over.
+	maxAnnouncements = 1000
+
+	// maxAnnouncementBlocks is the number of blocks covered by a single page.
+	// Indexed blocks without matching announcements cost nothing to skip.
+	maxAnnouncementBlocks = 100000
+)
+
+// GetStealthAnnouncements returns the stealth payment announcements of a
+// range of blocks, for wallets to scan with their own keys. viewTags
+// optionally restricts them to a set of view tags, one per byte. Wallets
+// can mix decoys with their own tag to hide it. A page ends early when it
+// is full, its Next field is where to continue.
+func (api *PublicObsidianAPI) GetStealthAnnouncements(ctx context.Context, fromBlock, toBlock rpc.BlockNumber, viewTags *hexutil.Bytes) (*stealth.AnnouncementPage, error) {
+	head := api.b.CurrentBlock().Number.Uint64()
+	from, to := resolveBlockNumber(fromBlock, head), resolveBlockNumber(toBlock, head)
+	if to > head {
+		to = head
+	}
+	var tags []byte
+	if viewTags != nil {
+		tags = *viewTags
+		if tags == nil {
+			tags = []byte{}
+		}
+	}
+
+	page := &stealth.AnnouncementPage{Announcements: make([]stealth.Announcement, 0)}
+	if from > to {
+		return page, nil
+	}
+	end := to
+	if end-from >= maxAnnouncementBlocks {
+		end = from + maxAnnouncementBlocks - 1
+	}
+	err := api.b.StealthAnnouncements(ctx, from, end, tags, func(number uint64, announcements []stealth.Announcement) bool {
+		page.Announcements = append(page.Announcements, announcements...)
+		if len(page.Announcements) >= maxAnnouncements {
+			end = number
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if end < to {
+		next := hexutil.Uint64(end + 1)
+		page.Next = &next
+	}
+	return page, nil
+}
+
+// resolveBlockNumber turns the latest and pending block tags into the head
+func resolveBlockNumber(number rpc.BlockNumber, head uint64) uint64 {
+	if number < 0 {
+		return head
+	}
+	return uint64(number)
+}
+
+// maxStealthFilterHeaders is the number of stealth filter headers served by a
+// single call
+const maxStealthFilterHeaders = 2000
+
+// GetStealthFilter returns the compact stealth announcement filter of a
+// block along with its filter header. Light wallets test the filter locally
+// and only fetch the block if it matches.
+func (api *PublicObsidianAPI) GetStealthFilter(ctx context.Context, blockHash common.Hash) (map[string]interface{}, error) {
+	block, err := api.b.BlockByHash(ctx, blockHash)
+	if err != nil || block == nil {
+		return nil, ErrUnknownBlock
+	}
+	r := api.b.StealthFilterRange(block.NumberU64(), blockHash, 1)
+	if r == nil {
+		return nil, errors.New("stealth filter not available")
+	}
+	return map[string]interface{}{
+		"blockHash":   blockHash,
+		"blockNumber": hexutil.Uint64(block.NumberU64()),
+		"filter":      hexutil.Bytes(r.Filters[0]),
+		"header":      r.Headers()[0],
+	}, nil
+}
+
+// GetStealthFilterHeaders returns the stealth filter headers of a range of
+// canonical blocks, along with the filter header of the block before them as
+// prevHeader and the hash of the last block. A wallet checks the filters it
+// fetches against them.
+func (api *PublicObsidianAPI) GetStealthFilterHeaders(ctx context.Context, fromBlock, toBlock rpc.BlockNumber) (map[string]interface{}, error) {
+	head := api.b.CurrentBlock().Number.Uint64()
+	from, to := resolveBlockNumber(fromBlock, head), resolveBlockNumber(toBlock, head)
+	if from > to || to > head {
+		return nil, fmt.Errorf("invalid block range %d-%d", from, to)
+	}
+	if to-from >= maxStealthFilterHeaders {
+		return nil, fmt.Errorf("block range too large, maximum %d blocks", maxStealthFilterHeaders)
+	}
+	stop, err := api.b.BlockByNumber(ctx, rpc.BlockNumber(to))
+	if err != nil || stop == nil {
+		return nil, fmt.Errorf("block %d: %w", to, ErrUnknownBlock)
+	}
+	r := api.b.StealthFilterRange(from, stop.Hash(), maxStealthFilterHeaders)
+	if r == nil {
+		return nil, errors.New("stealth filters not available")
+	}
+	return map[string]interface{}{
+		"prevHeader": r.Prev,
+		"headers":    r.Headers(),
+		"blockHash":  stop.Hash(),
+	}, nil
+}
+
+// GetMetaAddress returns the stealth meta-address an account registered in
+// the stealth registry, or null if it registered none
+func (api *PublicObsidianAPI) GetMetaAddress(ctx context.Context, account common.Address, blockNrOrHash *rpc.BlockNumberOrHash) (*string, error) {
+	blockNr := rpc.LatestBlockNumber
+	if blockNrOrHash != nil {
+		if number, ok := blockNrOrHash.Number(); ok {
+			blockNr = number
+		}
+	}
+	reader := &storageReader{ctx: ctx, b: api.b, blockNr: blockNr}
+	raw := registry.MetaAddressOf(reader, account, big.NewInt(registry.SchemeSecp256k1))
+	if reader.err != nil {
+		return nil, reader.err
+	}
+	meta, err := stealth.MetaAddressFromBytes(registry.SchemeSecp256k1, raw)
+	if err != nil {
+		return nil, nil
+	}
+	metaAddr := meta.String()
+	return &metaAddr, nil
+}
+
+// storageReader reads contract storage through the backend, keeping the
+// first error it runs into
+type storageReader struct {
+	ctx     context.Context
+	b       Backend
+	blockNr rpc.BlockNumber
+	err     error
+}
+
+func (r *storageReader) GetState(addr common.Address, key common.Hash) common.Hash {
+	if r.err != nil {
+		return common.Hash{}
+	}
+	value, err := r.b.GetStorageAt(r.ctx, addr, key, r.blockNr)
+	r.err = err
+	return value
+}
+
 // ScanStealthTransactions scans for stealth transactions belonging to a view key
+//
+// Deprecated: the view key is sent to the node, which learns every payment
+// of its owner. Wallets should scan GetStealthAnnouncements locally instead.
 func (api *PublicObsidianAPI) ScanStealthTransactions(args struct {
 	ViewPrivateKey string `json:"viewPrivateKey"`
 	SpendPublicKey string `json:"spendPublicKey"`
@@ -577,7 +753,7 @@ func (api *PublicObsidianAPI) ScanStealthTransactions(args struct {
 		}
 
 		for _, tx := range block.Transactions() {
-			if tx.Type() != obstypes.StealthTxType {
+			if tx.Type() != obstypes.StealthTxType && tx.Type() != obstypes.SponsoredTxType {
 				continue
 			}
 
@@ -1006,10 +1182,15 @@ func RPCMarshalTransaction(tx *obstypes.StealthTransaction, blockHash common.Has
 	}
 
 	// Add stealth-specific fields
-	if tx.Type() == obstypes.StealthTxType {
+	if tx.Type() == obstypes.StealthTxType || tx.Type() == obstypes.SponsoredTxType {
 		fields["ephemeralPubKey"] = hexutil.Bytes(tx.EphemeralPubKey())
 		fields["viewTag"] = hexutil.Uint(tx.ViewTag())
 	}
+	if tx.Sponsored() {
+		if sponsor, err := signer.Sponsor(tx); err == nil {
+			fields["sponsor"] = sponsor
+		}
+	}
 
 	v, r, s := tx.RawSignatureValues()
 	fields["v"] = (*hexutil.Big)(v)
@@ -14,6 +14,7 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/obsidian-chain/obsidian/core/txpool"
 	obstypes "github.com/obsidian-chain/obsidian/core/types"
 )
 
@@ -21,6 +22,7 @@ var (
 	ErrAccountNotFound = errors.New("account not found")
 	ErrAccountLocked   = errors.New("account is locked")
 	ErrPassphrase      = errors.New("invalid passphrase")
+	ErrTxNotPending    = errors.New("transaction is not pending")
 )
 
 // KeystoreBackend defines the keystore operations needed by the Personal API
@@ -48,6 +50,7 @@ type KeystoreBackend interface {
 type PersonalBackend interface {
 	Backend
 	GetKeystore() interface{} // Returns KeystoreBackend, typed as interface{} to avoid import cycles
+	PriceBump() uint64        // Minimum fee increase in percent for replacing a pending transaction
 }
 
 // PrivateAccountAPI provides personal account management
@@ -153,6 +156,59 @@ func (api *PrivateAccountAPI) SendTransaction(ctx context.Context, args SendTxAr
 	return api.backend.SendTransaction(ctx, signed)
 }
 
+// SpeedUpTransaction replaces a pending transaction with an identical one
+// paying the smallest fee increase the pool accepts
+func (api *PrivateAccountAPI) SpeedUpTransaction(ctx context.Context, hash common.Hash, password string) (common.Hash, error) {
+	return api.replaceTransaction(ctx, hash, password, false)
+}
+
+// CancelTransaction replaces a pending transaction with a zero-value transfer
+// to the sender, so that the original can no longer be mined
+func (api *PrivateAccountAPI) CancelTransaction(ctx context.Context, hash common.Hash, password string) (common.Hash, error) {
+	return api.replaceTransaction(ctx, hash, password, true)
+}
+
+// replaceTransaction re-signs a pending transaction with bumped fees and
+// submits it in place of the original
+func (api *PrivateAccountAPI) replaceTransaction(ctx context.Context, hash common.Hash, password string, cancel bool) (common.Hash, error) {
+	ks := api.getKeystore()
+	if ks == nil {
+		return common.Hash{}, errors.New("keystore not available")
+	}
+
+	tx, blockHash, _, _, err := api.backend.GetTransaction(ctx, hash)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if tx == nil {
+		return common.Hash{}, ErrNotFound
+	}
+	if blockHash != (common.Hash{}) {
+		return common.Hash{}, ErrTxNotPending
+	}
+
+	chainID := api.backend.ChainID()
+	from, err := obstypes.NewStealthEIP155Signer(chainID).Sender(tx)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if !ks.HasAddress(from) {
+		return common.Hash{}, ErrAccountNotFound
+	}
+
+	var replacement *obstypes.StealthTransaction
+	if cancel {
+		replacement = txpool.CancelTx(tx, from, api.backend.PriceBump())
+	} else {
+		replacement = txpool.SpeedUpTx(tx, api.backend.PriceBump())
+	}
+	signed, err := ks.SignTxWithPassword(from, password, replacement, chainID)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return api.backend.SendTransaction(ctx, signed)
+}
+
 // SignTransaction signs a transaction without sending it
 func (api *PrivateAccountAPI) SignTransaction(ctx context.Context, args SendTxArgs, password string) (*SignedTx, error) {
 	ks := api.getKeystore()
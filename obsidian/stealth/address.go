@@ -169,8 +169,42 @@ type StealthPayment struct {
 	EphemeralPubKey []byte
 	// Amount is the value transferred (in wei)
 	Amount string
-	// PrivateKey is the derived key (only set if recipient)
-	PrivateKey *ecdsa.PrivateKey
+	// BlockHash is the hash of the block containing this payment
+	BlockHash common.Hash
+	// Status tells whether the payment is final or spent
+	Status PaymentStatus
+	// Asset is what the payment transfers, Amount being a token ID for
+	// non-fungible tokens
+	Asset Asset `rlp:"optional"`
+	// Unverified is set if the chain doesn't check that the asset was
+	// transferred, as for token payments
+	Unverified bool `rlp:"optional"`
+}
+
+// PaymentStatus is the state of a detected stealth payment
+type PaymentStatus uint8
+
+const (
+	// PaymentPending payments are in a block that may still be reorged out
+	PaymentPending PaymentStatus = iota
+	// PaymentConfirmed payments are buried under enough blocks to be final
+	PaymentConfirmed
+	// PaymentSpent payments were swept by the owner
+	PaymentSpent
+)
+
+// String implements fmt.Stringer
+func (s PaymentStatus) String() string {
+	switch s {
+	case PaymentPending:
+		return "pending"
+	case PaymentConfirmed:
+		return "confirmed"
+	case PaymentSpent:
+		return "spent"
+	default:
+		return "unknown"
+	}
 }
 
 // ViewTagFilter is a fast filter for stealth address scanning
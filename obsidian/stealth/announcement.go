@@ -0,0 +1,145 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package stealth
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// Announcement is the public part of a stealth payment: what a recipient
+// needs to recognise the payment with their own keys. Nodes serve
+// announcements to wallets, which do the key agreement locally so that the
+// view key never leaves them.
+//
+// In JSON an announcement is a compact tuple:
+//
+//	[ephemeralPubKey, viewTag, recipient, value, txHash, blockNumber]
+//
+// Token payments add the token standard and contract, and carry the amount
+// or token ID as their value. They are unverified: the chain doesn't execute
+// the token call they are announced from.
+//
+//	[ephemeralPubKey, viewTag, recipient, value, txHash, blockNumber, standard, token]
+type Announcement struct {
+	EphemeralPubKey []byte
+	ViewTag         byte
+	Recipient       common.Address
+	Value           *big.Int
+	TxHash          common.Hash
+	BlockNumber     uint64
+	Asset           Asset
+}
+
+// announcementTuple is the JSON encoding of an announcement
+type announcementTuple struct {
+	EphemeralPubKey hexutil.Bytes
+	ViewTag         hexutil.Uint64
+	Recipient       common.Address
+	Value           *hexutil.Big
+	TxHash          common.Hash
+	BlockNumber     hexutil.Uint64
+	Standard        hexutil.Uint64
+	Token           common.Address
+}
+
+// MarshalJSON implements json.Marshaler
+func (a Announcement) MarshalJSON() ([]byte, error) {
+	value := a.Value
+	if value == nil {
+		value = new(big.Int)
+	}
+	tuple := []interface{}{
+		hexutil.Bytes(a.EphemeralPubKey),
+		hexutil.Uint64(a.ViewTag),
+		a.Recipient,
+		(*hexutil.Big)(value),
+		a.TxHash,
+		hexutil.Uint64(a.BlockNumber),
+	}
+	if a.Asset != NativeAsset {
+		tuple = append(tuple, hexutil.Uint64(a.Asset.Standard), a.Asset.Token)
+	}
+	return json.Marshal(tuple)
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (a *Announcement) UnmarshalJSON(input []byte) error {
+	var t announcementTuple
+	fields := []interface{}{&t.EphemeralPubKey, &t.ViewTag, &t.Recipient, &t.Value, &t.TxHash, &t.BlockNumber, &t.Standard, &t.Token}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(input, &raw); err != nil {
+		return err
+	}
+	if len(raw) != len(fields) && len(raw) != len(fields)-2 {
+		return fmt.Errorf("stealth announcement has %d fields, want %d or %d", len(raw), len(fields)-2, len(fields))
+	}
+	for i, field := range fields[:len(raw)] {
+		if err := json.Unmarshal(raw[i], field); err != nil {
+			return fmt.Errorf("stealth announcement field %d: %v", i, err)
+		}
+	}
+	if t.ViewTag > 0xff {
+		return fmt.Errorf("invalid view tag %d", t.ViewTag)
+	}
+	if t.Standard > hexutil.Uint64(ERC721Standard) {
+		return fmt.Errorf("unknown token standard %d", t.Standard)
+	}
+	*a = Announcement{
+		EphemeralPubKey: t.EphemeralPubKey,
+		ViewTag:         byte(t.ViewTag),
+		Recipient:       t.Recipient,
+		Value:           (*big.Int)(t.Value),
+		TxHash:          t.TxHash,
+		BlockNumber:     uint64(t.BlockNumber),
+		Asset:           Asset{Standard: TokenStandard(t.Standard), Token: t.Token},
+	}
+	return nil
+}
+
+// ScanAnnouncements returns the payments to the owner of the given keys among
+// announcements fetched from a node. It needs the view key only, the payments
+// come without their private keys.
+func ScanAnnouncements(viewPrivKey *ecdsa.PrivateKey, spendPubKey *ecdsa.PublicKey, announcements []Announcement) []*StealthPayment {
+	var payments []*StealthPayment
+	for _, a := range announcements {
+		ephPubKey, err := DecompressPublicKey(a.EphemeralPubKey)
+		if err != nil {
+			continue
+		}
+		sharedSecret := SharedSecret(viewPrivKey, ephPubKey)
+		if computeViewTag(sharedSecret) != a.ViewTag {
+			continue
+		}
+		if DeriveStealthAddressFromSharedSecret(spendPubKey, sharedSecret) != a.Recipient {
+			continue
+		}
+		amount := "0"
+		if a.Value != nil {
+			amount = a.Value.String()
+		}
+		payments = append(payments, &StealthPayment{
+			TxHash:          a.TxHash,
+			BlockNumber:     a.BlockNumber,
+			StealthAddress:  a.Recipient,
+			EphemeralPubKey: a.EphemeralPubKey,
+			Amount:          amount,
+			Asset:           a.Asset,
+			Unverified:      !a.Asset.Verified(),
+		})
+	}
+	return payments
+}
+
+// AnnouncementPage is a page of announcements served by a node. Next is the
+// block to continue from, nil once the requested range is exhausted.
+type AnnouncementPage struct {
+	Announcements []Announcement  `json:"announcements"`
+	Next          *hexutil.Uint64 `json:"next"`
+}
@@ -0,0 +1,156 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of Obsidian.
+
+package stealth
+
+import (
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// newAnnouncement announces a payment to the recipient of a meta-address
+func newAnnouncement(t *testing.T, to *StealthMetaAddress, block uint64) Announcement {
+	t.Helper()
+
+	addr, err := GenerateStealthAddress(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Announcement{
+		EphemeralPubKey: addr.EphemeralPubKey,
+		ViewTag:         addr.ViewTag,
+		Recipient:       addr.Address,
+		Value:           big.NewInt(int64(block) * 1000),
+		TxHash:          common.Hash{byte(block)},
+		BlockNumber:     block,
+	}
+}
+
+func TestAnnouncementJSON(t *testing.T) {
+	keyPair, _ := GenerateStealthKeyPair()
+	a := newAnnouncement(t, keyPair.MetaAddress(), 7)
+
+	data, err := json.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tuple []interface{}
+	if err := json.Unmarshal(data, &tuple); err != nil || len(tuple) != 6 {
+		t.Fatalf("announcement not encoded as a 6-tuple: %s", data)
+	}
+	var decoded Announcement
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, a) {
+		t.Fatalf("announcement changed in JSON:\n got %+v\nwant %+v", decoded, a)
+	}
+	if err := json.Unmarshal([]byte(`["0x02", "0x1ff", "0x00", "0x0", "0x00", "0x0"]`), &decoded); err == nil {
+		t.Fatal("decoded announcement with a malformed tuple")
+	}
+
+	// Token payments carry their asset in two more fields
+	a.Asset = Asset{ERC721Standard, common.Address{0x72}}
+	data, _ = json.Marshal(a)
+	if err := json.Unmarshal(data, &tuple); err != nil || len(tuple) != 8 {
+		t.Fatalf("token announcement not encoded as an 8-tuple: %s", data)
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil || !reflect.DeepEqual(decoded, a) {
+		t.Fatalf("token announcement changed in JSON: %+v, err %v", decoded, err)
+	}
+}
+
+func TestScanAnnouncements(t *testing.T) {
+	ours, _ := GenerateStealthKeyPair()
+	theirs, _ := GenerateStealthKeyPair()
+
+	var announcements []Announcement
+	for block := uint64(1); block <= 20; block++ {
+		to := theirs.MetaAddress()
+		if block%5 == 0 {
+			to = ours.MetaAddress()
+		}
+		announcements = append(announcements, newAnnouncement(t, to, block))
+	}
+	payments := ScanAnnouncements(ours.ViewPrivateKey, ours.SpendPublicKey, announcements)
+	if len(payments) != 4 {
+		t.Fatalf("found %d payments, want 4", len(payments))
+	}
+	for _, p := range payments {
+		if p.BlockNumber%5 != 0 || p.Amount != new(big.Int).SetUint64(p.BlockNumber*1000).String() {
+			t.Errorf("unexpected payment %+v", p)
+		}
+		key, _, err := DeriveStealthAddressPrivateKey(ours.ViewPrivateKey, ours.SpendPrivateKey, p.EphemeralPubKey)
+		if err != nil || PublicKeyToAddress(&key.PublicKey) != p.StealthAddress {
+			t.Errorf("payment to %s not spendable, err %v", p.StealthAddress.Hex(), err)
+		}
+	}
+}
+
+func TestAnnouncementLog(t *testing.T) {
+	keyPair, _ := GenerateStealthKeyPair()
+	a := newAnnouncement(t, keyPair.MetaAddress(), 3)
+
+	log := NewAnnouncementLog(SchemeSecp256k1, a.Recipient, common.Address{0xca}, a.EphemeralPubKey, NativeMetadata(a.ViewTag, a.Value))
+	log.TxHash, log.BlockNumber = a.TxHash, a.BlockNumber
+	if log.Topics[0] != AnnouncementEventID || log.Topics[3] != common.BytesToHash(common.Address{0xca}.Bytes()) {
+		t.Fatalf("unexpected topics %v", log.Topics)
+	}
+	parsed, err := ParseAnnouncementLog(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*parsed, a) {
+		t.Fatalf("parsed %+v, want %+v", *parsed, a)
+	}
+	if len(ScanAnnouncements(keyPair.ViewPrivateKey, keyPair.SpendPublicKey, []Announcement{*parsed})) != 1 {
+		t.Fatal("payment announced by log not found")
+	}
+
+	// Token metadata leaves the value unknown, other schemes aren't understood
+	log.Data, _ = announcementEvent.Inputs.NonIndexed().Pack(a.EphemeralPubKey, []byte{a.ViewTag, 0xa9, 0x05, 0x9c, 0xbb})
+	if parsed, err := ParseAnnouncementLog(log); err != nil || parsed.Value != nil || parsed.ViewTag != a.ViewTag {
+		t.Fatalf("parsed token announcement %+v, err %v", parsed, err)
+	}
+	log.Topics[1] = common.BigToHash(big.NewInt(2))
+	if _, err := ParseAnnouncementLog(log); err != ErrUnsupportedScheme {
+		t.Fatalf("parsed an unknown scheme, err %v", err)
+	}
+}
+
+func TestDecodeTransfer(t *testing.T) {
+	var (
+		token     = common.Address{0x20}
+		holder    = common.Address{0x01}
+		recipient = common.Address{0xaa}
+		amount    = big.NewInt(5e6)
+	)
+	for _, asset := range []Asset{{ERC20Standard, token}, {ERC721Standard, token}} {
+		to, data, err := TransferData(asset, holder, recipient, amount)
+		if err != nil || to != token {
+			t.Fatalf("%v: transfer to %s, err %v", asset, to.Hex(), err)
+		}
+		transfer := DecodeTransfer(to, new(big.Int), data)
+		if transfer.Recipient != recipient || transfer.Asset != asset || transfer.Amount.Cmp(amount) != 0 {
+			t.Fatalf("%v: decoded %+v", asset, transfer)
+		}
+
+		// Announcements carry the token in their metadata
+		log := NewAnnouncementLog(SchemeSecp256k1, transfer.Recipient, holder, make([]byte, 33), transfer.Metadata(0x42))
+		a, err := ParseAnnouncementLog(log)
+		if err != nil || a.Asset != asset || a.Value.Cmp(amount) != 0 || a.ViewTag != 0x42 || a.Recipient != recipient {
+			t.Fatalf("%v: parsed announcement %+v, err %v", asset, a, err)
+		}
+	}
+
+	// Anything else pays the destination in OBS
+	for _, data := range [][]byte{nil, {0xa9, 0x05, 0x9c, 0xbb}, {0x12, 0x34, 0x56, 0x78}} {
+		if transfer := DecodeTransfer(token, amount, data); transfer.Recipient != token || transfer.Asset != NativeAsset || transfer.Amount != amount {
+			t.Errorf("call data %x decoded as %+v", data, transfer)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package stealth
+
+import (
+	"errors"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	obstypes "github.com/obsidian-chain/obsidian/core/types"
+)
+
+// AnnouncerAddress is the address ERC-5564 announcements are emitted from,
+// the address of the singleton announcer contract on Ethereum
+var AnnouncerAddress = common.HexToAddress("0x55649E01B5Df198D18D95b5cc5051630cfD45564")
+
+// NativeToken is the token address ERC-5564 metadata uses for the native
+// currency of a chain
+var NativeToken = common.HexToAddress("0xEeeeeEeeeEeEeeEeEeEeeEEEeeeeEeeeeeeeEEeE")
+
+// nativeSelector is the function selector ERC-5564 metadata carries for plain
+// transfers of the native currency
+var nativeSelector = []byte{0xee, 0xee, 0xee, 0xee}
+
+// transferMetadataLen is the length of the metadata of a transfer: the view
+// tag, the selector, the token address and the amount
+const transferMetadataLen = 1 + 4 + common.AddressLength + 32
+
+var ErrInvalidAnnouncementLog = errors.New("invalid stealth announcement log")
+
+// announcerABI is the ERC-5564 announcer interface
+const announcerABI = `[
+	{"type":"event","name":"Announcement","anonymous":false,"inputs":[{"name":"schemeId","type":"uint256","indexed":true},{"name":"stealthAddress","type":"address","indexed":true},{"name":"caller","type":"address","indexed":true},{"name":"ephemeralPubKey","type":"bytes","indexed":false},{"name":"metadata","type":"bytes","indexed":false}]}
+]`
+
+var announcementEvent = func() abi.Event {
+	parsed, err := abi.JSON(strings.NewReader(announcerABI))
+	if err != nil {
+		panic(err)
+	}
+	return parsed.Events["Announcement"]
+}()
+
+// AnnouncementEventID is the topic of ERC-5564 Announcement logs
+var AnnouncementEventID = announcementEvent.ID
+
+// NativeMetadata returns the ERC-5564 metadata of a native transfer of value
+// to a stealth address
+func NativeMetadata(viewTag byte, value *big.Int) []byte {
+	return Transfer{Asset: NativeAsset, Amount: value, selector: nativeSelector}.Metadata(viewTag)
+}
+
+// NewAnnouncementLog returns the ERC-5564 Announcement log of a payment to a
+// stealth address, as emitted by the announcer
+func NewAnnouncementLog(schemeID uint64, stealthAddress, caller common.Address, ephemeralPubKey, metadata []byte) *obstypes.Log {
+	data, _ := announcementEvent.Inputs.NonIndexed().Pack(ephemeralPubKey, metadata)
+	return &obstypes.Log{
+		Address: AnnouncerAddress,
+		Topics: []common.Hash{
+			AnnouncementEventID,
+			common.BigToHash(new(big.Int).SetUint64(schemeID)),
+			common.BytesToHash(stealthAddress.Bytes()),
+			common.BytesToHash(caller.Bytes()),
+		},
+		Data: data,
+	}
+}
+
+// ParseAnnouncementLog returns the announcement carried by an ERC-5564
+// Announcement log. Only the secp256k1 scheme is understood. The asset and
+// value are decoded from the metadata of the transfers DecodeTransfer knows,
+// the value is left nil for others.
+func ParseAnnouncementLog(log *obstypes.Log) (*Announcement, error) {
+	if log.Address != AnnouncerAddress || len(log.Topics) != 4 || log.Topics[0] != AnnouncementEventID {
+		return nil, ErrInvalidAnnouncementLog
+	}
+	if log.Topics[1] != common.BigToHash(big.NewInt(SchemeSecp256k1)) {
+		return nil, ErrUnsupportedScheme
+	}
+	values, err := announcementEvent.Inputs.NonIndexed().Unpack(log.Data)
+	if err != nil {
+		return nil, ErrInvalidAnnouncementLog
+	}
+	ephemeralPubKey, metadata := values[0].([]byte), values[1].([]byte)
+	if len(ephemeralPubKey) != 33 || len(metadata) == 0 {
+		return nil, ErrInvalidAnnouncementLog
+	}
+	a := &Announcement{
+		EphemeralPubKey: ephemeralPubKey,
+		ViewTag:         metadata[0],
+		Recipient:       common.BytesToAddress(log.Topics[2].Bytes()),
+		TxHash:          log.TxHash,
+		BlockNumber:     log.BlockNumber,
+	}
+	if asset, amount, ok := parseMetadata(metadata); ok {
+		a.Asset, a.Value = asset, amount
+	}
+	return a, nil
+}
+
+// TxData returns the announcement in the form scanners match against
+func (a *Announcement) TxData() StealthTxData {
+	amount := "0"
+	if a.Value != nil {
+		amount = a.Value.String()
+	}
+	return StealthTxData{
+		TxHash:          a.TxHash,
+		ToAddress:       a.Recipient,
+		EphemeralPubKey: a.EphemeralPubKey,
+		ViewTag:         a.ViewTag,
+		Amount:          amount,
+		Asset:           a.Asset,
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+// Package filter implements compact per-block filters over stealth payment
+// announcements, in the style of the BIP-158 block filters.
+//
+// The filter of a block is a Golomb-coded set keyed by the block hash. For
+// every stealth announcement in the block it holds the view tag, the
+// ephemeral public key and the recipient address. A light wallet fetches the
+// filters of a range of blocks, tests them locally for what it is looking
+// for and downloads only the blocks that match, without telling the node
+// anything about its keys.
+//
+// Filters are committed to by a chain of filter headers: the header of a
+// block hashes its filter with the header of its parent's filter. A wallet
+// that learned the filter header of a block from several peers can check any
+// filter it is served against it.
+package filter
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Filter is the stealth announcement filter of a block
+type Filter struct {
+	set *gcs
+}
+
+// key derives the SipHash key of a block's filter from its hash
+func key(blockHash common.Hash) (k [16]byte) {
+	copy(k[:], blockHash[:16])
+	return k
+}
+
+// ViewTagItem returns the filter element of a view tag
+func ViewTagItem(tag byte) []byte {
+	return []byte{tag}
+}
+
+// AnnouncementItems returns the filter elements of a stealth announcement
+func AnnouncementItems(ephemeralPubKey []byte, viewTag byte, recipient common.Address) [][]byte {
+	return [][]byte{ViewTagItem(viewTag), common.CopyBytes(ephemeralPubKey), recipient.Bytes()}
+}
+
+// New builds the filter of a block from the elements of its announcements
+func New(blockHash common.Hash, items [][]byte) *Filter {
+	return &Filter{set: newGCS(key(blockHash), items)}
+}
+
+// Decode decodes the filter of a block
+func Decode(blockHash common.Hash, raw []byte) (*Filter, error) {
+	set, err := decodeGCS(key(blockHash), raw)
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{set: set}, nil
+}
+
+// Bytes returns the encoding of the filter
+func (f *Filter) Bytes() []byte {
+	return f.set.bytes()
+}
+
+// N returns the number of distinct elements in the filter
+func (f *Filter) N() uint64 {
+	return f.set.n
+}
+
+// Match reports whether an element may be in the filter. False positives
+// occur at a rate of 1/M, there are no false negatives.
+func (f *Filter) Match(item []byte) bool {
+	return f.set.matchAny([][]byte{item})
+}
+
+// MatchAny reports whether any of the elements may be in the filter
+func (f *Filter) MatchAny(items [][]byte) bool {
+	return f.set.matchAny(items)
+}
+
+// MatchViewTags reports whether the block may announce a payment with any of
+// the given view tags
+func (f *Filter) MatchViewTags(tags []byte) bool {
+	items := make([][]byte, len(tags))
+	for i, tag := range tags {
+		items[i] = ViewTagItem(tag)
+	}
+	return f.set.matchAny(items)
+}
+
+// MatchAddresses reports whether the block may announce a payment to any of
+// the given addresses
+func (f *Filter) MatchAddresses(addrs []common.Address) bool {
+	items := make([][]byte, len(addrs))
+	for i, addr := range addrs {
+		items[i] = addr.Bytes()
+	}
+	return f.set.matchAny(items)
+}
+
+// Hash returns the hash of an encoded filter
+func Hash(raw []byte) common.Hash {
+	return crypto.Keccak256Hash(raw)
+}
+
+// Header returns the filter header of a block from the hash of its filter
+// and the filter header of its parent, zero for the genesis block
+func Header(filterHash, prev common.Hash) common.Hash {
+	return crypto.Keccak256Hash(filterHash[:], prev[:])
+}
+
+// Headers chains the filter hashes of consecutive blocks onto the filter
+// header of the block before them, returning the header of every block
+func Headers(prev common.Hash, filterHashes []common.Hash) []common.Hash {
+	headers := make([]common.Hash, len(filterHashes))
+	for i, hash := range filterHashes {
+		prev = Header(hash, prev)
+		headers[i] = prev
+	}
+	return headers
+}
+
+// Range is the filters of a run of consecutive blocks
+type Range struct {
+	Prev    common.Hash   // Filter header of the block before the range
+	Blocks  []common.Hash // Hashes of the blocks
+	Filters [][]byte      // Encoded filters of the blocks
+}
+
+// FilterHashes returns the hashes of the filters of the range
+func (r *Range) FilterHashes() []common.Hash {
+	hashes := make([]common.Hash, len(r.Filters))
+	for i, raw := range r.Filters {
+		hashes[i] = Hash(raw)
+	}
+	return hashes
+}
+
+// Headers returns the filter headers of the blocks of the range
+func (r *Range) Headers() []common.Hash {
+	return Headers(r.Prev, r.FilterHashes())
+}
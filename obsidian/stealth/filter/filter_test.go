@@ -0,0 +1,114 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package filter
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func randomItems(n, size int) [][]byte {
+	items := make([][]byte, n)
+	for i := range items {
+		items[i] = make([]byte, size)
+		rand.Read(items[i])
+	}
+	return items
+}
+
+func TestFilterMatch(t *testing.T) {
+	block := common.Hash{0xb1, 0x0c}
+	items := randomItems(500, 33)
+	items = append(items, items[0]) // Duplicates are stored once
+
+	f, err := Decode(block, New(block, items).Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.N() != 500 {
+		t.Fatalf("filter has %d elements, want 500", f.N())
+	}
+	for i, item := range items {
+		if !f.Match(item) {
+			t.Fatalf("element %d not matched", i)
+		}
+	}
+	// False positives come at a rate of 1/M
+	var matches int
+	for _, item := range randomItems(10000, 33) {
+		if f.Match(item) {
+			matches++
+		}
+	}
+	if matches > 2 {
+		t.Errorf("%d false positives out of 10000", matches)
+	}
+	if !f.MatchAny(append(randomItems(10, 33), items[42])) {
+		t.Error("set containing an element not matched")
+	}
+
+	// The key comes from the block hash
+	other, err := Decode(common.Hash{0xb1, 0x0d}, f.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var matched int
+	for _, item := range items[:100] {
+		if other.Match(item) {
+			matched++
+		}
+	}
+	if matched > 2 {
+		t.Errorf("filter matches %d elements under another block's key", matched)
+	}
+}
+
+func TestFilterEncoding(t *testing.T) {
+	block := common.Hash{0x01}
+	empty := New(block, nil)
+	if raw := empty.Bytes(); len(raw) != 1 || raw[0] != 0 {
+		t.Fatalf("unexpected empty filter encoding %x", raw)
+	}
+	if empty.MatchViewTags([]byte{0, 1, 2}) {
+		t.Fatal("empty filter matched")
+	}
+
+	raw := New(block, AnnouncementItems([]byte{0x02, 0x03}, 0x7f, common.Address{0xaa})).Bytes()
+	for _, bad := range [][]byte{{}, raw[:len(raw)-2], append([]byte{0x10}, raw[1:]...)} {
+		if _, err := Decode(block, bad); err != ErrInvalidFilter {
+			t.Errorf("decoded malformed filter %x, err %v", bad, err)
+		}
+	}
+	f, _ := Decode(block, raw)
+	if !f.MatchViewTags([]byte{0x7f}) || !f.MatchAddresses([]common.Address{{0xaa}}) {
+		t.Fatal("announcement not matched")
+	}
+}
+
+func TestFilterHeaders(t *testing.T) {
+	var (
+		blocks  = []common.Hash{{1}, {2}, {3}}
+		r       = &Range{Blocks: blocks}
+		headers []common.Hash
+		prev    common.Hash
+	)
+	for _, block := range blocks {
+		raw := New(block, randomItems(3, 20)).Bytes()
+		r.Filters = append(r.Filters, raw)
+		prev = Header(Hash(raw), prev)
+		headers = append(headers, prev)
+	}
+	for i, header := range r.Headers() {
+		if header != headers[i] {
+			t.Fatalf("header %d mismatch", i)
+		}
+	}
+	// A changed filter changes its header and all those after it
+	r.Filters[1] = New(blocks[1], nil).Bytes()
+	if got := r.Headers(); got[0] != headers[0] || got[1] == headers[1] || got[2] == headers[2] {
+		t.Fatal("filter change not reflected in the header chain")
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package filter
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"sort"
+
+	"github.com/dchest/siphash"
+)
+
+// Golomb-coded set parameters, the ones BIP-158 picked for basic filters
+const (
+	// P is the number of bits of the remainders of the coded deltas
+	P = 19
+
+	// M is the inverse of the false positive rate of a single lookup
+	M = 784931
+)
+
+// ErrInvalidFilter is returned when decoding a malformed filter
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// gcs is a Golomb-coded set: the sorted hashes of its elements, reduced to
+// the range [0, N*M), delta coded with Golomb-Rice codes
+type gcs struct {
+	k0, k1 uint64
+	n      uint64
+	data   []byte // Encoded deltas, without the element count
+}
+
+// newGCS builds the set of the given elements under a SipHash key
+func newGCS(key [16]byte, items [][]byte) *gcs {
+	g := &gcs{
+		k0: binary.LittleEndian.Uint64(key[:8]),
+		k1: binary.LittleEndian.Uint64(key[8:]),
+	}
+	seen := make(map[string]struct{}, len(items))
+	for _, item := range items {
+		seen[string(item)] = struct{}{}
+	}
+	g.n = uint64(len(seen))
+
+	values := make([]uint64, 0, len(seen))
+	for item := range seen {
+		values = append(values, g.hash([]byte(item)))
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	var (
+		w    bitWriter
+		last uint64
+	)
+	for _, v := range values {
+		delta := v - last
+		last = v
+		for q := delta >> P; q > 0; q-- {
+			w.writeBit(1)
+		}
+		w.writeBit(0)
+		w.writeBits(delta, P)
+	}
+	g.data = w.bytes
+	return g
+}
+
+// decodeGCS decodes a set encoded by bytes, checking that it holds as many
+// deltas as it claims
+func decodeGCS(key [16]byte, raw []byte) (*gcs, error) {
+	n, size := binary.Uvarint(raw)
+	if size <= 0 {
+		return nil, ErrInvalidFilter
+	}
+	g := &gcs{
+		k0:   binary.LittleEndian.Uint64(key[:8]),
+		k1:   binary.LittleEndian.Uint64(key[8:]),
+		n:    n,
+		data: raw[size:],
+	}
+	// Every element takes at least P+1 bits
+	if n > uint64(len(g.data))*8/(P+1) {
+		return nil, ErrInvalidFilter
+	}
+	r := bitReader{data: g.data}
+	for i := uint64(0); i < n; i++ {
+		if _, err := r.readDelta(); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// bytes returns the encoding of the set: the element count as a uvarint,
+// followed by the coded deltas
+func (g *gcs) bytes() []byte {
+	out := binary.AppendUvarint(nil, g.n)
+	return append(out, g.data...)
+}
+
+// hash maps an element to [0, N*M)
+func (g *gcs) hash(item []byte) uint64 {
+	hi, _ := bits.Mul64(siphash.Hash(g.k0, g.k1, item), g.n*M)
+	return hi
+}
+
+// matchAny reports whether any of the items may be in the set
+func (g *gcs) matchAny(items [][]byte) bool {
+	if g.n == 0 || len(items) == 0 {
+		return false
+	}
+	targets := make([]uint64, len(items))
+	for i, item := range items {
+		targets[i] = g.hash(item)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i] < targets[j] })
+
+	var (
+		r     = bitReader{data: g.data}
+		value uint64
+	)
+	for i := uint64(0); i < g.n; i++ {
+		delta, err := r.readDelta()
+		if err != nil {
+			return false
+		}
+		value += delta
+		for len(targets) > 0 && targets[0] < value {
+			targets = targets[1:]
+		}
+		if len(targets) == 0 {
+			return false
+		}
+		if targets[0] == value {
+			return true
+		}
+	}
+	return false
+}
+
+// bitWriter appends bits to a byte slice, most significant bit first
+type bitWriter struct {
+	bytes []byte
+	used  uint8 // Bits used of the last byte
+}
+
+func (w *bitWriter) writeBit(bit uint8) {
+	if w.used == 0 || w.used == 8 {
+		w.bytes = append(w.bytes, 0)
+		w.used = 0
+	}
+	if bit != 0 {
+		w.bytes[len(w.bytes)-1] |= 0x80 >> w.used
+	}
+	w.used++
+}
+
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.writeBit(uint8(v>>uint(i)) & 1)
+	}
+}
+
+// bitReader reads back the bits written by a bitWriter
+type bitReader struct {
+	data []byte
+	pos  int // Index of the next bit
+}
+
+func (r *bitReader) readBit() (uint8, error) {
+	if r.pos >= len(r.data)*8 {
+		return 0, ErrInvalidFilter
+	}
+	bit := r.data[r.pos/8] >> (7 - uint(r.pos%8)) & 1
+	r.pos++
+	return bit, nil
+}
+
+// readDelta reads a Golomb-Rice coded delta
+func (r *bitReader) readDelta() (uint64, error) {
+	var q uint64
+	for {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if bit == 0 {
+			break
+		}
+		q++
+	}
+	var rem uint64
+	for i := 0; i < P; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		rem = rem<<1 | uint64(bit)
+	}
+	return q<<P | rem, nil
+}
@@ -11,8 +11,10 @@ import (
 	"crypto/rand"
 	"errors"
 	"math/big"
+	"strings"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/crypto"
 )
 
@@ -36,6 +38,27 @@ type StealthKeyPair struct {
 	ViewPublicKey  *ecdsa.PublicKey
 }
 
+// Stealth address schemes, numbered as in ERC-5564
+const (
+	// SchemeSecp256k1 is the secp256k1 scheme with view tags, the one of
+	// stealth transactions and st:obs: meta-addresses
+	SchemeSecp256k1 = 1
+)
+
+// Chain names of the st:<chain>: meta-address prefix
+const (
+	ChainObsidian = "obs"
+	ChainEthereum = "eth"
+)
+
+var (
+	// ErrUnsupportedScheme is returned for stealth address schemes other than
+	// SchemeSecp256k1
+	ErrUnsupportedScheme = errors.New("unsupported stealth address scheme")
+	// ErrInvalidMetaAddress is returned for malformed meta-addresses
+	ErrInvalidMetaAddress = errors.New("invalid stealth meta-address")
+)
+
 // StealthMetaAddress is the public information shared with senders
 // Senders use this to create stealth addresses
 type StealthMetaAddress struct {
@@ -43,6 +66,10 @@ type StealthMetaAddress struct {
 	SpendPubKey []byte
 	// ViewPubKey is the recipient's view public key
 	ViewPubKey []byte
+	// SchemeID is the ERC-5564 scheme of the keys
+	SchemeID uint64
+	// Chain is the chain name of the string form, ChainObsidian if empty
+	Chain string
 }
 
 // GenerateStealthKeyPair generates a new stealth key pair
@@ -92,30 +119,67 @@ func (kp *StealthKeyPair) MetaAddress() *StealthMetaAddress {
 	return &StealthMetaAddress{
 		SpendPubKey: crypto.CompressPubkey(kp.SpendPublicKey),
 		ViewPubKey:  crypto.CompressPubkey(kp.ViewPublicKey),
+		SchemeID:    SchemeSecp256k1,
+		Chain:       ChainObsidian,
+	}
+}
+
+// MetaAddressFromBytes creates a meta-address of a scheme from its raw keys,
+// as ERC-5564 and ERC-6538 contracts store them
+func MetaAddressFromBytes(schemeID uint64, raw []byte) (*StealthMetaAddress, error) {
+	if schemeID != SchemeSecp256k1 {
+		return nil, ErrUnsupportedScheme
+	}
+	if len(raw) != 66 { // 33 bytes spend + 33 bytes view
+		return nil, ErrInvalidMetaAddress
 	}
+	return &StealthMetaAddress{
+		SpendPubKey: common.CopyBytes(raw[:33]),
+		ViewPubKey:  common.CopyBytes(raw[33:]),
+		SchemeID:    schemeID,
+		Chain:       ChainObsidian,
+	}, nil
+}
+
+// Bytes returns the raw keys of the meta-address, spend key first
+func (m *StealthMetaAddress) Bytes() []byte {
+	return append(common.CopyBytes(m.SpendPubKey), m.ViewPubKey...)
 }
 
 // String returns the hex-encoded meta-address string
-// Format: "st:obs:<spendPubKey><viewPubKey>"
+// Format: "st:obs:<spendPubKey><viewPubKey>", or for other chains the
+// ERC-5564 form "st:<chain>:0x<spendPubKey><viewPubKey>"
 func (m *StealthMetaAddress) String() string {
-	return "st:obs:" + common.Bytes2Hex(m.SpendPubKey) + common.Bytes2Hex(m.ViewPubKey)
+	if m.Chain == "" || m.Chain == ChainObsidian {
+		return "st:obs:" + common.Bytes2Hex(m.Bytes())
+	}
+	return "st:" + m.Chain + ":" + hexutil.Encode(m.Bytes())
 }
 
-// ParseMetaAddress parses a stealth meta-address string
+// ParseMetaAddress parses a stealth meta-address string of the
+// SchemeSecp256k1 scheme, with either the st:obs: or the st:eth: prefix
 func ParseMetaAddress(s string) (*StealthMetaAddress, error) {
-	if len(s) < 7 || s[:7] != "st:obs:" {
+	return ParseMetaAddressForScheme(SchemeSecp256k1, s)
+}
+
+// ParseMetaAddressForScheme parses a stealth meta-address string whose keys
+// are of the given ERC-5564 scheme, as announced alongside it
+func ParseMetaAddressForScheme(schemeID uint64, s string) (*StealthMetaAddress, error) {
+	var chain string
+	switch {
+	case strings.HasPrefix(s, "st:"+ChainObsidian+":"):
+		chain = ChainObsidian
+	case strings.HasPrefix(s, "st:"+ChainEthereum+":"):
+		chain = ChainEthereum
+	default:
 		return nil, errors.New("invalid stealth meta-address format")
 	}
-
-	data := common.FromHex(s[7:])
-	if len(data) != 66 { // 33 bytes spend + 33 bytes view
-		return nil, errors.New("invalid stealth meta-address length")
+	meta, err := MetaAddressFromBytes(schemeID, common.FromHex(s[len("st:")+len(chain)+1:]))
+	if err != nil {
+		return nil, err
 	}
-
-	return &StealthMetaAddress{
-		SpendPubKey: data[:33],
-		ViewPubKey:  data[33:],
-	}, nil
+	meta.Chain = chain
+	return meta, nil
 }
 
 // PublicKeyToAddress converts a public key to an Ethereum address
@@ -0,0 +1,347 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package stealth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	// scanBatchBlocks is the number of consecutive blocks the scan pipeline
+	// fetches and matches at a time
+	scanBatchBlocks = 64
+
+	// scanFetchers is the number of block batches fetched concurrently
+	scanFetchers = 4
+
+	// maxScanRetries is the number of times a sync starts over after the
+	// chain reorganised under it before giving up
+	maxScanRetries = 3
+)
+
+// ScanProgress reports how far a scan over a range of blocks got
+type ScanProgress struct {
+	From     uint64 // First block of the range
+	To       uint64 // Last block of the range
+	Scanned  uint64 // Last block scanned so far
+	Payments int    // Payments found so far
+}
+
+// scanBlock is a block fetched by the scan pipeline. Once matched, paid holds
+// the announcements paying each scanner, keyed by its index in the scan set.
+type scanBlock struct {
+	number uint64
+	hash   common.Hash
+	parent common.Hash
+	txs    []StealthTxData
+	paid   map[int][]StealthTxData
+}
+
+// scanBatch is a run of consecutive blocks fetched together
+type scanBatch struct {
+	blocks []*scanBlock
+	head   bool  // Whether the batch stopped short at the chain head
+	err    error // Error that stopped the batch short
+}
+
+// fetchBatch fetches the canonical blocks from start to end along with their
+// announcements
+func fetchBatch(ctx context.Context, backend BlockchainBackend, start, end uint64) *scanBatch {
+	batch := new(scanBatch)
+	for number := start; ; number++ {
+		if batch.err = ctx.Err(); batch.err != nil {
+			return batch
+		}
+		hash, parent, err := backend.GetBlockHashes(ctx, number)
+		if err != nil {
+			batch.err = err
+			return batch
+		}
+		if hash == (common.Hash{}) {
+			batch.head = true
+			return batch
+		}
+		txs, err := backend.GetStealthTransactions(ctx, number)
+		if err != nil {
+			batch.err = err
+			return batch
+		}
+		if again, _, err := backend.GetBlockHashes(ctx, number); err != nil || again != hash {
+			batch.err = errChainChanged
+			return batch
+		}
+		batch.blocks = append(batch.blocks, &scanBlock{number: number, hash: hash, parent: parent, txs: txs})
+		if number == end {
+			return batch
+		}
+	}
+}
+
+// scanSet matches announcements against many scanners in one pass. Scanners
+// sharing a view key share the ECDH and the view tag check, the stealth
+// address is only derived per spend key for announcements passing it.
+type scanSet struct {
+	groups []scanGroup
+}
+
+// scanGroup is the scanners of a scan set sharing a view key
+type scanGroup struct {
+	viewPrivKey *ecdsa.PrivateKey
+	members     []scanMember
+}
+
+// scanMember is a scanner of a scan group
+type scanMember struct {
+	index       int // Index of the scanner in the scan set
+	spendPubKey *ecdsa.PublicKey
+}
+
+// newScanSet creates a scan set for the scanners, indexing them in order
+func newScanSet(scanners []*Scanner) *scanSet {
+	var (
+		set    = new(scanSet)
+		groups = make(map[string]int)
+	)
+	for i, s := range scanners {
+		key := string(s.viewPrivKey.D.Bytes())
+		g, ok := groups[key]
+		if !ok {
+			g = len(set.groups)
+			groups[key] = g
+			set.groups = append(set.groups, scanGroup{viewPrivKey: s.viewPrivKey})
+		}
+		set.groups[g].members = append(set.groups[g].members, scanMember{index: i, spendPubKey: s.spendPubKey})
+	}
+	return set
+}
+
+// match appends the indexes of the scanners an announcement pays to paid
+func (set *scanSet) match(tx *StealthTxData, paid []int) []int {
+	ephPubKey, err := DecompressPublicKey(tx.EphemeralPubKey)
+	if err != nil {
+		return paid
+	}
+	for _, g := range set.groups {
+		sharedSecret := SharedSecret(g.viewPrivKey, ephPubKey)
+		if computeViewTag(sharedSecret) != tx.ViewTag {
+			continue
+		}
+		for _, m := range g.members {
+			if DeriveStealthAddressFromSharedSecret(m.spendPubKey, sharedSecret) == tx.ToAddress {
+				paid = append(paid, m.index)
+			}
+		}
+	}
+	return paid
+}
+
+// matchBlocks matches the announcements of the blocks on the given number of
+// workers, filling in what they pay each scanner
+func (set *scanSet) matchBlocks(ctx context.Context, blocks []*scanBlock, workers int) error {
+	type job struct {
+		block *scanBlock
+		tx    int
+	}
+	var jobs []job
+	for _, block := range blocks {
+		for i := range block.txs {
+			jobs = append(jobs, job{block, i})
+		}
+	}
+	var (
+		paid = make([][]int, len(jobs))
+		next atomic.Int64
+		wg   sync.WaitGroup
+	)
+	for w := 0; w < min(workers, len(jobs)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				i := int(next.Add(1) - 1)
+				if i >= len(jobs) {
+					return
+				}
+				paid[i] = set.match(&jobs[i].block.txs[jobs[i].tx], nil)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for i, indexes := range paid {
+		block, tx := jobs[i].block, jobs[i].block.txs[jobs[i].tx]
+		for _, index := range indexes {
+			if block.paid == nil {
+				block.paid = make(map[int][]StealthTxData)
+			}
+			block.paid[index] = append(block.paid[index], tx)
+		}
+	}
+	return nil
+}
+
+// scanRange runs the scan pipeline over the canonical blocks from from to to,
+// stopping early at the chain head. Batches of blocks are fetched
+// concurrently, matched against the scan set on every CPU, and handed to fn in
+// block order. A block not linking up with the one before it aborts the scan
+// with errChainChanged.
+func scanRange(ctx context.Context, backend BlockchainBackend, from, to uint64, set *scanSet, fn func(blocks []*scanBlock) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Fetch batches ahead of matching, handing them over in order
+	pending := make(chan chan *scanBatch, scanFetchers)
+	go func() {
+		defer close(pending)
+		for start := from; start <= to; start += scanBatchBlocks {
+			end := to
+			if to-start >= scanBatchBlocks {
+				end = start + scanBatchBlocks - 1
+			}
+			res := make(chan *scanBatch, 1)
+			select {
+			case pending <- res:
+			case <-ctx.Done():
+				return
+			}
+			go func() { res <- fetchBatch(ctx, backend, start, end) }()
+			if end == to {
+				return
+			}
+		}
+	}()
+	var prev *scanBlock
+	for res := range pending {
+		batch := <-res
+		for _, block := range batch.blocks {
+			if prev != nil && block.parent != prev.hash {
+				return errChainChanged
+			}
+			prev = block
+		}
+		if len(batch.blocks) > 0 {
+			if err := set.matchBlocks(ctx, batch.blocks, runtime.NumCPU()); err != nil {
+				return err
+			}
+			if err := fn(batch.blocks); err != nil {
+				return err
+			}
+		}
+		if batch.err != nil {
+			return batch.err
+		}
+		if batch.head {
+			return nil
+		}
+	}
+	return ctx.Err()
+}
+
+// applyBlocks records the payments the scan pipeline found in a run of blocks
+// for the scanner with the given index in the scan set
+func (s *Scanner) applyBlocks(blocks []*scanBlock, index int) ([]*StealthPayment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var found []*StealthPayment
+	for _, block := range blocks {
+		found = s.record(block.number, block.hash, block.paid[index], found)
+	}
+	if len(found) > 0 || s.unsaved >= checkpointBlocks {
+		return found, s.save()
+	}
+	return found, nil
+}
+
+// syncAll brings the scanners up to block to as Sync does, scanning the blocks
+// needed by the scanners that stopped at the same place in a single pass.
+func syncAll(ctx context.Context, backend BlockchainBackend, scanners []*Scanner, from, to uint64, progress func(ScanProgress)) (map[*Scanner][]*StealthPayment, error) {
+	// Lock in a fixed order so that overlapping syncs can't deadlock
+	scanners = append([]*Scanner(nil), scanners...)
+	sort.Slice(scanners, func(i, j int) bool { return scanners[i].seq < scanners[j].seq })
+	for _, s := range scanners {
+		s.syncMu.Lock()
+		defer s.syncMu.Unlock()
+	}
+	var (
+		found    = make(map[*Scanner][]*StealthPayment)
+		payments int
+	)
+	for retries := 0; ; retries++ {
+		// Group the scanners by the block they resume at
+		groups := make(map[uint64][]*Scanner)
+		for _, s := range scanners {
+			number, err := s.resume(ctx, backend, from)
+			if err != nil {
+				return found, err
+			}
+			if number <= to {
+				groups[number] = append(groups[number], s)
+			}
+		}
+		starts := make([]uint64, 0, len(groups))
+		for start := range groups {
+			starts = append(starts, start)
+		}
+		sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+		reorged := false
+		for _, start := range starts {
+			group := groups[start]
+			err := scanRange(ctx, backend, start, to, newScanSet(group), func(blocks []*scanBlock) error {
+				for i, s := range group {
+					if s == nil {
+						continue
+					}
+					s.mu.RLock()
+					last, ok := s.lastBlock()
+					s.mu.RUnlock()
+					if ok && last.Number+1 == blocks[0].number && last.Hash != blocks[0].parent {
+						// The last block the scanner scanned was reorged out
+						group[i], reorged = nil, true
+						continue
+					}
+					scanned, err := s.applyBlocks(blocks, i)
+					found[s] = append(found[s], scanned...)
+					payments += len(scanned)
+					if err != nil {
+						return err
+					}
+				}
+				if progress != nil {
+					progress(ScanProgress{From: start, To: to, Scanned: blocks[len(blocks)-1].number, Payments: payments})
+				}
+				return nil
+			})
+			if err == errChainChanged {
+				reorged = true
+				continue
+			}
+			if err != nil {
+				return found, err
+			}
+		}
+		if !reorged {
+			break
+		}
+		if retries == maxScanRetries {
+			return found, errChainChanged
+		}
+	}
+	for _, s := range scanners {
+		if err := s.Flush(); err != nil {
+			return found, err
+		}
+	}
+	return found, nil
+}
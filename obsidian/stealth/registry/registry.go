@@ -0,0 +1,307 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+// Package registry implements the stealth meta-address registry, a native
+// contract at params.StealthRegistryAddress in the spirit of ERC-6538.
+//
+// Accounts register the meta-address senders should derive their stealth
+// addresses from, either by calling the registry themselves or by signing
+// the registration for someone else to submit. The registry speaks the
+// ERC-6538 ABI, so wallets built for it can use it unchanged, but runs
+// natively instead of as EVM code.
+package registry
+
+import (
+	"errors"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	obstypes "github.com/obsidian-chain/obsidian/core/types"
+	"github.com/obsidian-chain/obsidian/params"
+	"github.com/obsidian-chain/obsidian/stealth"
+)
+
+// SchemeSecp256k1 is the only scheme meta-addresses can be registered for
+const SchemeSecp256k1 = stealth.SchemeSecp256k1
+
+// Gas charged for the registry's work on top of the intrinsic gas of a call
+const (
+	loadGas    = 2100  // Reading a storage slot
+	storeGas   = 20000 // Writing a storage slot
+	recoverGas = 3000  // Recovering the signer of a registration
+)
+
+// metaAddressSlots is the number of storage slots holding a meta-address:
+// its length and the two chunks of its 66 bytes
+const metaAddressSlots = 1 + 3
+
+var (
+	ErrUnknownMethod      = errors.New("unknown registry method")
+	ErrInvalidInput       = errors.New("invalid registry call input")
+	ErrUnsupportedScheme  = stealth.ErrUnsupportedScheme
+	ErrInvalidMetaAddress = stealth.ErrInvalidMetaAddress
+	ErrInvalidSignature   = errors.New("invalid registration signature")
+)
+
+// Address is where the registry lives
+var Address = common.BytesToAddress([]byte{params.StealthRegistryAddress})
+
+// registryABI is the ERC-6538 interface of the registry
+const registryABI = `[
+	{"type":"function","name":"registerKeys","stateMutability":"nonpayable","inputs":[{"name":"schemeId","type":"uint256"},{"name":"stealthMetaAddress","type":"bytes"}],"outputs":[]},
+	{"type":"function","name":"registerKeysOnBehalf","stateMutability":"nonpayable","inputs":[{"name":"registrant","type":"address"},{"name":"schemeId","type":"uint256"},{"name":"signature","type":"bytes"},{"name":"stealthMetaAddress","type":"bytes"}],"outputs":[]},
+	{"type":"function","name":"incrementNonce","stateMutability":"nonpayable","inputs":[],"outputs":[]},
+	{"type":"function","name":"stealthMetaAddressOf","stateMutability":"view","inputs":[{"name":"registrant","type":"address"},{"name":"schemeId","type":"uint256"}],"outputs":[{"name":"","type":"bytes"}]},
+	{"type":"function","name":"nonceOf","stateMutability":"view","inputs":[{"name":"registrant","type":"address"}],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"DOMAIN_SEPARATOR","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"bytes32"}]},
+	{"type":"event","name":"StealthMetaAddressSet","anonymous":false,"inputs":[{"name":"registrant","type":"address","indexed":true},{"name":"schemeId","type":"uint256","indexed":true},{"name":"stealthMetaAddress","type":"bytes","indexed":false}]},
+	{"type":"event","name":"NonceIncremented","anonymous":false,"inputs":[{"name":"registrant","type":"address","indexed":true},{"name":"newNonce","type":"uint256","indexed":false}]}
+]`
+
+// ABI is the parsed interface of the registry, for packing calls to it
+var ABI = func() abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(registryABI))
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}()
+
+// EIP-712 type hashes of registrations signed on behalf of a registrant
+var (
+	domainTypeHash = crypto.Keccak256Hash([]byte("EIP712Domain(string name,string version,uint256 chainId,address verifyingContract)"))
+	entryTypeHash  = crypto.Keccak256Hash([]byte("Erc6538RegistryEntry(uint256 schemeId,bytes stealthMetaAddress,uint256 nonce)"))
+)
+
+// StateReader is the state the registry is read from
+type StateReader interface {
+	GetState(addr common.Address, key common.Hash) common.Hash
+}
+
+// StateDB is the state the registry runs on
+type StateDB interface {
+	StateReader
+	SetState(addr common.Address, key, value common.Hash)
+	GetNonce(addr common.Address) uint64
+	SetNonce(addr common.Address, nonce uint64)
+}
+
+// RequiredGas returns the gas a call to the registry costs beyond its
+// intrinsic gas
+func RequiredGas(input []byte) uint64 {
+	if len(input) < 4 {
+		return 0
+	}
+	method, err := ABI.MethodById(input[:4])
+	if err != nil {
+		return 0
+	}
+	switch method.Name {
+	case "registerKeys":
+		return metaAddressSlots * storeGas
+	case "registerKeysOnBehalf":
+		return metaAddressSlots*storeGas + recoverGas + storeGas
+	case "incrementNonce":
+		return storeGas
+	case "stealthMetaAddressOf":
+		return metaAddressSlots * loadGas
+	case "nonceOf":
+		return loadGas
+	}
+	return 0
+}
+
+// Run executes a call to the registry made by caller and returns its output
+// along with the logs it emitted. A failed call leaves the state untouched.
+func Run(state StateDB, chainID *big.Int, caller common.Address, input []byte) ([]byte, []*obstypes.Log, error) {
+	if len(input) < 4 {
+		return nil, nil, ErrUnknownMethod
+	}
+	method, err := ABI.MethodById(input[:4])
+	if err != nil {
+		return nil, nil, ErrUnknownMethod
+	}
+	args, err := method.Inputs.Unpack(input[4:])
+	if err != nil {
+		return nil, nil, ErrInvalidInput
+	}
+	switch method.Name {
+	case "registerKeys":
+		scheme, metaAddress := args[0].(*big.Int), args[1].([]byte)
+		if err := validate(scheme, metaAddress); err != nil {
+			return nil, nil, err
+		}
+		return nil, []*obstypes.Log{register(state, caller, scheme, metaAddress)}, nil
+
+	case "registerKeysOnBehalf":
+		registrant, scheme, sig, metaAddress := args[0].(common.Address), args[1].(*big.Int), args[2].([]byte), args[3].([]byte)
+		if err := validate(scheme, metaAddress); err != nil {
+			return nil, nil, err
+		}
+		nonce := NonceOf(state, registrant)
+		if signer, err := recoverSigner(RegistrationHash(chainID, scheme, metaAddress, nonce), sig); err != nil || signer != registrant {
+			return nil, nil, ErrInvalidSignature
+		}
+		setNonce(state, registrant, nonce+1)
+		return nil, []*obstypes.Log{register(state, registrant, scheme, metaAddress)}, nil
+
+	case "incrementNonce":
+		nonce := NonceOf(state, caller) + 1
+		setNonce(state, caller, nonce)
+		event := ABI.Events["NonceIncremented"]
+		data, _ := event.Inputs.NonIndexed().Pack(new(big.Int).SetUint64(nonce))
+		return nil, []*obstypes.Log{{
+			Address: Address,
+			Topics:  []common.Hash{event.ID, common.BytesToHash(caller.Bytes())},
+			Data:    data,
+		}}, nil
+
+	case "stealthMetaAddressOf":
+		out, err := method.Outputs.Pack(MetaAddressOf(state, args[0].(common.Address), args[1].(*big.Int)))
+		return out, nil, err
+
+	case "nonceOf":
+		out, err := method.Outputs.Pack(new(big.Int).SetUint64(NonceOf(state, args[0].(common.Address))))
+		return out, nil, err
+
+	case "DOMAIN_SEPARATOR":
+		out, err := method.Outputs.Pack(domainSeparator(chainID))
+		return out, nil, err
+	}
+	return nil, nil, ErrUnknownMethod
+}
+
+// validate checks that a meta-address is well formed for its scheme
+func validate(scheme *big.Int, metaAddress []byte) error {
+	if !scheme.IsUint64() {
+		return ErrUnsupportedScheme
+	}
+	meta, err := stealth.MetaAddressFromBytes(scheme.Uint64(), metaAddress)
+	if err != nil {
+		return err
+	}
+	for _, key := range [][]byte{meta.SpendPubKey, meta.ViewPubKey} {
+		if _, err := stealth.DecompressPublicKey(key); err != nil {
+			return ErrInvalidMetaAddress
+		}
+	}
+	return nil
+}
+
+// register stores the meta-address of a registrant and returns the log
+// announcing it
+func register(state StateDB, registrant common.Address, scheme *big.Int, metaAddress []byte) *obstypes.Log {
+	touch(state)
+
+	base := metaAddressBase(registrant, scheme)
+	state.SetState(Address, base, common.BigToHash(big.NewInt(int64(len(metaAddress)))))
+	for i := 0; i*32 < len(metaAddress); i++ {
+		var chunk common.Hash
+		copy(chunk[:], metaAddress[i*32:])
+		state.SetState(Address, chunkSlot(base, i), chunk)
+	}
+	event := ABI.Events["StealthMetaAddressSet"]
+	data, _ := event.Inputs.NonIndexed().Pack(metaAddress)
+	return &obstypes.Log{
+		Address: Address,
+		Topics:  []common.Hash{event.ID, common.BytesToHash(registrant.Bytes()), common.BigToHash(scheme)},
+		Data:    data,
+	}
+}
+
+// touch makes sure the registry account isn't empty, so that its storage
+// isn't discarded with it
+func touch(state StateDB) {
+	if state.GetNonce(Address) == 0 {
+		state.SetNonce(Address, 1)
+	}
+}
+
+// MetaAddressOf returns the meta-address a registrant registered for a
+// scheme, or nil if there is none
+func MetaAddressOf(state StateReader, registrant common.Address, scheme *big.Int) []byte {
+	base := metaAddressBase(registrant, scheme)
+	length := state.GetState(Address, base).Big()
+	if length.Sign() == 0 || length.Cmp(big.NewInt(96)) > 0 {
+		return nil
+	}
+	metaAddress := make([]byte, 0, 96)
+	for i := 0; i*32 < int(length.Int64()); i++ {
+		chunk := state.GetState(Address, chunkSlot(base, i))
+		metaAddress = append(metaAddress, chunk[:]...)
+	}
+	return metaAddress[:length.Int64()]
+}
+
+// NonceOf returns the nonce a registrant's next registration signed on its
+// behalf must carry
+func NonceOf(state StateReader, registrant common.Address) uint64 {
+	return state.GetState(Address, nonceSlot(registrant)).Big().Uint64()
+}
+
+// setNonce sets the registration nonce of a registrant
+func setNonce(state StateDB, registrant common.Address, nonce uint64) {
+	touch(state)
+	state.SetState(Address, nonceSlot(registrant), common.BigToHash(new(big.Int).SetUint64(nonce)))
+}
+
+// metaAddressBase returns the slot holding the length of a registrant's
+// meta-address for a scheme
+func metaAddressBase(registrant common.Address, scheme *big.Int) common.Hash {
+	return crypto.Keccak256Hash(common.LeftPadBytes(registrant.Bytes(), 32), common.BigToHash(scheme).Bytes())
+}
+
+// chunkSlot returns the slot holding the i-th 32 bytes of a meta-address
+func chunkSlot(base common.Hash, i int) common.Hash {
+	slot := crypto.Keccak256Hash(base.Bytes()).Big()
+	return common.BigToHash(slot.Add(slot, big.NewInt(int64(i))))
+}
+
+// nonceSlot returns the slot holding a registrant's registration nonce
+func nonceSlot(registrant common.Address) common.Hash {
+	return crypto.Keccak256Hash(common.LeftPadBytes(registrant.Bytes(), 32))
+}
+
+// domainSeparator returns the EIP-712 domain of the registry on a chain
+func domainSeparator(chainID *big.Int) common.Hash {
+	return crypto.Keccak256Hash(
+		domainTypeHash.Bytes(),
+		crypto.Keccak256([]byte("ERC6538Registry")),
+		crypto.Keccak256([]byte("1.0")),
+		common.BigToHash(chainID).Bytes(),
+		common.LeftPadBytes(Address.Bytes(), 32),
+	)
+}
+
+// RegistrationHash returns the EIP-712 hash a registrant signs to have a
+// meta-address registered on its behalf. The nonce is the registrant's
+// current one, see NonceOf.
+func RegistrationHash(chainID, scheme *big.Int, metaAddress []byte, nonce uint64) common.Hash {
+	entry := crypto.Keccak256(
+		entryTypeHash.Bytes(),
+		common.BigToHash(scheme).Bytes(),
+		crypto.Keccak256(metaAddress),
+		common.BigToHash(new(big.Int).SetUint64(nonce)).Bytes(),
+	)
+	return crypto.Keccak256Hash([]byte("\x19\x01"), domainSeparator(chainID).Bytes(), entry)
+}
+
+// recoverSigner returns the account that signed a hash. Both the 0/1 and
+// the 27/28 recovery ids are accepted.
+func recoverSigner(hash common.Hash, sig []byte) (common.Address, error) {
+	if len(sig) != crypto.SignatureLength {
+		return common.Address{}, ErrInvalidSignature
+	}
+	sig = common.CopyBytes(sig)
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+	pub, err := crypto.SigToPub(hash.Bytes(), sig)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return crypto.PubkeyToAddress(*pub), nil
+}
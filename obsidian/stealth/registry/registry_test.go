@@ -0,0 +1,155 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package registry
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	obsstate "github.com/obsidian-chain/obsidian/core/state"
+	"github.com/obsidian-chain/obsidian/stealth"
+)
+
+var (
+	chainID = big.NewInt(1719)
+	scheme  = big.NewInt(SchemeSecp256k1)
+)
+
+// newMetaAddress returns the raw bytes of a fresh meta-address
+func newMetaAddress(t *testing.T) []byte {
+	t.Helper()
+
+	keys, err := stealth.GenerateStealthKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys.MetaAddress().Bytes()
+}
+
+// call packs a registry call and runs it
+func call(t *testing.T, state StateDB, caller common.Address, method string, args ...interface{}) ([]byte, error) {
+	t.Helper()
+
+	input, err := ABI.Pack(method, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _, err := Run(state, chainID, caller, input)
+	return out, err
+}
+
+func TestRegister(t *testing.T) {
+	var (
+		state   = obsstate.NewMemoryStateDB()
+		account = common.Address{0x01}
+		meta    = newMetaAddress(t)
+	)
+	input, _ := ABI.Pack("registerKeys", scheme, meta)
+	_, logs, err := Run(state, chainID, account, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(MetaAddressOf(state, account, scheme), meta) {
+		t.Fatal("registered meta-address not found")
+	}
+	if MetaAddressOf(state, common.Address{0x02}, scheme) != nil {
+		t.Fatal("meta-address found for an account that registered none")
+	}
+	event := ABI.Events["StealthMetaAddressSet"]
+	if len(logs) != 1 || logs[0].Address != Address || len(logs[0].Topics) != 3 ||
+		logs[0].Topics[0] != event.ID || logs[0].Topics[1] != common.BytesToHash(account[:]) {
+		t.Fatalf("unexpected logs %+v", logs)
+	}
+	if values, err := event.Inputs.NonIndexed().Unpack(logs[0].Data); err != nil || !bytes.Equal(values[0].([]byte), meta) {
+		t.Fatalf("event carries the wrong meta-address, err %v", err)
+	}
+
+	// Updating replaces the meta-address, and views read it back
+	meta = newMetaAddress(t)
+	if _, err := call(t, state, account, "registerKeys", scheme, meta); err != nil {
+		t.Fatal(err)
+	}
+	out, err := call(t, state, common.Address{}, "stealthMetaAddressOf", account, scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values, err := ABI.Unpack("stealthMetaAddressOf", out); err != nil || !bytes.Equal(values[0].([]byte), meta) {
+		t.Fatalf("view returned the wrong meta-address, err %v", err)
+	}
+
+	// Malformed registrations are rejected
+	if _, err := call(t, state, account, "registerKeys", big.NewInt(2), meta); err != ErrUnsupportedScheme {
+		t.Fatalf("registered an unknown scheme, err %v", err)
+	}
+	if _, err := call(t, state, account, "registerKeys", scheme, meta[:33]); err != ErrInvalidMetaAddress {
+		t.Fatalf("registered a truncated meta-address, err %v", err)
+	}
+	if _, _, err := Run(state, chainID, account, []byte{1, 2, 3, 4}); err != ErrUnknownMethod {
+		t.Fatalf("ran an unknown method, err %v", err)
+	}
+
+	// The registry account must survive the removal of empty accounts
+	state.Finalise(true)
+	if !bytes.Equal(MetaAddressOf(state, account, scheme), meta) {
+		t.Fatal("registry storage dropped with an empty account")
+	}
+}
+
+func TestRegisterOnBehalf(t *testing.T) {
+	var (
+		state      = obsstate.NewMemoryStateDB()
+		key, _     = crypto.GenerateKey()
+		registrant = crypto.PubkeyToAddress(key.PublicKey)
+		relayer    = common.Address{0xee}
+		meta       = newMetaAddress(t)
+	)
+	sign := func(meta []byte, nonce uint64) []byte {
+		sig, err := crypto.Sign(RegistrationHash(chainID, scheme, meta, nonce).Bytes(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig[crypto.RecoveryIDOffset] += 27
+		return sig
+	}
+	sig := sign(meta, 0)
+	if _, err := call(t, state, relayer, "registerKeysOnBehalf", registrant, scheme, sig, meta); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(MetaAddressOf(state, registrant, scheme), meta) || MetaAddressOf(state, relayer, scheme) != nil {
+		t.Fatal("meta-address not registered for the registrant")
+	}
+	if NonceOf(state, registrant) != 1 {
+		t.Fatalf("nonce %d after a registration, want 1", NonceOf(state, registrant))
+	}
+
+	// Signatures can't be replayed, used for another meta-address or forged
+	if _, err := call(t, state, relayer, "registerKeysOnBehalf", registrant, scheme, sig, meta); err != ErrInvalidSignature {
+		t.Fatalf("replayed a registration, err %v", err)
+	}
+	if _, err := call(t, state, relayer, "registerKeysOnBehalf", registrant, scheme, sign(meta, 1), newMetaAddress(t)); err != ErrInvalidSignature {
+		t.Fatalf("registered a meta-address that wasn't signed, err %v", err)
+	}
+	if _, err := call(t, state, relayer, "registerKeysOnBehalf", relayer, scheme, sign(meta, 0), meta); err != ErrInvalidSignature {
+		t.Fatalf("registered for an account that didn't sign, err %v", err)
+	}
+
+	// Bumping the nonce revokes outstanding signatures
+	pending := sign(meta, 1)
+	if _, err := call(t, state, registrant, "incrementNonce"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := call(t, state, relayer, "registerKeysOnBehalf", registrant, scheme, pending, meta); err != ErrInvalidSignature {
+		t.Fatalf("used a revoked signature, err %v", err)
+	}
+	out, err := call(t, state, relayer, "nonceOf", registrant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values, err := ABI.Unpack("nonceOf", out); err != nil || values[0].(*big.Int).Uint64() != 2 {
+		t.Fatalf("view returned nonce %v, want 2, err %v", values, err)
+	}
+}
@@ -6,16 +6,53 @@ package stealth
 import (
 	"context"
 	"crypto/ecdsa"
+	"errors"
 	"math/big"
+	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
 )
 
-// Scanner scans the blockchain for stealth payments to the owner
+const (
+	// maxReorgDepth is the number of recently scanned blocks a scanner keeps
+	// the hashes of, to find where the chain forked after a reorg
+	maxReorgDepth = 128
+
+	// paymentConfirmations is the number of blocks on top of a payment after
+	// which it is considered final
+	paymentConfirmations = 12
+
+	// checkpointBlocks is the number of blocks a persistent scanner scans
+	// without finding payments before saving its progress
+	checkpointBlocks = 1024
+)
+
+var (
+	// ErrPaymentNotFound is returned for payments the scanner doesn't know
+	ErrPaymentNotFound = errors.New("stealth payment not found")
+
+	// ErrWatchOnly is returned when a watch-only scanner is asked for keys
+	ErrWatchOnly = errors.New("watch-only scanner has no spend key")
+
+	// errChainChanged is returned when the chain reorganises under a scan
+	errChainChanged = errors.New("chain reorganised during scan")
+
+	// scannerSeq numbers the scanners in creation order
+	scannerSeq atomic.Uint64
+)
+
+// Scanner scans the blockchain for stealth payments to the owner. A scanner
+// created with NewPersistentScanner saves its progress and payments, so that
+// it resumes where it stopped after a restart. Payments don't carry their
+// stealth private keys, PaymentKey derives them when needed.
 type Scanner struct {
-	mu sync.RWMutex
+	mu     sync.RWMutex
+	syncMu sync.Mutex // Serialises Sync calls
+	seq    uint64     // Creation order, fixing the order syncMu is taken in
 
 	// Keys for scanning
 	viewPrivKey  *ecdsa.PrivateKey
@@ -24,58 +61,270 @@ type Scanner struct {
 
 	// Detected payments
 	payments []*StealthPayment
+	byTx     map[common.Hash]*StealthPayment
 
 	// Scanning state
-	lastScannedBlock uint64
+	recent []blockRef // Recently scanned blocks, the last one being the newest
+
+	store   *scanStore // Nil for scanners kept in memory
+	unsaved int        // Blocks scanned since the state was last saved
 }
 
-// NewScanner creates a new stealth address scanner
+// NewScanner creates a new stealth address scanner keeping its state in memory
 func NewScanner(viewPrivKey, spendPrivKey *ecdsa.PrivateKey) *Scanner {
+	s := NewWatchOnlyScanner(viewPrivKey, &spendPrivKey.PublicKey)
+	s.spendPrivKey = spendPrivKey
+	return s
+}
+
+// NewWatchOnlyScanner creates a scanner that finds payments with the view key
+// alone. It can't derive the keys spending them.
+func NewWatchOnlyScanner(viewPrivKey *ecdsa.PrivateKey, spendPubKey *ecdsa.PublicKey) *Scanner {
 	return &Scanner{
-		viewPrivKey:  viewPrivKey,
-		spendPrivKey: spendPrivKey,
-		spendPubKey:  &spendPrivKey.PublicKey,
-		payments:     make([]*StealthPayment, 0),
+		seq:         scannerSeq.Add(1),
+		viewPrivKey: viewPrivKey,
+		spendPubKey: spendPubKey,
+		payments:    make([]*StealthPayment, 0),
+		byTx:        make(map[common.Hash]*StealthPayment),
+	}
+}
+
+// NewPersistentScanner creates a scanner whose state is stored encrypted in
+// dir, picking up the state left there by a previous scanner with the same keys
+func NewPersistentScanner(dir string, viewPrivKey, spendPrivKey *ecdsa.PrivateKey) (*Scanner, error) {
+	s := NewScanner(viewPrivKey, spendPrivKey)
+	if err := s.openStore(dir); err != nil {
+		return nil, err
 	}
+	return s, nil
+}
+
+// NewPersistentWatchOnlyScanner is the watch-only counterpart of
+// NewPersistentScanner. Both share the state of the same keys.
+func NewPersistentWatchOnlyScanner(dir string, viewPrivKey *ecdsa.PrivateKey, spendPubKey *ecdsa.PublicKey) (*Scanner, error) {
+	s := NewWatchOnlyScanner(viewPrivKey, spendPubKey)
+	if err := s.openStore(dir); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// openStore loads the state stored in dir and keeps saving it there
+func (s *Scanner) openStore(dir string) error {
+	store, err := openScanStore(dir, s.viewPrivKey, s.spendPubKey)
+	if err != nil {
+		return err
+	}
+	state, err := store.load()
+	if err != nil {
+		return err
+	}
+	s.store = store
+	if state != nil {
+		s.recent = state.Recent
+		s.payments = state.Payments
+		for _, p := range s.payments {
+			s.byTx[p.TxHash] = p
+		}
+	}
+	return nil
 }
 
 // ScanBlock scans a block for stealth payments
 // stealthTxs should be a list of stealth transaction data from the block
 func (s *Scanner) ScanBlock(blockNumber uint64, stealthTxs []StealthTxData) []*StealthPayment {
+	found, err := s.ProcessBlock(blockNumber, common.Hash{}, stealthTxs)
+	if err != nil {
+		log.Warn("Failed to save stealth scan state", "block", blockNumber, "err", err)
+	}
+	return found
+}
+
+// ProcessBlock scans the block with the given number and hash for stealth
+// payments and returns the new ones. Rescanning a block finds nothing new.
+// The error reports a failure to save the state, the scan itself succeeded.
+func (s *Scanner) ProcessBlock(blockNumber uint64, blockHash common.Hash, stealthTxs []StealthTxData) ([]*StealthPayment, error) {
+	var (
+		set  = newScanSet([]*Scanner{s})
+		ours []StealthTxData
+	)
+	for i := range stealthTxs {
+		if len(set.match(&stealthTxs[i], nil)) > 0 {
+			ours = append(ours, stealthTxs[i])
+		}
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	var found []*StealthPayment
-
-	for _, tx := range stealthTxs {
-		// Quick view tag filter
-		if !s.checkViewTag(tx.EphemeralPubKey, tx.ViewTag) {
-			continue
-		}
+	found := s.record(blockNumber, blockHash, ours, nil)
+	if len(found) > 0 || s.unsaved >= checkpointBlocks {
+		return found, s.save()
+	}
+	return found, nil
+}
 
-		// Full address derivation check
-		isOurs, privKey, stealthAddr := s.checkAndDerive(tx.EphemeralPubKey, tx.ToAddress)
-		if !isOurs {
+// record adds the payments to the scanner found in a block to found and marks
+// the block scanned. It must be called with the lock held.
+func (s *Scanner) record(blockNumber uint64, blockHash common.Hash, ours []StealthTxData, found []*StealthPayment) []*StealthPayment {
+	for _, tx := range ours {
+		if payment, ok := s.byTx[tx.TxHash]; ok {
+			if payment.BlockHash == blockHash {
+				continue
+			}
+			// Included again in another block
+			payment.BlockNumber, payment.BlockHash = blockNumber, blockHash
+			if payment.Status != PaymentSpent {
+				payment.Status = PaymentPending
+			}
+			found = append(found, copyPayment(payment))
 			continue
 		}
-
 		payment := &StealthPayment{
 			TxHash:          tx.TxHash,
 			BlockNumber:     blockNumber,
-			StealthAddress:  stealthAddr,
+			StealthAddress:  tx.ToAddress,
 			EphemeralPubKey: tx.EphemeralPubKey,
 			Amount:          tx.Amount,
-			PrivateKey:      privKey,
+			BlockHash:       blockHash,
+			Asset:           tx.Asset,
+			Unverified:      !tx.Asset.Verified(),
 		}
-
-		found = append(found, payment)
 		s.payments = append(s.payments, payment)
+		s.byTx[payment.TxHash] = payment
+		found = append(found, copyPayment(payment))
 	}
 
-	s.lastScannedBlock = blockNumber
+	if last, ok := s.lastBlock(); !ok || blockNumber > last.Number {
+		s.recent = append(s.recent, blockRef{Number: blockNumber, Hash: blockHash})
+		if len(s.recent) > maxReorgDepth {
+			s.recent = append(s.recent[:0], s.recent[len(s.recent)-maxReorgDepth:]...)
+		}
+		s.confirm(blockNumber)
+	}
+	s.unsaved++
 	return found
 }
 
+// lastBlock returns the newest scanned block. It must be called with the
+// lock held.
+func (s *Scanner) lastBlock() (blockRef, bool) {
+	if len(s.recent) == 0 {
+		return blockRef{}, false
+	}
+	return s.recent[len(s.recent)-1], true
+}
+
+// confirm marks the pending payments buried deep enough under head as
+// confirmed. It must be called with the lock held.
+func (s *Scanner) confirm(head uint64) {
+	for _, p := range s.payments {
+		if p.Status == PaymentPending && p.BlockNumber+paymentConfirmations <= head {
+			p.Status = PaymentConfirmed
+		}
+	}
+}
+
+// save writes the state of a persistent scanner. It must be called with the
+// lock held.
+func (s *Scanner) save() error {
+	if s.store == nil {
+		return nil
+	}
+	if err := s.store.save(&scanState{Recent: s.recent, Payments: s.payments}); err != nil {
+		return err
+	}
+	s.unsaved = 0
+	return nil
+}
+
+// Flush saves the progress made since the state was last saved
+func (s *Scanner) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.unsaved == 0 {
+		return nil
+	}
+	return s.save()
+}
+
+// Sync scans the canonical chain up to block to and returns the payments
+// found. It resumes after the last scanned block, or starts at from if the
+// scanner never scanned. Payments in blocks that were reorged out since they
+// were scanned are dropped first.
+func (s *Scanner) Sync(ctx context.Context, backend BlockchainBackend, from, to uint64) ([]*StealthPayment, error) {
+	found, err := syncAll(ctx, backend, []*Scanner{s}, from, to, nil)
+	return found[s], err
+}
+
+// resume finds the newest scanned block that is still canonical, rolls the
+// scanner back to it and returns the number of the block to scan next. Any
+// block known to be canonical vouches for its ancestors, so besides recent
+// blocks, those of the payments are checked too. If none of them survived,
+// scanning starts over at from.
+func (s *Scanner) resume(ctx context.Context, backend BlockchainBackend, from uint64) (uint64, error) {
+	s.mu.RLock()
+	var refs []blockRef
+	for i := len(s.recent) - 1; i >= 0; i-- {
+		refs = append(refs, s.recent[i])
+	}
+	for i := len(s.payments) - 1; i >= 0; i-- {
+		refs = append(refs, blockRef{Number: s.payments[i].BlockNumber, Hash: s.payments[i].BlockHash})
+	}
+	s.mu.RUnlock()
+
+	if len(refs) == 0 {
+		return from, nil
+	}
+	sort.SliceStable(refs, func(i, j int) bool { return refs[i].Number > refs[j].Number })
+	for i, ref := range refs {
+		hash, _, err := backend.GetBlockHashes(ctx, ref.Number)
+		if err != nil {
+			return 0, err
+		}
+		if hash == ref.Hash {
+			if i > 0 {
+				return ref.Number + 1, s.rewind(ref)
+			}
+			return ref.Number + 1, nil
+		}
+	}
+	log.Warn("Stealth scan state not on the canonical chain, rescanning", "from", from)
+	return from, s.rewind(blockRef{})
+}
+
+// rewind drops the payments and scanned blocks above a canonical block, or
+// everything when given the zero block
+func (s *Scanner) rewind(ref blockRef) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keep := func(number uint64) bool { return ref.Hash != (common.Hash{}) && number <= ref.Number }
+
+	payments := s.payments[:0]
+	for _, p := range s.payments {
+		if keep(p.BlockNumber) {
+			payments = append(payments, p)
+			continue
+		}
+		log.Info("Stealth payment reorged out", "tx", p.TxHash, "block", p.BlockNumber)
+		delete(s.byTx, p.TxHash)
+	}
+	s.payments = payments
+
+	recent := s.recent[:0]
+	for _, r := range s.recent {
+		if keep(r.Number) {
+			recent = append(recent, r)
+		}
+	}
+	if ref.Hash != (common.Hash{}) && (len(recent) == 0 || recent[len(recent)-1] != ref) {
+		recent = append(recent, ref)
+	}
+	s.recent = recent
+	return s.save()
+}
+
 // StealthTxData represents the stealth-specific data from a transaction
 type StealthTxData struct {
 	TxHash          common.Hash
@@ -83,44 +332,41 @@ type StealthTxData struct {
 	EphemeralPubKey []byte
 	ViewTag         byte
 	Amount          string
+	Asset           Asset
 }
 
-// checkViewTag performs a quick view tag check
-func (s *Scanner) checkViewTag(ephemeralPubKey []byte, viewTag byte) bool {
-	ephPubKey, err := DecompressPublicKey(ephemeralPubKey)
-	if err != nil {
-		return false
+// PaymentKey derives the private key controlling a payment's stealth address
+func (s *Scanner) PaymentKey(payment *StealthPayment) (*ecdsa.PrivateKey, error) {
+	if s.spendPrivKey == nil {
+		return nil, ErrWatchOnly
 	}
-
-	sharedSecret := SharedSecret(s.viewPrivKey, ephPubKey)
-	computedTag := computeViewTag(sharedSecret)
-
-	return computedTag == viewTag
-}
-
-// checkAndDerive checks if we're the recipient and derives the private key
-func (s *Scanner) checkAndDerive(ephemeralPubKey []byte, expectedAddr common.Address) (bool, *ecdsa.PrivateKey, common.Address) {
-	ephPubKey, err := DecompressPublicKey(ephemeralPubKey)
+	key, addr, err := DeriveStealthAddressPrivateKey(s.viewPrivKey, s.spendPrivKey, payment.EphemeralPubKey)
 	if err != nil {
-		return false, nil, common.Address{}
+		return nil, err
 	}
+	if addr != payment.StealthAddress {
+		return nil, ErrNotRecipient
+	}
+	return key, nil
+}
 
-	// Compute shared secret
-	sharedSecret := SharedSecret(s.viewPrivKey, ephPubKey)
-
-	// Derive stealth public key
-	stealthPubKey := DeriveStealthPublicKey(s.spendPubKey, sharedSecret)
-	derivedAddr := PublicKeyToAddress(stealthPubKey)
+// MarkSpent records that the owner swept the payment made in a transaction
+func (s *Scanner) MarkSpent(txHash common.Hash) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// Check if address matches
-	if derivedAddr != expectedAddr {
-		return false, nil, common.Address{}
+	payment, ok := s.byTx[txHash]
+	if !ok {
+		return ErrPaymentNotFound
 	}
+	payment.Status = PaymentSpent
+	return s.save()
+}
 
-	// Derive private key
-	stealthPrivKey := DeriveStealthPrivateKey(s.spendPrivKey, sharedSecret)
-
-	return true, stealthPrivKey, derivedAddr
+// copyPayment returns a copy of a payment that is safe to hand out
+func copyPayment(p *StealthPayment) *StealthPayment {
+	cpy := *p
+	return &cpy
 }
 
 // computeViewTag computes the view tag from shared secret
@@ -141,7 +387,9 @@ func (s *Scanner) GetPayments() []*StealthPayment {
 	defer s.mu.RUnlock()
 
 	result := make([]*StealthPayment, len(s.payments))
-	copy(result, s.payments)
+	for i, p := range s.payments {
+		result[i] = copyPayment(p)
+	}
 	return result
 }
 
@@ -153,7 +401,7 @@ func (s *Scanner) GetPaymentsByAddress(addr common.Address) []*StealthPayment {
 	var result []*StealthPayment
 	for _, p := range s.payments {
 		if p.StealthAddress == addr {
-			result = append(result, p)
+			result = append(result, copyPayment(p))
 		}
 	}
 	return result
@@ -163,22 +411,58 @@ func (s *Scanner) GetPaymentsByAddress(addr common.Address) []*StealthPayment {
 func (s *Scanner) LastScannedBlock() uint64 {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.lastScannedBlock
+
+	last, _ := s.lastBlock()
+	return last.Number
 }
 
-// TotalBalance calculates the total balance of all detected payments
+// TotalBalance calculates the total OBS balance of the detected payments
+// that haven't been spent
 func (s *Scanner) TotalBalance() *big.Int {
+	return s.Balances()[NativeAsset]
+}
+
+// Balances calculates the balance of every verified asset among the detected
+// payments that haven't been spent. OBS is always included.
+func (s *Scanner) Balances() map[Asset]*big.Int {
+	balances := s.balances(true)
+	if balances[NativeAsset] == nil {
+		balances[NativeAsset] = new(big.Int)
+	}
+	return balances
+}
+
+// UnverifiedBalances calculates the balance of every asset the chain doesn't
+// check the transfer of, such as tokens, among the detected payments that
+// haven't been spent. They are what the payments claim, the tokens may never
+// have been transferred. Non-fungible tokens count the tokens held.
+func (s *Scanner) UnverifiedBalances() map[Asset]*big.Int {
+	return s.balances(false)
+}
+
+// balances sums the unspent payments of the verified or unverified assets
+func (s *Scanner) balances(verified bool) map[Asset]*big.Int {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	total := big.NewInt(0)
+	balances := make(map[Asset]*big.Int)
 	for _, p := range s.payments {
+		if p.Status == PaymentSpent || p.Asset.Verified() != verified {
+			continue
+		}
 		amount, ok := new(big.Int).SetString(p.Amount, 10)
-		if ok {
-			total.Add(total, amount)
+		if !ok {
+			continue
+		}
+		if p.Asset.Standard == ERC721Standard {
+			amount.SetInt64(1)
+		}
+		if balances[p.Asset] == nil {
+			balances[p.Asset] = new(big.Int)
 		}
+		balances[p.Asset].Add(balances[p.Asset], amount)
 	}
-	return total
+	return balances
 }
 
 // BlockScanner provides a higher-level interface for continuous scanning
@@ -194,8 +478,11 @@ type BlockScanner struct {
 type BlockchainBackend interface {
 	// GetStealthTransactions returns stealth transactions in a block
 	GetStealthTransactions(ctx context.Context, blockNumber uint64) ([]StealthTxData, error)
-	// CurrentBlock returns the current block number
-	CurrentBlock(ctx context.Context) (uint64, error)
+	// GetBlockHashes returns the hashes of the canonical block with the given
+	// number and of its parent, or zero hashes if there is no such block
+	GetBlockHashes(ctx context.Context, blockNumber uint64) (common.Hash, common.Hash, error)
+	// CurrentBlockNumber returns the current block number
+	CurrentBlockNumber(ctx context.Context) (uint64, error)
 	// SubscribeNewBlocks subscribes to new block events
 	SubscribeNewBlocks(ctx context.Context, ch chan<- uint64) error
 }
@@ -209,7 +496,8 @@ func NewBlockScanner(scanner *Scanner, backend BlockchainBackend) *BlockScanner
 	}
 }
 
-// Start starts continuous scanning
+// Start starts continuous scanning from startBlock, or from where the
+// scanner stopped if it scanned before
 func (bs *BlockScanner) Start(ctx context.Context, startBlock uint64) error {
 	bs.wg.Add(1)
 	go bs.scanLoop(ctx, startBlock)
@@ -226,7 +514,6 @@ func (bs *BlockScanner) Stop() {
 func (bs *BlockScanner) scanLoop(ctx context.Context, startBlock uint64) {
 	defer bs.wg.Done()
 
-	currentBlock := startBlock
 	newBlocks := make(chan uint64, 10)
 
 	// Subscribe to new blocks
@@ -240,14 +527,9 @@ func (bs *BlockScanner) scanLoop(ctx context.Context, startBlock uint64) {
 			return
 		case newBlock := <-newBlocks:
 			// Scan any missed blocks
-			for b := currentBlock; b <= newBlock; b++ {
-				txs, err := bs.backend.GetStealthTransactions(ctx, b)
-				if err != nil {
-					continue
-				}
-				bs.scanner.ScanBlock(b, txs)
+			if _, err := bs.scanner.Sync(ctx, bs.backend, startBlock, newBlock); err != nil {
+				log.Warn("Stealth scan failed", "block", newBlock, "err", err)
 			}
-			currentBlock = newBlock + 1
 		}
 	}
 }
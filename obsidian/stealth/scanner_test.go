@@ -0,0 +1,325 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of Obsidian.
+
+package stealth
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// testBlock is a block of the fake chain
+type testBlock struct {
+	hash   common.Hash
+	parent common.Hash
+	txs    []StealthTxData
+}
+
+// testChain is a BlockchainBackend whose canonical chain can be rewritten
+type testChain struct {
+	blocks []testBlock
+}
+
+// newTestChain creates a chain of empty blocks up to head
+func newTestChain(head uint64) *testChain {
+	c := new(testChain)
+	c.extend(head, 0)
+	return c
+}
+
+// extend appends empty blocks up to head, the fork byte making their hashes
+// differ from the blocks they replace
+func (c *testChain) extend(head uint64, fork byte) {
+	for n := uint64(len(c.blocks)); n <= head; n++ {
+		block := testBlock{hash: common.Hash{fork, byte(n >> 8), byte(n), 0xff}}
+		if n > 0 {
+			block.parent = c.blocks[n-1].hash
+		}
+		c.blocks = append(c.blocks, block)
+	}
+}
+
+// fork rewrites the chain from number on up to head
+func (c *testChain) fork(number, head uint64, fork byte) {
+	c.blocks = c.blocks[:number]
+	c.extend(head, fork)
+}
+
+// pay adds a payment to the recipient in a block
+func (c *testChain) pay(t testing.TB, number uint64, to *StealthKeyPair) StealthTxData {
+	t.Helper()
+
+	addr, err := GenerateStealthAddress(to.MetaAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hash common.Hash
+	rand.Read(hash[:])
+	tx := StealthTxData{
+		TxHash:          hash,
+		ToAddress:       addr.Address,
+		EphemeralPubKey: addr.EphemeralPubKey,
+		ViewTag:         addr.ViewTag,
+		Amount:          "1000",
+	}
+	c.blocks[number].txs = append(c.blocks[number].txs, tx)
+	return tx
+}
+
+func (c *testChain) GetStealthTransactions(ctx context.Context, blockNumber uint64) ([]StealthTxData, error) {
+	if blockNumber >= uint64(len(c.blocks)) {
+		return nil, nil
+	}
+	return c.blocks[blockNumber].txs, nil
+}
+
+func (c *testChain) GetBlockHashes(ctx context.Context, blockNumber uint64) (common.Hash, common.Hash, error) {
+	if blockNumber >= uint64(len(c.blocks)) {
+		return common.Hash{}, common.Hash{}, nil
+	}
+	return c.blocks[blockNumber].hash, c.blocks[blockNumber].parent, nil
+}
+
+func (c *testChain) CurrentBlockNumber(ctx context.Context) (uint64, error) {
+	return uint64(len(c.blocks) - 1), nil
+}
+
+func (c *testChain) SubscribeNewBlocks(ctx context.Context, ch chan<- uint64) error {
+	return nil
+}
+
+func newTestScanner(t *testing.T, dir string, keys *StealthKeyPair) *Scanner {
+	t.Helper()
+
+	s, err := NewPersistentScanner(dir, keys.ViewPrivateKey, keys.SpendPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestScannerPersistence(t *testing.T) {
+	keys, _ := GenerateStealthKeyPair()
+	chain := newTestChain(100)
+	tx := chain.pay(t, 40, keys)
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	s := newTestScanner(t, dir, keys)
+	if found, err := s.Sync(ctx, chain, 0, 60); err != nil || len(found) != 1 {
+		t.Fatalf("found %d payments, err %v", len(found), err)
+	}
+
+	// A restarted scanner picks up where the last one stopped
+	s = newTestScanner(t, dir, keys)
+	if last := s.LastScannedBlock(); last != 60 {
+		t.Fatalf("resumed at block %d, want 60", last)
+	}
+	payments := s.GetPayments()
+	if len(payments) != 1 || payments[0].TxHash != tx.TxHash || payments[0].Status != PaymentConfirmed {
+		t.Fatalf("unexpected payments after restart: %+v", payments)
+	}
+	if found, err := s.Sync(ctx, chain, 0, 100); err != nil || len(found) != 0 {
+		t.Fatalf("found %d payments again, err %v", len(found), err)
+	}
+
+	// Keys are derived on demand and never stored
+	key, err := s.PaymentKey(payments[0])
+	if err != nil || crypto.PubkeyToAddress(key.PublicKey) != tx.ToAddress {
+		t.Fatalf("derived wrong payment key, err %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, PublicKeyToAddress(&keys.SpendPrivateKey.PublicKey).Hex()+".scan"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range [][]byte{crypto.FromECDSA(key), tx.ToAddress[:], tx.TxHash[:]} {
+		if bytes.Contains(data, secret) {
+			t.Fatal("scan store leaks payment data in plaintext")
+		}
+	}
+
+	// Other keys can't read the state
+	other, _ := GenerateStealthKeyPair()
+	if _, err := NewPersistentScanner(dir, other.ViewPrivateKey, keys.SpendPrivateKey); err != ErrScanStoreCorrupt {
+		t.Fatalf("opened store with the wrong view key, err %v", err)
+	}
+}
+
+func TestScannerTokenBalances(t *testing.T) {
+	keys, _ := GenerateStealthKeyPair()
+	chain := newTestChain(30)
+	var (
+		usd = Asset{ERC20Standard, common.Address{0x20}}
+		nft = Asset{ERC721Standard, common.Address{0x72}}
+	)
+	chain.pay(t, 3, keys)
+	for i, asset := range []Asset{usd, usd, nft, nft} {
+		chain.pay(t, uint64(10+i), keys)
+		tx := &chain.blocks[10+i].txs[0]
+		tx.Asset, tx.Amount = asset, "7"
+	}
+	dir := t.TempDir()
+	if _, err := newTestScanner(t, dir, keys).Sync(context.Background(), chain, 0, 30); err != nil {
+		t.Fatal(err)
+	}
+
+	// Balances are kept per asset, and survive a restart. Token payments are
+	// kept apart as unverified.
+	scanner := newTestScanner(t, dir, keys)
+	if balances := scanner.Balances(); len(balances) != 1 || balances[NativeAsset].String() != "1000" {
+		t.Fatalf("verified balances %v, want 1000 OBS only", balances)
+	}
+	balances := scanner.UnverifiedBalances()
+	want := map[Asset]string{usd: "14", nft: "2"}
+	if len(balances) != len(want) {
+		t.Fatalf("unverified balances of %d assets, want %d", len(balances), len(want))
+	}
+	for asset, balance := range want {
+		if balances[asset] == nil || balances[asset].String() != balance {
+			t.Errorf("%v balance %v, want %s", asset, balances[asset], balance)
+		}
+	}
+	for _, p := range scanner.GetPayments() {
+		if p.Unverified != !p.Asset.Verified() {
+			t.Errorf("payment of %v marked unverified: %v", p.Asset, p.Unverified)
+		}
+	}
+}
+
+func TestScannerReorg(t *testing.T) {
+	keys, _ := GenerateStealthKeyPair()
+	chain := newTestChain(50)
+	kept := chain.pay(t, 20, keys)
+	orphaned := chain.pay(t, 45, keys)
+	ctx := context.Background()
+
+	s := newTestScanner(t, t.TempDir(), keys)
+	if _, err := s.Sync(ctx, chain, 0, 50); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the blocks from 40 on, including one payment again elsewhere
+	chain.fork(40, 55, 1)
+	chain.blocks[48].txs = append(chain.blocks[48].txs, orphaned)
+
+	found, err := s.Sync(ctx, chain, 0, 55)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].TxHash != orphaned.TxHash || found[0].BlockNumber != 48 {
+		t.Fatalf("found %v after the reorg, want the payment in its new block", found)
+	}
+	if len(s.GetPayments()) != 2 {
+		t.Fatalf("%d payments after the reorg, want 2", len(s.GetPayments()))
+	}
+	if payments := s.GetPaymentsByAddress(kept.ToAddress); len(payments) != 1 || payments[0].BlockNumber != 20 {
+		t.Fatalf("payment duplicated or moved: %+v", payments)
+	}
+	if last := s.LastScannedBlock(); last != 55 {
+		t.Fatalf("scanned up to %d, want 55", last)
+	}
+
+	// A fork right after genesis drops every payment
+	chain.fork(1, 55, 2)
+	chain.pay(t, 10, keys)
+	if found, err := s.Sync(ctx, chain, 0, 55); err != nil || len(found) != 1 || len(s.GetPayments()) != 1 {
+		t.Fatalf("found %d of %d payments after a deep reorg, err %v", len(found), len(s.GetPayments()), err)
+	}
+}
+
+func TestScannerSpent(t *testing.T) {
+	keys, _ := GenerateStealthKeyPair()
+	chain := newTestChain(10)
+	a, b := chain.pay(t, 5, keys), chain.pay(t, 6, keys)
+	dir := t.TempDir()
+
+	s := newTestScanner(t, dir, keys)
+	if _, err := s.Sync(context.Background(), chain, 0, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MarkSpent(a.TxHash); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MarkSpent(common.Hash{}); err != ErrPaymentNotFound {
+		t.Fatalf("marked an unknown payment spent, err %v", err)
+	}
+	s = newTestScanner(t, dir, keys)
+	if balance := s.TotalBalance(); balance.String() != b.Amount {
+		t.Fatalf("balance %v, want only the unspent payment", balance)
+	}
+	if p := s.GetPaymentsByAddress(a.ToAddress); len(p) != 1 || p[0].Status != PaymentSpent {
+		t.Fatal("spent status not persisted")
+	}
+}
+
+func TestServiceScanBlocks(t *testing.T) {
+	var (
+		chain   = newTestChain(200)
+		service = NewStealthService()
+		keys    []*StealthKeyPair
+		ids     []common.Address
+	)
+	service.SetBackend(chain)
+	for i := 0; i < 12; i++ {
+		k, _ := GenerateStealthKeyPair()
+		if i%3 == 2 {
+			// Merchants may share a view key across their spend keys
+			k.ViewPrivateKey, k.ViewPublicKey = keys[i-1].ViewPrivateKey, keys[i-1].ViewPublicKey
+		}
+		id, err := service.RegisterScanner(k.ViewPrivateKey, k.SpendPrivateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, ids = append(keys, k), append(ids, id)
+	}
+	want := make(map[common.Address]int)
+	for n := uint64(3); n <= 200; n += 7 {
+		i := int(n) % len(keys)
+		chain.pay(t, n, keys[i])
+		want[ids[i]]++
+	}
+
+	var last ScanProgress
+	results, err := service.ScanBlocksWithProgress(context.Background(), 1, 250, func(p ScanProgress) {
+		if p.Scanned <= last.Scanned {
+			t.Errorf("progress went from block %d to %d", last.Scanned, p.Scanned)
+		}
+		last = p
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Scanned != 200 || last.Payments != 29 {
+		t.Fatalf("last progress %+v, want 29 payments up to the head", last)
+	}
+	for i, id := range ids {
+		if len(results[id]) != want[id] {
+			t.Errorf("scanner %d found %d payments, want %d", i, len(results[id]), want[id])
+		}
+		for _, p := range results[id] {
+			if p.BlockNumber%7 != 3 || int(p.BlockNumber)%len(keys) != i {
+				t.Errorf("scanner %d credited with the payment in block %d", i, p.BlockNumber)
+			}
+		}
+	}
+
+	// Syncing at the head scans all the scanners together and finds nothing new
+	chain.extend(201, 0)
+	chain.pay(t, 201, keys[4])
+	if results, err := service.syncScanners(context.Background(), 201); err != nil || len(results) != 1 || len(results[ids[4]]) != 1 {
+		t.Fatalf("unexpected payments syncing the head: %v, err %v", results, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := service.ScanBlocks(ctx, 1, 200); err != context.Canceled {
+		t.Fatalf("cancelled scan returned %v", err)
+	}
+}
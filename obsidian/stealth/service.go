@@ -7,6 +7,7 @@ import (
 	"context"
 	"crypto/ecdsa"
 	"errors"
+	"math/big"
 	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -25,6 +26,7 @@ type StealthService struct {
 	mu       sync.RWMutex
 	scanners map[common.Address]*Scanner // keyed by spend public key address
 	backend  BlockchainBackend
+	dataDir  string // Where scanners keep their state, empty for memory
 
 	stopCh chan struct{}
 	wg     sync.WaitGroup
@@ -45,6 +47,13 @@ func (s *StealthService) SetBackend(backend BlockchainBackend) {
 	s.backend = backend
 }
 
+// SetDataDir makes scanners registered from now on keep their state in dir
+func (s *StealthService) SetDataDir(dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dataDir = dir
+}
+
 // RegisterScanner registers a new scanner for the given keys
 func (s *StealthService) RegisterScanner(viewPrivKey, spendPrivKey *ecdsa.PrivateKey) (common.Address, error) {
 	if viewPrivKey == nil || spendPrivKey == nil {
@@ -62,6 +71,12 @@ func (s *StealthService) RegisterScanner(viewPrivKey, spendPrivKey *ecdsa.Privat
 	}
 
 	scanner := NewScanner(viewPrivKey, spendPrivKey)
+	if s.dataDir != "" {
+		var err error
+		if scanner, err = NewPersistentScanner(s.dataDir, viewPrivKey, spendPrivKey); err != nil {
+			return scannerID, err
+		}
+	}
 	s.scanners[scannerID] = scanner
 
 	log.Info("Stealth scanner registered", "id", scannerID.Hex())
@@ -77,6 +92,9 @@ func (s *StealthService) UnregisterScanner(scannerID common.Address) error {
 		return ErrScannerNotFound
 	}
 
+	if err := s.scanners[scannerID].Flush(); err != nil {
+		log.Warn("Failed to save stealth scan state", "id", scannerID.Hex(), "err", err)
+	}
 	delete(s.scanners, scannerID)
 	log.Info("Stealth scanner unregistered", "id", scannerID.Hex())
 	return nil
@@ -108,42 +126,60 @@ func (s *StealthService) ListScanners() []common.Address {
 
 // ScanBlocks scans a range of blocks for all registered scanners
 func (s *StealthService) ScanBlocks(ctx context.Context, fromBlock, toBlock uint64) (map[common.Address][]*StealthPayment, error) {
-	s.mu.RLock()
-	backend := s.backend
-	scanners := make(map[common.Address]*Scanner, len(s.scanners))
-	for id, scanner := range s.scanners {
-		scanners[id] = scanner
-	}
-	s.mu.RUnlock()
+	return s.ScanBlocksWithProgress(ctx, fromBlock, toBlock, nil)
+}
 
+// ScanBlocksWithProgress scans a range of blocks for all registered scanners,
+// calling progress, if not nil, as batches of blocks get scanned. Blocks are
+// fetched and matched concurrently, each announcement being checked against
+// all the scanners at once. Cancelling the context stops the scan, the
+// payments found until then are returned with the error.
+func (s *StealthService) ScanBlocksWithProgress(ctx context.Context, fromBlock, toBlock uint64, progress func(ScanProgress)) (map[common.Address][]*StealthPayment, error) {
+	backend, ids, scanners := s.snapshot()
 	if backend == nil {
 		return nil, ErrBackendRequired
 	}
 
-	results := make(map[common.Address][]*StealthPayment)
-
-	for blockNum := fromBlock; blockNum <= toBlock; blockNum++ {
-		// Get stealth transactions from block
-		txs, err := backend.GetStealthTransactions(ctx, blockNum)
-		if err != nil {
-			log.Warn("Failed to get stealth txs", "block", blockNum, "err", err)
-			continue
+	var (
+		results  = make(map[common.Address][]*StealthPayment)
+		payments int
+	)
+	err := scanRange(ctx, backend, fromBlock, toBlock, newScanSet(scanners), func(blocks []*scanBlock) error {
+		for i, scanner := range scanners {
+			found, err := scanner.applyBlocks(blocks, i)
+			if err != nil {
+				log.Warn("Failed to save stealth scan state", "id", ids[i].Hex(), "err", err)
+			}
+			if len(found) > 0 {
+				results[ids[i]] = append(results[ids[i]], found...)
+				payments += len(found)
+			}
 		}
-
-		if len(txs) == 0 {
-			continue
+		if progress != nil {
+			progress(ScanProgress{From: fromBlock, To: toBlock, Scanned: blocks[len(blocks)-1].number, Payments: payments})
 		}
-
-		// Scan with each scanner
-		for id, scanner := range scanners {
-			payments := scanner.ScanBlock(blockNum, txs)
-			if len(payments) > 0 {
-				results[id] = append(results[id], payments...)
-			}
+		return nil
+	})
+	for i, scanner := range scanners {
+		if err := scanner.Flush(); err != nil {
+			log.Warn("Failed to save stealth scan state", "id", ids[i].Hex(), "err", err)
 		}
 	}
+	return results, err
+}
 
-	return results, nil
+// snapshot returns the backend and the registered scanners with their IDs
+func (s *StealthService) snapshot() (BlockchainBackend, []common.Address, []*Scanner) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := make([]common.Address, 0, len(s.scanners))
+	scanners := make([]*Scanner, 0, len(s.scanners))
+	for id, scanner := range s.scanners {
+		ids = append(ids, id)
+		scanners = append(scanners, scanner)
+	}
+	return s.backend, ids, scanners
 }
 
 // ScanSingleBlock scans a single block for all scanners
@@ -169,6 +205,35 @@ func (s *StealthService) GetTotalBalance(scannerID common.Address) (string, erro
 	return scanner.TotalBalance().String(), nil
 }
 
+// GetBalances returns the balance of every verified asset for a scanner,
+// keyed by the name of the asset
+func (s *StealthService) GetBalances(scannerID common.Address) (map[string]string, error) {
+	scanner, err := s.GetScanner(scannerID)
+	if err != nil {
+		return nil, err
+	}
+	return balanceStrings(scanner.Balances()), nil
+}
+
+// GetUnverifiedBalances returns what the token payments to a scanner claim to
+// transfer, keyed by the name of the asset
+func (s *StealthService) GetUnverifiedBalances(scannerID common.Address) (map[string]string, error) {
+	scanner, err := s.GetScanner(scannerID)
+	if err != nil {
+		return nil, err
+	}
+	return balanceStrings(scanner.UnverifiedBalances()), nil
+}
+
+// balanceStrings formats balances keyed by asset for JSON
+func balanceStrings(balances map[Asset]*big.Int) map[string]string {
+	out := make(map[string]string, len(balances))
+	for asset, balance := range balances {
+		out[asset.String()] = balance.String()
+	}
+	return out
+}
+
 // StartAutoScan starts automatic scanning for new blocks
 func (s *StealthService) StartAutoScan(ctx context.Context) error {
 	s.mu.RLock()
@@ -185,10 +250,18 @@ func (s *StealthService) StartAutoScan(ctx context.Context) error {
 	return nil
 }
 
-// Stop stops all scanning
+// Stop stops all scanning and saves the progress of the scanners
 func (s *StealthService) Stop() {
 	close(s.stopCh)
 	s.wg.Wait()
+
+	s.mu.RLock()
+	for id, scanner := range s.scanners {
+		if err := scanner.Flush(); err != nil {
+			log.Warn("Failed to save stealth scan state", "id", id.Hex(), "err", err)
+		}
+	}
+	s.mu.RUnlock()
 	log.Info("Stealth service stopped")
 }
 
@@ -215,7 +288,7 @@ func (s *StealthService) autoScanLoop(ctx context.Context) {
 		case <-s.stopCh:
 			return
 		case blockNum := <-newBlocks:
-			results, err := s.ScanSingleBlock(ctx, blockNum)
+			results, err := s.syncScanners(ctx, blockNum)
 			if err != nil {
 				log.Warn("Auto-scan failed", "block", blockNum, "err", err)
 				continue
@@ -229,6 +302,7 @@ func (s *StealthService) autoScanLoop(ctx context.Context) {
 						"tx", payment.TxHash.Hex(),
 						"address", payment.StealthAddress.Hex(),
 						"amount", payment.Amount,
+						"asset", payment.Asset,
 					)
 				}
 			}
@@ -236,13 +310,37 @@ func (s *StealthService) autoScanLoop(ctx context.Context) {
 	}
 }
 
+// syncScanners brings every scanner up to the given head block. Scanners
+// resume where they stopped, rolling back reorged payments, and new ones
+// start at the head. Scanners that stopped at the same block are scanned
+// together.
+func (s *StealthService) syncScanners(ctx context.Context, head uint64) (map[common.Address][]*StealthPayment, error) {
+	backend, ids, scanners := s.snapshot()
+	if backend == nil {
+		return nil, ErrBackendRequired
+	}
+	found, err := syncAll(ctx, backend, scanners, head, head, nil)
+	if err != nil {
+		log.Warn("Stealth scan failed", "head", head, "err", err)
+	}
+	results := make(map[common.Address][]*StealthPayment)
+	for i, scanner := range scanners {
+		if len(found[scanner]) > 0 {
+			results[ids[i]] = found[scanner]
+		}
+	}
+	return results, nil
+}
+
 // ScanResult represents the result of scanning for a specific scanner
 type ScanResult struct {
-	ScannerID   common.Address    `json:"scannerId"`
-	Payments    []*StealthPayment `json:"payments"`
-	TotalAmount string            `json:"totalAmount"`
-	BlocksFrom  uint64            `json:"blocksFrom"`
-	BlocksTo    uint64            `json:"blocksTo"`
+	ScannerID          common.Address    `json:"scannerId"`
+	Payments           []*StealthPayment `json:"payments"`
+	TotalAmount        string            `json:"totalAmount"`
+	Balances           map[string]string `json:"balances"`
+	UnverifiedBalances map[string]string `json:"unverifiedBalances"`
+	BlocksFrom         uint64            `json:"blocksFrom"`
+	BlocksTo           uint64            `json:"blocksTo"`
 }
 
 // ScanForPayments is a convenience method that scans blocks and returns results
@@ -261,23 +359,25 @@ func (s *StealthService) ScanForPayments(ctx context.Context, scannerID common.A
 	}
 
 	var newPayments []*StealthPayment
-
-	for blockNum := fromBlock; blockNum <= toBlock; blockNum++ {
-		txs, err := backend.GetStealthTransactions(ctx, blockNum)
-		if err != nil {
-			continue
-		}
-		if len(txs) > 0 {
-			payments := scanner.ScanBlock(blockNum, txs)
-			newPayments = append(newPayments, payments...)
-		}
+	err = scanRange(ctx, backend, fromBlock, toBlock, newScanSet([]*Scanner{scanner}), func(blocks []*scanBlock) error {
+		payments, err := scanner.applyBlocks(blocks, 0)
+		newPayments = append(newPayments, payments...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := scanner.Flush(); err != nil {
+		return nil, err
 	}
 
 	return &ScanResult{
-		ScannerID:   scannerID,
-		Payments:    newPayments,
-		TotalAmount: scanner.TotalBalance().String(),
-		BlocksFrom:  fromBlock,
-		BlocksTo:    toBlock,
+		ScannerID:          scannerID,
+		Payments:           newPayments,
+		TotalAmount:        scanner.TotalBalance().String(),
+		Balances:           balanceStrings(scanner.Balances()),
+		UnverifiedBalances: balanceStrings(scanner.UnverifiedBalances()),
+		BlocksFrom:         fromBlock,
+		BlocksTo:           toBlock,
 	}, nil
 }
@@ -4,6 +4,11 @@
 package stealth
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"runtime"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -77,6 +82,30 @@ func TestParseMetaAddress(t *testing.T) {
 	}
 }
 
+func TestParseEthereumMetaAddress(t *testing.T) {
+	keyPair, _ := GenerateStealthKeyPair()
+	meta := keyPair.MetaAddress()
+
+	// ERC-5564 tooling writes st:eth: with a 0x-prefixed hex payload
+	str := "st:eth:0x" + hex.EncodeToString(meta.Bytes())
+	parsed, err := ParseMetaAddress(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Chain != ChainEthereum || parsed.SchemeID != SchemeSecp256k1 || !bytes.Equal(parsed.Bytes(), meta.Bytes()) {
+		t.Fatalf("parsed %+v", parsed)
+	}
+	if parsed.String() != str {
+		t.Errorf("round trip gave %s, want %s", parsed.String(), str)
+	}
+	if _, err := ParseMetaAddressForScheme(2, str); err != ErrUnsupportedScheme {
+		t.Errorf("parsed an unknown scheme, err %v", err)
+	}
+	if _, err := ParseMetaAddress("st:btc:" + hex.EncodeToString(meta.Bytes())); err == nil {
+		t.Error("parsed a meta-address for an unknown chain")
+	}
+}
+
 func TestGenerateStealthAddress(t *testing.T) {
 	// Generate recipient's key pair
 	recipientKeyPair, err := GenerateStealthKeyPair()
@@ -321,3 +350,90 @@ func TestMultipleStealthAddressesAreDifferent(t *testing.T) {
 		t.Errorf("Expected %d unique addresses, got %d", numAddresses, len(addresses))
 	}
 }
+
+// newBenchService creates a service with the given number of scanners over a
+// chain of 64 blocks, each paying four of them
+func newBenchService(b *testing.B, scanners int) *StealthService {
+	chain := newTestChain(64)
+	service := NewStealthService()
+	service.SetBackend(chain)
+
+	var keys []*StealthKeyPair
+	for i := 0; i < scanners; i++ {
+		k, _ := GenerateStealthKeyPair()
+		if _, err := service.RegisterScanner(k.ViewPrivateKey, k.SpendPrivateKey); err != nil {
+			b.Fatal(err)
+		}
+		keys = append(keys, k)
+	}
+	for n := uint64(1); n <= 64; n++ {
+		for i := 0; i < 4; i++ {
+			chain.pay(b, n, keys[(int(n)*4+i)%scanners])
+		}
+	}
+	return service
+}
+
+// BenchmarkScanBlocksSequential scans block by block, one scanner at a time,
+// as a baseline for the scan pipeline
+func BenchmarkScanBlocksSequential(b *testing.B) {
+	for _, scanners := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("scanners=%d", scanners), func(b *testing.B) {
+			var (
+				service = newBenchService(b, scanners)
+				ctx     = context.Background()
+			)
+			_, _, list := service.snapshot()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for n := uint64(1); n <= 64; n++ {
+					hash, _, _ := service.backend.GetBlockHashes(ctx, n)
+					txs, _ := service.backend.GetStealthTransactions(ctx, n)
+					for _, scanner := range list {
+						scanner.ProcessBlock(n, hash, txs)
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkScanBlocks(b *testing.B) {
+	for _, scanners := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("scanners=%d", scanners), func(b *testing.B) {
+			service := newBenchService(b, scanners)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := service.ScanBlocks(context.Background(), 1, 64); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMatchSharedViewKey matches announcements against scanners sharing
+// a view key, which need a single ECDH per announcement
+func BenchmarkMatchSharedViewKey(b *testing.B) {
+	view, _ := GenerateStealthKeyPair()
+	var scanners []*Scanner
+	for i := 0; i < 100; i++ {
+		k, _ := GenerateStealthKeyPair()
+		scanners = append(scanners, NewScanner(view.ViewPrivateKey, k.SpendPrivateKey))
+	}
+	var (
+		set   = newScanSet(scanners)
+		block = &scanBlock{}
+	)
+	for i := 0; i < 256; i++ {
+		k, _ := GenerateStealthKeyPair()
+		addr, _ := GenerateStealthAddress(k.MetaAddress())
+		block.txs = append(block.txs, StealthTxData{ToAddress: addr.Address, EphemeralPubKey: addr.EphemeralPubKey, ViewTag: addr.ViewTag})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := set.matchBlocks(context.Background(), []*scanBlock{block}, runtime.NumCPU()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package stealth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// scanStoreVersion is the format version of scanner state files
+const scanStoreVersion = 1
+
+// ErrScanStoreCorrupt is returned when a scanner state file can't be
+// decrypted, either because it is damaged or because it belongs to other keys
+var ErrScanStoreCorrupt = errors.New("stealth scan store corrupt or encrypted with other keys")
+
+// blockRef identifies a scanned block, so that the scanner can tell whether
+// it is still part of the canonical chain
+type blockRef struct {
+	Number uint64
+	Hash   common.Hash
+}
+
+// scanState is the persisted state of a scanner
+type scanState struct {
+	Last     blockRef          // Last scanned block, zero hash if none
+	Recent   []blockRef        // Recently scanned blocks, oldest first
+	Payments []*StealthPayment // Payments discovered so far
+}
+
+// scanStore keeps the state of a scanner in a file of its own. The file is
+// encrypted with AES-256-GCM under a key derived from the view key, so that
+// it reveals nothing that the view key can't recover by rescanning the chain.
+// Derived stealth private keys are never written.
+type scanStore struct {
+	path string
+	aead cipher.AEAD
+}
+
+// openScanStore opens the state file of the scanner with the given keys in
+// dir, creating the directory if needed
+func openScanStore(dir string, viewPrivKey *ecdsa.PrivateKey, spendPubKey *ecdsa.PublicKey) (*scanStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	key := crypto.Keccak256([]byte("obsidian stealth scan store"), crypto.FromECDSA(viewPrivKey))
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	name := PublicKeyToAddress(spendPubKey).Hex() + ".scan"
+	return &scanStore{path: filepath.Join(dir, name), aead: aead}, nil
+}
+
+// load reads the stored state, returning nil if nothing was stored yet
+func (st *scanStore) load() (*scanState, error) {
+	data, err := os.ReadFile(st.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := st.aead.NonceSize()
+	if len(data) < 1+nonceSize || data[0] != scanStoreVersion {
+		return nil, ErrScanStoreCorrupt
+	}
+	nonce, sealed := data[1:1+nonceSize], data[1+nonceSize:]
+	plain, err := st.aead.Open(nil, nonce, sealed, data[:1])
+	if err != nil {
+		return nil, ErrScanStoreCorrupt
+	}
+	state := new(scanState)
+	if err := rlp.DecodeBytes(plain, state); err != nil {
+		return nil, fmt.Errorf("invalid stealth scan state: %v", err)
+	}
+	return state, nil
+}
+
+// save replaces the stored state. The file is written aside and renamed into
+// place, so a crash leaves either the old or the new state behind.
+func (st *scanStore) save(state *scanState) error {
+	plain, err := rlp.EncodeToBytes(state)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, st.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	version := []byte{scanStoreVersion}
+	data := append(append([]byte{}, version...), nonce...)
+	data = st.aead.Seal(data, nonce, plain, version)
+
+	tmp := st.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.path)
+}
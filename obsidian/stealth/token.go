@@ -0,0 +1,170 @@
+// Copyright 2024 The Obsidian Authors
+// This file is part of the Obsidian library.
+
+package stealth
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// TokenStandard is the kind of asset a stealth payment transfers
+type TokenStandard uint8
+
+const (
+	// NativeStandard payments transfer OBS
+	NativeStandard TokenStandard = iota
+	// ERC20Standard payments transfer an amount of a fungible token
+	ERC20Standard
+	// ERC721Standard payments transfer a single non-fungible token, the
+	// amount of the payment being the token ID
+	ERC721Standard
+)
+
+// Asset identifies what a stealth payment transfers
+type Asset struct {
+	Standard TokenStandard
+	Token    common.Address // Token contract, zero for OBS
+}
+
+// NativeAsset is the asset of payments in OBS
+var NativeAsset = Asset{}
+
+// Verified reports whether the chain checks payments of the asset. Token
+// payments are announced from the call data of their transaction, which the
+// chain doesn't execute, so the tokens may never have moved.
+func (a Asset) Verified() bool {
+	return a.Standard == NativeStandard
+}
+
+// String implements fmt.Stringer
+func (a Asset) String() string {
+	switch a.Standard {
+	case NativeStandard:
+		return "OBS"
+	case ERC20Standard:
+		return "erc20:" + a.Token.Hex()
+	case ERC721Standard:
+		return "erc721:" + a.Token.Hex()
+	}
+	return fmt.Sprintf("unknown(%d):%s", a.Standard, a.Token.Hex())
+}
+
+// Function selectors of the token transfers stealth payments are made with
+var (
+	erc20TransferSelector     = []byte{0xa9, 0x05, 0x9c, 0xbb} // transfer(address,uint256)
+	erc20TransferFromSelector = []byte{0x23, 0xb8, 0x72, 0xdd} // transferFrom(address,address,uint256)
+	erc721TransferSelector    = []byte{0x42, 0x84, 0x2e, 0x0e} // safeTransferFrom(address,address,uint256)
+)
+
+// Transfer is what a transaction to a stealth address transfers, and to which
+// stealth address
+type Transfer struct {
+	Recipient common.Address
+	Asset     Asset
+	Amount    *big.Int // Value or token ID
+	selector  []byte
+}
+
+// DecodeTransfer returns what a transaction sending value to to with the
+// given call data transfers. Token transfer calls pay the recipient of the
+// tokens, anything else pays to in OBS.
+func DecodeTransfer(to common.Address, value *big.Int, data []byte) Transfer {
+	if value == nil {
+		value = new(big.Int)
+	}
+	native := Transfer{Recipient: to, Asset: NativeAsset, Amount: value, selector: nativeSelector}
+	if len(data) < 4 {
+		return native
+	}
+	// Arguments are 32 byte words, addresses taking the low 20 bytes
+	words := func(n int) [][]byte {
+		if len(data) != 4+32*n {
+			return nil
+		}
+		args := make([][]byte, n)
+		for i := range args {
+			args[i] = data[4+32*i : 4+32*(i+1)]
+			if i < n-1 && !bytes.Equal(args[i][:12], make([]byte, 12)) {
+				return nil
+			}
+		}
+		return args
+	}
+	selector := data[:4]
+	switch {
+	case bytes.Equal(selector, erc20TransferSelector):
+		if args := words(2); args != nil {
+			return Transfer{common.BytesToAddress(args[0]), Asset{ERC20Standard, to}, new(big.Int).SetBytes(args[1]), erc20TransferSelector}
+		}
+	case bytes.Equal(selector, erc20TransferFromSelector):
+		if args := words(3); args != nil {
+			return Transfer{common.BytesToAddress(args[1]), Asset{ERC20Standard, to}, new(big.Int).SetBytes(args[2]), erc20TransferFromSelector}
+		}
+	case bytes.Equal(selector, erc721TransferSelector):
+		if args := words(3); args != nil {
+			return Transfer{common.BytesToAddress(args[1]), Asset{ERC721Standard, to}, new(big.Int).SetBytes(args[2]), erc721TransferSelector}
+		}
+	}
+	return native
+}
+
+// TransferData returns the call data of a transaction transferring amount of
+// a token to a stealth address, and the address the transaction goes to. The
+// from account is the token holder, which only ERC-721 transfers name.
+func TransferData(asset Asset, from, recipient common.Address, amount *big.Int) (common.Address, []byte, error) {
+	word := func(b []byte) []byte { return common.LeftPadBytes(b, 32) }
+	switch asset.Standard {
+	case ERC20Standard:
+		data := append(append(common.CopyBytes(erc20TransferSelector), word(recipient.Bytes())...), word(amount.Bytes())...)
+		return asset.Token, data, nil
+	case ERC721Standard:
+		data := append(common.CopyBytes(erc721TransferSelector), word(from.Bytes())...)
+		data = append(append(data, word(recipient.Bytes())...), word(amount.Bytes())...)
+		return asset.Token, data, nil
+	}
+	return common.Address{}, nil, fmt.Errorf("no token transfer for %v", asset)
+}
+
+// Metadata returns the ERC-5564 metadata announcing the transfer: the view
+// tag, the function selector, the token address and the amount
+func (t Transfer) Metadata(viewTag byte) []byte {
+	token := t.Asset.Token
+	if t.Asset.Standard == NativeStandard {
+		token = NativeToken
+	}
+	metadata := make([]byte, 0, transferMetadataLen)
+	metadata = append(metadata, viewTag)
+	metadata = append(metadata, t.selector...)
+	metadata = append(metadata, token.Bytes()...)
+	amount := t.Amount
+	if amount == nil {
+		amount = new(big.Int)
+	}
+	return append(metadata, common.BigToHash(amount).Bytes()...)
+}
+
+// parseMetadata decodes the asset and amount of ERC-5564 transfer metadata,
+// returning false for metadata of transfers it doesn't know
+func parseMetadata(metadata []byte) (Asset, *big.Int, bool) {
+	if len(metadata) != transferMetadataLen {
+		return Asset{}, nil, false
+	}
+	var (
+		selector = metadata[1:5]
+		token    = common.BytesToAddress(metadata[5:25])
+		amount   = new(big.Int).SetBytes(metadata[25:])
+	)
+	switch {
+	case bytes.Equal(selector, nativeSelector) && token == NativeToken:
+		return NativeAsset, amount, true
+	case bytes.Equal(selector, erc20TransferSelector), bytes.Equal(selector, erc20TransferFromSelector):
+		return Asset{ERC20Standard, token}, amount, true
+	case bytes.Equal(selector, erc721TransferSelector):
+		return Asset{ERC721Standard, token}, amount, true
+	}
+	return Asset{}, nil, false
+}